@@ -0,0 +1,53 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package api
+
+import "time"
+
+// AuditDecision is the access decision for an audited request.
+type AuditDecision string
+
+const (
+	AuditAllow AuditDecision = "allow"
+	AuditDeny  AuditDecision = "deny"
+)
+
+// AuditRecord describes a request that modifies the system, as recorded
+// in the audit log.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+
+	// UID and PID identify the client that sent the request. Exe is
+	// the path of its executable and Label its AppArmor label, which
+	// are omitted if they are not known or the client is unconfined.
+	UID   uint32 `json:"uid"`
+	PID   int32  `json:"pid"`
+	Exe   string `json:"exe,omitempty"`
+	Label string `json:"label,omitempty"`
+
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	Decision AuditDecision `json:"decision"`
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+	// Change is the ID of the change created by the request, if any.
+	Change string `json:"change,omitempty"`
+}
@@ -0,0 +1,69 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015-2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Change describes a change and the tasks that it is made of.
+type Change struct {
+	ID      string  `json:"id"`
+	Kind    string  `json:"kind"`
+	Summary string  `json:"summary"`
+	Status  string  `json:"status"`
+	Tasks   []*Task `json:"tasks,omitempty"`
+	Ready   bool    `json:"ready"`
+	Err     string  `json:"err,omitempty"`
+
+	SpawnTime time.Time  `json:"spawn-time,omitempty"`
+	ReadyTime *time.Time `json:"ready-time,omitempty"`
+
+	// Data holds information that the change makes available to the
+	// client, such as a prompt for secrets.
+	Data map[string]*json.RawMessage `json:"data,omitempty"`
+}
+
+// Task describes a single task that is part of a change.
+type Task struct {
+	ID       string       `json:"id"`
+	Kind     string       `json:"kind"`
+	Summary  string       `json:"summary"`
+	Status   string       `json:"status"`
+	Log      []string     `json:"log,omitempty"`
+	Progress TaskProgress `json:"progress"`
+
+	SpawnTime time.Time  `json:"spawn-time,omitempty"`
+	ReadyTime *time.Time `json:"ready-time,omitempty"`
+}
+
+// TaskProgress describes the progress of a task.
+type TaskProgress struct {
+	Label string `json:"label"`
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+}
+
+// ChangeAction is the body of a request to perform an action on a change.
+type ChangeAction struct {
+	// Action is the action to perform. The only supported action is "abort".
+	Action string `json:"action"`
+}
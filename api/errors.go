@@ -24,6 +24,33 @@ import "encoding/json"
 // ErrorKind describes the kind of error
 type ErrorKind string
 
+const (
+	// ErrorKindChangeNotFound indicates that a requested change does not exist.
+	ErrorKindChangeNotFound ErrorKind = "change-not-found"
+
+	// ErrorKindChangeReady indicates that a change cannot be modified
+	// because it is already ready.
+	ErrorKindChangeReady ErrorKind = "change-ready"
+
+	// ErrorKindChangeConflict indicates that a change cannot be
+	// created because another change is operating on the same
+	// container.
+	ErrorKindChangeConflict ErrorKind = "change-conflict"
+
+	// ErrorKindNotAuthorized indicates that polkit did not authorize
+	// the client to perform the request.
+	ErrorKindNotAuthorized ErrorKind = "not-authorized"
+
+	// ErrorKindAuthCancelled indicates that the user dismissed the
+	// interactive authentication prompt.
+	ErrorKindAuthCancelled ErrorKind = "auth-cancelled"
+
+	// ErrorKindInteractionRequired indicates that the request could be
+	// authorized if the user authenticated interactively. The client
+	// may retry the request with interaction allowed.
+	ErrorKindInteractionRequired ErrorKind = "interaction-required"
+)
+
 // ErrorResult contains information about an error
 type ErrorResult struct {
 	Kind    ErrorKind       `json:"kind,omitempty"`
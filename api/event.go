@@ -0,0 +1,48 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package api
+
+// EventType is the type of an event sent on the event stream.
+type EventType string
+
+const (
+	// EventChange is sent when the status of a change changes.
+	EventChange EventType = "change"
+	// EventTask is sent when the status of a task changes.
+	EventTask EventType = "task"
+	// EventTaskProgress is sent when the progress of a running task
+	// changes.
+	EventTaskProgress EventType = "task-progress"
+)
+
+// Event describes an update sent on the event stream, as a line of
+// JSON.
+type Event struct {
+	Type EventType `json:"type"`
+
+	// Change is the change that the event is about, for change
+	// events.
+	Change *Change `json:"change,omitempty"`
+
+	// ChangeID and Task identify the task that the event is about,
+	// for task and task progress events.
+	ChangeID string `json:"change-id,omitempty"`
+	Task     *Task  `json:"task,omitempty"`
+}
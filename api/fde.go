@@ -0,0 +1,365 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package api
+
+import "time"
+
+// ProtectorKind describes what protects a keyslot.
+type ProtectorKind string
+
+const (
+	ProtectorTPM         ProtectorKind = "tpm"
+	ProtectorRecoveryKey ProtectorKind = "recovery-key"
+	ProtectorPassphrase  ProtectorKind = "passphrase"
+	ProtectorUnknown     ProtectorKind = "unknown"
+)
+
+// FDEStatus describes the full disk encryption status of the system.
+type FDEStatus struct {
+	Containers []*Container `json:"containers"`
+}
+
+// Container describes an encrypted container.
+type Container struct {
+	DevicePath string     `json:"device-path"`
+	UUID       string     `json:"uuid"`
+	Label      string     `json:"label,omitempty"`
+	Keyslots   []*Keyslot `json:"keyslots"`
+
+	// WillUnseal indicates whether the TPM sealed key for this
+	// container is expected to unseal on the next boot. It is
+	// omitted when the container has no TPM protected keyslot.
+	WillUnseal *bool `json:"will-unseal,omitempty"`
+
+	// PCRProfile is the PCR profile that the TPM sealed key for
+	// this container was last sealed against.
+	PCRProfile *PCRProfile `json:"pcr-profile,omitempty"`
+
+	// PendingPCRProfile is the PCR profile that the TPM sealed key
+	// will be resealed against once the system has booted using one
+	// of its boot chains.
+	PendingPCRProfile *PCRProfile `json:"pending-pcr-profile,omitempty"`
+}
+
+// Keyslot describes a used keyslot in an encrypted container.
+type Keyslot struct {
+	Slot      int           `json:"slot"`
+	Name      string        `json:"name,omitempty"`
+	Protector ProtectorKind `json:"protector"`
+
+	// PIN indicates whether a PIN is required in addition to the
+	// TPM to unlock a TPM protected keyslot.
+	PIN bool `json:"pin,omitempty"`
+}
+
+// PCRProfile describes the PCRs and the boot chains that a sealed
+// key is bound to.
+type PCRProfile struct {
+	PCRs       []int        `json:"pcrs"`
+	BootChains []*BootChain `json:"boot-chains"`
+}
+
+// BootChain describes a sequence of EFI images loaded during boot,
+// starting with the first one loaded by the firmware, and the kernel
+// command lines that the last image may be started with.
+type BootChain struct {
+	Images         []*BootImage `json:"images"`
+	KernelCmdlines []string     `json:"kernel-cmdlines,omitempty"`
+}
+
+// BootImage describes an EFI image that is part of a boot chain.
+type BootImage struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// UnlockMethod describes how an encrypted container was unlocked at
+// boot.
+type UnlockMethod string
+
+const (
+	UnlockTPM         UnlockMethod = "tpm"
+	UnlockTPMWithPIN  UnlockMethod = "tpm-pin"
+	UnlockPassphrase  UnlockMethod = "passphrase"
+	UnlockRecoveryKey UnlockMethod = "recovery-key"
+)
+
+// BootStatus describes how the encrypted containers were unlocked at
+// the current boot.
+type BootStatus struct {
+	Containers []*BootUnlock `json:"containers"`
+}
+
+// BootUnlock describes how an encrypted container was unlocked at the
+// current boot.
+type BootUnlock struct {
+	Container  string       `json:"container"`
+	DevicePath string       `json:"device-path"`
+	BootID     string       `json:"boot-id"`
+	Method     UnlockMethod `json:"method"`
+
+	// Slot and Keyslot are the number and the name of the keyslot
+	// that was used, which are omitted if they are not known.
+	Slot    *int   `json:"slot,omitempty"`
+	Keyslot string `json:"keyslot,omitempty"`
+}
+
+// RecoveryKey describes a recovery key keyslot of an encrypted
+// container.
+type RecoveryKey struct {
+	Container  string `json:"container"`
+	DevicePath string `json:"device-path"`
+	Slot       int    `json:"slot"`
+	Name       string `json:"name"`
+
+	// CreationTime is omitted for recovery keys that were not
+	// created by the manager.
+	CreationTime *time.Time `json:"creation-time,omitempty"`
+}
+
+// RecoveryKeyAction is the body of a request to generate or revoke a
+// recovery key.
+type RecoveryKeyAction struct {
+	// Action is either "generate" or "revoke".
+	Action string `json:"action"`
+	// Container is the UUID of the encrypted container.
+	Container string `json:"container"`
+	// Name is the name of the recovery key keyslot.
+	Name string `json:"name"`
+}
+
+// RecoveryKeyResult is the result of a request to generate a recovery
+// key. The recovery key is only ever returned once. Like the recovery
+// keys of installed containers, it is provisional until the change
+// that enrolls it is done.
+type RecoveryKeyResult struct {
+	RecoveryKey string `json:"recovery-key"`
+	Provisional bool   `json:"provisional"`
+}
+
+// KeyslotAction is the body of a request to manage the passphrase of
+// a keyslot.
+type KeyslotAction struct {
+	// Action is one of "add-passphrase", "change-passphrase",
+	// "remove-passphrase" or "provide-secrets".
+	Action string `json:"action"`
+	// Container is the UUID of the encrypted container.
+	Container string `json:"container,omitempty"`
+
+	// OldSecret and NewSecret are the current and the new passphrase.
+	// If interaction is allowed they can be omitted, in which case the
+	// change prompts for them and they are supplied with the
+	// "provide-secrets" action.
+	OldSecret string `json:"old-secret,omitempty"`
+	NewSecret string `json:"new-secret,omitempty"`
+
+	// Change is the ID of the change that prompts for secrets, for
+	// the "provide-secrets" action.
+	Change string `json:"change,omitempty"`
+}
+
+// SecretPrompt is stored under "prompt" in the data of a change that
+// waits for secrets.
+type SecretPrompt struct {
+	Container string `json:"container"`
+	Keyslot   string `json:"keyslot"`
+	// Op is the action that the secrets are for.
+	Op string `json:"op"`
+	// Old and New indicate whether the current and the new secret
+	// are required.
+	Old     bool      `json:"old"`
+	New     bool      `json:"new"`
+	Expires time.Time `json:"expires"`
+}
+
+// FDEAction is the body of a request to perform an action on the
+// encrypted containers of the system.
+type FDEAction struct {
+	// Action is the action to perform, which is "reseal",
+	// "update-dbx", "install" or "verify".
+	Action string `json:"action"`
+
+	// BootChains are the boot chains to reseal the TPM sealed keys
+	// against, or to seal the keys of the target system against
+	// when installing.
+	BootChains []*BootChain `json:"boot-chains,omitempty"`
+
+	// Devices are the block devices or image files of the target
+	// system to encrypt when installing.
+	Devices []*InstallDevice `json:"devices,omitempty"`
+
+	// Payload is the authenticated write of the dbx variable that
+	// updates the forbidden signature database. It is base64
+	// encoded in JSON.
+	Payload []byte `json:"payload,omitempty"`
+
+	// Repair requests that the "verify" action also fixes the
+	// inconsistencies that are safe to fix, in a change.
+	Repair bool `json:"repair,omitempty"`
+}
+
+// InstallDevice describes a block device or an image file of the
+// target system that is encrypted during installation.
+type InstallDevice struct {
+	DevicePath string `json:"device-path"`
+	Label      string `json:"label,omitempty"`
+}
+
+// InstallResult is the result of a request to encrypt the target
+// system. The recovery keys are only ever returned once.
+type InstallResult struct {
+	Containers []*InstalledContainer `json:"containers"`
+}
+
+// InstalledContainer describes an encrypted container that is created
+// during installation.
+type InstalledContainer struct {
+	DevicePath string `json:"device-path"`
+	UUID       string `json:"uuid"`
+	// RecoveryKey is returned before the change that enrolls it
+	// runs, as indicated by Provisional. It must only be shown to
+	// the user once the UUID of the container is listed in the
+	// "recovery-keys-enrolled" data of the change and the change is
+	// done, as the key is not enrolled if the change fails.
+	RecoveryKey string `json:"recovery-key"`
+	Provisional bool   `json:"provisional"`
+}
+
+// ProfilePreviewRequest is the body of a request to preview the PCR
+// profile of a boot configuration.
+type ProfilePreviewRequest struct {
+	// BootChain is the boot chain to predict PCR 4 and PCR 12 for.
+	// If it is omitted, they are predicted for the current boot.
+	BootChain *BootChain `json:"boot-chain,omitempty"`
+	// SecureBootVariables are the contents of the secure boot
+	// configuration variables to predict PCR 7 for, keyed by name.
+	SecureBootVariables map[string][]byte `json:"secure-boot-variables,omitempty"`
+}
+
+// ProfilePreview describes the predicted PCR values for a boot
+// configuration and whether the TPM sealed keys would unseal with it.
+type ProfilePreview struct {
+	PCRs       []*PCRPreview              `json:"pcrs"`
+	Containers []*ContainerProfilePreview `json:"containers"`
+}
+
+// PCRPreview describes the predicted value of a PCR and the value that
+// was measured during the current boot.
+type PCRPreview struct {
+	PCR int `json:"pcr"`
+	// KernelCmdline is the kernel command line that the value of
+	// PCR 12 is predicted for.
+	KernelCmdline string `json:"kernel-cmdline,omitempty"`
+	Measured      string `json:"measured"`
+	Predicted     string `json:"predicted"`
+}
+
+// ContainerProfilePreview describes whether the TPM sealed keys of an
+// encrypted container would unseal with a boot configuration.
+type ContainerProfilePreview struct {
+	Container   string               `json:"container"`
+	DevicePath  string               `json:"device-path"`
+	WillUnseal  bool                 `json:"will-unseal"`
+	Differences []*ProfileDifference `json:"differences"`
+	// WillUnsealAfterCommit indicates whether the TPM sealed keys
+	// would still unseal once the pending PCR profile of the container
+	// is committed. It is omitted if there is no pending profile.
+	WillUnsealAfterCommit *bool `json:"will-unseal-after-commit,omitempty"`
+}
+
+// ProfileDifferenceKind describes what differs between a boot
+// configuration and a sealed PCR profile.
+type ProfileDifferenceKind string
+
+const (
+	DifferenceBootImage          ProfileDifferenceKind = "boot-image"
+	DifferenceKernelCmdline      ProfileDifferenceKind = "kernel-cmdline"
+	DifferenceSecureBootVariable ProfileDifferenceKind = "secure-boot-variable"
+)
+
+// ProfileDifference describes an input to a PCR that differs between a
+// boot configuration and a sealed PCR profile.
+type ProfileDifference struct {
+	PCR  int                   `json:"pcr"`
+	Kind ProfileDifferenceKind `json:"kind"`
+
+	// Path, Digest and SealedDigest describe a boot image that is
+	// not part of the sealed boot chain at the same position.
+	Path         string `json:"path,omitempty"`
+	Digest       string `json:"digest,omitempty"`
+	SealedDigest string `json:"sealed-digest,omitempty"`
+
+	// KernelCmdline is a kernel command line that the sealed boot
+	// chain cannot be started with.
+	KernelCmdline string `json:"kernel-cmdline,omitempty"`
+
+	// Variable is the name of a secure boot variable that differs
+	// from the one measured during the current boot.
+	Variable string `json:"variable,omitempty"`
+}
+
+// FindingKind describes an inconsistency between the state of the
+// manager and the encrypted containers, the sealed key objects or the
+// TPM.
+type FindingKind string
+
+const (
+	FindingOrphanedKeyslot     FindingKind = "orphaned-keyslot"
+	FindingMissingKeyslot      FindingKind = "missing-keyslot"
+	FindingOrphanedToken       FindingKind = "orphaned-token"
+	FindingMissingToken        FindingKind = "missing-token"
+	FindingMissingSealedObject FindingKind = "missing-sealed-object"
+	FindingUnownedNVIndex      FindingKind = "unowned-nv-index"
+	FindingStalePolicyCounter  FindingKind = "stale-policy-counter"
+)
+
+// Finding describes an inconsistency found when verifying the state.
+// The findings of a repair, and of the verify-fde-state change queued
+// when the daemon starts, are stored under "findings" in the data of
+// the change.
+type Finding struct {
+	Kind FindingKind `json:"kind"`
+
+	// Container and DevicePath identify the encrypted container,
+	// and Keyslot and Token the keyslot or the LUKS2 token that the
+	// inconsistency is about, if any.
+	Container  string `json:"container,omitempty"`
+	DevicePath string `json:"device-path,omitempty"`
+	Keyslot    *int   `json:"keyslot,omitempty"`
+	Token      *int   `json:"token,omitempty"`
+
+	// Path is a missing sealed key object file.
+	Path string `json:"path,omitempty"`
+	// Handle is an NV index of the TPM.
+	Handle uint32 `json:"handle,omitempty"`
+
+	Message string `json:"message"`
+
+	// Repairable indicates whether the inconsistency is fixed by a
+	// repair.
+	Repairable bool `json:"repairable"`
+	// Repaired indicates whether the inconsistency was fixed.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// VerifyResult is the result of a request to verify the state.
+type VerifyResult struct {
+	Findings []*Finding `json:"findings"`
+}
@@ -0,0 +1,47 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package api
+
+import "time"
+
+// Notice describes an event of interest to the users of the system,
+// such as the recovery key having been used to unlock the system.
+// Repeated occurrences of the same event, as identified by the type
+// and key, are recorded in a single notice.
+type Notice struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Key  string `json:"key"`
+
+	FirstOccurred time.Time `json:"first-occurred"`
+	LastOccurred  time.Time `json:"last-occurred"`
+	// LastRepeated is the time at which the notice was last
+	// repeated. Occurrences may not repeat the notice for a while
+	// after it was repeated, to avoid waking up clients too often.
+	LastRepeated time.Time `json:"last-repeated"`
+	Occurrences  int       `json:"occurrences"`
+
+	// LastData is the data supplied with the last occurrence.
+	LastData map[string]string `json:"last-data,omitempty"`
+
+	// RepeatAfter and ExpireAfter are durations, such as "24h0m0s".
+	RepeatAfter string `json:"repeat-after,omitempty"`
+	ExpireAfter string `json:"expire-after,omitempty"`
+}
@@ -0,0 +1,60 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package api
+
+// TPMStatus describes the state of the TPM of the system.
+type TPMStatus struct {
+	// Present indicates whether the system has a TPM2 device. The
+	// other fields are omitted if it hasn't.
+	Present         bool   `json:"present"`
+	Manufacturer    string `json:"manufacturer,omitempty"`
+	FirmwareVersion string `json:"firmware-version,omitempty"`
+
+	// Owned indicates whether the TPM is provisioned, with the
+	// authorization value of the lockout hierarchy set and the
+	// storage root key persisted.
+	Owned          bool `json:"owned"`
+	LockoutAuthSet bool `json:"lockout-auth-set"`
+	SRKPresent     bool `json:"srk-present"`
+	// LockoutAuthKnown indicates whether the manager holds the
+	// authorization value of the lockout hierarchy, which is
+	// required to reset the lockout and to clear the TPM.
+	LockoutAuthKnown bool `json:"lockout-auth-known"`
+
+	// Lockout indicates whether the TPM is in dictionary attack
+	// lockout mode. LockoutCounter is the number of authorization
+	// failures and MaxTries the number of failures that puts the TPM
+	// in lockout mode. Each failure is forgotten after RecoveryTime,
+	// and the lockout hierarchy cannot be used for LockoutRecovery
+	// after an authorization failure. The durations are strings
+	// such as "2h0m0s".
+	Lockout         bool   `json:"lockout"`
+	LockoutCounter  uint32 `json:"lockout-counter"`
+	MaxTries        uint32 `json:"max-tries"`
+	RecoveryTime    string `json:"recovery-time,omitempty"`
+	LockoutRecovery string `json:"lockout-recovery,omitempty"`
+}
+
+// TPMAction is the body of a request to perform an action on the TPM.
+type TPMAction struct {
+	// Action is one of "provision", "reset-lockout" or "clear".
+	// Clearing the TPM makes the keys sealed with it unusable.
+	Action string `json:"action"`
+}
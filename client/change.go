@@ -0,0 +1,152 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015-2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/snapcore/fdemanager/api"
+)
+
+// ChangeSelector selects which changes are returned from [Client.ListChanges].
+type ChangeSelector string
+
+const (
+	ChangesInProgress ChangeSelector = "in-progress"
+	ChangesReady      ChangeSelector = "ready"
+	ChangesAll        ChangeSelector = "all"
+)
+
+// ChangeError is returned from [Client.WaitChange] when a change completes
+// with an error.
+type ChangeError struct {
+	Change *api.Change
+}
+
+// FailedTasks returns the tasks of the change that are in the error state.
+func (e *ChangeError) FailedTasks() (tasks []*api.Task) {
+	for _, t := range e.Change.Tasks {
+		if t.Status == "Error" {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks
+}
+
+func (e *ChangeError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "change %s (%q) failed: %s", e.Change.ID, e.Change.Summary, e.Change.Err)
+	for _, t := range e.FailedTasks() {
+		if len(t.Log) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\nlog for task %s (%q):", t.ID, t.Summary)
+		for _, l := range t.Log {
+			fmt.Fprintf(&b, "\n  %s", l)
+		}
+	}
+	return b.String()
+}
+
+// GetChange returns the change with the specified ID.
+func (c *Client) GetChange(ctx context.Context, id string) (*api.Change, error) {
+	var chg *api.Change
+	if err := c.doSync(ctx, http.MethodGet, "/v1/changes/"+url.PathEscape(id), nil, nil, &chg); err != nil {
+		return nil, err
+	}
+	return chg, nil
+}
+
+// ListChanges returns the changes selected by the specified selector. If no
+// selector is supplied, the changes that are in progress are returned.
+func (c *Client) ListChanges(ctx context.Context, selector ChangeSelector) ([]*api.Change, error) {
+	query := make(url.Values)
+	if selector != "" {
+		query.Set("select", string(selector))
+	}
+
+	var chgs []*api.Change
+	if err := c.doSync(ctx, http.MethodGet, "/v1/changes", query, nil, &chgs); err != nil {
+		return nil, err
+	}
+	return chgs, nil
+}
+
+// AbortChange requests that the change with the specified ID is aborted,
+// returning the updated change.
+func (c *Client) AbortChange(ctx context.Context, id string) (*api.Change, error) {
+	var chg *api.Change
+	if err := c.doSync(ctx, http.MethodPost, "/v1/changes/"+url.PathEscape(id), nil, &api.ChangeAction{Action: "abort"}, &chg); err != nil {
+		return nil, err
+	}
+	return chg, nil
+}
+
+// WaitChangeOptions provides options for [Client.WaitChange].
+type WaitChangeOptions struct {
+	// Progress is called with the latest version of the change
+	// every time the daemon responds to a wait request.
+	Progress func(*api.Change)
+
+	// Timeout is how long the daemon waits for the status of the
+	// change to change before responding to each wait request. If it
+	// is not set, the default timeout of the daemon is used.
+	Timeout time.Duration
+}
+
+// WaitChange waits until the change with the specified ID is ready,
+// using requests that the daemon responds to when the status of the
+// change changes. If the change completes with an error, a
+// *[ChangeError] is returned along with the change.
+func (c *Client) WaitChange(ctx context.Context, id string, opts *WaitChangeOptions) (*api.Change, error) {
+	if opts == nil {
+		opts = new(WaitChangeOptions)
+	}
+	query := make(url.Values)
+	if opts.Timeout > 0 {
+		query.Set("timeout", opts.Timeout.String())
+	}
+
+	for {
+		var chg *api.Change
+		if err := c.doSync(ctx, http.MethodGet, "/v1/changes/"+url.PathEscape(id)+"/wait", query, nil, &chg); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, err
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(chg)
+		}
+
+		if chg.Ready {
+			if chg.Err != "" {
+				return chg, &ChangeError{Change: chg}
+			}
+			return chg, nil
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/api"
+	. "github.com/snapcore/fdemanager/client"
+)
+
+type changeSuite struct {
+	clientSuite
+}
+
+var _ = Suite(&changeSuite{})
+
+func (s *changeSuite) TestGetChange(c *C) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, http.MethodGet)
+		c.Check(r.URL, DeepEquals, &url.URL{Path: "/v1/changes/5"})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"type":"sync","status-code":200,"status":"OK","result":{"id":"5","kind":"reseal","summary":"reseal keys","status":"Doing","tasks":[{"id":"10","kind":"reseal-keys","summary":"reseal","status":"Doing","progress":{"label":"","done":1,"total":2},"spawn-time":"2023-10-10T10:00:00Z"}],"ready":false,"spawn-time":"2023-10-10T10:00:00Z"}}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	chg, err := client.GetChange(context.Background(), "5")
+	c.Assert(err, IsNil)
+
+	spawnTime := time.Date(2023, 10, 10, 10, 0, 0, 0, time.UTC)
+	c.Check(chg, DeepEquals, &api.Change{
+		ID:      "5",
+		Kind:    "reseal",
+		Summary: "reseal keys",
+		Status:  "Doing",
+		Tasks: []*api.Task{
+			{
+				ID:        "10",
+				Kind:      "reseal-keys",
+				Summary:   "reseal",
+				Status:    "Doing",
+				Progress:  api.TaskProgress{Done: 1, Total: 2},
+				SpawnTime: spawnTime,
+			},
+		},
+		SpawnTime: spawnTime,
+	})
+}
+
+func (s *changeSuite) TestGetChangeNotFound(c *C) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"type":"error","status-code":404,"status":"Not Found","result":{"message":"cannot find change with id \"5\"","kind":"change-not-found"}}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	_, err := client.GetChange(context.Background(), "5")
+	c.Check(err, DeepEquals, &Error{
+		StatusCode: http.StatusNotFound,
+		ErrorResult: api.ErrorResult{
+			Kind:    api.ErrorKindChangeNotFound,
+			Message: `cannot find change with id "5"`,
+		},
+	})
+}
+
+func (s *changeSuite) testListChanges(c *C, selector ChangeSelector, expectedQuery string) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, http.MethodGet)
+		c.Check(r.URL, DeepEquals, &url.URL{Path: "/v1/changes", RawQuery: expectedQuery})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"type":"sync","status-code":200,"status":"OK","result":[{"id":"1","kind":"foo","summary":"foo","status":"Done","ready":true},{"id":"2","kind":"bar","summary":"bar","status":"Do","ready":false}]}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	chgs, err := client.ListChanges(context.Background(), selector)
+	c.Assert(err, IsNil)
+	c.Check(chgs, DeepEquals, []*api.Change{
+		{ID: "1", Kind: "foo", Summary: "foo", Status: "Done", Ready: true},
+		{ID: "2", Kind: "bar", Summary: "bar", Status: "Do"},
+	})
+}
+
+func (s *changeSuite) TestListChangesDefault(c *C) {
+	s.testListChanges(c, "", "")
+}
+
+func (s *changeSuite) TestListChangesAll(c *C) {
+	s.testListChanges(c, ChangesAll, "select=all")
+}
+
+func (s *changeSuite) TestListChangesReady(c *C) {
+	s.testListChanges(c, ChangesReady, "select=ready")
+}
+
+func (s *changeSuite) TestAbortChange(c *C) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, http.MethodPost)
+		c.Check(r.URL, DeepEquals, &url.URL{Path: "/v1/changes/5"})
+		body, err := io.ReadAll(r.Body)
+		c.Check(err, IsNil)
+		c.Check(body, DeepEquals, []byte(`{"action":"abort"}
+`))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"type":"sync","status-code":200,"status":"OK","result":{"id":"5","kind":"reseal","summary":"reseal keys","status":"Hold","ready":true}}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	chg, err := client.AbortChange(context.Background(), "5")
+	c.Assert(err, IsNil)
+	c.Check(chg, DeepEquals, &api.Change{ID: "5", Kind: "reseal", Summary: "reseal keys", Status: "Hold", Ready: true})
+}
+
+func (s *changeSuite) TestAbortChangeReady(c *C) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"error","status-code":400,"status":"Bad Request","result":{"message":"cannot abort change 5 with nothing pending","kind":"change-ready"}}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	_, err := client.AbortChange(context.Background(), "5")
+	c.Assert(err, FitsTypeOf, &Error{})
+	c.Check(err.(*Error).Kind, Equals, api.ErrorKindChangeReady)
+}
+
+func (s *changeSuite) mockChangeServer(c *C, statuses []string, final string, expectedQuery string) *int {
+	n := 0
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, http.MethodGet)
+		c.Check(r.URL, DeepEquals, &url.URL{Path: "/v1/changes/5/wait", RawQuery: expectedQuery})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if n < len(statuses) {
+			fmt.Fprintf(w, `{"type":"sync","status-code":200,"status":"OK","result":{"id":"5","kind":"reseal","summary":"reseal keys","status":%q,"ready":false}}`, statuses[n])
+		} else {
+			w.Write([]byte(final))
+		}
+		n++
+	}))
+	s.AddCleanup(srv.Close)
+	return &n
+}
+
+func (s *changeSuite) TestWaitChange(c *C) {
+	n := s.mockChangeServer(c, []string{"Do", "Doing", "Doing"},
+		`{"type":"sync","status-code":200,"status":"OK","result":{"id":"5","kind":"reseal","summary":"reseal keys","status":"Done","ready":true}}`, "")
+
+	var progress []string
+	client := New(nil)
+	chg, err := client.WaitChange(context.Background(), "5", &WaitChangeOptions{
+		Progress: func(chg *api.Change) {
+			progress = append(progress, chg.Status)
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Check(chg, DeepEquals, &api.Change{ID: "5", Kind: "reseal", Summary: "reseal keys", Status: "Done", Ready: true})
+	c.Check(*n, Equals, 4)
+	c.Check(progress, DeepEquals, []string{"Do", "Doing", "Doing", "Done"})
+}
+
+func (s *changeSuite) TestWaitChangeTimeout(c *C) {
+	n := s.mockChangeServer(c, []string{"Doing"},
+		`{"type":"sync","status-code":200,"status":"OK","result":{"id":"5","kind":"reseal","summary":"reseal keys","status":"Done","ready":true}}`, "timeout=1m0s")
+
+	client := New(nil)
+	_, err := client.WaitChange(context.Background(), "5", &WaitChangeOptions{
+		Timeout: time.Minute,
+	})
+	c.Assert(err, IsNil)
+	c.Check(*n, Equals, 2)
+}
+
+func (s *changeSuite) TestWaitChangeError(c *C) {
+	s.mockChangeServer(c, []string{"Doing"},
+		`{"type":"sync","status-code":200,"status":"OK","result":{"id":"5","kind":"reseal","summary":"reseal keys","status":"Error","ready":true,"err":"cannot perform the following tasks:\n- reseal (cannot reseal)","tasks":[{"id":"1","kind":"compute","summary":"compute","status":"Undone","progress":{"label":"","done":1,"total":1}},{"id":"2","kind":"reseal","summary":"reseal","status":"Error","log":["2023-10-10T10:00:00Z INFO starting","2023-10-10T10:00:01Z ERROR cannot reseal"],"progress":{"label":"","done":1,"total":1}}]}}`, "")
+
+	client := New(nil)
+	chg, err := client.WaitChange(context.Background(), "5", nil)
+	c.Assert(err, FitsTypeOf, &ChangeError{})
+	c.Check(err.(*ChangeError).Change, Equals, chg)
+	c.Check(chg.Status, Equals, "Error")
+
+	failed := err.(*ChangeError).FailedTasks()
+	c.Assert(failed, HasLen, 1)
+	c.Check(failed[0].ID, Equals, "2")
+
+	c.Check(err, ErrorMatches, `change 5 \("reseal keys"\) failed: cannot perform the following tasks:
+- reseal \(cannot reseal\)
+log for task 2 \("reseal"\):
+  2023-10-10T10:00:00Z INFO starting
+  2023-10-10T10:00:01Z ERROR cannot reseal`)
+}
+
+func (s *changeSuite) TestWaitChangeCancelled(c *C) {
+	n := s.mockChangeServer(c, []string{"Doing", "Doing"}, "", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := New(nil)
+	_, err := client.WaitChange(ctx, "5", &WaitChangeOptions{
+		Progress: func(*api.Change) {
+			cancel()
+		},
+	})
+	c.Check(err, Equals, context.Canceled)
+	c.Check(*n, Equals, 1)
+}
+
+func (s *changeSuite) TestChangeIDEscaped(c *C) {
+	var paths []string
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"type":"sync","status-code":200,"status":"OK","result":{"id":"5","kind":"reseal","summary":"reseal keys","status":"Done","ready":true}}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	_, err := client.GetChange(context.Background(), "5/../1")
+	c.Check(err, IsNil)
+	_, err = client.AbortChange(context.Background(), "5?x")
+	c.Check(err, IsNil)
+	_, err = client.WaitChange(context.Background(), "5/wait", nil)
+	c.Check(err, IsNil)
+	c.Check(paths, DeepEquals, []string{
+		"/v1/changes/5%2F..%2F1",
+		"/v1/changes/5%3Fx",
+		"/v1/changes/5%2Fwait/wait",
+	})
+}
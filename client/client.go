@@ -110,10 +110,16 @@ func New(config *Config) *Client {
 }
 
 func (c *Client) do(ctx context.Context, method, path string, query url.Values, args any) (*api.Response, error) {
+	// path may contain escaped segments, such as IDs
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %w", err)
+	}
 	u := url.URL{
 		Scheme:   "http",
 		Host:     "localhost",
-		Path:     path,
+		Path:     unescaped,
+		RawPath:  path,
 		RawQuery: query.Encode(),
 	}
 
@@ -153,6 +159,18 @@ func (c *Client) do(ctx context.Context, method, path string, query url.Values,
 	return rsp, nil
 }
 
+func errorFromResponse(rsp *api.Response) error {
+	var errResult *api.ErrorResult
+	if err := json.Unmarshal(rsp.Result, &errResult); err != nil {
+		return &InvalidResponseError{fmt.Errorf("cannot decode error result: %w", err)}
+	}
+
+	return &Error{
+		StatusCode:  rsp.StatusCode,
+		ErrorResult: *errResult,
+	}
+}
+
 func (c *Client) doSync(ctx context.Context, method, path string, query url.Values, args, result any) error {
 	rsp, err := c.do(ctx, method, path, query, args)
 	if err != nil {
@@ -160,15 +178,7 @@ func (c *Client) doSync(ctx context.Context, method, path string, query url.Valu
 	}
 
 	if rsp.Type == api.ResponseTypeError {
-		var errResult *api.ErrorResult
-		if err := json.Unmarshal(rsp.Result, &errResult); err != nil {
-			return &InvalidResponseError{fmt.Errorf("cannot decode error result: %w", err)}
-		}
-
-		return &Error{
-			StatusCode:  rsp.StatusCode,
-			ErrorResult: *errResult,
-		}
+		return errorFromResponse(rsp)
 	}
 
 	if rsp.Type != "sync" {
@@ -183,3 +193,23 @@ func (c *Client) doSync(ctx context.Context, method, path string, query url.Valu
 
 	return nil
 }
+
+func (c *Client) doAsync(ctx context.Context, method, path string, query url.Values, args any) (changeID string, err error) {
+	rsp, err := c.do(ctx, method, path, query, args)
+	if err != nil {
+		return "", err
+	}
+
+	if rsp.Type == api.ResponseTypeError {
+		return "", errorFromResponse(rsp)
+	}
+
+	if rsp.Type != api.ResponseTypeAsync {
+		return "", &InvalidResponseError{errors.New("invalid response type")}
+	}
+	if rsp.Change == "" {
+		return "", &InvalidResponseError{errors.New("async response without change reference")}
+	}
+
+	return rsp.Change, nil
+}
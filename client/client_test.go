@@ -316,3 +316,80 @@ func (s *clientSuite) TestDoSyncErrorResult(c *C) {
 	})
 	c.Check(result, DeepEquals, json.RawMessage(nil))
 }
+
+func (s *clientSuite) TestDoAsync(c *C) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, http.MethodPost)
+		c.Check(r.URL, DeepEquals, &url.URL{Path: "/v1/bar"})
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/json")
+		body, err := io.ReadAll(r.Body)
+		c.Check(err, IsNil)
+		c.Check(body, DeepEquals, []byte(`{"foo":1}
+`))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"type":"async","status-code":202,"status":"Accepted","result":null,"change":"5"}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	c.Assert(client, NotNil)
+
+	id, err := client.DoAsync(context.Background(), http.MethodPost, "/v1/bar", nil, json.RawMessage(`{"foo":1}`))
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "5")
+}
+
+func (s *clientSuite) TestDoAsyncErrorResult(c *C) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"error","status-code":400,"status":"Bad Request","result":{"message":"invalid request","kind":"foo"}}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	c.Assert(client, NotNil)
+
+	_, err := client.DoAsync(context.Background(), http.MethodPost, "/v1/bar", nil, nil)
+	c.Check(err, DeepEquals, &Error{
+		StatusCode: http.StatusBadRequest,
+		ErrorResult: api.ErrorResult{
+			Kind:    "foo",
+			Message: "invalid request",
+		},
+	})
+}
+
+func (s *clientSuite) TestDoAsyncSyncResponse(c *C) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"type":"sync","status-code":200,"status":"OK","result":null}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	c.Assert(client, NotNil)
+
+	_, err := client.DoAsync(context.Background(), http.MethodPost, "/v1/bar", nil, nil)
+	c.Check(err, ErrorMatches, `invalid response from service: invalid response type`)
+	c.Check(err, FitsTypeOf, &InvalidResponseError{})
+}
+
+func (s *clientSuite) TestDoAsyncNoChange(c *C) {
+	srv := s.mockHttpServer(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"type":"async","status-code":202,"status":"Accepted","result":null}`))
+	}))
+	defer srv.Close()
+
+	client := New(nil)
+	c.Assert(client, NotNil)
+
+	_, err := client.DoAsync(context.Background(), http.MethodPost, "/v1/bar", nil, nil)
+	c.Check(err, ErrorMatches, `invalid response from service: async response without change reference`)
+	c.Check(err, FitsTypeOf, &InvalidResponseError{})
+}
@@ -33,3 +33,7 @@ func (c *Client) Do(ctx context.Context, method, path string, query url.Values,
 func (c *Client) DoSync(ctx context.Context, method, path string, query url.Values, args, result any) error {
 	return c.doSync(ctx, method, path, query, args, result)
 }
+
+func (c *Client) DoAsync(ctx context.Context, method, path string, query url.Values, args any) (string, error) {
+	return c.doAsync(ctx, method, path, query, args)
+}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/snapcore/fdemanager/internal/daemon"
 	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/tpm"
 	"github.com/snapcore/snapd/logger"
 )
 
@@ -36,6 +37,7 @@ func init() {
 		fmt.Fprintf(os.Stderr, "WARNING: failed to activate logging: %s\n", err)
 	}
 	paths.SetTargetRootDir(os.Getenv("FDEMANAGERD_TARGET_ROOT"))
+	tpm.UseSimulator(os.Getenv("FDEMANAGERD_TPM_SIMULATOR"))
 }
 
 func run(ch chan os.Signal) error {
@@ -62,7 +64,7 @@ out:
 		}
 	}
 
-	return d.Stop()
+	return d.Stop(ch)
 }
 
 func main() {
@@ -3,8 +3,11 @@ module github.com/snapcore/fdemanager
 go 1.18
 
 require (
+	github.com/canonical/go-tpm2 v0.0.0-20210827151749-f80ff5afff61
 	github.com/coreos/go-systemd v0.0.0-20180511133405-39ca1b05acc7
+	github.com/godbus/dbus v0.0.0-20190726142602-4481cbc300e2
 	github.com/gorilla/mux v1.7.4-0.20190701202633-d83b6ffe499a
+	github.com/snapcore/secboot v0.0.0-20230623151406-4d331d24f830
 	github.com/snapcore/snapd v0.0.0-20231013155511-40847d1b3299
 	golang.org/x/sys v0.7.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
@@ -15,16 +18,13 @@ require (
 	github.com/canonical/go-efilib v0.3.1-0.20220815143333-7e5151412e93 // indirect
 	github.com/canonical/go-sp800.108-kdf v0.0.0-20210314145419-a3359f2d21b9 // indirect
 	github.com/canonical/go-sp800.90a-drbg v0.0.0-20210314144037-6eeb1040d6c3 // indirect
-	github.com/canonical/go-tpm2 v0.0.0-20210827151749-f80ff5afff61 // indirect
 	github.com/canonical/tcglog-parser v0.0.0-20210824131805-69fa1e9f0ad2 // indirect
-	github.com/godbus/dbus v0.0.0-20190726142602-4481cbc300e2 // indirect
 	github.com/juju/ratelimit v1.0.1 // indirect
 	github.com/kr/pretty v0.2.2-0.20200810074440-814ac30b4b18 // indirect
 	github.com/kr/text v0.1.0 // indirect
 	github.com/mvo5/goconfigparser v0.0.0-20200803085309-72e476556adb // indirect
 	github.com/snapcore/bolt v1.3.2-0.20210908134111-63c8bfcf7af8 // indirect
 	github.com/snapcore/go-gettext v0.0.0-20191107141714-82bbea49e785 // indirect
-	github.com/snapcore/secboot v0.0.0-20230623151406-4d331d24f830 // indirect
 	go.mozilla.org/pkcs7 v0.0.0-20200128120323-432b2356ecb1 // indirect
 	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90 // indirect
 	golang.org/x/net v0.9.0 // indirect
@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package audit implements an append-only log of the requests that
+// modify the system, stored as JSON lines.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/snapcore/snapd/logger"
+
+	"github.com/snapcore/fdemanager/api"
+)
+
+const (
+	// DefaultMaxSize is the size above which the log is rotated.
+	DefaultMaxSize = 1024 * 1024
+	// DefaultKeep is the number of rotated logs that are kept.
+	DefaultKeep = 4
+)
+
+// Log is an audit log. Records are appended to the file at its path,
+// which is rotated by renaming it to path.1, path.1 to path.2 and so
+// on, once appending would grow it beyond the maximum size. The oldest
+// rotated log is removed.
+type Log struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu sync.Mutex
+}
+
+// New returns an audit log stored at the specified path, which is
+// created when the first record is appended.
+func New(path string, maxSize int64, keep int) *Log {
+	return &Log{
+		path:    path,
+		maxSize: maxSize,
+		keep:    keep,
+	}
+}
+
+func (l *Log) rotatedPath(n int) string {
+	if n == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+func (l *Log) rotate() error {
+	for n := l.keep; n > 0; n-- {
+		err := os.Rename(l.rotatedPath(n-1), l.rotatedPath(n))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if l.keep == 0 {
+		return os.Remove(l.path)
+	}
+	return nil
+}
+
+// Append appends a record to the log.
+func (l *Log) Append(rec *api.AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("cannot marshal audit record: %v", err)
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return fmt.Errorf("cannot create audit log directory: %v", err)
+	}
+	fi, err := os.Stat(l.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("cannot open audit log: %v", err)
+	}
+	if err == nil && fi.Size() > 0 && fi.Size()+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("cannot rotate audit log: %v", err)
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %v", err)
+	}
+	defer f.Close()
+	// records are written with a single write, so that they are not
+	// interleaved with others
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("cannot write audit record: %v", err)
+	}
+	return nil
+}
+
+// Filter selects records from the log.
+type Filter struct {
+	// Since and Until, if not zero, select the records made at or
+	// after Since and before Until.
+	Since time.Time
+	Until time.Time
+	// UID, if not nil, selects the records of requests from the
+	// user with that uid.
+	UID *uint32
+}
+
+func (f *Filter) match(rec *api.AuditRecord) bool {
+	if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !rec.Time.Before(f.Until) {
+		return false
+	}
+	if f.UID != nil && rec.UID != *f.UID {
+		return false
+	}
+	return true
+}
+
+// Read returns the records in the log, including the rotated logs,
+// that match the filter, from the oldest to the most recent.
+func (l *Log) Read(filter *Filter) ([]*api.AuditRecord, error) {
+	if filter == nil {
+		filter = &Filter{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var recs []*api.AuditRecord
+	for n := l.keep; n >= 0; n-- {
+		var err error
+		recs, err = readFile(l.rotatedPath(n), filter, recs)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read audit log: %v", err)
+		}
+	}
+	return recs, nil
+}
+
+func readFile(path string, filter *Filter, recs []*api.AuditRecord) ([]*api.AuditRecord, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return recs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var rec *api.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec == nil {
+			// a record may have been cut short by a crash
+			logger.Noticef("cannot parse audit record at %s:%d: %v", path, line, err)
+			continue
+		}
+		if filter.match(rec) {
+			recs = append(recs, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
@@ -0,0 +1,189 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package audit_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/audit"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type auditSuite struct {
+	path string
+}
+
+var _ = Suite(&auditSuite{})
+
+func (s *auditSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "state", "audit.log")
+}
+
+func record(t time.Time, uid uint32, path string) *api.AuditRecord {
+	return &api.AuditRecord{
+		Time:     t,
+		UID:      uid,
+		PID:      100,
+		Exe:      "/usr/bin/fdemanagerctl",
+		Method:   "POST",
+		Path:     path,
+		Decision: api.AuditAllow,
+		Status:   202,
+		Change:   "1",
+	}
+}
+
+var t0 = time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC)
+
+func (s *auditSuite) TestAppendRead(c *C) {
+	l := audit.New(s.path, audit.DefaultMaxSize, audit.DefaultKeep)
+
+	recs, err := l.Read(nil)
+	c.Assert(err, IsNil)
+	c.Check(recs, HasLen, 0)
+
+	rec1 := record(t0, 0, "/v1/system/fde")
+	rec2 := record(t0.Add(time.Minute), 1000, "/v1/system/fde/recovery-keys")
+	rec2.Label = "snap.fde-agent.agent"
+	rec2.Decision = api.AuditDeny
+	rec2.Status = 403
+	rec2.Change = ""
+	c.Assert(l.Append(rec1), IsNil)
+	c.Assert(l.Append(rec2), IsNil)
+
+	recs, err = l.Read(nil)
+	c.Assert(err, IsNil)
+	c.Check(recs, DeepEquals, []*api.AuditRecord{rec1, rec2})
+
+	fi, err := os.Stat(s.path)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	data, err := os.ReadFile(s.path)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"time":"2023-10-16T12:00:00Z","uid":0,"pid":100,"exe":"/usr/bin/fdemanagerctl","method":"POST","path":"/v1/system/fde","decision":"allow","status":202,"change":"1"}
+{"time":"2023-10-16T12:01:00Z","uid":1000,"pid":100,"exe":"/usr/bin/fdemanagerctl","label":"snap.fde-agent.agent","method":"POST","path":"/v1/system/fde/recovery-keys","decision":"deny","status":403}
+`)
+}
+
+func (s *auditSuite) TestAppendExisting(c *C) {
+	l := audit.New(s.path, audit.DefaultMaxSize, audit.DefaultKeep)
+	rec1 := record(t0, 0, "/v1/system/fde")
+	c.Assert(l.Append(rec1), IsNil)
+
+	// records are appended to those written by a previous instance
+	l = audit.New(s.path, audit.DefaultMaxSize, audit.DefaultKeep)
+	rec2 := record(t0.Add(time.Minute), 0, "/v1/system/fde")
+	c.Assert(l.Append(rec2), IsNil)
+
+	recs, err := l.Read(nil)
+	c.Assert(err, IsNil)
+	c.Check(recs, DeepEquals, []*api.AuditRecord{rec1, rec2})
+}
+
+func (s *auditSuite) TestRotate(c *C) {
+	// each record is a little under 200 bytes, so that 2 fit in a log
+	l := audit.New(s.path, 400, 2)
+
+	var all []*api.AuditRecord
+	for i := 0; i < 7; i++ {
+		rec := record(t0.Add(time.Duration(i)*time.Minute), 0, "/v1/system/fde")
+		c.Assert(l.Append(rec), IsNil)
+		all = append(all, rec)
+	}
+
+	// the oldest records were in the log that was removed
+	recs, err := l.Read(nil)
+	c.Assert(err, IsNil)
+	c.Check(recs, DeepEquals, all[2:])
+
+	for _, t := range []struct {
+		path  string
+		lines int
+	}{
+		{s.path, 1},
+		{s.path + ".1", 2},
+		{s.path + ".2", 2},
+	} {
+		data, err := os.ReadFile(t.path)
+		c.Assert(err, IsNil)
+		c.Check(strings.Count(string(data), "\n"), Equals, t.lines, Commentf(t.path))
+	}
+	c.Check(s.path+".3", testutil.FileAbsent)
+}
+
+func (s *auditSuite) TestReadFilter(c *C) {
+	l := audit.New(s.path, audit.DefaultMaxSize, audit.DefaultKeep)
+
+	rec1 := record(t0, 0, "/v1/system/fde")
+	rec2 := record(t0.Add(time.Minute), 1000, "/v1/system/fde")
+	rec3 := record(t0.Add(2*time.Minute), 0, "/v1/system/fde")
+	for _, rec := range []*api.AuditRecord{rec1, rec2, rec3} {
+		c.Assert(l.Append(rec), IsNil)
+	}
+
+	root := uint32(0)
+	user := uint32(1000)
+	other := uint32(1001)
+	for _, t := range []struct {
+		filter   *audit.Filter
+		expected []*api.AuditRecord
+	}{
+		{&audit.Filter{}, []*api.AuditRecord{rec1, rec2, rec3}},
+		{&audit.Filter{Since: t0.Add(time.Minute)}, []*api.AuditRecord{rec2, rec3}},
+		{&audit.Filter{Until: t0.Add(time.Minute)}, []*api.AuditRecord{rec1}},
+		{&audit.Filter{Since: t0.Add(30 * time.Second), Until: t0.Add(90 * time.Second)}, []*api.AuditRecord{rec2}},
+		{&audit.Filter{UID: &root}, []*api.AuditRecord{rec1, rec3}},
+		{&audit.Filter{UID: &user}, []*api.AuditRecord{rec2}},
+		{&audit.Filter{UID: &other}, nil},
+		{&audit.Filter{Since: t0.Add(time.Minute), UID: &root}, []*api.AuditRecord{rec3}},
+	} {
+		recs, err := l.Read(t.filter)
+		c.Assert(err, IsNil)
+		c.Check(recs, DeepEquals, t.expected, Commentf("%+v", t.filter))
+	}
+}
+
+func (s *auditSuite) TestReadSkipsTruncatedRecord(c *C) {
+	c.Assert(os.MkdirAll(filepath.Dir(s.path), 0700), IsNil)
+	c.Assert(os.WriteFile(s.path, []byte(`{"time":"2023-10-16T12:00:00Z","uid":0,"pid":100,"method":"POST","path":"/v1/system/fde","decision":"allow","status":200}
+{"time":"2023-10-16T12:01:00Z","uid":0,"pi`), 0600), IsNil)
+
+	l := audit.New(s.path, audit.DefaultMaxSize, audit.DefaultKeep)
+	recs, err := l.Read(nil)
+	c.Assert(err, IsNil)
+	c.Check(recs, DeepEquals, []*api.AuditRecord{{
+		Time:     t0,
+		PID:      100,
+		Method:   "POST",
+		Path:     "/v1/system/fde",
+		Decision: api.AuditAllow,
+		Status:   200,
+	}})
+}
@@ -19,7 +19,30 @@
 
 package daemon
 
-import "syscall"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/snapcore/snapd/logger"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/netutil"
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/polkit"
+	"github.com/snapcore/fdemanager/internal/procfs"
+)
 
 // accessChecker checks whether a particular request is allowed.
 //
@@ -27,13 +50,389 @@ import "syscall"
 // accessUnknown, which indicates the decision should be delegated to
 // the next access checker.
 type accessChecker interface {
-	CheckAccess(d *Daemon, peerCred *syscall.Ucred, allowInteraction bool) *apiError
+	CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError
+}
+
+// accessUnknown is returned by an access checker that cannot decide
+// whether a request is allowed. If no access checker decides, the
+// request is denied.
+var accessUnknown = &apiError{
+	Status:  http.StatusForbidden,
+	Message: "access denied",
+}
+
+// accessChain is an access checker that consults each of its access
+// checkers in turn, until one of them allows or denies the request.
+type accessChain []accessChecker
+
+func (chain accessChain) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+	for _, ac := range chain {
+		if err := ac.CheckAccess(d, r, peerCred, allowInteraction); err != accessUnknown {
+			return err
+		}
+	}
+	return accessUnknown
 }
 
 type openAccessImpl struct{}
 
-func (*openAccessImpl) CheckAccess(d *Daemon, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+func (*openAccessImpl) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
 	return nil
 }
 
 var openAccess = &openAccessImpl{}
+
+type rootAccessImpl struct{}
+
+// CheckAccess allows requests from root, unless root is confined by
+// AppArmor.
+func (*rootAccessImpl) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+	if peerCred == nil || peerCred.Uid != 0 {
+		return accessUnknown
+	}
+	label, err := peerAppArmorLabel(r)
+	if err != nil {
+		logger.Noticef("cannot obtain AppArmor label of pid %d: %v", peerCred.Pid, err)
+		return accessUnknown
+	}
+	if label != "" {
+		return accessUnknown
+	}
+	return nil
+}
+
+var rootAccess = &rootAccessImpl{}
+
+// uidAccess allows requests from the listed users.
+type uidAccess struct {
+	uids []uint32
+}
+
+func (ac *uidAccess) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+	if peerCred == nil {
+		return accessUnknown
+	}
+	for _, uid := range ac.uids {
+		if peerCred.Uid == uid {
+			return nil
+		}
+	}
+	return accessUnknown
+}
+
+var userLookupGroup = user.LookupGroup
+
+var errNoPidfd = errors.New("no pidfd for client")
+
+// peerPidfd returns the pidfd of the client that sent the request, or
+// nil if it is not known.
+func peerPidfd(r *http.Request) *netutil.Pidfd {
+	pidfd, _ := r.Context().Value(pidfdKey).(*netutil.Pidfd)
+	return pidfd
+}
+
+// withPeerPid calls f with the pid of the client that sent the request.
+// It fails if the client exits before f returns, as what f looked up by
+// pid could then be about another process.
+func withPeerPid(r *http.Request, f func(pid int32) error) error {
+	pidfd := peerPidfd(r)
+	if pidfd == nil {
+		return errNoPidfd
+	}
+	if err := f(pidfd.Pid()); err != nil {
+		return err
+	}
+	return pidfd.CheckAlive()
+}
+
+// groupAccess allows requests from members of the named group, either
+// through the primary or the supplementary groups of the peer.
+type groupAccess struct {
+	group string
+}
+
+func (ac *groupAccess) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+	if peerCred == nil {
+		return accessUnknown
+	}
+	grp, err := userLookupGroup(ac.group)
+	if err != nil {
+		var unknownGroup user.UnknownGroupError
+		if !errors.As(err, &unknownGroup) {
+			logger.Noticef("cannot look up group %q: %v", ac.group, err)
+		}
+		return accessUnknown
+	}
+	gid, err := strconv.ParseUint(grp.Gid, 10, 32)
+	if err != nil {
+		logger.Noticef("cannot parse gid of group %q: %v", ac.group, err)
+		return accessUnknown
+	}
+	if peerCred.Gid == uint32(gid) {
+		return nil
+	}
+
+	var gids []uint32
+	err = withPeerPid(r, func(pid int32) (err error) {
+		gids, err = procfs.Groups(pid)
+		return err
+	})
+	if err != nil {
+		logger.Noticef("cannot obtain groups of pid %d: %v", peerCred.Pid, err)
+		return accessUnknown
+	}
+	for _, g := range gids {
+		if g == uint32(gid) {
+			return nil
+		}
+	}
+	return accessUnknown
+}
+
+var netutilConnPeerSecurityLabel = netutil.ConnPeerSecurityLabel
+
+func appArmorEnabled() bool {
+	data, err := os.ReadFile(filepath.Join(paths.SysfsDir, "module/apparmor/parameters/enabled"))
+	return err == nil && strings.TrimSpace(string(data)) == "Y"
+}
+
+// peerAppArmorLabel returns the AppArmor label of the client that sent
+// the request, without the mode, or an empty label if the client is not
+// confined by AppArmor.
+func peerAppArmorLabel(r *http.Request) (string, error) {
+	conn, ok := r.Context().Value(connectionKey).(net.Conn)
+	if !ok {
+		return "", fmt.Errorf("no connection associated with request")
+	}
+	label, err := netutilConnPeerSecurityLabel(conn)
+	if errors.Is(err, netutil.ErrNoPeerSecurityLabel) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// the label may belong to another LSM
+	if !appArmorEnabled() {
+		return "", nil
+	}
+	// the mode follows the profile name, as in "snap.foo.bar (enforce)"
+	if idx := strings.LastIndex(label, " ("); idx > 0 && strings.HasSuffix(label, ")") {
+		label = label[:idx]
+	}
+	if label == "unconfined" {
+		return "", nil
+	}
+	return label, nil
+}
+
+// snapNameFromLabel returns the name of the snap that the AppArmor
+// label belongs to, or an empty string if the label does not belong to
+// a snap. Snap labels have the form snap.<instance>.<app> or
+// snap.<instance>.hook.<hook>, where the instance is the snap name
+// optionally followed by "_" and an instance key.
+func snapNameFromLabel(label string) string {
+	parts := strings.SplitN(label, ".", 3)
+	if len(parts) != 3 || parts[0] != "snap" || parts[1] == "" || parts[2] == "" {
+		return ""
+	}
+	name, _, _ := strings.Cut(parts[1], "_")
+	return name
+}
+
+// appArmorAccess decides requests from clients confined by AppArmor.
+// Clients whose label matches one of the patterns are allowed, other
+// confined clients are denied, and the decision for unconfined clients
+// is left to the next access checker.
+type appArmorAccess struct {
+	labels []string
+}
+
+func (ac *appArmorAccess) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+	label, err := peerAppArmorLabel(r)
+	if err != nil {
+		logger.Noticef("cannot obtain AppArmor label of client: %v", err)
+		return statusForbidden("access denied")
+	}
+	if label == "" {
+		return accessUnknown
+	}
+	for _, pattern := range ac.labels {
+		if ok, _ := path.Match(pattern, label); ok {
+			return nil
+		}
+	}
+	if snapName := snapNameFromLabel(label); snapName != "" {
+		return statusForbidden("access denied for snap %q", snapName)
+	}
+	return statusForbidden("access denied")
+}
+
+// polkitActionManageKeys is the polkit action that authorizes changes
+// to the keys protecting encrypted containers.
+const polkitActionManageKeys = "io.snapcraft.fdemanager.manage-keys"
+
+// polkitActionManageTPM is the polkit action that authorizes changes
+// to the TPM.
+const polkitActionManageTPM = "io.snapcraft.fdemanager.manage-tpm"
+
+var polkitCheckAuthorization = polkit.CheckAuthorization
+
+// polkitAccess allows requests from clients that polkit authorizes to
+// perform the action, and denies all others.
+type polkitAccess struct {
+	actionID string
+}
+
+func (ac *polkitAccess) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+	if peerCred == nil {
+		return statusForbidden("access denied")
+	}
+
+	flags := polkit.CheckNone
+	if allowInteraction {
+		flags |= polkit.CheckAllowInteraction
+	}
+	authorized, err := polkitCheckAuthorization(peerCred.Pid, peerCred.Uid, ac.actionID, nil, flags)
+	switch {
+	case errors.Is(err, polkit.ErrDismissed):
+		return &apiError{
+			Status:  http.StatusForbidden,
+			Message: "authentication cancelled",
+			Kind:    api.ErrorKindAuthCancelled,
+		}
+	case errors.Is(err, polkit.ErrInteraction):
+		return &apiError{
+			Status:  http.StatusUnauthorized,
+			Message: "interactive authentication required",
+			Kind:    api.ErrorKindInteractionRequired,
+		}
+	case err != nil:
+		logger.Noticef("cannot check polkit authorization for %s: %v", ac.actionID, err)
+		return statusForbidden("access denied")
+	case !authorized:
+		return &apiError{
+			Status:  http.StatusForbidden,
+			Message: "not authorized",
+			Kind:    api.ErrorKindNotAuthorized,
+		}
+	}
+	return nil
+}
+
+// fdeAdminGroup is the group whose members may manage keys without
+// being authorized by polkit.
+const fdeAdminGroup = "fde-admin"
+
+// manageKeysAccess allows unconfined root and members of the fde-admin
+// group to manage keys, and otherwise asks polkit. Clients confined by
+// AppArmor are denied.
+var manageKeysAccess = accessChain{
+	&appArmorAccess{},
+	rootAccess,
+	&groupAccess{group: fdeAdminGroup},
+	&polkitAccess{actionID: polkitActionManageKeys},
+}
+
+// manageTPMAccess allows unconfined root and members of the fde-admin
+// group to manage the TPM, and otherwise asks polkit. Clients confined
+// by AppArmor are denied.
+var manageTPMAccess = accessChain{
+	&appArmorAccess{},
+	rootAccess,
+	&groupAccess{group: fdeAdminGroup},
+	&polkitAccess{actionID: polkitActionManageTPM},
+}
+
+// fdeAgentLabels are the AppArmor labels of the FDE agent snap, which
+// is allowed to reseal keys.
+var fdeAgentLabels = []string{"snap.fde-agent.*"}
+
+// resealAccess additionally allows the FDE agent snap to reseal keys.
+var resealAccess = accessChain{
+	&appArmorAccess{labels: fdeAgentLabels},
+	manageKeysAccess,
+}
+
+// noticesAccess allows the FDE agent snap, which surfaces notices to
+// users, and unconfined clients to read notices. Other snaps are
+// denied.
+var noticesAccess = accessChain{
+	&appArmorAccess{labels: fdeAgentLabels},
+	openAccess,
+}
+
+// auditAccess allows unconfined root and members of the fde-admin group
+// to read the audit log.
+var auditAccess = accessChain{
+	&appArmorAccess{},
+	rootAccess,
+	&groupAccess{group: fdeAdminGroup},
+}
+
+// actionAccess picks the access checker by the action named in the
+// JSON body of a request, for endpoints whose actions are allowed to
+// different clients. Actions without an access checker of their own,
+// and bodies that cannot be decoded, are checked by fallback.
+type actionAccess struct {
+	actions  map[string]accessChecker
+	fallback accessChecker
+}
+
+// maxActionBodySize is the size of the largest request body that
+// actionAccess reads before the client is authorized.
+const maxActionBodySize = 64 * 1024
+
+func (ac *actionAccess) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+	if r.Body == nil {
+		return ac.fallback.CheckAccess(d, r, peerCred, allowInteraction)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxActionBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return statusBadRequest("cannot read request body: %v", err)
+	}
+	if len(body) > maxActionBodySize {
+		return statusBadRequest("request body is larger than %d bytes", maxActionBodySize)
+	}
+	// the response function reads the body again
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		Action string `json:"action"`
+	}
+	access := ac.fallback
+	if err := json.Unmarshal(body, &req); err == nil {
+		if a, ok := ac.actions[req.Action]; ok {
+			access = a
+		}
+	}
+	return access.CheckAccess(d, r, peerCred, allowInteraction)
+}
+
+// fdeActionAccess allows the FDE agent snap to reseal keys, and
+// requires the access to manage keys for any other FDE action.
+var fdeActionAccess = &actionAccess{
+	actions: map[string]accessChecker{
+		"reseal": resealAccess,
+	},
+	fallback: manageKeysAccess,
+}
+
+// changeAccess picks the access checker by the kind of the change
+// named in the path of a request: changes of the TPM require the
+// access to manage the TPM and any other change the access to manage
+// keys.
+type changeAccess struct{}
+
+func (changeAccess) CheckAccess(d *Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *apiError {
+	var access accessChecker = manageKeysAccess
+
+	st := d.state
+	st.Lock()
+	if chg := st.Change(muxVars(r)["id"]); chg != nil && isTPMChange(chg) {
+		access = manageTPMAccess
+	}
+	st.Unlock()
+
+	return access.CheckAccess(d, r, peerCred, allowInteraction)
+}
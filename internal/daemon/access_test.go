@@ -0,0 +1,457 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/netutil"
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/polkit"
+	"github.com/snapcore/fdemanager/internal/polkit/polkittest"
+)
+
+type accessSuite struct {
+	testutil.BaseTest
+
+	rootDir string
+	req     *http.Request
+	label   string
+}
+
+var _ = Suite(&accessSuite{})
+
+func (s *accessSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.rootDir = c.MkDir()
+	s.AddCleanup(paths.MockRootDir(s.rootDir))
+
+	conn := new(net.UnixConn)
+	ctx := context.WithValue(context.Background(), daemon.ConnectionKey, conn)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/system/fde", nil)
+	c.Assert(err, IsNil)
+	s.req = req
+
+	s.label = ""
+	s.AddCleanup(daemon.MockNetutilConnPeerSecurityLabel(func(innerConn net.Conn) (string, error) {
+		c.Check(innerConn, Equals, conn)
+		if s.label == "" {
+			return "", netutil.ErrNoPeerSecurityLabel
+		}
+		return s.label, nil
+	}))
+}
+
+func (s *accessSuite) mockAppArmorLabel(c *C, label string) {
+	s.label = label
+	enabled := filepath.Join(s.rootDir, "sys/module/apparmor/parameters/enabled")
+	c.Assert(os.MkdirAll(filepath.Dir(enabled), 0755), IsNil)
+	c.Assert(os.WriteFile(enabled, []byte("Y\n"), 0644), IsNil)
+}
+
+func (s *accessSuite) TestOpenAccess(c *C) {
+	c.Check(daemon.OpenAccess.CheckAccess(nil, s.req, nil, false), IsNil)
+	c.Check(daemon.OpenAccess.CheckAccess(nil, s.req, &syscall.Ucred{Uid: 1000}, false), IsNil)
+}
+
+func (s *accessSuite) TestRootAccess(c *C) {
+	c.Check(daemon.RootAccess.CheckAccess(nil, s.req, &syscall.Ucred{Uid: 0}, false), IsNil)
+
+	for _, ucred := range []*syscall.Ucred{nil, {Uid: 1000}} {
+		err := daemon.RootAccess.CheckAccess(nil, s.req, ucred, true)
+		c.Assert(err, NotNil)
+		c.Check(err.Status, Equals, http.StatusForbidden)
+		c.Check(err.Message, Equals, "access denied")
+		// the decision is left to the next access checker
+		c.Check(err, Equals, daemon.AccessUnknown)
+	}
+}
+
+func (s *accessSuite) TestRootAccessConfined(c *C) {
+	ucred := &syscall.Ucred{Pid: 100, Uid: 0}
+
+	s.mockAppArmorLabel(c, "unconfined")
+	c.Check(daemon.RootAccess.CheckAccess(nil, s.req, ucred, false), IsNil)
+
+	// root in a confined snap is not trusted as root
+	s.mockAppArmorLabel(c, "snap.foo.app (enforce)")
+	c.Check(daemon.RootAccess.CheckAccess(nil, s.req, ucred, false), Equals, daemon.AccessUnknown)
+	s.mockAppArmorLabel(c, "snap.foo.app (complain)")
+	c.Check(daemon.RootAccess.CheckAccess(nil, s.req, ucred, false), Equals, daemon.AccessUnknown)
+
+	// labels of other LSMs are ignored
+	c.Assert(os.WriteFile(filepath.Join(s.rootDir, "sys/module/apparmor/parameters/enabled"), []byte("N\n"), 0644), IsNil)
+	s.label = "system_u:system_r:unconfined_t:s0"
+	c.Check(daemon.RootAccess.CheckAccess(nil, s.req, ucred, false), IsNil)
+}
+
+func (s *accessSuite) TestSnapNameFromLabel(c *C) {
+	for _, t := range []struct {
+		label, snapName string
+	}{
+		{"snap.fde-agent.fde-agent", "fde-agent"},
+		{"snap.fde-agent_test.daemon", "fde-agent"},
+		{"snap.foo.hook.configure", "foo"},
+		{"snap.foo", ""},
+		{"snap..app", ""},
+		{"snap-update-ns.foo", ""},
+		{"/usr/bin/foo", ""},
+		{"unconfined", ""},
+	} {
+		c.Check(daemon.SnapNameFromLabel(t.label), Equals, t.snapName, Commentf(t.label))
+	}
+}
+
+func (s *accessSuite) TestAppArmorAccess(c *C) {
+	ac := daemon.NewAppArmorAccess("snap.fde-agent.*")
+	ucred := &syscall.Ucred{Pid: 100, Uid: 1000}
+
+	// unconfined clients are left to the next checker
+	c.Check(ac.CheckAccess(nil, s.req, ucred, false), Equals, daemon.AccessUnknown)
+	s.mockAppArmorLabel(c, "unconfined")
+	c.Check(ac.CheckAccess(nil, s.req, ucred, false), Equals, daemon.AccessUnknown)
+
+	s.mockAppArmorLabel(c, "snap.fde-agent.fde-agent (enforce)")
+	c.Check(ac.CheckAccess(nil, s.req, ucred, false), IsNil)
+
+	s.mockAppArmorLabel(c, "snap.other.app (enforce)")
+	err := ac.CheckAccess(nil, s.req, ucred, false)
+	c.Assert(err, NotNil)
+	c.Check(err, Not(Equals), daemon.AccessUnknown)
+	c.Check(err.Status, Equals, http.StatusForbidden)
+	c.Check(err.Message, Equals, `access denied for snap "other"`)
+
+	s.mockAppArmorLabel(c, "/usr/sbin/foo (enforce)")
+	err = ac.CheckAccess(nil, s.req, ucred, false)
+	c.Assert(err, NotNil)
+	c.Check(err, Not(Equals), daemon.AccessUnknown)
+	c.Check(err.Message, Equals, "access denied")
+}
+
+func (s *accessSuite) TestResealAccess(c *C) {
+	s.AddCleanup(daemon.MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		c.Error("unexpected polkit check")
+		return false, nil
+	}))
+	root := &syscall.Ucred{Pid: 100, Uid: 0}
+
+	s.mockAppArmorLabel(c, "snap.fde-agent.fde-agent (enforce)")
+	c.Check(daemon.ResealAccess.CheckAccess(nil, s.req, &syscall.Ucred{Pid: 100, Uid: 1000}, false), IsNil)
+	c.Check(daemon.ResealAccess.CheckAccess(nil, s.req, root, false), IsNil)
+	// only resealing is allowed for the agent
+	c.Check(daemon.ManageKeysAccess.CheckAccess(nil, s.req, root, false), NotNil)
+
+	s.mockAppArmorLabel(c, "snap.other.app (enforce)")
+	c.Check(daemon.ResealAccess.CheckAccess(nil, s.req, root, false), NotNil)
+
+	s.mockAppArmorLabel(c, "unconfined")
+	c.Check(daemon.ResealAccess.CheckAccess(nil, s.req, root, false), IsNil)
+}
+
+func (s *accessSuite) TestFDEActionAccess(c *C) {
+	s.AddCleanup(daemon.MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		c.Error("unexpected polkit check")
+		return false, nil
+	}))
+	root := &syscall.Ucred{Pid: 100, Uid: 0}
+	s.mockAppArmorLabel(c, "snap.fde-agent.fde-agent (enforce)")
+
+	for _, t := range []struct {
+		body    string
+		allowed bool
+	}{
+		{`{"action":"reseal"}`, true},
+		{`{"action":"install"}`, false},
+		{`{"action":"update-dbx"}`, false},
+		{`{"action":"verify","repair":true}`, false},
+		{`{"action":"frobnicate"}`, false},
+		{`not json`, false},
+	} {
+		req := s.req.Clone(s.req.Context())
+		req.Body = io.NopCloser(strings.NewReader(t.body))
+		err := daemon.FDEActionAccess.CheckAccess(nil, req, root, false)
+		if t.allowed {
+			c.Check(err, IsNil, Commentf(t.body))
+		} else {
+			c.Check(err, NotNil, Commentf(t.body))
+		}
+		// the body is still there for the response function
+		body, rerr := io.ReadAll(req.Body)
+		c.Assert(rerr, IsNil)
+		c.Check(string(body), Equals, t.body)
+	}
+
+	// everything is allowed for unconfined root
+	s.mockAppArmorLabel(c, "unconfined")
+	req := s.req.Clone(s.req.Context())
+	req.Body = io.NopCloser(strings.NewReader(`{"action":"install"}`))
+	c.Check(daemon.FDEActionAccess.CheckAccess(nil, req, root, false), IsNil)
+}
+
+func (s *accessSuite) TestFDEActionAccessBodyTooLarge(c *C) {
+	root := &syscall.Ucred{Pid: 100, Uid: 0}
+	req := s.req.Clone(s.req.Context())
+	req.Body = io.NopCloser(strings.NewReader(`{"action":"reseal","padding":"` + strings.Repeat("x", 64*1024) + `"}`))
+	err := daemon.FDEActionAccess.CheckAccess(nil, req, root, false)
+	c.Assert(err, NotNil)
+	c.Check(err.Status, Equals, http.StatusBadRequest)
+	c.Check(err.Message, Equals, "request body is larger than 65536 bytes")
+}
+
+type mockAccessChecker struct {
+	err    *daemon.ApiError
+	called int
+}
+
+func (ac *mockAccessChecker) CheckAccess(d *daemon.Daemon, r *http.Request, peerCred *syscall.Ucred, allowInteraction bool) *daemon.ApiError {
+	ac.called++
+	return ac.err
+}
+
+func (s *accessSuite) TestAccessChain(c *C) {
+	denied := &daemon.ApiError{Status: http.StatusForbidden, Message: "nope"}
+	unknown := &mockAccessChecker{err: daemon.AccessUnknown}
+	allow := &mockAccessChecker{}
+	deny := &mockAccessChecker{err: denied}
+
+	// the first decision wins
+	chain := daemon.AccessChain{unknown, allow, deny}
+	c.Check(chain.CheckAccess(nil, s.req, nil, false), IsNil)
+	c.Check(unknown.called, Equals, 1)
+	c.Check(allow.called, Equals, 1)
+	c.Check(deny.called, Equals, 0)
+
+	chain = daemon.AccessChain{unknown, deny, allow}
+	c.Check(chain.CheckAccess(nil, s.req, nil, false), Equals, denied)
+	c.Check(allow.called, Equals, 1)
+
+	// without a decision the request is denied
+	chain = daemon.AccessChain{unknown, unknown}
+	err := chain.CheckAccess(nil, s.req, nil, false)
+	c.Check(err, Equals, daemon.AccessUnknown)
+	c.Check(err.Status, Equals, http.StatusForbidden)
+	c.Check(daemon.AccessChain{}.CheckAccess(nil, s.req, nil, false), Equals, daemon.AccessUnknown)
+
+	// chains can be nested
+	chain = daemon.AccessChain{daemon.AccessChain{unknown}, daemon.AccessChain{allow}}
+	c.Check(chain.CheckAccess(nil, s.req, nil, false), IsNil)
+}
+
+func (s *accessSuite) TestUIDAccess(c *C) {
+	ac := daemon.NewUIDAccess(1000, 1001)
+	c.Check(ac.CheckAccess(nil, s.req, &syscall.Ucred{Uid: 1000}, false), IsNil)
+	c.Check(ac.CheckAccess(nil, s.req, &syscall.Ucred{Uid: 1001}, false), IsNil)
+	c.Check(ac.CheckAccess(nil, s.req, &syscall.Ucred{Uid: 0}, false), Equals, daemon.AccessUnknown)
+	c.Check(ac.CheckAccess(nil, s.req, nil, false), Equals, daemon.AccessUnknown)
+}
+
+// mockGroup makes fde-admin a group with gid 989 and returns a request
+// from the process with the specified pid, whose supplementary groups
+// are as given.
+func (s *accessSuite) mockGroup(c *C, pid int, groups string) *http.Request {
+	s.AddCleanup(daemon.MockUserLookupGroup(func(name string) (*user.Group, error) {
+		if name != "fde-admin" {
+			return nil, user.UnknownGroupError(name)
+		}
+		return &user.Group{Name: name, Gid: "989"}, nil
+	}))
+
+	statusDir := filepath.Join(s.rootDir, "proc", strconv.Itoa(pid))
+	c.Assert(os.MkdirAll(statusDir, 0755), IsNil)
+	status := fmt.Sprintf("Name:\tfdectl\nUid:\t1000\t1000\t1000\t1000\nGroups:\t%s\nVmPeak:\t0 kB\n", groups)
+	c.Assert(os.WriteFile(filepath.Join(statusDir, "status"), []byte(status), 0644), IsNil)
+
+	pidfd, err := netutil.PidfdOpen(int32(pid))
+	c.Assert(err, IsNil)
+	s.AddCleanup(func() { pidfd.Close() })
+	return s.req.WithContext(context.WithValue(s.req.Context(), daemon.PidfdKey, pidfd))
+}
+
+func (s *accessSuite) TestGroupAccessSupplementary(c *C) {
+	pid := os.Getpid()
+	req := s.mockGroup(c, pid, "4 24 989 1000")
+	ac := daemon.NewGroupAccess("fde-admin")
+	c.Check(ac.CheckAccess(nil, req, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 1000}, false), IsNil)
+}
+
+func (s *accessSuite) TestGroupAccessPrimary(c *C) {
+	pid := os.Getpid()
+	req := s.mockGroup(c, pid, "")
+	ac := daemon.NewGroupAccess("fde-admin")
+	c.Check(ac.CheckAccess(nil, req, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 989}, false), IsNil)
+	// the primary group does not need a pidfd
+	c.Check(ac.CheckAccess(nil, s.req, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 989}, false), IsNil)
+}
+
+func (s *accessSuite) TestGroupAccessNotMember(c *C) {
+	pid := os.Getpid()
+	req := s.mockGroup(c, pid, "4 24 1000")
+	ac := daemon.NewGroupAccess("fde-admin")
+	c.Check(ac.CheckAccess(nil, req, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 1000}, false), Equals, daemon.AccessUnknown)
+	c.Check(ac.CheckAccess(nil, req, nil, false), Equals, daemon.AccessUnknown)
+
+	// groups that do not exist have no members
+	ac = daemon.NewGroupAccess("other")
+	c.Check(ac.CheckAccess(nil, req, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 989}, false), Equals, daemon.AccessUnknown)
+}
+
+func (s *accessSuite) TestGroupAccessNoPidfd(c *C) {
+	pid := os.Getpid()
+	s.mockGroup(c, pid, "989")
+	ac := daemon.NewGroupAccess("fde-admin")
+	// the supplementary groups cannot be trusted without a pidfd
+	c.Check(ac.CheckAccess(nil, s.req, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 1000}, false), Equals, daemon.AccessUnknown)
+}
+
+func (s *accessSuite) TestGroupAccessProcessExited(c *C) {
+	cmd := exec.Command("sleep", "60")
+	c.Assert(cmd.Start(), IsNil)
+	pid := cmd.Process.Pid
+	req := s.mockGroup(c, pid, "989")
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	// the pid may have been reused by another process
+	ac := daemon.NewGroupAccess("fde-admin")
+	c.Check(ac.CheckAccess(nil, req, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 1000}, false), Equals, daemon.AccessUnknown)
+}
+
+func (s *accessSuite) TestManageKeysAccess(c *C) {
+	pid := os.Getpid()
+	member := s.mockGroup(c, pid, "989")
+	polkitCalls := 0
+	s.AddCleanup(daemon.MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		polkitCalls++
+		c.Check(actionID, Equals, "io.snapcraft.fdemanager.manage-keys")
+		return uid == 1002, nil
+	}))
+
+	// root and members of fde-admin do not need polkit
+	c.Check(daemon.ManageKeysAccess.CheckAccess(nil, s.req, &syscall.Ucred{Pid: 200, Uid: 0}, false), IsNil)
+	c.Check(daemon.ManageKeysAccess.CheckAccess(nil, member, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 1000}, false), IsNil)
+	c.Check(polkitCalls, Equals, 0)
+
+	c.Check(daemon.ManageKeysAccess.CheckAccess(nil, s.req, &syscall.Ucred{Pid: 200, Uid: 1002, Gid: 1002}, false), IsNil)
+	err := daemon.ManageKeysAccess.CheckAccess(nil, s.req, &syscall.Ucred{Pid: 200, Uid: 1001, Gid: 1001}, false)
+	c.Assert(err, NotNil)
+	c.Check(err.Kind, Equals, api.ErrorKindNotAuthorized)
+	c.Check(polkitCalls, Equals, 2)
+}
+
+func (s *accessSuite) TestManageTPMAccess(c *C) {
+	pid := os.Getpid()
+	member := s.mockGroup(c, pid, "989")
+	var actionIDs []string
+	s.AddCleanup(daemon.MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		actionIDs = append(actionIDs, actionID)
+		return uid == 1002, nil
+	}))
+
+	c.Check(daemon.ManageTPMAccess.CheckAccess(nil, s.req, &syscall.Ucred{Pid: 200, Uid: 0}, false), IsNil)
+	c.Check(daemon.ManageTPMAccess.CheckAccess(nil, member, &syscall.Ucred{Pid: int32(pid), Uid: 1000, Gid: 1000}, false), IsNil)
+	c.Check(actionIDs, HasLen, 0)
+
+	c.Check(daemon.ManageTPMAccess.CheckAccess(nil, s.req, &syscall.Ucred{Pid: 200, Uid: 1002, Gid: 1002}, false), IsNil)
+	c.Check(daemon.ManageTPMAccess.CheckAccess(nil, s.req, &syscall.Ucred{Pid: 200, Uid: 1001, Gid: 1001}, false), NotNil)
+	c.Check(actionIDs, DeepEquals, []string{"io.snapcraft.fdemanager.manage-tpm", "io.snapcraft.fdemanager.manage-tpm"})
+}
+
+func (s *accessSuite) mockAuthority(c *C, result *polkittest.Result, err error) *[]*polkittest.Request {
+	// polkit identifies this process by its start time
+	stat, statErr := os.ReadFile("/proc/self/stat")
+	c.Assert(statErr, IsNil)
+	statDir := filepath.Join(s.rootDir, "proc", strconv.Itoa(os.Getpid()))
+	c.Assert(os.MkdirAll(statDir, 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(statDir, "stat"), stat, 0644), IsNil)
+
+	var reqs []*polkittest.Request
+	restore, mockErr := polkittest.MockAuthority(func(req *polkittest.Request) (*polkittest.Result, error) {
+		reqs = append(reqs, req)
+		return result, err
+	})
+	c.Assert(mockErr, IsNil)
+	s.AddCleanup(restore)
+	return &reqs
+}
+
+func (s *accessSuite) TestPolkitAccessAuthorized(c *C) {
+	reqs := s.mockAuthority(c, &polkittest.Result{Authorized: true}, nil)
+	ac := daemon.NewPolkitAccess(daemon.PolkitActionManageKeys)
+
+	ucred := &syscall.Ucred{Pid: int32(os.Getpid()), Uid: 1000}
+	c.Check(ac.CheckAccess(nil, s.req, ucred, false), IsNil)
+	c.Check(ac.CheckAccess(nil, s.req, ucred, true), IsNil)
+
+	c.Assert(*reqs, HasLen, 2)
+	c.Check((*reqs)[0].Uid, Equals, uint32(1000))
+	c.Check((*reqs)[0].Pid, Equals, uint32(os.Getpid()))
+	c.Check((*reqs)[0].ActionID, Equals, "io.snapcraft.fdemanager.manage-keys")
+	c.Check((*reqs)[0].Flags, Equals, polkit.CheckNone)
+	c.Check((*reqs)[1].Flags, Equals, polkit.CheckAllowInteraction)
+}
+
+func (s *accessSuite) TestPolkitAccessDenied(c *C) {
+	for _, t := range []struct {
+		result  *polkittest.Result
+		err     error
+		status  int
+		kind    api.ErrorKind
+		message string
+	}{
+		{&polkittest.Result{}, nil, http.StatusForbidden, api.ErrorKindNotAuthorized, "not authorized"},
+		{&polkittest.Result{Dismissed: true}, nil, http.StatusForbidden, api.ErrorKindAuthCancelled, "authentication cancelled"},
+		{&polkittest.Result{Challenge: true}, nil, http.StatusUnauthorized, api.ErrorKindInteractionRequired, "interactive authentication required"},
+		{nil, errors.New("boom"), http.StatusForbidden, "", "access denied"},
+	} {
+		s.mockAuthority(c, t.result, t.err)
+
+		ac := daemon.NewPolkitAccess(daemon.PolkitActionManageKeys)
+		apiErr := ac.CheckAccess(nil, s.req, &syscall.Ucred{Pid: int32(os.Getpid()), Uid: 1000}, true)
+
+		c.Assert(apiErr, NotNil)
+		c.Check(apiErr.Status, Equals, t.status)
+		c.Check(apiErr.Kind, Equals, t.kind)
+		c.Check(apiErr.Message, Equals, t.message)
+	}
+
+	// without credentials polkit cannot be asked
+	apiErr := daemon.NewPolkitAccess(daemon.PolkitActionManageKeys).CheckAccess(nil, s.req, nil, false)
+	c.Assert(apiErr, NotNil)
+	c.Check(apiErr.Status, Equals, http.StatusForbidden)
+	c.Check(apiErr.Message, Equals, "access denied")
+}
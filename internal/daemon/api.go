@@ -18,4 +18,17 @@
  */
 package daemon
 
-var apiCommands = []*command{}
+var apiCommands = []*command{
+	changesCmd,
+	changeCmd,
+	changeWaitCmd,
+	systemFDECmd,
+	systemFDEBootCmd,
+	systemFDEProfilePreviewCmd,
+	recoveryKeysCmd,
+	keyslotCmd,
+	auditCmd,
+	eventsCmd,
+	noticesCmd,
+	tpmCmd,
+}
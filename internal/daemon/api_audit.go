@@ -0,0 +1,76 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/audit"
+)
+
+var (
+	auditCmd = &command{
+		Path:       "/v1/audit",
+		GET:        getAudit,
+		ReadAccess: auditAccess,
+	}
+)
+
+func getAudit(d *Daemon, _ map[string]string, query url.Values, _ io.Reader, _ bool) response {
+	var filter audit.Filter
+	for _, t := range []struct {
+		param string
+		time  *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	} {
+		value := query.Get(t.param)
+		if value == "" {
+			continue
+		}
+		tm, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return statusBadRequest("invalid %s parameter: %q", t.param, value)
+		}
+		*t.time = tm
+	}
+	if value := query.Get("uid"); value != "" {
+		uid, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return statusBadRequest("invalid uid parameter: %q", value)
+		}
+		uid32 := uint32(uid)
+		filter.UID = &uid32
+	}
+
+	recs, err := d.auditLog.Read(&filter)
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+	if recs == nil {
+		recs = []*api.AuditRecord{}
+	}
+	return syncResponse(recs)
+}
@@ -0,0 +1,244 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/netutil"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/polkit"
+)
+
+type auditSuite struct {
+	apiBaseSuite
+
+	uid uint32
+	now time.Time
+}
+
+var _ = Suite(&auditSuite{})
+
+var auditTestTime = time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC)
+
+func (s *auditSuite) SetUpTest(c *C) {
+	s.apiBaseSuite.SetUpTest(c)
+
+	s.uid = 0
+	s.AddCleanup(daemon.MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: 100, Uid: s.uid, Gid: s.uid}, nil
+	}))
+	s.now = auditTestTime
+	s.AddCleanup(daemon.MockTimeNow(func() time.Time {
+		now := s.now
+		s.now = s.now.Add(time.Minute)
+		return now
+	}))
+	s.AddCleanup(daemon.MockEnsureStateSoon(func(*state.State) {}))
+	s.AddCleanup(daemon.MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		return false, nil
+	}))
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       keyslotsTestUUID,
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "default", Protector: fdestate.ProtectorTPM, SealedObject: "/var/lib/fdemanager/keys/default.sealed-key"},
+			{Slot: 1, Name: "user", Protector: fdestate.ProtectorPassphrase},
+		},
+	}), IsNil)
+}
+
+const auditTestChangePassphrase = `{"action":"change-passphrase","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","old-secret":"old","new-secret":"new"}`
+
+func (s *auditSuite) auditRecords(c *C, query string) []*api.AuditRecord {
+	var recs []*api.AuditRecord
+	s.syncReq(c, http.MethodGet, "/v1/audit"+query, nil, &recs)
+	return recs
+}
+
+func (s *auditSuite) TestAuditWriteRequests(c *C) {
+	c.Check(s.auditRecords(c, ""), DeepEquals, []*api.AuditRecord{})
+
+	// allowed, creating a change
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde/keyslots/user", strings.NewReader(auditTestChangePassphrase))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	chgID := rsp.Change
+
+	// allowed, but failing
+	rsp = s.req(c, http.MethodPost, "/v1/system/fde/keyslots/user", strings.NewReader(`{"action":"frobnicate"}`))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeError)
+
+	// denied
+	s.uid = 1000
+	rsp = s.req(c, http.MethodPost, "/v1/system/fde/keyslots/user", strings.NewReader(auditTestChangePassphrase))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeError)
+	s.uid = 0
+
+	// read requests are not audited
+	s.req(c, http.MethodGet, "/v1/system/fde", nil)
+
+	c.Check(s.auditRecords(c, ""), DeepEquals, []*api.AuditRecord{
+		{
+			Time:     auditTestTime,
+			UID:      0,
+			PID:      100,
+			Method:   "POST",
+			Path:     "/v1/system/fde/keyslots/user",
+			Decision: api.AuditAllow,
+			Status:   http.StatusAccepted,
+			Change:   chgID,
+		},
+		{
+			Time:     auditTestTime.Add(time.Minute),
+			UID:      0,
+			PID:      100,
+			Method:   "POST",
+			Path:     "/v1/system/fde/keyslots/user",
+			Decision: api.AuditAllow,
+			Status:   http.StatusBadRequest,
+		},
+		{
+			Time:     auditTestTime.Add(2 * time.Minute),
+			UID:      1000,
+			PID:      100,
+			Method:   "POST",
+			Path:     "/v1/system/fde/keyslots/user",
+			Decision: api.AuditDeny,
+			Status:   http.StatusForbidden,
+		},
+	})
+
+	// the log is stored in the state directory
+	c.Check(paths.ManagerAuditLogFile, Equals, filepath.Join(paths.ManagerStateDir, "audit.log"))
+	data, err := os.ReadFile(paths.ManagerAuditLogFile)
+	c.Assert(err, IsNil)
+	c.Check(strings.Count(string(data), "\n"), Equals, 3)
+}
+
+func (s *auditSuite) TestAuditPeerDetails(c *C) {
+	pid := os.Getpid()
+	procDir := filepath.Join(paths.ProcDir, strconv.Itoa(pid))
+	c.Assert(os.MkdirAll(procDir, 0755), IsNil)
+	c.Assert(os.Symlink("/usr/bin/fdemanagerctl", filepath.Join(procDir, "exe")), IsNil)
+	restore := daemon.MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: int32(pid), Uid: 0, Gid: 0}, nil
+	})
+	defer restore()
+	restore = daemon.MockNetutilConnPeerPidfd(func(net.Conn, uint64) (*netutil.Pidfd, error) {
+		return netutil.PidfdOpen(int32(pid))
+	})
+	defer restore()
+	restore = daemon.MockNetutilConnPeerSecurityLabel(func(net.Conn) (string, error) {
+		return "snap.fde-agent.agent (enforce)", nil
+	})
+	defer restore()
+	c.Assert(os.MkdirAll(filepath.Join(paths.SysfsDir, "module/apparmor/parameters"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(paths.SysfsDir, "module/apparmor/parameters/enabled"), []byte("Y\n"), 0644), IsNil)
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde/keyslots/user", strings.NewReader(auditTestChangePassphrase))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeError)
+
+	// the AppArmor label prevents access to the audit log, so
+	// read it as an unconfined client
+	restore = daemon.MockNetutilConnPeerSecurityLabel(func(net.Conn) (string, error) {
+		return "", netutil.ErrNoPeerSecurityLabel
+	})
+	defer restore()
+	c.Check(s.auditRecords(c, ""), DeepEquals, []*api.AuditRecord{{
+		Time:     auditTestTime,
+		UID:      0,
+		PID:      int32(pid),
+		Exe:      "/usr/bin/fdemanagerctl",
+		Label:    "snap.fde-agent.agent",
+		Method:   "POST",
+		Path:     "/v1/system/fde/keyslots/user",
+		Decision: api.AuditDeny,
+		Status:   http.StatusForbidden,
+	}})
+}
+
+func (s *auditSuite) TestAuditFilter(c *C) {
+	for _, uid := range []uint32{0, 1000, 0} {
+		s.uid = uid
+		s.req(c, http.MethodPost, "/v1/system/fde/keyslots/user", strings.NewReader(`{"action":"frobnicate"}`))
+	}
+	s.uid = 0
+
+	for _, t := range []struct {
+		query string
+		times []time.Duration
+	}{
+		{"", []time.Duration{0, time.Minute, 2 * time.Minute}},
+		{"?uid=0", []time.Duration{0, 2 * time.Minute}},
+		{"?uid=1000", []time.Duration{time.Minute}},
+		{"?uid=1001", nil},
+		{"?since=2023-10-16T12:01:00Z", []time.Duration{time.Minute, 2 * time.Minute}},
+		{"?until=2023-10-16T12:01:00Z", []time.Duration{0}},
+		{"?since=2023-10-16T12:00:30Z&until=2023-10-16T14:01:30%2B02:00", []time.Duration{time.Minute}},
+		{"?since=2023-10-16T12:01:00Z&uid=0", []time.Duration{2 * time.Minute}},
+	} {
+		recs := s.auditRecords(c, t.query)
+		var times []time.Duration
+		for _, rec := range recs {
+			times = append(times, rec.Time.Sub(auditTestTime))
+		}
+		c.Check(times, DeepEquals, t.times, Commentf("%s", t.query))
+	}
+}
+
+func (s *auditSuite) TestAuditFilterErrors(c *C) {
+	for _, t := range []struct {
+		query   string
+		message string
+	}{
+		{"?since=yesterday", `invalid since parameter: "yesterday"`},
+		{"?until=2023-10-16", `invalid until parameter: "2023-10-16"`},
+		{"?uid=root", `invalid uid parameter: "root"`},
+		{"?uid=-1", `invalid uid parameter: "-1"`},
+	} {
+		status, result := s.errorReq(c, http.MethodGet, "/v1/audit"+t.query, nil)
+		c.Check(status, Equals, http.StatusBadRequest, Commentf("%s", t.query))
+		c.Check(result.Message, Equals, t.message, Commentf("%s", t.query))
+	}
+}
+
+func (s *auditSuite) TestAuditRequiresAdmin(c *C) {
+	s.uid = 1000
+	status, result := s.errorReq(c, http.MethodGet, "/v1/audit", nil)
+	c.Check(status, Equals, http.StatusForbidden)
+	c.Check(result.Message, Equals, "access denied")
+}
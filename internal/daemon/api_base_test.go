@@ -0,0 +1,105 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/api"
+	. "github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/netutil"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+type apiBaseSuite struct {
+	testutil.BaseTest
+
+	d *Daemon
+}
+
+func (s *apiBaseSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "run"), 0755), IsNil)
+	s.AddCleanup(paths.MockRootDir(dir))
+
+	s.AddCleanup(MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: 100, Uid: 0, Gid: 0}, nil
+	}))
+	s.AddCleanup(MockNetutilConnPeerSecurityLabel(func(net.Conn) (string, error) {
+		return "", netutil.ErrNoPeerSecurityLabel
+	}))
+
+	d, err := New()
+	c.Assert(err, IsNil)
+	s.d = d
+}
+
+// req sends a request to the daemon's router over a fake connection
+// and returns the decoded response.
+func (s *apiBaseSuite) req(c *C, method, target string, body io.Reader) *api.Response {
+	return s.reqWithHeader(c, method, target, body, nil)
+}
+
+func (s *apiBaseSuite) reqWithHeader(c *C, method, target string, body io.Reader, header http.Header) *api.Response {
+	ctx := context.WithValue(context.Background(), ConnectionKey, new(net.UnixConn))
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	c.Assert(err, IsNil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	rec := httptest.NewRecorder()
+	s.d.Router().ServeHTTP(rec, req)
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/json")
+
+	var rsp *api.Response
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &rsp), IsNil)
+	c.Check(rsp.StatusCode, Equals, rec.Code)
+	return rsp
+}
+
+func (s *apiBaseSuite) syncReq(c *C, method, target string, body io.Reader, result any) {
+	rsp := s.req(c, method, target, body)
+	c.Assert(rsp.Type, Equals, api.ResponseTypeSync, Commentf("%s", rsp.Result))
+	c.Check(rsp.StatusCode, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rsp.Result, result), IsNil)
+}
+
+func (s *apiBaseSuite) errorReq(c *C, method, target string, body io.Reader) (int, *api.ErrorResult) {
+	rsp := s.req(c, method, target, body)
+	c.Assert(rsp.Type, Equals, api.ResponseTypeError)
+
+	var result *api.ErrorResult
+	c.Assert(json.Unmarshal(rsp.Result, &result), IsNil)
+	return rsp.StatusCode, result
+}
@@ -0,0 +1,309 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015-2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/api"
+)
+
+var (
+	changesCmd = &command{
+		Path:       "/v1/changes",
+		GET:        getChanges,
+		ReadAccess: openAccess,
+	}
+
+	changeCmd = &command{
+		Path:        "/v1/changes/{id}",
+		GET:         getChange,
+		POST:        abortChange,
+		ReadAccess:  openAccess,
+		WriteAccess: changeAccess{},
+	}
+
+	changeWaitCmd = &command{
+		Path:       "/v1/changes/{id}/wait",
+		GET:        waitChange,
+		ReadAccess: openAccess,
+	}
+)
+
+const (
+	defaultChangeWaitTimeout = 30 * time.Second
+	maxChangeWaitTimeout     = 10 * time.Minute
+)
+
+var ensureStateSoon = func(st *state.State) {
+	st.EnsureBefore(0)
+}
+
+func changeNotFound(id string) *apiError {
+	return &apiError{
+		Status:  http.StatusNotFound,
+		Message: fmt.Sprintf("cannot find change with id %q", id),
+		Kind:    api.ErrorKindChangeNotFound,
+	}
+}
+
+func change2api(chg *state.Change) *api.Change {
+	status := chg.Status()
+	apiChg := &api.Change{
+		ID:      chg.ID(),
+		Kind:    chg.Kind(),
+		Summary: chg.Summary(),
+		Status:  status.String(),
+		Ready:   status.Ready(),
+
+		SpawnTime: chg.SpawnTime(),
+	}
+	readyTime := chg.ReadyTime()
+	if !readyTime.IsZero() {
+		apiChg.ReadyTime = &readyTime
+	}
+	if err := chg.Err(); err != nil {
+		apiChg.Err = err.Error()
+	}
+	var data map[string]*json.RawMessage
+	if chg.Get("api-data", &data) == nil {
+		apiChg.Data = data
+	}
+
+	tasks := chg.Tasks()
+	apiTasks := make([]*api.Task, len(tasks))
+	for i, t := range tasks {
+		apiTasks[i] = task2api(t)
+	}
+	apiChg.Tasks = apiTasks
+
+	return apiChg
+}
+
+func task2api(t *state.Task) *api.Task {
+	label, done, total := t.Progress()
+
+	apiTask := &api.Task{
+		ID:      t.ID(),
+		Kind:    t.Kind(),
+		Summary: t.Summary(),
+		Status:  t.Status().String(),
+		Log:     t.Log(),
+		Progress: api.TaskProgress{
+			Label: label,
+			Done:  done,
+			Total: total,
+		},
+		SpawnTime: t.SpawnTime(),
+	}
+	readyTime := t.ReadyTime()
+	if !readyTime.IsZero() {
+		apiTask.ReadyTime = &readyTime
+	}
+	return apiTask
+}
+
+func getChange(d *Daemon, vars map[string]string, _ url.Values, _ io.Reader, _ bool) response {
+	id := vars["id"]
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(id)
+	if chg == nil {
+		return changeNotFound(id)
+	}
+
+	return syncResponse(change2api(chg))
+}
+
+func abortChange(d *Daemon, vars map[string]string, _ url.Values, body io.Reader, _ bool) response {
+	id := vars["id"]
+
+	var req api.ChangeAction
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&req); err != nil {
+		return statusBadRequest("cannot decode request body: %v", err)
+	}
+	if req.Action != "abort" {
+		return statusBadRequest("change action %q is unsupported", req.Action)
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(id)
+	if chg == nil {
+		return changeNotFound(id)
+	}
+
+	if chg.IsReady() {
+		return &apiError{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("cannot abort change %s with nothing pending", id),
+			Kind:    api.ErrorKindChangeReady,
+		}
+	}
+
+	chg.Abort()
+
+	// ask the overlord to process the abort now rather than waiting
+	// for the next scheduled ensure.
+	ensureStateSoon(st)
+
+	return syncResponse(change2api(chg))
+}
+
+func getChanges(d *Daemon, _ map[string]string, query url.Values, _ io.Reader, _ bool) response {
+	var filter func(*state.Change) bool
+	switch query.Get("select") {
+	case "all":
+		filter = func(*state.Change) bool { return true }
+	case "in-progress", "":
+		filter = func(chg *state.Change) bool { return !chg.IsReady() }
+	case "ready":
+		filter = func(chg *state.Change) bool { return chg.IsReady() }
+	default:
+		return statusBadRequest("select should be one of: all,in-progress,ready")
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	chgs := st.Changes()
+	apiChgs := make([]*api.Change, 0, len(chgs))
+	for _, chg := range chgs {
+		if !filter(chg) {
+			continue
+		}
+		apiChgs = append(apiChgs, change2api(chg))
+	}
+	return syncResponse(apiChgs)
+}
+
+// waitChange waits until the status of the change with the specified
+// ID changes, or the timeout elapses, and returns the change.
+func waitChange(d *Daemon, vars map[string]string, query url.Values, _ io.Reader, _ bool) response {
+	id := vars["id"]
+
+	timeout := defaultChangeWaitTimeout
+	if value := query.Get("timeout"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout < 0 || timeout > maxChangeWaitTimeout {
+			return statusBadRequest("timeout should be a duration of at most %s", maxChangeWaitTimeout)
+		}
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(id)
+	if chg == nil {
+		return changeNotFound(id)
+	}
+	if chg.IsReady() {
+		return syncResponse(change2api(chg))
+	}
+
+	// subscribe with the state locked so that no status change is
+	// missed
+	return &changeWaitResponse{
+		d:       d,
+		id:      id,
+		status:  chg.Status().String(),
+		timeout: timeout,
+		events:  d.events.subscribe(),
+	}
+}
+
+// changeWaitResponse waits for the status of a change to change before
+// responding with the change.
+type changeWaitResponse struct {
+	d       *Daemon
+	id      string
+	status  string
+	timeout time.Duration
+	events  chan *api.Event
+}
+
+func (r *changeWaitResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.serve(req.Context(), w)
+}
+
+func (r *changeWaitResponse) Write(w http.ResponseWriter) {
+	r.serve(context.Background(), w)
+}
+
+func (r *changeWaitResponse) wait(ctx context.Context) {
+	defer r.d.events.unsubscribe(r.events)
+
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ev, ok := <-r.events:
+			if !ok {
+				// the subscription was dropped, so the
+				// status may have changed unnoticed
+				return
+			}
+			if ev.Type == api.EventChange && ev.Change.ID == r.id && ev.Change.Status != r.status {
+				return
+			}
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		case <-r.d.tomb.Dying():
+			return
+		}
+	}
+}
+
+func (r *changeWaitResponse) serve(ctx context.Context, w http.ResponseWriter) {
+	r.wait(ctx)
+
+	st := r.d.state
+	st.Lock()
+	chg := st.Change(r.id)
+	var rsp response
+	if chg == nil {
+		rsp = changeNotFound(r.id)
+	} else {
+		rsp = syncResponse(change2api(chg))
+	}
+	st.Unlock()
+
+	rsp.Write(w)
+}
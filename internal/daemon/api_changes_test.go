@@ -0,0 +1,411 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015-2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/api"
+	. "github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/polkit"
+)
+
+type changesSuite struct {
+	apiBaseSuite
+}
+
+var _ = Suite(&changesSuite{})
+
+func (s *changesSuite) addChanges(c *C) (inProgress, done, failed *state.Change) {
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	inProgress = st.NewChange("reseal", "reseal keys")
+	t1 := st.NewTask("compute-profile", "compute PCR profile")
+	t1.SetStatus(state.DoneStatus)
+	t1.Logf("computed profile")
+	t2 := st.NewTask("reseal-keys", "reseal keys")
+	t2.WaitFor(t1)
+	t2.SetProgress("resealing", 1, 3)
+	inProgress.AddAll(state.NewTaskSet(t1, t2))
+
+	done = st.NewChange("foo", "some change")
+	t3 := st.NewTask("bar", "some task")
+	done.AddTask(t3)
+	t3.SetStatus(state.DoneStatus)
+
+	failed = st.NewChange("baz", "failing change")
+	t4 := st.NewTask("bar", "failing task")
+	failed.AddTask(t4)
+	t4.Errorf("something went wrong")
+	t4.SetStatus(state.ErrorStatus)
+
+	return inProgress, done, failed
+}
+
+func changeIDs(chgs []*api.Change) []string {
+	var ids []string
+	for _, chg := range chgs {
+		ids = append(ids, chg.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *changesSuite) TestGetChange(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	var result *api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes/"+chg.ID(), nil, &result)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	c.Check(result.ID, Equals, chg.ID())
+	c.Check(result.Kind, Equals, "reseal")
+	c.Check(result.Summary, Equals, "reseal keys")
+	c.Check(result.Status, Equals, "Do")
+	c.Check(result.Ready, Equals, false)
+	c.Check(result.Err, Equals, "")
+	c.Check(result.SpawnTime.Equal(chg.SpawnTime()), Equals, true)
+	c.Check(result.ReadyTime, IsNil)
+
+	tasks := chg.Tasks()
+	c.Assert(result.Tasks, HasLen, 2)
+
+	c.Check(result.Tasks[0].ID, Equals, tasks[0].ID())
+	c.Check(result.Tasks[0].Kind, Equals, "compute-profile")
+	c.Check(result.Tasks[0].Summary, Equals, "compute PCR profile")
+	c.Check(result.Tasks[0].Status, Equals, "Done")
+	c.Assert(result.Tasks[0].Log, HasLen, 1)
+	c.Check(result.Tasks[0].Log[0], Matches, `.* INFO computed profile`)
+	c.Check(result.Tasks[0].Progress, DeepEquals, api.TaskProgress{Label: "", Done: 1, Total: 1})
+	c.Check(result.Tasks[0].SpawnTime.Equal(tasks[0].SpawnTime()), Equals, true)
+	c.Assert(result.Tasks[0].ReadyTime, NotNil)
+	c.Check(result.Tasks[0].ReadyTime.Equal(tasks[0].ReadyTime()), Equals, true)
+
+	c.Check(result.Tasks[1].ID, Equals, tasks[1].ID())
+	c.Check(result.Tasks[1].Kind, Equals, "reseal-keys")
+	c.Check(result.Tasks[1].Status, Equals, "Do")
+	c.Check(result.Tasks[1].Log, HasLen, 0)
+	c.Check(result.Tasks[1].Progress, DeepEquals, api.TaskProgress{Label: "resealing", Done: 1, Total: 3})
+	c.Check(result.Tasks[1].ReadyTime, IsNil)
+}
+
+func (s *changesSuite) TestGetChangeError(c *C) {
+	_, _, chg := s.addChanges(c)
+
+	var result *api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes/"+chg.ID(), nil, &result)
+
+	c.Check(result.ID, Equals, chg.ID())
+	c.Check(result.Status, Equals, "Error")
+	c.Check(result.Ready, Equals, true)
+	c.Check(result.Err, Equals, "cannot perform the following tasks:\n- failing task (something went wrong)")
+	c.Check(result.ReadyTime, NotNil)
+	c.Assert(result.Tasks, HasLen, 1)
+	c.Assert(result.Tasks[0].Log, HasLen, 1)
+	c.Check(result.Tasks[0].Log[0], Matches, `.* ERROR something went wrong`)
+}
+
+func (s *changesSuite) TestGetChangeNotFound(c *C) {
+	status, result := s.errorReq(c, http.MethodGet, "/v1/changes/42", nil)
+	c.Check(status, Equals, http.StatusNotFound)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeNotFound)
+	c.Check(result.Message, Equals, `cannot find change with id "42"`)
+}
+
+func (s *changesSuite) TestGetChangesDefault(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	var result []*api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes", nil, &result)
+	c.Check(changeIDs(result), DeepEquals, []string{chg.ID()})
+}
+
+func (s *changesSuite) TestGetChangesInProgress(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	var result []*api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes?select=in-progress", nil, &result)
+	c.Check(changeIDs(result), DeepEquals, []string{chg.ID()})
+}
+
+func (s *changesSuite) TestGetChangesReady(c *C) {
+	_, done, failed := s.addChanges(c)
+
+	var result []*api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes?select=ready", nil, &result)
+	c.Check(changeIDs(result), DeepEquals, []string{done.ID(), failed.ID()})
+}
+
+func (s *changesSuite) TestGetChangesAll(c *C) {
+	inProgress, done, failed := s.addChanges(c)
+
+	var result []*api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes?select=all", nil, &result)
+	c.Check(changeIDs(result), DeepEquals, []string{inProgress.ID(), done.ID(), failed.ID()})
+}
+
+func (s *changesSuite) TestGetChangesNone(c *C) {
+	var result []*api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes?select=all", nil, &result)
+	c.Check(result, HasLen, 0)
+	c.Check(result, NotNil)
+}
+
+func (s *changesSuite) TestGetChangesInvalidSelect(c *C) {
+	status, result := s.errorReq(c, http.MethodGet, "/v1/changes?select=foo", nil)
+	c.Check(status, Equals, http.StatusBadRequest)
+	c.Check(result.Message, Equals, "select should be one of: all,in-progress,ready")
+}
+
+func (s *changesSuite) TestAbortChange(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	ensureCalls := 0
+	restore := MockEnsureStateSoon(func(st *state.State) {
+		c.Check(st, Equals, s.d.Overlord().State())
+		ensureCalls++
+	})
+	defer restore()
+
+	var result *api.Change
+	s.syncReq(c, http.MethodPost, "/v1/changes/"+chg.ID(), strings.NewReader(`{"action":"abort"}`), &result)
+	c.Check(ensureCalls, Equals, 1)
+
+	c.Check(result.ID, Equals, chg.ID())
+	c.Assert(result.Tasks, HasLen, 2)
+	// completed tasks are undone and pending tasks are put on hold
+	c.Check(result.Tasks[0].Status, Equals, "Undo")
+	c.Check(result.Tasks[1].Status, Equals, "Hold")
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+	c.Check(chg.Tasks()[1].Status(), Equals, state.HoldStatus)
+}
+
+func (s *changesSuite) TestAbortChangeRequiresAuthorization(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	restore := MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: 100, Uid: 1000, Gid: 1000}, nil
+	})
+	defer restore()
+	restore = MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		c.Check(uid, Equals, uint32(1000))
+		c.Check(actionID, Equals, "io.snapcraft.fdemanager.manage-keys")
+		return false, nil
+	})
+	defer restore()
+	restore = MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/changes/"+chg.ID(), strings.NewReader(`{"action":"abort"}`))
+	c.Check(status, Equals, http.StatusForbidden)
+	c.Check(result.Kind, Equals, api.ErrorKindNotAuthorized)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+	c.Check(chg.Status(), Equals, state.DoStatus)
+}
+
+func (s *changesSuite) TestAbortTPMChangeRequiresTPMAuthorization(c *C) {
+	st := s.d.Overlord().State()
+	st.Lock()
+	chg := st.NewChange("clear-tpm", "Clear the TPM")
+	chg.AddTask(st.NewTask("clear-tpm", "Clear the TPM"))
+	st.Unlock()
+
+	restore := MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: 100, Uid: 1000, Gid: 1000}, nil
+	})
+	defer restore()
+	restore = MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		c.Check(actionID, Equals, "io.snapcraft.fdemanager.manage-tpm")
+		return false, nil
+	})
+	defer restore()
+	restore = MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/changes/"+chg.ID(), strings.NewReader(`{"action":"abort"}`))
+	c.Check(status, Equals, http.StatusForbidden)
+	c.Check(result.Kind, Equals, api.ErrorKindNotAuthorized)
+
+	st.Lock()
+	defer st.Unlock()
+	c.Check(chg.Status(), Equals, state.DoStatus)
+}
+
+func (s *changesSuite) TestAbortChangeNotFound(c *C) {
+	restore := MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/changes/42", strings.NewReader(`{"action":"abort"}`))
+	c.Check(status, Equals, http.StatusNotFound)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeNotFound)
+	c.Check(result.Message, Equals, `cannot find change with id "42"`)
+}
+
+func (s *changesSuite) TestAbortChangeReady(c *C) {
+	_, chg, _ := s.addChanges(c)
+
+	restore := MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/changes/"+chg.ID(), strings.NewReader(`{"action":"abort"}`))
+	c.Check(status, Equals, http.StatusBadRequest)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeReady)
+	c.Check(result.Message, Equals, "cannot abort change "+chg.ID()+" with nothing pending")
+}
+
+func (s *changesSuite) TestAbortChangeUnsupportedAction(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/changes/"+chg.ID(), strings.NewReader(`{"action":"foo"}`))
+	c.Check(status, Equals, http.StatusBadRequest)
+	c.Check(result.Kind, Equals, api.ErrorKind(""))
+	c.Check(result.Message, Equals, `change action "foo" is unsupported`)
+}
+
+func (s *changesSuite) TestAbortChangeInvalidBody(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/changes/"+chg.ID(), strings.NewReader(`{`))
+	c.Check(status, Equals, http.StatusBadRequest)
+	c.Check(result.Message, Equals, "cannot decode request body: unexpected EOF")
+}
+
+// waitReq sends a request to wait for a change in the background,
+// returning when the daemon is waiting for the change to change.
+func (s *changesSuite) waitReq(c *C, target string) <-chan *httptest.ResponseRecorder {
+	ctx := context.WithValue(context.Background(), ConnectionKey, new(net.UnixConn))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	c.Assert(err, IsNil)
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.d.Router().ServeHTTP(rec, req)
+		done <- rec
+	}()
+	for i := 0; i < 500 && s.d.EventSubscribers() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.d.EventSubscribers(), Equals, 1)
+	return done
+}
+
+func (s *changesSuite) waitResult(c *C, done <-chan *httptest.ResponseRecorder) *api.Change {
+	var rec *httptest.ResponseRecorder
+	select {
+	case rec = <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("request did not complete")
+	}
+	c.Check(s.d.EventSubscribers(), Equals, 0)
+
+	var rsp *api.Response
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &rsp), IsNil)
+	c.Assert(rsp.Type, Equals, api.ResponseTypeSync, Commentf("%s", rsp.Result))
+	var chg *api.Change
+	c.Assert(json.Unmarshal(rsp.Result, &chg), IsNil)
+	return chg
+}
+
+func (s *changesSuite) TestWaitChange(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	done := s.waitReq(c, "/v1/changes/"+chg.ID()+"/wait")
+
+	// changes to other changes are ignored
+	st := s.d.Overlord().State()
+	st.Lock()
+	other := st.NewChange("other", "other change")
+	t := st.NewTask("foo", "foo")
+	other.AddTask(t)
+	t.SetStatus(state.DoingStatus)
+	st.Unlock()
+
+	select {
+	case <-done:
+		c.Fatal("request completed early")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	st.Lock()
+	chg.Tasks()[1].SetStatus(state.DoingStatus)
+	st.Unlock()
+
+	result := s.waitResult(c, done)
+	c.Check(result.ID, Equals, chg.ID())
+	c.Check(result.Status, Equals, "Doing")
+}
+
+func (s *changesSuite) TestWaitChangeTimeout(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	done := s.waitReq(c, "/v1/changes/"+chg.ID()+"/wait?timeout=50ms")
+	result := s.waitResult(c, done)
+	c.Check(result.ID, Equals, chg.ID())
+	c.Check(result.Status, Equals, "Do")
+}
+
+func (s *changesSuite) TestWaitChangeReady(c *C) {
+	_, chg, _ := s.addChanges(c)
+
+	var result *api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes/"+chg.ID()+"/wait", nil, &result)
+	c.Check(result.ID, Equals, chg.ID())
+	c.Check(result.Status, Equals, "Done")
+	c.Check(s.d.EventSubscribers(), Equals, 0)
+}
+
+func (s *changesSuite) TestWaitChangeNotFound(c *C) {
+	status, result := s.errorReq(c, http.MethodGet, "/v1/changes/42/wait", nil)
+	c.Check(status, Equals, http.StatusNotFound)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeNotFound)
+}
+
+func (s *changesSuite) TestWaitChangeInvalidTimeout(c *C) {
+	chg, _, _ := s.addChanges(c)
+
+	for _, timeout := range []string{"soon", "-1s", "1h"} {
+		status, result := s.errorReq(c, http.MethodGet, "/v1/changes/"+chg.ID()+"/wait?timeout="+timeout, nil)
+		c.Check(status, Equals, http.StatusBadRequest)
+		c.Check(result.Message, Equals, "timeout should be a duration of at most 10m0s")
+	}
+}
@@ -0,0 +1,249 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/api"
+)
+
+var (
+	eventsCmd = &command{
+		Path:       "/v1/events",
+		GET:        getEvents,
+		ReadAccess: openAccess,
+	}
+)
+
+// eventsQueueSize is the number of events that are queued for a
+// subscriber. A subscriber that falls further behind is dropped.
+const eventsQueueSize = 64
+
+// eventsProgressInterval is how often the progress of running tasks is
+// checked for changes, as updating it does not notify anyone.
+var eventsProgressInterval = time.Second
+
+// eventHub sends the events about changes and tasks to its
+// subscribers.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan *api.Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan *api.Event]struct{})}
+}
+
+// watchState makes the hub send events when the status of changes and
+// tasks in the state changes.
+func (h *eventHub) watchState(st *state.State) {
+	st.Lock()
+	defer st.Unlock()
+
+	// the handlers are called with the state locked, from the task
+	// runner, and so must not block
+	st.AddChangeStatusChangedHandler(func(chg *state.Change, old, new state.Status) {
+		h.publish(&api.Event{
+			Type:   api.EventChange,
+			Change: change2api(chg),
+		})
+	})
+	st.AddTaskStatusChangedHandler(func(t *state.Task, old, new state.Status) {
+		ev := &api.Event{
+			Type: api.EventTask,
+			Task: task2api(t),
+		}
+		if chg := t.Change(); chg != nil {
+			ev.ChangeID = chg.ID()
+		}
+		h.publish(ev)
+	})
+}
+
+// subscribe returns a channel on which events are received until the
+// subscriber unsubscribes. The channel is closed if the subscriber
+// falls behind.
+func (h *eventHub) subscribe() chan *api.Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan *api.Event, eventsQueueSize)
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan *api.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) publish(ev *api.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func getEvents(d *Daemon, _ map[string]string, query url.Values, _ io.Reader, _ bool) response {
+	return &eventsResponse{
+		d:        d,
+		changeID: query.Get("change"),
+		events:   d.events.subscribe(),
+	}
+}
+
+// eventsResponse streams events as lines of JSON until the client goes
+// away, the subscription is dropped or the daemon stops.
+type eventsResponse struct {
+	d *Daemon
+	// changeID, if not empty, restricts the events to those about
+	// the change with that ID.
+	changeID string
+	events   chan *api.Event
+}
+
+func (r *eventsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.serve(req.Context(), w)
+}
+
+func (r *eventsResponse) Write(w http.ResponseWriter) {
+	r.serve(context.Background(), w)
+}
+
+func (r *eventsResponse) match(ev *api.Event) bool {
+	switch {
+	case r.changeID == "":
+		return true
+	case ev.Change != nil:
+		return ev.Change.ID == r.changeID
+	default:
+		return ev.ChangeID == r.changeID
+	}
+}
+
+// progressEvents returns the events for the running tasks whose
+// progress differs from that in the last progress map, which is
+// updated.
+func (r *eventsResponse) progressEvents(last map[string]api.TaskProgress) []*api.Event {
+	st := r.d.state
+	st.Lock()
+	defer st.Unlock()
+
+	var events []*api.Event
+	current := make(map[string]api.TaskProgress)
+	for _, chg := range st.Changes() {
+		if chg.IsReady() || (r.changeID != "" && chg.ID() != r.changeID) {
+			continue
+		}
+		for _, t := range chg.Tasks() {
+			if t.Status() != state.DoingStatus {
+				continue
+			}
+			apiTask := task2api(t)
+			current[t.ID()] = apiTask.Progress
+			if progress, ok := last[t.ID()]; ok && progress == apiTask.Progress {
+				continue
+			}
+			events = append(events, &api.Event{
+				Type:     api.EventTaskProgress,
+				ChangeID: chg.ID(),
+				Task:     apiTask,
+			})
+		}
+	}
+
+	for id := range last {
+		delete(last, id)
+	}
+	for id, progress := range current {
+		last[id] = progress
+	}
+	return events
+}
+
+func (r *eventsResponse) serve(ctx context.Context, w http.ResponseWriter) {
+	defer r.d.events.unsubscribe(r.events)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	enc := json.NewEncoder(w)
+	progress := make(map[string]api.TaskProgress)
+	ticker := time.NewTicker(eventsProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		var events []*api.Event
+		select {
+		case ev, ok := <-r.events:
+			if !ok {
+				// the subscription was dropped, the client
+				// needs to catch up by other means
+				return
+			}
+			if r.match(ev) {
+				events = append(events, ev)
+			}
+		case <-ticker.C:
+			events = r.progressEvents(progress)
+		case <-ctx.Done():
+			return
+		case <-r.d.tomb.Dying():
+			return
+		}
+
+		if len(events) == 0 {
+			continue
+		}
+		for _, ev := range events {
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		}
+		flush()
+	}
+}
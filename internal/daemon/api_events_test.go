@@ -0,0 +1,231 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/fdemanager/api"
+	. "github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+type eventsSuite struct {
+	testutil.BaseTest
+
+	d *Daemon
+}
+
+var _ = Suite(&eventsSuite{})
+
+func (s *eventsSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "run"), 0755), IsNil)
+	s.AddCleanup(paths.MockRootDir(dir))
+	s.AddCleanup(MockEventsProgressInterval(10 * time.Millisecond))
+
+	d, err := New()
+	c.Assert(err, IsNil)
+	// keep the tasks in the tests running
+	d.Overlord().TaskRunner().AddHandler("run", func(*state.Task, *tomb.Tomb) error {
+		return &state.Retry{After: time.Hour}
+	}, nil)
+	c.Assert(d.Start(), IsNil)
+	s.d = d
+
+	// wait for the verification of the state on start up so that
+	// its events are not part of the streams in the tests
+	st := d.Overlord().State()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		st.Lock()
+		pending := false
+		for _, chg := range st.Changes() {
+			pending = pending || !chg.IsReady()
+		}
+		st.Unlock()
+		if !pending {
+			break
+		}
+		c.Assert(time.Since(start) < 5*time.Second, Equals, true, Commentf("state not verified on start up"))
+	}
+}
+
+func (s *eventsSuite) TearDownTest(c *C) {
+	if s.d != nil {
+		c.Check(s.d.Stop(nil), IsNil)
+	}
+	s.BaseTest.TearDownTest(c)
+}
+
+type eventStream struct {
+	rsp     *http.Response
+	scanner *bufio.Scanner
+}
+
+func (s *eventsSuite) openEvents(c *C, query string) *eventStream {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", paths.ManagerSocket)
+			},
+		},
+	}
+	rsp, err := client.Get("http://localhost/v1/events" + query)
+	c.Assert(err, IsNil)
+	s.AddCleanup(func() { rsp.Body.Close() })
+	c.Check(rsp.StatusCode, Equals, http.StatusOK)
+	c.Check(rsp.Header.Get("Content-Type"), Equals, "application/x-ndjson")
+
+	return &eventStream{rsp: rsp, scanner: bufio.NewScanner(rsp.Body)}
+}
+
+func (es *eventStream) next(c *C) *api.Event {
+	scanned := make(chan bool, 1)
+	go func() { scanned <- es.scanner.Scan() }()
+	select {
+	case ok := <-scanned:
+		c.Assert(ok, Equals, true, Commentf("%v", es.scanner.Err()))
+	case <-time.After(5 * time.Second):
+		c.Fatal("no event received")
+	}
+	var ev *api.Event
+	c.Assert(json.Unmarshal(es.scanner.Bytes(), &ev), IsNil)
+	return ev
+}
+
+func (s *eventsSuite) TestEvents(c *C) {
+	es := s.openEvents(c, "")
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	chg := st.NewChange("reseal", "reseal keys")
+	t := st.NewTask("run", "run")
+	chg.AddTask(t)
+	st.EnsureBefore(0)
+	st.Unlock()
+
+	// the change status changes before the task status is
+	// reported
+	ev := es.next(c)
+	c.Check(ev.Type, Equals, api.EventChange)
+	c.Check(ev.Change.ID, Equals, chg.ID())
+	c.Check(ev.Change.Status, Equals, "Doing")
+
+	ev = es.next(c)
+	c.Check(ev.Type, Equals, api.EventTask)
+	c.Check(ev.ChangeID, Equals, chg.ID())
+	c.Check(ev.Task.ID, Equals, t.ID())
+	c.Check(ev.Task.Status, Equals, "Doing")
+
+	// the progress of the running task is sent once it is noticed
+	ev = es.next(c)
+	c.Check(ev.Type, Equals, api.EventTaskProgress)
+	c.Check(ev.ChangeID, Equals, chg.ID())
+	c.Check(ev.Task.Progress, DeepEquals, api.TaskProgress{Done: 1, Total: 1})
+
+	st.Lock()
+	t.SetProgress("resealing", 1, 2)
+	st.Unlock()
+
+	ev = es.next(c)
+	c.Check(ev.Type, Equals, api.EventTaskProgress)
+	c.Check(ev.Task.Progress, DeepEquals, api.TaskProgress{Label: "resealing", Done: 1, Total: 2})
+
+	st.Lock()
+	t.SetStatus(state.DoneStatus)
+	st.Unlock()
+
+	ev = es.next(c)
+	c.Check(ev.Type, Equals, api.EventChange)
+	c.Check(ev.Change.Status, Equals, "Done")
+	c.Check(ev.Change.Ready, Equals, true)
+	ev = es.next(c)
+	c.Check(ev.Type, Equals, api.EventTask)
+	c.Check(ev.Task.Status, Equals, "Done")
+}
+
+func (s *eventsSuite) TestEventsForChange(c *C) {
+	st := s.d.Overlord().State()
+	st.Lock()
+	var chgs []*state.Change
+	var tasks []*state.Task
+	for i := 0; i < 2; i++ {
+		chg := st.NewChange("reseal", "reseal keys")
+		t := st.NewTask("run", "run")
+		chg.AddTask(t)
+		t.SetStatus(state.DoingStatus)
+		chgs = append(chgs, chg)
+		tasks = append(tasks, t)
+	}
+	st.Unlock()
+
+	es := s.openEvents(c, "?change="+chgs[1].ID())
+
+	ev := es.next(c)
+	c.Check(ev.Type, Equals, api.EventTaskProgress)
+	c.Check(ev.ChangeID, Equals, chgs[1].ID())
+
+	st.Lock()
+	tasks[0].SetStatus(state.DoneStatus)
+	tasks[1].SetStatus(state.DoneStatus)
+	st.Unlock()
+
+	ev = es.next(c)
+	c.Check(ev.Type, Equals, api.EventChange)
+	c.Check(ev.Change.ID, Equals, chgs[1].ID())
+	ev = es.next(c)
+	c.Check(ev.Type, Equals, api.EventTask)
+	c.Check(ev.ChangeID, Equals, chgs[1].ID())
+}
+
+func (s *eventsSuite) TestEventsStop(c *C) {
+	es := s.openEvents(c, "")
+
+	// an open stream prevents the daemon from going into standby
+	c.Check(s.d.ConnTracker().CanStandby(), Equals, false)
+	c.Check(s.d.EventSubscribers(), Equals, 1)
+
+	// and ends when the daemon stops
+	done := make(chan error, 1)
+	go func() { done <- s.d.Stop(nil) }()
+	select {
+	case err := <-done:
+		c.Check(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("daemon did not stop")
+	}
+	s.d = nil
+
+	c.Check(es.scanner.Scan(), Equals, false)
+	c.Check(es.scanner.Err(), IsNil)
+}
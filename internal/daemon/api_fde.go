@@ -0,0 +1,417 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+)
+
+var (
+	systemFDECmd = &command{
+		Path:        "/v1/system/fde",
+		GET:         getFDEStatus,
+		POST:        postFDEAction,
+		ReadAccess:  openAccess,
+		WriteAccess: fdeActionAccess,
+	}
+
+	systemFDEBootCmd = &command{
+		Path:       "/v1/system/fde/boot",
+		GET:        getFDEBootStatus,
+		ReadAccess: openAccess,
+	}
+
+	systemFDEProfilePreviewCmd = &command{
+		Path:        "/v1/system/fde/profile/preview",
+		POST:        postProfilePreview,
+		ReadAccess:  openAccess,
+		WriteAccess: resealAccess,
+	}
+)
+
+func pcrProfile2api(profile *fdestate.PCRProfile) *api.PCRProfile {
+	if profile == nil {
+		return nil
+	}
+
+	apiProfile := &api.PCRProfile{
+		PCRs:       profile.PCRs,
+		BootChains: make([]*api.BootChain, 0, len(profile.BootChains)),
+	}
+	for _, chain := range profile.BootChains {
+		apiChain := &api.BootChain{
+			KernelCmdlines: chain.KernelCmdlines,
+		}
+		for _, img := range chain.Images {
+			apiChain.Images = append(apiChain.Images, &api.BootImage{
+				Path:   img.Path,
+				Digest: img.Digest,
+			})
+		}
+		apiProfile.BootChains = append(apiProfile.BootChains, apiChain)
+	}
+	return apiProfile
+}
+
+func container2api(c *fdestate.Container) *api.Container {
+	apiContainer := &api.Container{
+		DevicePath: c.DevicePath,
+		UUID:       c.UUID,
+		Label:      c.Label,
+		Keyslots:   make([]*api.Keyslot, 0, len(c.Keyslots)),
+		WillUnseal: c.WillUnseal,
+		PCRProfile: pcrProfile2api(c.PCRProfile),
+
+		PendingPCRProfile: pcrProfile2api(c.PendingPCRProfile),
+	}
+	for _, ks := range c.Keyslots {
+		apiContainer.Keyslots = append(apiContainer.Keyslots, &api.Keyslot{
+			Slot:      ks.Slot,
+			Name:      ks.Name,
+			Protector: api.ProtectorKind(ks.Protector),
+			PIN:       ks.PIN,
+		})
+	}
+	return apiContainer
+}
+
+func getFDEStatus(d *Daemon, _ map[string]string, _ url.Values, _ io.Reader, _ bool) response {
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	containers, err := fdestate.Containers(st)
+	if err != nil {
+		return statusInternalError("cannot obtain encrypted containers: %v", err)
+	}
+
+	status := &api.FDEStatus{
+		Containers: make([]*api.Container, 0, len(containers)),
+	}
+	for _, c := range containers {
+		status.Containers = append(status.Containers, container2api(c))
+	}
+	return syncResponse(status)
+}
+
+func getFDEBootStatus(d *Daemon, _ map[string]string, _ url.Values, _ io.Reader, _ bool) response {
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	containers, err := fdestate.Containers(st)
+	if err != nil {
+		return statusInternalError("cannot obtain encrypted containers: %v", err)
+	}
+
+	status := &api.BootStatus{
+		Containers: []*api.BootUnlock{},
+	}
+	for _, c := range containers {
+		if c.BootUnlock == nil {
+			continue
+		}
+		unlock := &api.BootUnlock{
+			Container:  c.UUID,
+			DevicePath: c.DevicePath,
+			BootID:     c.BootUnlock.BootID,
+			Method:     api.UnlockMethod(c.BootUnlock.Method),
+			Slot:       c.BootUnlock.Keyslot,
+		}
+		if unlock.Slot != nil {
+			if ks := c.Keyslot(*unlock.Slot); ks != nil {
+				unlock.Keyslot = ks.Name
+			}
+		}
+		status.Containers = append(status.Containers, unlock)
+	}
+	return syncResponse(status)
+}
+
+func api2bootChains(apiChains []*api.BootChain) []*fdestate.BootChain {
+	chains := make([]*fdestate.BootChain, 0, len(apiChains))
+	for _, apiChain := range apiChains {
+		chain := &fdestate.BootChain{
+			KernelCmdlines: apiChain.KernelCmdlines,
+		}
+		for _, img := range apiChain.Images {
+			chain.Images = append(chain.Images, &fdestate.BootImage{
+				Path:   img.Path,
+				Digest: img.Digest,
+			})
+		}
+		chains = append(chains, chain)
+	}
+	return chains
+}
+
+// fdeError converts an error returned by fdestate into an error
+// response.
+func fdeError(err error) response {
+	var notFound *fdestate.ContainerNotFoundError
+	if errors.As(err, &notFound) {
+		return statusNotFound("%v", err)
+	}
+	var conflict *fdestate.ChangeConflictError
+	if errors.As(err, &conflict) {
+		return &apiError{
+			Status:  http.StatusConflict,
+			Message: err.Error(),
+			Kind:    api.ErrorKindChangeConflict,
+			Value: map[string]string{
+				"change-kind": conflict.ChangeKind,
+				"change-id":   conflict.ChangeID,
+			},
+		}
+	}
+	return statusBadRequest("%v", err)
+}
+
+func postFDEAction(d *Daemon, _ map[string]string, _ url.Values, body io.Reader, _ bool) response {
+	var req api.FDEAction
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&req); err != nil {
+		return statusBadRequest("cannot decode request body: %v", err)
+	}
+
+	switch req.Action {
+	case "reseal":
+		return resealFDE(d, &req)
+	case "update-dbx":
+		return updateDBX(d, &req)
+	case "install":
+		return installFDE(d, &req)
+	case "verify":
+		return verifyFDE(d, &req)
+	default:
+		return statusBadRequest("fde action %q is unsupported", req.Action)
+	}
+}
+
+func resealFDE(d *Daemon, req *api.FDEAction) response {
+	for _, chain := range req.BootChains {
+		for _, img := range chain.Images {
+			if img.Path == "" {
+				return statusBadRequest("boot image path must be specified")
+			}
+		}
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	tss, err := fdestate.ResealForBootChains(st, api2bootChains(req.BootChains))
+	if err != nil {
+		return fdeError(err)
+	}
+
+	chg := st.NewChange("reseal", "Reseal TPM sealed keys")
+	for _, ts := range tss {
+		chg.AddAll(ts)
+	}
+	ensureStateSoon(st)
+
+	return asyncResponse(nil, chg.ID())
+}
+
+func updateDBX(d *Daemon, req *api.FDEAction) response {
+	if len(req.Payload) == 0 {
+		return statusBadRequest("dbx update payload must be specified")
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	ts, err := fdestate.UpdateDBX(st, req.Payload)
+	if err != nil {
+		return fdeError(err)
+	}
+
+	chg := st.NewChange("update-dbx", "Update the secure boot forbidden signature database")
+	chg.AddAll(ts)
+	ensureStateSoon(st)
+
+	return asyncResponse(nil, chg.ID())
+}
+
+func installFDE(d *Daemon, req *api.FDEAction) response {
+	for _, chain := range req.BootChains {
+		for _, img := range chain.Images {
+			if img.Path == "" {
+				return statusBadRequest("boot image path must be specified")
+			}
+		}
+	}
+	devices := make([]*fdestate.InstallDevice, 0, len(req.Devices))
+	for _, dev := range req.Devices {
+		devices = append(devices, &fdestate.InstallDevice{
+			DevicePath: dev.DevicePath,
+			Label:      dev.Label,
+		})
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	ts, installed, err := fdestate.Install(st, devices, api2bootChains(req.BootChains))
+	if err != nil {
+		return fdeError(err)
+	}
+
+	chg := st.NewChange("install", "Encrypt the containers of the target system")
+	chg.AddAll(ts)
+	ensureStateSoon(st)
+
+	result := &api.InstallResult{
+		Containers: make([]*api.InstalledContainer, 0, len(installed)),
+	}
+	for _, c := range installed {
+		result.Containers = append(result.Containers, &api.InstalledContainer{
+			DevicePath:  c.DevicePath,
+			UUID:        c.UUID,
+			RecoveryKey: c.RecoveryKey,
+			Provisional: true,
+		})
+	}
+	return asyncResponse(result, chg.ID())
+}
+
+func finding2api(f *fdestate.Finding) *api.Finding {
+	return &api.Finding{
+		Kind:       api.FindingKind(f.Kind),
+		Container:  f.Container,
+		DevicePath: f.DevicePath,
+		Keyslot:    f.Keyslot,
+		Token:      f.Token,
+		Path:       f.Path,
+		Handle:     f.Handle,
+		Message:    f.Message,
+		Repairable: f.Repairable,
+		Repaired:   f.Repaired,
+	}
+}
+
+func verifyFDE(d *Daemon, req *api.FDEAction) response {
+	st := d.state
+
+	if req.Repair {
+		st.Lock()
+		defer st.Unlock()
+
+		ts, err := fdestate.Repair(st)
+		if err != nil {
+			return fdeError(err)
+		}
+
+		chg := st.NewChange("repair-fde-state", "Repair the FDE state")
+		chg.AddAll(ts)
+		ensureStateSoon(st)
+
+		return asyncResponse(nil, chg.ID())
+	}
+
+	// the containers and the TPM are read without holding the state
+	// lock
+	findings, err := fdestate.Verify(st)
+	if err != nil {
+		return statusInternalError("cannot verify FDE state: %v", err)
+	}
+
+	result := &api.VerifyResult{
+		Findings: make([]*api.Finding, 0, len(findings)),
+	}
+	for _, f := range findings {
+		result.Findings = append(result.Findings, finding2api(f))
+	}
+	return syncResponse(result)
+}
+
+func postProfilePreview(d *Daemon, _ map[string]string, _ url.Values, body io.Reader, _ bool) response {
+	var req api.ProfilePreviewRequest
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&req); err != nil {
+		return statusBadRequest("cannot decode request body: %v", err)
+	}
+
+	params := &fdestate.PreviewParams{
+		SecureBootVariables: req.SecureBootVariables,
+	}
+	if req.BootChain != nil {
+		for _, img := range req.BootChain.Images {
+			if img.Path == "" {
+				return statusBadRequest("boot image path must be specified")
+			}
+		}
+		params.BootChain = api2bootChains([]*api.BootChain{req.BootChain})[0]
+	}
+
+	// the boot images and the event log are read without holding
+	// the state lock
+	preview, err := fdestate.PreviewProfile(d.state, params)
+	if err != nil {
+		return fdeError(err)
+	}
+
+	result := &api.ProfilePreview{
+		PCRs:       make([]*api.PCRPreview, 0, len(preview.PCRs)),
+		Containers: make([]*api.ContainerProfilePreview, 0, len(preview.Containers)),
+	}
+	for _, p := range preview.PCRs {
+		result.PCRs = append(result.PCRs, &api.PCRPreview{
+			PCR:           p.PCR,
+			KernelCmdline: p.KernelCmdline,
+			Measured:      p.Measured,
+			Predicted:     p.Predicted,
+		})
+	}
+	for _, c := range preview.Containers {
+		apiContainer := &api.ContainerProfilePreview{
+			Container:   c.UUID,
+			DevicePath:  c.DevicePath,
+			WillUnseal:  c.WillUnseal,
+			Differences: make([]*api.ProfileDifference, 0, len(c.Differences)),
+
+			WillUnsealAfterCommit: c.WillUnsealAfterCommit,
+		}
+		for _, diff := range c.Differences {
+			apiContainer.Differences = append(apiContainer.Differences, &api.ProfileDifference{
+				PCR:           diff.PCR,
+				Kind:          api.ProfileDifferenceKind(diff.Kind),
+				Path:          diff.Path,
+				Digest:        diff.Digest,
+				SealedDigest:  diff.SealedDigest,
+				KernelCmdline: diff.KernelCmdline,
+				Variable:      diff.Variable,
+			})
+		}
+		result.Containers = append(result.Containers, apiContainer)
+	}
+	return syncResponse(result)
+}
@@ -0,0 +1,676 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/efi/efitest"
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/luks/lukstest"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/tpm/tpmtest"
+)
+
+type fdeSuite struct {
+	apiBaseSuite
+}
+
+var _ = Suite(&fdeSuite{})
+
+func (s *fdeSuite) TestGetFDEStatusEmpty(c *C) {
+	var result *api.FDEStatus
+	s.syncReq(c, http.MethodGet, "/v1/system/fde", nil, &result)
+	c.Check(result, DeepEquals, &api.FDEStatus{Containers: []*api.Container{}})
+}
+
+func (s *fdeSuite) TestGetFDEStatus(c *C) {
+	st := s.d.Overlord().State()
+	st.Lock()
+	willUnseal := true
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Label:      "ubuntu-data-enc",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "default", Protector: fdestate.ProtectorTPM},
+			{Slot: 1, Name: "default-recovery", Protector: fdestate.ProtectorRecoveryKey},
+		},
+		PCRProfile: &fdestate.PCRProfile{
+			PCRs: []int{4, 7, 12},
+			BootChains: []*fdestate.BootChain{
+				{
+					Images: []*fdestate.BootImage{
+						{Path: "/boot/efi/EFI/ubuntu/shimx64.efi", Digest: "aaaa"},
+						{Path: "/boot/efi/EFI/ubuntu/grubx64.efi", Digest: "bbbb"},
+					},
+					KernelCmdlines: []string{"console=ttyS0"},
+				},
+			},
+		},
+		WillUnseal: &willUnseal,
+	}), IsNil)
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda3",
+		UUID:       "5a5ae4a0-d9b6-477f-9b0b-2bcd0cc9dc4d",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Protector: fdestate.ProtectorPassphrase},
+		},
+	}), IsNil)
+	st.Unlock()
+
+	var result *api.FDEStatus
+	s.syncReq(c, http.MethodGet, "/v1/system/fde", nil, &result)
+	c.Check(result, DeepEquals, &api.FDEStatus{
+		Containers: []*api.Container{
+			{
+				DevicePath: "/dev/sda3",
+				UUID:       "5a5ae4a0-d9b6-477f-9b0b-2bcd0cc9dc4d",
+				Keyslots: []*api.Keyslot{
+					{Slot: 0, Protector: api.ProtectorPassphrase},
+				},
+			},
+			{
+				DevicePath: "/dev/sda4",
+				UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+				Label:      "ubuntu-data-enc",
+				Keyslots: []*api.Keyslot{
+					{Slot: 0, Name: "default", Protector: api.ProtectorTPM},
+					{Slot: 1, Name: "default-recovery", Protector: api.ProtectorRecoveryKey},
+				},
+				WillUnseal: &willUnseal,
+				PCRProfile: &api.PCRProfile{
+					PCRs: []int{4, 7, 12},
+					BootChains: []*api.BootChain{
+						{
+							Images: []*api.BootImage{
+								{Path: "/boot/efi/EFI/ubuntu/shimx64.efi", Digest: "aaaa"},
+								{Path: "/boot/efi/EFI/ubuntu/grubx64.efi", Digest: "bbbb"},
+							},
+							KernelCmdlines: []string{"console=ttyS0"},
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (s *fdeSuite) TestGetFDEBootStatus(c *C) {
+	var result *api.BootStatus
+	s.syncReq(c, http.MethodGet, "/v1/system/fde/boot", nil, &result)
+	c.Check(result, DeepEquals, &api.BootStatus{Containers: []*api.BootUnlock{}})
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	slot := 1
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "default", Protector: fdestate.ProtectorTPM},
+			{Slot: 1, Name: "default-recovery", Protector: fdestate.ProtectorRecoveryKey},
+		},
+		BootUnlock: &fdestate.BootUnlock{
+			BootID:  "boot-1",
+			Method:  fdestate.UnlockRecoveryKey,
+			Keyslot: &slot,
+		},
+	}), IsNil)
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda3",
+		UUID:       "5a5ae4a0-d9b6-477f-9b0b-2bcd0cc9dc4d",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Protector: fdestate.ProtectorPassphrase},
+		},
+		BootUnlock: &fdestate.BootUnlock{
+			BootID: "boot-1",
+			Method: fdestate.UnlockPassphrase,
+		},
+	}), IsNil)
+	// not unlocked at the current boot
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sdb1",
+		UUID:       "e2a5a2b4-95c4-4b8e-9fb0-2d1f3a0e2f7c",
+	}), IsNil)
+	st.Unlock()
+
+	result = nil
+	s.syncReq(c, http.MethodGet, "/v1/system/fde/boot", nil, &result)
+	c.Check(result, DeepEquals, &api.BootStatus{
+		Containers: []*api.BootUnlock{
+			{
+				Container:  "5a5ae4a0-d9b6-477f-9b0b-2bcd0cc9dc4d",
+				DevicePath: "/dev/sda3",
+				BootID:     "boot-1",
+				Method:     api.UnlockPassphrase,
+			},
+			{
+				Container:  "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+				DevicePath: "/dev/sda4",
+				BootID:     "boot-1",
+				Method:     api.UnlockRecoveryKey,
+				Slot:       &slot,
+				Keyslot:    "default-recovery",
+			},
+		},
+	})
+}
+
+func (s *fdeSuite) addSealedContainer(c *C) {
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "run", Protector: fdestate.ProtectorTPM, SealedObject: "/foo.sealed-key"},
+		},
+	}), IsNil)
+}
+
+const resealBody = `{"action":"reseal","boot-chains":[{"images":[{"path":"/boot/efi/EFI/ubuntu/shimx64.efi"},{"path":"/boot/efi/EFI/ubuntu/grubx64.efi"}],"kernel-cmdlines":["console=ttyS0"]}]}`
+
+func (s *fdeSuite) TestPostFDEReseal(c *C) {
+	s.addSealedContainer(c)
+
+	ensureCalls := 0
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { ensureCalls++ })
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde", strings.NewReader(resealBody))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	c.Check(rsp.StatusCode, Equals, http.StatusAccepted)
+	c.Check(ensureCalls, Equals, 1)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Kind(), Equals, "reseal")
+	tasks := chg.Tasks()
+	c.Assert(tasks, HasLen, 2)
+	c.Check(tasks[0].Kind(), Equals, "compute-pcr-profile")
+	c.Check(tasks[1].Kind(), Equals, "reseal-key")
+
+	var chains []*fdestate.BootChain
+	c.Assert(tasks[0].Get("boot-chains", &chains), IsNil)
+	c.Check(chains, DeepEquals, []*fdestate.BootChain{{
+		Images: []*fdestate.BootImage{
+			{Path: "/boot/efi/EFI/ubuntu/shimx64.efi"},
+			{Path: "/boot/efi/EFI/ubuntu/grubx64.efi"},
+		},
+		KernelCmdlines: []string{"console=ttyS0"},
+	}})
+}
+
+func (s *fdeSuite) TestPostFDEResealConflict(c *C) {
+	s.addSealedContainer(c)
+
+	restore := daemon.MockEnsureStateSoon(func(*state.State) {})
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde", strings.NewReader(resealBody))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(resealBody))
+	c.Check(status, Equals, http.StatusConflict)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeConflict)
+	c.Check(result.Message, Matches, `container .* has "reseal" change in progress`)
+}
+
+func (s *fdeSuite) TestPostFDEResealErrors(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	for _, t := range []struct {
+		body    string
+		message string
+	}{
+		{`{"action":"reseal"}`, `no boot chains`},
+		{`{"action":"reseal","boot-chains":[{"images":[]}]}`, `boot chain has no images`},
+		{`{"action":"reseal","boot-chains":[{"images":[{"digest":"aaaa"}]}]}`, `boot image path must be specified`},
+		{resealBody, `no TPM sealed keys to reseal`},
+		{`{"action":"frobnicate"}`, `fde action "frobnicate" is unsupported`},
+		{`{`, `cannot decode request body: .*`},
+	} {
+		status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(t.body))
+		c.Check(status, Equals, http.StatusBadRequest, Commentf(t.body))
+		c.Check(result.Message, Matches, t.message, Commentf(t.body))
+	}
+}
+
+func (s *fdeSuite) dbxUpdateBody() string {
+	owner := efi.GUID{0x77, 0xfa, 0x9a, 0xbd, 0x03, 0x59, 0xb6, 0x4d, 0x80, 0x04, 0x7c, 0x0c, 0xa3, 0x3e, 0xec, 0x8e}
+	revoked := sha256.Sum256([]byte("shim"))
+	payload := efitest.NewAuthenticatedVariable(efitest.NewSignatureList(efi.CertSHA256, owner, revoked[:]))
+	return fmt.Sprintf(`{"action":"update-dbx","payload":%q}`, base64.StdEncoding.EncodeToString(payload))
+}
+
+func (s *fdeSuite) TestPostFDEUpdateDBX(c *C) {
+	s.addSealedContainer(c)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	container, err := fdestate.ContainerByUUID(st, "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	c.Assert(err, IsNil)
+	container.PCRProfile = &fdestate.PCRProfile{
+		PCRs: fdestate.DefaultPCRs,
+		BootChains: []*fdestate.BootChain{
+			{Images: []*fdestate.BootImage{{Path: "/boot/efi/EFI/ubuntu/shimx64.efi", Digest: "aaaa"}}},
+		},
+	}
+	c.Assert(fdestate.SetContainer(st, container), IsNil)
+	st.Unlock()
+
+	ensureCalls := 0
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { ensureCalls++ })
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde", strings.NewReader(s.dbxUpdateBody()))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	c.Check(rsp.StatusCode, Equals, http.StatusAccepted)
+	c.Check(ensureCalls, Equals, 1)
+
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Kind(), Equals, "update-dbx")
+	var kinds []string
+	for _, t := range chg.Tasks() {
+		kinds = append(kinds, t.Kind())
+	}
+	c.Check(kinds, DeepEquals, []string{"prepare-dbx-update", "reseal-key", "write-dbx-update", "finalize-dbx-update", "reseal-key"})
+}
+
+func (s *fdeSuite) TestPostFDEUpdateDBXConflict(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) {})
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde", strings.NewReader(s.dbxUpdateBody()))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(s.dbxUpdateBody()))
+	c.Check(status, Equals, http.StatusConflict)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeConflict)
+	c.Check(result.Message, Equals, `"update-dbx" change in progress`)
+}
+
+func (s *fdeSuite) TestPostFDEUpdateDBXErrors(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	for _, t := range []struct {
+		body    string
+		message string
+	}{
+		{`{"action":"update-dbx"}`, `dbx update payload must be specified`},
+		{`{"action":"update-dbx","payload":"cGF5bG9hZA=="}`, `invalid dbx update: authentication header is truncated`},
+		{`{"action":"update-dbx","payload":"!"}`, `cannot decode request body: .*`},
+	} {
+		status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(t.body))
+		c.Check(status, Equals, http.StatusBadRequest, Commentf(t.body))
+		c.Check(result.Message, Matches, t.message, Commentf(t.body))
+	}
+}
+
+func (s *fdeSuite) mockDrift(c *C) {
+	fake := lukstest.New()
+	s.AddCleanup(lukstest.Mock(fake))
+	fake.AddContainer("/dev/sda4", &luks.Header{UUID: "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"}, map[int][]byte{
+		1: []byte("recovery-key"),
+	})
+	t := tpmtest.New()
+	t.NVIndices = []uint32{0x01880010, 0x01880013}
+	s.AddCleanup(tpmtest.Mock(t))
+
+	// the sealed key was removed from keyslot 0
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "run", Protector: fdestate.ProtectorTPM, PCRPolicyCounter: 0x01880010},
+			{Slot: 1, Name: "default-recovery", Protector: fdestate.ProtectorRecoveryKey},
+		},
+	}), IsNil)
+}
+
+func (s *fdeSuite) TestPostFDEVerify(c *C) {
+	s.mockDrift(c)
+
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	var result *api.VerifyResult
+	s.syncReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(`{"action":"verify"}`), &result)
+	slot := 0
+	c.Check(result, DeepEquals, &api.VerifyResult{
+		Findings: []*api.Finding{
+			{
+				Kind:       api.FindingMissingKeyslot,
+				Container:  "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+				DevicePath: "/dev/sda4",
+				Keyslot:    &slot,
+				Message:    `keyslot 0 ("run") of /dev/sda4 is not in use anymore`,
+				Repairable: true,
+			},
+			{
+				Kind:    api.FindingUnownedNVIndex,
+				Handle:  0x01880013,
+				Message: "NV index 0x1880013 is not used by any keyslot",
+			},
+		},
+	})
+
+	// nothing is changed
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+	c.Check(st.Changes(), HasLen, 0)
+}
+
+func (s *fdeSuite) TestPostFDEVerifyNoFindings(c *C) {
+	var result *api.VerifyResult
+	s.syncReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(`{"action":"verify"}`), &result)
+	c.Check(result, DeepEquals, &api.VerifyResult{Findings: []*api.Finding{}})
+}
+
+func (s *fdeSuite) TestPostFDERepair(c *C) {
+	s.mockDrift(c)
+
+	ensureCalls := 0
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { ensureCalls++ })
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde", strings.NewReader(`{"action":"verify","repair":true}`))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	c.Check(rsp.StatusCode, Equals, http.StatusAccepted)
+	c.Check(ensureCalls, Equals, 1)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Kind(), Equals, "repair-fde-state")
+	c.Assert(chg.Tasks(), HasLen, 1)
+	c.Check(chg.Tasks()[0].Kind(), Equals, "repair-state")
+	st.Unlock()
+
+	// only one repair runs at a time
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(`{"action":"verify","repair":true}`))
+	c.Check(status, Equals, http.StatusConflict)
+	c.Check(result.Message, Equals, `"repair-fde-state" change in progress`)
+}
+
+func (s *fdeSuite) TestPostFDERepairConflict(c *C) {
+	s.addSealedContainer(c)
+
+	restore := daemon.MockEnsureStateSoon(func(*state.State) {})
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde", strings.NewReader(resealBody))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(`{"action":"verify","repair":true}`))
+	c.Check(status, Equals, http.StatusConflict)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeConflict)
+	c.Check(result.Message, Matches, `container .* has "reseal" change in progress`)
+}
+
+const installBody = `{"action":"install","devices":[{"device-path":"/dev/vda4","label":"ubuntu-data-enc"}],"boot-chains":[{"images":[{"path":"/target/boot/efi/EFI/ubuntu/shimx64.efi"},{"path":"/target/boot/efi/EFI/ubuntu/grubx64.efi"}]}]}`
+
+func (s *fdeSuite) TestPostFDEInstall(c *C) {
+	paths.SetTargetRootDir(c.MkDir())
+	defer paths.SetTargetRootDir("")
+
+	ensureCalls := 0
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { ensureCalls++ })
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde", strings.NewReader(installBody))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	c.Check(rsp.StatusCode, Equals, http.StatusAccepted)
+	c.Check(ensureCalls, Equals, 1)
+
+	var result *api.InstallResult
+	c.Assert(json.Unmarshal(rsp.Result, &result), IsNil)
+	c.Assert(result.Containers, HasLen, 1)
+	c.Check(result.Containers[0].DevicePath, Equals, "/dev/vda4")
+	c.Check(result.Containers[0].UUID, Matches, `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	c.Check(result.Containers[0].RecoveryKey, Matches, `([0-9]{5}-){7}[0-9]{5}`)
+	// until the change enrolls it
+	c.Check(result.Containers[0].Provisional, Equals, true)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Kind(), Equals, "install")
+	var kinds []string
+	for _, t := range chg.Tasks() {
+		kinds = append(kinds, t.Kind())
+	}
+	c.Check(kinds, DeepEquals, []string{"format-container", "seal-install-key", "add-recovery-key"})
+
+	// the recovery key is not written to the state
+	data, err := json.Marshal(st)
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(data), result.Containers[0].RecoveryKey), Equals, false)
+}
+
+func (s *fdeSuite) TestPostFDEActionFDEAgent(c *C) {
+	s.addSealedContainer(c)
+	restore := daemon.MockEnsureStateSoon(func(*state.State) {})
+	defer restore()
+	restore = daemon.MockNetutilConnPeerSecurityLabel(func(net.Conn) (string, error) {
+		return "snap.fde-agent.fde-agent (enforce)", nil
+	})
+	defer restore()
+	c.Assert(os.MkdirAll(filepath.Join(paths.SysfsDir, "module/apparmor/parameters"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(paths.SysfsDir, "module/apparmor/parameters/enabled"), []byte("Y\n"), 0644), IsNil)
+
+	// the FDE agent is allowed to reseal
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde", strings.NewReader(resealBody))
+	c.Check(rsp.Type, Equals, api.ResponseTypeAsync)
+
+	// but not to do anything else
+	for _, body := range []string{installBody, `{"action":"update-dbx"}`, `{"action":"verify","repair":true}`} {
+		status, _ := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(body))
+		c.Check(status, Equals, http.StatusForbidden, Commentf(body))
+	}
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+	c.Check(st.Changes(), HasLen, 1)
+}
+
+func (s *fdeSuite) TestPostFDEInstallErrors(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(installBody))
+	c.Check(status, Equals, http.StatusBadRequest)
+	c.Check(result.Message, Equals, `cannot install outside of install mode`)
+
+	paths.SetTargetRootDir(c.MkDir())
+	defer paths.SetTargetRootDir("")
+
+	for _, t := range []struct {
+		body    string
+		message string
+	}{
+		{`{"action":"install","boot-chains":[{"images":[{"path":"/boot/efi/EFI/ubuntu/shimx64.efi"}]}]}`, `no devices to encrypt`},
+		{`{"action":"install","devices":[{"device-path":"/dev/vda4"}]}`, `cannot seal keys: PCR profile has no boot chains`},
+		{`{"action":"install","devices":[{"device-path":"/dev/vda4"}],"boot-chains":[{"images":[{"digest":"aaaa"}]}]}`, `boot image path must be specified`},
+		{`{"action":"install","devices":[{"label":"foo"}],"boot-chains":[{"images":[{"path":"/boot/efi/EFI/ubuntu/shimx64.efi"}]}]}`, `device path must be specified`},
+	} {
+		status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde", strings.NewReader(t.body))
+		c.Check(status, Equals, http.StatusBadRequest, Commentf(t.body))
+		c.Check(result.Message, Matches, t.message, Commentf(t.body))
+	}
+}
+
+// mockBootConfig writes the images of a boot chain and an event log
+// that records booting it, and returns the paths of the images.
+func (s *fdeSuite) mockBootConfig(c *C, cmdline string, contents ...string) []string {
+	dir := c.MkDir()
+	params := &efitest.LogParams{
+		KernelCmdline: cmdline,
+		Variables:     map[string][]byte{"SecureBoot": {1}, "dbx": []byte("dbx")},
+	}
+	var images []string
+	for i, content := range contents {
+		path := filepath.Join(dir, fmt.Sprintf("image%d.efi", i))
+		c.Assert(ioutil.WriteFile(path, efitest.NewImage([]byte(content)), 0644), IsNil)
+		digest, err := efi.ImageDigest(path)
+		c.Assert(err, IsNil)
+		params.ImageDigests = append(params.ImageDigests, digest)
+		images = append(images, path)
+	}
+
+	var buf bytes.Buffer
+	c.Assert(efitest.NewLog(params).Write(&buf), IsNil)
+	c.Assert(os.MkdirAll(filepath.Dir(paths.EventLogFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(paths.EventLogFile, buf.Bytes(), 0444), IsNil)
+	return images
+}
+
+func fileDigest(c *C, path string) string {
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func (s *fdeSuite) TestPostProfilePreview(c *C) {
+	images := s.mockBootConfig(c, "console=ttyS0", "shim", "kernel")
+	newKernel := filepath.Join(filepath.Dir(images[0]), "new-kernel.efi")
+	c.Assert(ioutil.WriteFile(newKernel, efitest.NewImage([]byte("new kernel")), 0644), IsNil)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	profile := &fdestate.PCRProfile{
+		PCRs: []int{4, 7, 12},
+		BootChains: []*fdestate.BootChain{{
+			Images: []*fdestate.BootImage{
+				{Path: images[0], Digest: fileDigest(c, images[0])},
+				{Path: images[1], Digest: fileDigest(c, images[1])},
+			},
+			KernelCmdlines: []string{"console=ttyS0"},
+		}},
+	}
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "run", Protector: fdestate.ProtectorTPM, SealedObject: "/foo.sealed-key"},
+		},
+		PCRProfile:        profile,
+		PendingPCRProfile: profile,
+	}), IsNil)
+	st.Unlock()
+
+	body := fmt.Sprintf(`{"boot-chain":{"images":[{"path":%q},{"path":%q}],"kernel-cmdlines":["console=ttyS0"]},"secure-boot-variables":{"dbx":"ZGJ4"}}`, images[0], newKernel)
+	var result *api.ProfilePreview
+	s.syncReq(c, http.MethodPost, "/v1/system/fde/profile/preview", strings.NewReader(body), &result)
+
+	c.Assert(result.PCRs, HasLen, 3)
+	for i, pcr := range []int{4, 7, 12} {
+		c.Check(result.PCRs[i].PCR, Equals, pcr)
+		c.Check(result.PCRs[i].Measured, HasLen, 64)
+	}
+	c.Check(result.PCRs[0].Predicted, Not(Equals), result.PCRs[0].Measured)
+	c.Check(result.PCRs[1].Predicted, Equals, result.PCRs[1].Measured)
+	c.Check(result.PCRs[2].Predicted, Equals, result.PCRs[2].Measured)
+	c.Check(result.PCRs[2].KernelCmdline, Equals, "console=ttyS0")
+	willUnsealAfterCommit := false
+	c.Check(result.Containers, DeepEquals, []*api.ContainerProfilePreview{{
+		Container:  "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		DevicePath: "/dev/sda4",
+		WillUnseal: false,
+		Differences: []*api.ProfileDifference{{
+			PCR:          4,
+			Kind:         api.DifferenceBootImage,
+			Path:         newKernel,
+			Digest:       fileDigest(c, newKernel),
+			SealedDigest: fileDigest(c, images[1]),
+		}},
+		WillUnsealAfterCommit: &willUnsealAfterCommit,
+	}})
+
+	// previewing doesn't create changes
+	st.Lock()
+	defer st.Unlock()
+	c.Check(st.Changes(), HasLen, 0)
+}
+
+func (s *fdeSuite) TestPostProfilePreviewErrors(c *C) {
+	images := s.mockBootConfig(c, "console=ttyS0", "shim")
+
+	for _, t := range []struct {
+		body    string
+		message string
+	}{
+		{`{"boot-chain":{"images":[]}}`, `boot chain has no images`},
+		{`{"boot-chain":{"images":[{"digest":"aaaa"}]}}`, `boot image path must be specified`},
+		{`{"boot-chain":{"images":[{"path":"/missing.efi"}]}}`, `cannot compute digest of boot image: .*`},
+		{`{"secure-boot-variables":{"dbt":""}}`, `secure boot variable "dbt" is not measured in the event log`},
+		{`{`, `cannot decode request body: .*`},
+	} {
+		status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde/profile/preview", strings.NewReader(t.body))
+		c.Check(status, Equals, http.StatusBadRequest, Commentf(t.body))
+		c.Check(result.Message, Matches, t.message, Commentf(t.body))
+	}
+
+	var result *api.ProfilePreview
+	s.syncReq(c, http.MethodPost, "/v1/system/fde/profile/preview", strings.NewReader(fmt.Sprintf(`{"boot-chain":{"images":[{"path":%q}]}}`, images[0])), &result)
+	c.Check(result.Containers, HasLen, 0)
+}
@@ -0,0 +1,111 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+)
+
+var (
+	keyslotCmd = &command{
+		Path:        "/v1/system/fde/keyslots/{name}",
+		POST:        postKeyslotAction,
+		ReadAccess:  openAccess,
+		WriteAccess: manageKeysAccess,
+	}
+)
+
+func postKeyslotAction(d *Daemon, vars map[string]string, _ url.Values, body io.Reader, allowInteraction bool) response {
+	var req api.KeyslotAction
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&req); err != nil {
+		return statusBadRequest("cannot decode request body: %v", err)
+	}
+	name := vars["name"]
+
+	var secrets *fdestate.Secrets
+	if req.OldSecret != "" || req.NewSecret != "" {
+		secrets = &fdestate.Secrets{
+			Old: []byte(req.OldSecret),
+			New: []byte(req.NewSecret),
+		}
+	}
+
+	if req.Action == "provide-secrets" {
+		return provideKeyslotSecrets(d, name, req.Change, secrets)
+	}
+
+	op := fdestate.ProtectorOp(req.Action)
+	switch op {
+	case fdestate.AddPassphrase, fdestate.ChangePassphrase, fdestate.RemovePassphrase:
+	default:
+		return statusBadRequest("keyslot action %q is unsupported", req.Action)
+	}
+	if req.Container == "" {
+		return statusBadRequest("container must be specified")
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	ts, err := fdestate.UpdateProtector(st, req.Container, name, op, secrets, allowInteraction)
+	if err != nil {
+		return fdeError(err)
+	}
+	chg := st.NewChange(req.Action, fmt.Sprintf("Perform %s on keyslot %q", req.Action, name))
+	chg.AddAll(ts)
+	ensureStateSoon(st)
+
+	return asyncResponse(nil, chg.ID())
+}
+
+func provideKeyslotSecrets(d *Daemon, name, chgID string, secrets *fdestate.Secrets) response {
+	if chgID == "" {
+		return statusBadRequest("change must be specified")
+	}
+	if secrets == nil {
+		return statusBadRequest("secrets must be provided")
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	if st.Change(chgID) == nil {
+		return changeNotFound(chgID)
+	}
+	if err := fdestate.ProvideSecrets(st, chgID, name, secrets); err != nil {
+		if errors.Is(err, fdestate.ErrNoPrompt) {
+			return statusBadRequest("%v", err)
+		}
+		return fdeError(err)
+	}
+	ensureStateSoon(st)
+
+	return syncResponse(nil)
+}
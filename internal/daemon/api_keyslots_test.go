@@ -0,0 +1,259 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/testutil"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/luks/lukstest"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/polkit"
+)
+
+type keyslotsSuite struct {
+	apiBaseSuite
+}
+
+var _ = Suite(&keyslotsSuite{})
+
+const keyslotsTestUUID = "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"
+
+func (s *keyslotsSuite) SetUpTest(c *C) {
+	s.apiBaseSuite.SetUpTest(c)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       keyslotsTestUUID,
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "default", Protector: fdestate.ProtectorTPM, SealedObject: "/var/lib/fdemanager/keys/default.sealed-key"},
+			{Slot: 1, Name: "default-recovery", Protector: fdestate.ProtectorRecoveryKey},
+			{Slot: 2, Name: "user", Protector: fdestate.ProtectorPassphrase},
+		},
+	}), IsNil)
+}
+
+func (s *keyslotsSuite) TestChangePassphrase(c *C) {
+	ensureCalls := 0
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { ensureCalls++ })
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde/keyslots/user", strings.NewReader(`{"action":"change-passphrase","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","old-secret":"old","new-secret":"new"}`))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	c.Check(rsp.StatusCode, Equals, http.StatusAccepted)
+	c.Check(ensureCalls, Equals, 1)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Kind(), Equals, "change-passphrase")
+	c.Assert(chg.Tasks(), HasLen, 1)
+	c.Check(chg.Tasks()[0].Kind(), Equals, "update-protector")
+
+	// the secrets are not written to the state
+	data, err := json.Marshal(st)
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(data), `"new"`), Equals, false)
+}
+
+func (s *keyslotsSuite) TestChangePassphraseRunsChange(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) {})
+	defer restore()
+	fake := lukstest.New()
+	defer lukstest.Mock(fake)()
+	fake.AddContainer("/dev/sda4", &luks.Header{UUID: keyslotsTestUUID}, map[int][]byte{
+		0: []byte("unlock-key"),
+		1: []byte("recovery-key"),
+		2: []byte("old"),
+	})
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde/keyslots/user", strings.NewReader(`{"action":"change-passphrase","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","old-secret":"old","new-secret":"new"}`))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	c.Assert(s.d.Overlord().Settle(testutil.HostScaledTimeout(15*time.Second)), IsNil)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Err(), IsNil)
+	c.Check(chg.Status(), Equals, state.DoneStatus)
+	st.Unlock()
+
+	// the passphrase moved to a new keyslot
+	c.Check(fake.Key("/dev/sda4", 2), IsNil)
+	c.Check(fake.Key("/dev/sda4", 3), DeepEquals, []byte("new"))
+
+	var result *api.FDEStatus
+	s.syncReq(c, http.MethodGet, "/v1/system/fde", nil, &result)
+	c.Assert(result.Containers, HasLen, 1)
+	c.Check(result.Containers[0].Keyslots, DeepEquals, []*api.Keyslot{
+		{Slot: 0, Name: "default", Protector: api.ProtectorTPM},
+		{Slot: 1, Name: "default-recovery", Protector: api.ProtectorRecoveryKey},
+		{Slot: 3, Name: "user", Protector: api.ProtectorPassphrase},
+	})
+}
+
+func (s *keyslotsSuite) TestInteractive(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) {})
+	defer restore()
+
+	body := `{"action":"add-passphrase","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"}`
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde/keyslots/other", strings.NewReader(body))
+	c.Check(status, Equals, http.StatusBadRequest)
+	c.Check(result.Message, Equals, "secrets must be provided if interaction is not allowed")
+
+	header := http.Header{api.AllowInteractionHeader: []string{"true"}}
+	rsp := s.reqWithHeader(c, http.MethodPost, "/v1/system/fde/keyslots/other", strings.NewReader(body), header)
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	chgID := rsp.Change
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	chg := st.Change(chgID)
+	c.Assert(chg, NotNil)
+	tasks := chg.Tasks()
+	c.Assert(tasks, HasLen, 2)
+	update := tasks[1]
+	c.Assert(update.Kind(), Equals, "update-protector")
+	st.Unlock()
+
+	// the change is not prompting yet
+	status, result = s.errorReq(c, http.MethodPost, "/v1/system/fde/keyslots/other", strings.NewReader(`{"action":"provide-secrets","change":"`+chgID+`","new-secret":"new"}`))
+	c.Check(status, Equals, http.StatusBadRequest)
+	c.Check(result.Message, Equals, "change is not waiting for secrets")
+
+	// pretend that the task is waiting for secrets
+	expires := time.Date(2023, 10, 16, 12, 5, 0, 0, time.UTC)
+	st.Lock()
+	update.SetStatus(state.DoingStatus)
+	update.Set("prompt-time", expires.Add(-5*time.Minute))
+	chg.Set("api-data", map[string]interface{}{
+		"prompt": &fdestate.Prompt{
+			Container: keyslotsTestUUID,
+			Keyslot:   "other",
+			Op:        fdestate.AddPassphrase,
+			New:       true,
+			Expires:   expires,
+		},
+	})
+	st.Unlock()
+
+	var apiChg *api.Change
+	s.syncReq(c, http.MethodGet, "/v1/changes/"+chgID, nil, &apiChg)
+	c.Assert(apiChg.Data["prompt"], NotNil)
+	var prompt *api.SecretPrompt
+	c.Assert(json.Unmarshal(*apiChg.Data["prompt"], &prompt), IsNil)
+	c.Check(prompt, DeepEquals, &api.SecretPrompt{
+		Container: keyslotsTestUUID,
+		Keyslot:   "other",
+		Op:        "add-passphrase",
+		New:       true,
+		Expires:   expires,
+	})
+
+	status, result = s.errorReq(c, http.MethodPost, "/v1/system/fde/keyslots/other", strings.NewReader(`{"action":"provide-secrets","change":"`+chgID+`"}`))
+	c.Check(status, Equals, http.StatusBadRequest)
+	c.Check(result.Message, Equals, "secrets must be provided")
+
+	var nothing interface{}
+	s.syncReq(c, http.MethodPost, "/v1/system/fde/keyslots/other", strings.NewReader(`{"action":"provide-secrets","change":"`+chgID+`","new-secret":"new"}`), &nothing)
+
+	apiChg = nil
+	s.syncReq(c, http.MethodGet, "/v1/changes/"+chgID, nil, &apiChg)
+	c.Check(apiChg.Data, IsNil)
+}
+
+func (s *keyslotsSuite) TestKeyslotActionErrors(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	for _, t := range []struct {
+		name    string
+		body    string
+		status  int
+		message string
+	}{
+		{"user", `{"action":"frobnicate","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"}`, http.StatusBadRequest, `keyslot action "frobnicate" is unsupported`},
+		{"user", `{"action":"remove-passphrase","old-secret":"old"}`, http.StatusBadRequest, `container must be specified`},
+		{"user", `{"action":"remove-passphrase","container":"missing","old-secret":"old"}`, http.StatusNotFound, `cannot find container with UUID "missing"`},
+		{"user", `{"action":"change-passphrase","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","old-secret":"old"}`, http.StatusBadRequest, `new secret must be provided`},
+		{"default", `{"action":"add-pin","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","new-secret":"1234"}`, http.StatusBadRequest, `keyslot action "add-pin" is unsupported`},
+		{"user", `{"action":"provide-secrets","new-secret":"new"}`, http.StatusBadRequest, `change must be specified`},
+		{"user", `{"action":"provide-secrets","change":"42","new-secret":"new"}`, http.StatusNotFound, `cannot find change with id "42"`},
+		{"user", `{`, http.StatusBadRequest, `cannot decode request body: .*`},
+	} {
+		status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde/keyslots/"+t.name, strings.NewReader(t.body))
+		c.Check(status, Equals, t.status, Commentf(t.body))
+		c.Check(result.Message, Matches, t.message, Commentf(t.body))
+	}
+}
+
+func (s *keyslotsSuite) TestKeyslotActionRequiresAuthorization(c *C) {
+	restore := daemon.MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: 100, Uid: 1000, Gid: 1000}, nil
+	})
+	defer restore()
+	restore = daemon.MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		c.Check(uid, Equals, uint32(1000))
+		c.Check(actionID, Equals, "io.snapcraft.fdemanager.manage-keys")
+		return false, nil
+	})
+	defer restore()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde/keyslots/user", strings.NewReader(`{"action":"remove-passphrase","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","old-secret":"old"}`))
+	c.Check(status, Equals, http.StatusForbidden)
+	c.Check(result.Kind, Equals, api.ErrorKindNotAuthorized)
+	c.Check(result.Message, Equals, "not authorized")
+}
+
+func (s *keyslotsSuite) TestFDEStatusReportsPIN(c *C) {
+	st := s.d.Overlord().State()
+	st.Lock()
+	container, err := fdestate.ContainerByUUID(st, keyslotsTestUUID)
+	c.Assert(err, IsNil)
+	container.Keyslots[0].PIN = true
+	c.Assert(fdestate.SetContainer(st, container), IsNil)
+	st.Unlock()
+
+	var result *api.FDEStatus
+	s.syncReq(c, http.MethodGet, "/v1/system/fde", nil, &result)
+	c.Assert(result.Containers, HasLen, 1)
+	c.Check(result.Containers[0].Keyslots[0].PIN, Equals, true)
+	c.Check(result.Containers[0].Keyslots[2].PIN, Equals, false)
+}
@@ -0,0 +1,168 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+)
+
+var (
+	noticesCmd = &command{
+		Path:       "/v1/notices",
+		GET:        getNotices,
+		ReadAccess: noticesAccess,
+	}
+)
+
+const maxNoticesTimeout = 10 * time.Minute
+
+func splitQueryList(query url.Values, param string) []string {
+	var l []string
+	for _, value := range query[param] {
+		for _, elem := range strings.Split(value, ",") {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				l = append(l, elem)
+			}
+		}
+	}
+	return l
+}
+
+// getNotices returns the notices selected by the query. If a timeout
+// is specified, it waits up to the timeout for a notice to be added or
+// repeated if there are none.
+func getNotices(d *Daemon, _ map[string]string, query url.Values, _ io.Reader, _ bool) response {
+	var filter noticestate.Filter
+	for _, typ := range splitQueryList(query, "types") {
+		filter.Types = append(filter.Types, noticestate.Type(typ))
+	}
+	filter.Keys = splitQueryList(query, "keys")
+	if value := query.Get("after"); value != "" {
+		after, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return statusBadRequest("invalid after parameter: %q", value)
+		}
+		filter.After = after
+	}
+
+	var timeout time.Duration
+	if value := query.Get("timeout"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout < 0 || timeout > maxNoticesTimeout {
+			return statusBadRequest("timeout should be a duration of at most %s", maxNoticesTimeout)
+		}
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	notices, err := noticestate.Notices(st, &filter)
+	if err != nil {
+		return statusInternalError("cannot obtain notices: %v", err)
+	}
+	if len(notices) == 0 && timeout > 0 {
+		return &noticesWaitResponse{
+			d:       d,
+			filter:  &filter,
+			timeout: timeout,
+		}
+	}
+	return syncResponse(notices2api(notices))
+}
+
+func notices2api(notices []*noticestate.Notice) []*api.Notice {
+	apiNotices := make([]*api.Notice, 0, len(notices))
+	for _, n := range notices {
+		apiNotice := &api.Notice{
+			ID:            n.ID,
+			Type:          string(n.Type),
+			Key:           n.Key,
+			FirstOccurred: n.FirstOccurred,
+			LastOccurred:  n.LastOccurred,
+			LastRepeated:  n.LastRepeated,
+			Occurrences:   n.Occurrences,
+			LastData:      n.LastData,
+		}
+		if n.RepeatAfter != 0 {
+			apiNotice.RepeatAfter = n.RepeatAfter.String()
+		}
+		if n.ExpireAfter != 0 {
+			apiNotice.ExpireAfter = n.ExpireAfter.String()
+		}
+		apiNotices = append(apiNotices, apiNotice)
+	}
+	return apiNotices
+}
+
+// noticesWaitResponse waits for a notice selected by the filter before
+// responding with the selected notices.
+type noticesWaitResponse struct {
+	d       *Daemon
+	filter  *noticestate.Filter
+	timeout time.Duration
+}
+
+func (r *noticesWaitResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.serve(req.Context(), w)
+}
+
+func (r *noticesWaitResponse) Write(w http.ResponseWriter) {
+	r.serve(context.Background(), w)
+}
+
+func (r *noticesWaitResponse) serve(ctx context.Context, w http.ResponseWriter) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.d.tomb.Dying():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	st := r.d.state
+	st.Lock()
+	notices, err := noticestate.WaitNotices(ctx, st, r.filter)
+	st.Unlock()
+
+	var rsp response
+	switch {
+	case err == nil:
+		rsp = syncResponse(notices2api(notices))
+	case ctx.Err() != nil:
+		// the timeout elapsed, the client went away or the daemon
+		// is stopping
+		rsp = syncResponse([]*api.Notice{})
+	default:
+		rsp = statusInternalError("cannot obtain notices: %v", err)
+	}
+	rsp.Write(w)
+}
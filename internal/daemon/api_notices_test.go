@@ -0,0 +1,195 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/api"
+	. "github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+type noticesSuite struct {
+	apiBaseSuite
+}
+
+var _ = Suite(&noticesSuite{})
+
+func (s *noticesSuite) addNotice(c *C, typ noticestate.Type, key string, data map[string]string) {
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+	_, err := noticestate.AddNotice(st, typ, key, &noticestate.AddOptions{Data: data})
+	c.Assert(err, IsNil)
+}
+
+func (s *noticesSuite) notices(c *C, query string) []*api.Notice {
+	var notices []*api.Notice
+	s.syncReq(c, http.MethodGet, "/v1/notices"+query, nil, &notices)
+	return notices
+}
+
+func (s *noticesSuite) TestGetNotices(c *C) {
+	c.Check(s.notices(c, ""), DeepEquals, []*api.Notice{})
+
+	s.addNotice(c, noticestate.ResealRequired, "uuid-1", map[string]string{"device-path": "/dev/sda4"})
+	s.addNotice(c, noticestate.TPMLockout, "tpm", nil)
+
+	notices := s.notices(c, "")
+	c.Assert(notices, HasLen, 2)
+	n := notices[0]
+	c.Check(n.ID, Equals, "1")
+	c.Check(n.Type, Equals, "reseal-required")
+	c.Check(n.Key, Equals, "uuid-1")
+	c.Check(n.Occurrences, Equals, 1)
+	c.Check(n.LastData, DeepEquals, map[string]string{"device-path": "/dev/sda4"})
+	c.Check(n.ExpireAfter, Equals, "168h0m0s")
+	c.Check(n.RepeatAfter, Equals, "")
+	c.Check(n.LastRepeated.Equal(n.FirstOccurred), Equals, true)
+	c.Check(notices[1].Type, Equals, "tpm-lockout")
+
+	notices = s.notices(c, "?types=tpm-lockout,dbx-update-pending")
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, "tpm-lockout")
+
+	notices = s.notices(c, "?keys=uuid-1&keys=uuid-2")
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Key, Equals, "uuid-1")
+
+	after := notices[0].LastRepeated.Format(time.RFC3339Nano)
+	notices = s.notices(c, "?after="+url.QueryEscape(after))
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, "tpm-lockout")
+}
+
+func (s *noticesSuite) TestGetNoticesAccess(c *C) {
+	s.addNotice(c, noticestate.ResealRequired, "uuid-1", map[string]string{"device-path": "/dev/sda4"})
+
+	// the desktop agent runs as the user
+	restore := MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: 100, Uid: 1000, Gid: 1000}, nil
+	})
+	defer restore()
+	c.Check(s.notices(c, ""), HasLen, 1)
+
+	label := "snap.fde-agent.fde-agent (enforce)"
+	restore = MockNetutilConnPeerSecurityLabel(func(net.Conn) (string, error) {
+		return label, nil
+	})
+	defer restore()
+	c.Assert(os.MkdirAll(filepath.Join(paths.SysfsDir, "module/apparmor/parameters"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(paths.SysfsDir, "module/apparmor/parameters/enabled"), []byte("Y\n"), 0644), IsNil)
+	c.Check(s.notices(c, ""), HasLen, 1)
+
+	// other snaps are denied
+	label = "snap.other.app (enforce)"
+	status, result := s.errorReq(c, http.MethodGet, "/v1/notices", nil)
+	c.Check(status, Equals, http.StatusForbidden)
+	c.Check(result.Message, Equals, `access denied for snap "other"`)
+}
+
+func (s *noticesSuite) TestGetNoticesErrors(c *C) {
+	for _, t := range []struct {
+		query   string
+		message string
+	}{
+		{"?after=yesterday", `invalid after parameter: "yesterday"`},
+		{"?timeout=forever", `timeout should be a duration of at most 10m0s`},
+		{"?timeout=11m", `timeout should be a duration of at most 10m0s`},
+		{"?timeout=-1s", `timeout should be a duration of at most 10m0s`},
+	} {
+		status, result := s.errorReq(c, http.MethodGet, "/v1/notices"+t.query, nil)
+		c.Check(status, Equals, http.StatusBadRequest, Commentf(t.query))
+		c.Check(result.Message, Equals, t.message, Commentf(t.query))
+	}
+}
+
+// waitReq sends a request to wait for notices in the background.
+func (s *noticesSuite) waitReq(c *C, target string) <-chan *httptest.ResponseRecorder {
+	ctx := context.WithValue(context.Background(), ConnectionKey, new(net.UnixConn))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	c.Assert(err, IsNil)
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.d.Router().ServeHTTP(rec, req)
+		done <- rec
+	}()
+	return done
+}
+
+func (s *noticesSuite) waitResult(c *C, done <-chan *httptest.ResponseRecorder) []*api.Notice {
+	var rec *httptest.ResponseRecorder
+	select {
+	case rec = <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("request did not complete")
+	}
+
+	var rsp *api.Response
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &rsp), IsNil)
+	c.Assert(rsp.Type, Equals, api.ResponseTypeSync, Commentf("%s", rsp.Result))
+	var notices []*api.Notice
+	c.Assert(json.Unmarshal(rsp.Result, &notices), IsNil)
+	return notices
+}
+
+func (s *noticesSuite) TestWaitNotices(c *C) {
+	done := s.waitReq(c, "/v1/notices?types=tpm-lockout&timeout=1m")
+
+	// notices that are not selected are ignored
+	s.addNotice(c, noticestate.ResealRequired, "uuid-1", nil)
+	select {
+	case <-done:
+		c.Fatal("request completed early")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.addNotice(c, noticestate.TPMLockout, "tpm", nil)
+	notices := s.waitResult(c, done)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, "tpm-lockout")
+}
+
+func (s *noticesSuite) TestWaitNoticesExisting(c *C) {
+	s.addNotice(c, noticestate.TPMLockout, "tpm", nil)
+
+	notices := s.waitResult(c, s.waitReq(c, "/v1/notices?timeout=1m"))
+	c.Check(notices, HasLen, 1)
+}
+
+func (s *noticesSuite) TestWaitNoticesTimeout(c *C) {
+	notices := s.waitResult(c, s.waitReq(c, "/v1/notices?timeout=50ms"))
+	c.Check(notices, DeepEquals, []*api.Notice{})
+}
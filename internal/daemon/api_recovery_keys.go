@@ -0,0 +1,112 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+)
+
+var (
+	recoveryKeysCmd = &command{
+		Path:        "/v1/system/fde/recovery-keys",
+		GET:         getRecoveryKeys,
+		POST:        postRecoveryKeyAction,
+		ReadAccess:  openAccess,
+		WriteAccess: manageKeysAccess,
+	}
+)
+
+func getRecoveryKeys(d *Daemon, _ map[string]string, _ url.Values, _ io.Reader, _ bool) response {
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	containers, err := fdestate.Containers(st)
+	if err != nil {
+		return statusInternalError("cannot obtain encrypted containers: %v", err)
+	}
+
+	recoveryKeys := []*api.RecoveryKey{}
+	for _, c := range containers {
+		for _, ks := range c.Keyslots {
+			if ks.Protector != fdestate.ProtectorRecoveryKey {
+				continue
+			}
+			recoveryKey := &api.RecoveryKey{
+				Container:  c.UUID,
+				DevicePath: c.DevicePath,
+				Slot:       ks.Slot,
+				Name:       ks.Name,
+			}
+			if !ks.CreationTime.IsZero() {
+				creationTime := ks.CreationTime
+				recoveryKey.CreationTime = &creationTime
+			}
+			recoveryKeys = append(recoveryKeys, recoveryKey)
+		}
+	}
+	return syncResponse(recoveryKeys)
+}
+
+func postRecoveryKeyAction(d *Daemon, _ map[string]string, _ url.Values, body io.Reader, _ bool) response {
+	var req api.RecoveryKeyAction
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&req); err != nil {
+		return statusBadRequest("cannot decode request body: %v", err)
+	}
+	switch req.Action {
+	case "generate", "revoke":
+	default:
+		return statusBadRequest("recovery key action %q is unsupported", req.Action)
+	}
+	if req.Container == "" {
+		return statusBadRequest("container must be specified")
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	if req.Action == "generate" {
+		ts, recoveryKey, err := fdestate.AddRecoveryKey(st, req.Container, req.Name)
+		if err != nil {
+			return fdeError(err)
+		}
+		chg := st.NewChange("add-recovery-key", fmt.Sprintf("Add recovery key %q", req.Name))
+		chg.AddAll(ts)
+		ensureStateSoon(st)
+		return asyncResponse(&api.RecoveryKeyResult{RecoveryKey: recoveryKey, Provisional: true}, chg.ID())
+	}
+
+	ts, err := fdestate.RemoveRecoveryKey(st, req.Container, req.Name)
+	if err != nil {
+		return fdeError(err)
+	}
+	chg := st.NewChange("remove-recovery-key", fmt.Sprintf("Revoke recovery key %q", req.Name))
+	chg.AddAll(ts)
+	ensureStateSoon(st)
+	return asyncResponse(nil, chg.ID())
+}
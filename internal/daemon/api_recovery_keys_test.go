@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/polkit"
+)
+
+type recoveryKeysSuite struct {
+	apiBaseSuite
+}
+
+var _ = Suite(&recoveryKeysSuite{})
+
+var testCreationTime = time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC)
+
+func (s *recoveryKeysSuite) SetUpTest(c *C) {
+	s.apiBaseSuite.SetUpTest(c)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "default", Protector: fdestate.ProtectorTPM},
+			{Slot: 1, Name: "default-recovery", Protector: fdestate.ProtectorRecoveryKey},
+			{Slot: 2, Name: "helpdesk", Protector: fdestate.ProtectorRecoveryKey, CreationTime: testCreationTime},
+		},
+	}), IsNil)
+}
+
+func (s *recoveryKeysSuite) TestGetRecoveryKeys(c *C) {
+	var result []*api.RecoveryKey
+	s.syncReq(c, http.MethodGet, "/v1/system/fde/recovery-keys", nil, &result)
+	c.Check(result, DeepEquals, []*api.RecoveryKey{
+		{
+			Container:  "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+			DevicePath: "/dev/sda4",
+			Slot:       1,
+			Name:       "default-recovery",
+		},
+		{
+			Container:    "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+			DevicePath:   "/dev/sda4",
+			Slot:         2,
+			Name:         "helpdesk",
+			CreationTime: &testCreationTime,
+		},
+	})
+}
+
+func (s *recoveryKeysSuite) TestGenerateRecoveryKey(c *C) {
+	ensureCalls := 0
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { ensureCalls++ })
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde/recovery-keys", strings.NewReader(`{"action":"generate","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","name":"rotated"}`))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	c.Check(rsp.StatusCode, Equals, http.StatusAccepted)
+	c.Check(ensureCalls, Equals, 1)
+
+	var result *api.RecoveryKeyResult
+	c.Assert(json.Unmarshal(rsp.Result, &result), IsNil)
+	c.Check(result.RecoveryKey, Matches, `([0-9]{5}-){7}[0-9]{5}`)
+	c.Check(result.Provisional, Equals, true)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Kind(), Equals, "add-recovery-key")
+	c.Assert(chg.Tasks(), HasLen, 2)
+	c.Check(chg.Tasks()[1].Kind(), Equals, "add-recovery-key")
+
+	// the recovery key is not written to the state
+	data, err := json.Marshal(st)
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(data), result.RecoveryKey), Equals, false)
+}
+
+func (s *recoveryKeysSuite) TestRevokeRecoveryKey(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) {})
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/fde/recovery-keys", strings.NewReader(`{"action":"revoke","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","name":"helpdesk"}`))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+	c.Check(rsp.StatusCode, Equals, http.StatusAccepted)
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Kind(), Equals, "remove-recovery-key")
+	c.Assert(chg.Tasks(), HasLen, 2)
+	c.Check(chg.Tasks()[1].Kind(), Equals, "remove-keyslot")
+}
+
+func (s *recoveryKeysSuite) TestRecoveryKeyActionErrors(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	for _, t := range []struct {
+		body    string
+		status  int
+		message string
+	}{
+		{`{"action":"frobnicate","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"}`, http.StatusBadRequest, `recovery key action "frobnicate" is unsupported`},
+		{`{"action":"generate","name":"foo"}`, http.StatusBadRequest, `container must be specified`},
+		{`{"action":"generate","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"}`, http.StatusBadRequest, `recovery key name must be specified`},
+		{`{"action":"generate","container":"missing","name":"foo"}`, http.StatusNotFound, `cannot find container with UUID "missing"`},
+		{`{"action":"revoke","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","name":"default"}`, http.StatusBadRequest, `container .* has no recovery key named "default"`},
+		{`{`, http.StatusBadRequest, `cannot decode request body: .*`},
+	} {
+		status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde/recovery-keys", strings.NewReader(t.body))
+		c.Check(status, Equals, t.status, Commentf(t.body))
+		c.Check(result.Message, Matches, t.message, Commentf(t.body))
+	}
+}
+
+func (s *recoveryKeysSuite) TestRecoveryKeyActionRequiresAuthorization(c *C) {
+	restore := daemon.MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: 100, Uid: 1000, Gid: 1000}, nil
+	})
+	defer restore()
+	restore = daemon.MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		c.Check(uid, Equals, uint32(1000))
+		c.Check(actionID, Equals, "io.snapcraft.fdemanager.manage-keys")
+		return false, nil
+	})
+	defer restore()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/fde/recovery-keys", strings.NewReader(`{"action":"revoke","container":"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21","name":"helpdesk"}`))
+	c.Check(status, Equals, http.StatusForbidden)
+	c.Check(result.Kind, Equals, api.ErrorKindNotAuthorized)
+	c.Check(result.Message, Equals, "not authorized")
+
+	// listing is allowed
+	var keys []*api.RecoveryKey
+	s.syncReq(c, http.MethodGet, "/v1/system/fde/recovery-keys", nil, &keys)
+	c.Check(keys, HasLen, 2)
+}
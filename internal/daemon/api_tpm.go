@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/overlord/tpmstate"
+)
+
+var (
+	tpmCmd = &command{
+		Path:        "/v1/system/tpm",
+		GET:         getTPMStatus,
+		POST:        postTPMAction,
+		ReadAccess:  openAccess,
+		WriteAccess: manageTPMAccess,
+	}
+)
+
+func getTPMStatus(d *Daemon, _ map[string]string, _ url.Values, _ io.Reader, _ bool) response {
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	status, err := tpmstate.GetStatus(st)
+	if err != nil {
+		return statusInternalError("cannot obtain TPM status: %v", err)
+	}
+
+	apiStatus := &api.TPMStatus{Present: status.Present}
+	if status.Present {
+		apiStatus.Manufacturer = status.Manufacturer
+		apiStatus.FirmwareVersion = status.FirmwareVersion
+		apiStatus.Owned = status.Owned
+		apiStatus.LockoutAuthSet = status.LockoutAuthSet
+		apiStatus.SRKPresent = status.SRKPresent
+		apiStatus.LockoutAuthKnown = status.LockoutAuthKnown
+		apiStatus.Lockout = status.InLockout
+		apiStatus.LockoutCounter = status.LockoutCounter
+		apiStatus.MaxTries = status.MaxTries
+		apiStatus.RecoveryTime = status.RecoveryTime.String()
+		apiStatus.LockoutRecovery = status.LockoutRecovery.String()
+	}
+	return syncResponse(apiStatus)
+}
+
+var tpmActions = map[string]struct {
+	kind    string
+	summary string
+	tasks   func(st *state.State) (*state.TaskSet, error)
+}{
+	"provision":     {"provision-tpm", "Provision the TPM", tpmstate.Provision},
+	"reset-lockout": {"reset-tpm-lockout", "Reset the TPM dictionary attack lockout", tpmstate.ResetLockout},
+	"clear":         {"clear-tpm", "Clear the TPM", tpmstate.Clear},
+}
+
+// isTPMChange returns whether the change was created by a TPM action.
+func isTPMChange(chg *state.Change) bool {
+	for _, action := range tpmActions {
+		if chg.Kind() == action.kind {
+			return true
+		}
+	}
+	return false
+}
+
+func postTPMAction(d *Daemon, _ map[string]string, _ url.Values, body io.Reader, _ bool) response {
+	var req api.TPMAction
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&req); err != nil {
+		return statusBadRequest("cannot decode request body: %v", err)
+	}
+	action, ok := tpmActions[req.Action]
+	if !ok {
+		return statusBadRequest("tpm action %q is unsupported", req.Action)
+	}
+
+	st := d.state
+	st.Lock()
+	defer st.Unlock()
+
+	ts, err := action.tasks(st)
+	if err != nil {
+		return tpmError(err)
+	}
+	chg := st.NewChange(action.kind, action.summary)
+	chg.AddAll(ts)
+	ensureStateSoon(st)
+
+	return asyncResponse(nil, chg.ID())
+}
+
+// tpmError converts an error returned by tpmstate into an error
+// response.
+func tpmError(err error) response {
+	var fdeConflict *fdestate.ChangeConflictError
+	if errors.As(err, &fdeConflict) {
+		return fdeError(err)
+	}
+	var conflict *tpmstate.ChangeConflictError
+	if errors.As(err, &conflict) {
+		return &apiError{
+			Status:  http.StatusConflict,
+			Message: err.Error(),
+			Kind:    api.ErrorKindChangeConflict,
+			Value: map[string]string{
+				"change-kind": conflict.ChangeKind,
+				"change-id":   conflict.ChangeID,
+			},
+		}
+	}
+	return statusInternalError("%v", err)
+}
@@ -0,0 +1,199 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package daemon_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/api"
+	"github.com/snapcore/fdemanager/internal/daemon"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/polkit"
+	"github.com/snapcore/fdemanager/internal/tpm"
+	"github.com/snapcore/fdemanager/internal/tpm/tpmtest"
+)
+
+type tpmSuite struct {
+	apiBaseSuite
+
+	tpm *tpmtest.TPM
+}
+
+var _ = Suite(&tpmSuite{})
+
+func (s *tpmSuite) SetUpTest(c *C) {
+	s.apiBaseSuite.SetUpTest(c)
+
+	s.tpm = tpmtest.New()
+	s.AddCleanup(tpmtest.Mock(s.tpm))
+}
+
+func (s *tpmSuite) TestGetTPMStatus(c *C) {
+	s.tpm.SRKPresent = true
+	s.tpm.LockoutAuth = []byte("lockout")
+	s.tpm.InLockout = true
+	s.tpm.LockoutCounter = 3
+	c.Assert(s.d.Overlord().TPMManager().Ensure(), IsNil)
+
+	var result *api.TPMStatus
+	s.syncReq(c, http.MethodGet, "/v1/system/tpm", nil, &result)
+	c.Check(result, DeepEquals, &api.TPMStatus{
+		Present:         true,
+		Manufacturer:    "IBM",
+		FirmwareVersion: "8217.4131.22.13878",
+		Owned:           true,
+		LockoutAuthSet:  true,
+		SRKPresent:      true,
+		Lockout:         true,
+		LockoutCounter:  3,
+		MaxTries:        3,
+		RecoveryTime:    "16m40s",
+		LockoutRecovery: "0s",
+	})
+}
+
+func (s *tpmSuite) TestGetTPMStatusNoTPM(c *C) {
+	s.tpm.Err = tpm.ErrNoTPM
+	c.Assert(s.d.Overlord().TPMManager().Ensure(), IsNil)
+
+	var result *api.TPMStatus
+	s.syncReq(c, http.MethodGet, "/v1/system/tpm", nil, &result)
+	c.Check(result, DeepEquals, &api.TPMStatus{})
+}
+
+func (s *tpmSuite) TestPostTPMAction(c *C) {
+	ensureCalls := 0
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { ensureCalls++ })
+	defer restore()
+
+	for _, t := range []struct {
+		action string
+		kind   string
+	}{
+		{"provision", "provision-tpm"},
+		{"reset-lockout", "reset-tpm-lockout"},
+		{"clear", "clear-tpm"},
+	} {
+		rsp := s.req(c, http.MethodPost, "/v1/system/tpm", strings.NewReader(`{"action":"`+t.action+`"}`))
+		c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+		c.Check(rsp.StatusCode, Equals, http.StatusAccepted)
+
+		st := s.d.Overlord().State()
+		st.Lock()
+		chg := st.Change(rsp.Change)
+		c.Assert(chg, NotNil)
+		c.Check(chg.Kind(), Equals, t.kind)
+		c.Assert(chg.Tasks(), HasLen, 1)
+		c.Check(chg.Tasks()[0].Kind(), Equals, t.kind)
+		// let the next action proceed
+		chg.SetStatus(state.DoneStatus)
+		st.Unlock()
+	}
+	c.Check(ensureCalls, Equals, 3)
+}
+
+func (s *tpmSuite) TestPostTPMActionConflict(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) {})
+	defer restore()
+
+	rsp := s.req(c, http.MethodPost, "/v1/system/tpm", strings.NewReader(`{"action":"provision"}`))
+	c.Assert(rsp.Type, Equals, api.ResponseTypeAsync)
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/tpm", strings.NewReader(`{"action":"clear"}`))
+	c.Check(status, Equals, http.StatusConflict)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeConflict)
+	c.Check(result.Message, Equals, `TPM has "provision-tpm" change in progress`)
+	var value map[string]string
+	c.Assert(json.Unmarshal(result.Value, &value), IsNil)
+	c.Check(value, DeepEquals, map[string]string{
+		"change-kind": "provision-tpm",
+		"change-id":   rsp.Change,
+	})
+}
+
+func (s *tpmSuite) TestPostTPMClearFDEConflict(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	st := s.d.Overlord().State()
+	st.Lock()
+	c.Assert(fdestate.SetContainer(st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+	}), IsNil)
+	t := st.NewTask("seal-key", "...")
+	t.Set("container", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	chg := st.NewChange("seal", "...")
+	chg.AddTask(t)
+	st.Unlock()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/tpm", strings.NewReader(`{"action":"clear"}`))
+	c.Check(status, Equals, http.StatusConflict)
+	c.Check(result.Kind, Equals, api.ErrorKindChangeConflict)
+	c.Check(result.Message, Equals, `container 7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21 has "seal" change in progress`)
+	var value map[string]string
+	c.Assert(json.Unmarshal(result.Value, &value), IsNil)
+	c.Check(value, DeepEquals, map[string]string{
+		"change-kind": "seal",
+		"change-id":   chg.ID(),
+	})
+}
+
+func (s *tpmSuite) TestPostTPMActionErrors(c *C) {
+	restore := daemon.MockEnsureStateSoon(func(*state.State) { c.Error("unexpected ensure") })
+	defer restore()
+
+	for _, t := range []struct {
+		body    string
+		message string
+	}{
+		{`{"action":"frobnicate"}`, `tpm action "frobnicate" is unsupported`},
+		{`{}`, `tpm action "" is unsupported`},
+		{`{`, `cannot decode request body: .*`},
+	} {
+		status, result := s.errorReq(c, http.MethodPost, "/v1/system/tpm", strings.NewReader(t.body))
+		c.Check(status, Equals, http.StatusBadRequest, Commentf(t.body))
+		c.Check(result.Message, Matches, t.message, Commentf(t.body))
+	}
+}
+
+func (s *tpmSuite) TestPostTPMActionRequiresAuthorization(c *C) {
+	restore := daemon.MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: 100, Uid: 1000, Gid: 1000}, nil
+	})
+	defer restore()
+	restore = daemon.MockPolkitCheckAuthorization(func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error) {
+		c.Check(actionID, Equals, "io.snapcraft.fdemanager.manage-tpm")
+		return false, nil
+	})
+	defer restore()
+
+	status, result := s.errorReq(c, http.MethodPost, "/v1/system/tpm", strings.NewReader(`{"action":"clear"}`))
+	c.Check(status, Equals, http.StatusForbidden)
+	c.Check(result.Kind, Equals, api.ErrorKindNotAuthorized)
+}
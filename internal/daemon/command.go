@@ -20,24 +20,34 @@
 package daemon
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/snapcore/fdemanager/api"
 	"github.com/snapcore/fdemanager/internal/netutil"
+	"github.com/snapcore/fdemanager/internal/procfs"
 	"github.com/snapcore/snapd/logger"
 )
 
 var (
-	muxVars             = mux.Vars
-	netutilConnPeerCred = netutil.ConnPeerCred
+	muxVars              = mux.Vars
+	netutilConnPeerCred  = netutil.ConnPeerCred
+	netutilConnPeerPidfd = netutil.ConnPeerPidfd
+	netutilBootTimeTicks = netutil.BootTimeTicks
+	timeNow              = time.Now
 )
 
-// A responseFunc handles one of the individual verbs for a method
-type responseFunc func(*Daemon, map[string]string, io.Reader) response
+// A responseFunc handles one of the individual verbs for a method.
+// allowInteraction indicates whether the client is able to handle
+// interactive prompts on behalf of the user.
+type responseFunc func(d *Daemon, vars map[string]string, query url.Values, body io.Reader, allowInteraction bool) response
 
 // A command routes a request to an individual per-verb responseFUnc
 type command struct {
@@ -65,6 +75,18 @@ func (c *command) Run(d *Daemon, r *http.Request) response {
 		logger.Noticef("unexpected error when attempting to obtain peer credentials: %v", err)
 		return statusInternalError(err.Error())
 	}
+	// access checkers use the pidfd to know that what they look up
+	// by pid is about the client and not about a process that reused
+	// its pid. Without a recorded accept time no process is known to
+	// have made the connection when SO_PEERPIDFD is unsupported.
+	acceptTime, _ := r.Context().Value(acceptTimeKey).(uint64)
+	pidfd, err := netutilConnPeerPidfd(conn, acceptTime)
+	if err != nil {
+		logger.Debugf("cannot obtain pidfd of peer: %v", err)
+	} else {
+		defer pidfd.Close()
+		r = r.WithContext(context.WithValue(r.Context(), pidfdKey, pidfd))
+	}
 
 	var rspf responseFunc
 	var access accessChecker
@@ -97,9 +119,60 @@ func (c *command) Run(d *Daemon, r *http.Request) response {
 			logger.Noticef("error parsing %s header: %s", api.AllowInteractionHeader, err)
 		}
 	}
-	if err := access.CheckAccess(d, ucred, allowInteraction); err != nil {
+	// requests that require write access are audited, whether they
+	// are allowed or not
+	audit := r.Method != http.MethodGet
+	if err := access.CheckAccess(d, r, ucred, allowInteraction); err != nil {
+		if audit {
+			d.auditRequest(r, ucred, api.AuditDeny, err)
+		}
+		return err
+	}
+
+	rsp := rspf(d, muxVars(r), r.URL.Query(), r.Body, allowInteraction)
+	if audit {
+		d.auditRequest(r, ucred, api.AuditAllow, rsp)
+	}
+	return rsp
+}
+
+// auditRequest appends a record of the request, the access decision
+// and the response to the audit log.
+func (d *Daemon) auditRequest(r *http.Request, ucred *syscall.Ucred, decision api.AuditDecision, rsp response) {
+	if d.auditLog == nil {
+		return
+	}
+
+	rec := &api.AuditRecord{
+		Time:     timeNow().UTC(),
+		UID:      ucred.Uid,
+		PID:      ucred.Pid,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Decision: decision,
+	}
+	err := withPeerPid(r, func(pid int32) (err error) {
+		rec.Exe, err = procfs.Exe(pid)
 		return err
+	})
+	if err != nil {
+		logger.Debugf("cannot obtain executable of pid %d: %v", ucred.Pid, err)
+		rec.Exe = ""
+	}
+	rec.Label, err = peerAppArmorLabel(r)
+	if err != nil {
+		logger.Debugf("cannot obtain AppArmor label of pid %d: %v", ucred.Pid, err)
+	}
+
+	switch rsp := rsp.(type) {
+	case *apiError:
+		rec.Status = rsp.Status
+	case *resp:
+		rec.Status = rsp.Status
+		rec.Change = rsp.Change
 	}
 
-	return rspf(d, muxVars(r), r.Body)
+	if err := d.auditLog.Append(rec); err != nil {
+		logger.Noticef("cannot audit %s %s: %v", r.Method, r.URL.Path, err)
+	}
 }
@@ -24,6 +24,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"syscall"
 
 	. "gopkg.in/check.v1"
@@ -48,10 +50,10 @@ func (r *mockResponse) Write(w http.ResponseWriter) {
 	w.Write([]byte("{}"))
 }
 
-type mockAccessCheckerFunc func(*Daemon, *syscall.Ucred, bool) *ApiError
+type mockAccessCheckerFunc func(*Daemon, *http.Request, *syscall.Ucred, bool) *ApiError
 
-func (fn mockAccessCheckerFunc) CheckAccess(d *Daemon, ucred *syscall.Ucred, allowInteractive bool) *ApiError {
-	return fn(d, ucred, allowInteractive)
+func (fn mockAccessCheckerFunc) CheckAccess(d *Daemon, r *http.Request, ucred *syscall.Ucred, allowInteractive bool) *ApiError {
+	return fn(d, r, ucred, allowInteractive)
 }
 
 type testCommandMethodDispatchData struct {
@@ -59,11 +61,13 @@ type testCommandMethodDispatchData struct {
 	accessErr                *ApiError
 	prepareCmd               func(*Command)
 	method                   string
+	target                   string
 	headers                  http.Header
 	peerCred                 *syscall.Ucred
 	peerCredErr              error
 	expectedAllowInteraction bool
 	expectedMethod           string
+	expectedQuery            url.Values
 	expectedRsp              Response
 	expectedStatus           int
 }
@@ -84,44 +88,52 @@ func (s *commandSuite) testCommandMethodDispatch(c *C, data *testCommandMethodDi
 	defer restore()
 
 	cmd := new(Command)
-	cmd.GET = func(innerDaemon *Daemon, innerParams map[string]string, body io.Reader) Response {
+	cmd.GET = func(innerDaemon *Daemon, innerParams map[string]string, query url.Values, body io.Reader, allowInteraction bool) Response {
 		c.Assert(method, Equals, "")
 		c.Check(access, Equals, "read")
 		c.Check(innerDaemon, Equals, d)
 		c.Check(innerParams, DeepEquals, params)
+		c.Check(query, DeepEquals, data.expectedQuery)
 		c.Check(body, Equals, req.Body)
+		c.Check(allowInteraction, Equals, data.expectedAllowInteraction)
 		method = http.MethodGet
 		return data.rsp
 	}
-	cmd.PUT = func(innerDaemon *Daemon, innerParams map[string]string, body io.Reader) Response {
+	cmd.PUT = func(innerDaemon *Daemon, innerParams map[string]string, query url.Values, body io.Reader, allowInteraction bool) Response {
 		c.Assert(method, Equals, "")
 		c.Check(access, Equals, "write")
 		c.Check(innerDaemon, Equals, d)
 		c.Check(innerParams, DeepEquals, params)
+		c.Check(query, DeepEquals, data.expectedQuery)
 		c.Check(body, Equals, req.Body)
+		c.Check(allowInteraction, Equals, data.expectedAllowInteraction)
 		method = http.MethodPut
 		return data.rsp
 	}
-	cmd.POST = func(innerDaemon *Daemon, innerParams map[string]string, body io.Reader) Response {
+	cmd.POST = func(innerDaemon *Daemon, innerParams map[string]string, query url.Values, body io.Reader, allowInteraction bool) Response {
 		c.Assert(method, Equals, "")
 		c.Check(access, Equals, "write")
 		c.Check(innerDaemon, Equals, d)
 		c.Check(innerParams, DeepEquals, params)
+		c.Check(query, DeepEquals, data.expectedQuery)
 		c.Check(body, Equals, req.Body)
+		c.Check(allowInteraction, Equals, data.expectedAllowInteraction)
 		method = http.MethodPost
 		return data.rsp
 	}
-	cmd.ReadAccess = mockAccessCheckerFunc(func(innerDaemon *Daemon, ucred *syscall.Ucred, allowInteraction bool) *ApiError {
+	cmd.ReadAccess = mockAccessCheckerFunc(func(innerDaemon *Daemon, innerReq *http.Request, ucred *syscall.Ucred, allowInteraction bool) *ApiError {
 		c.Assert(access, Equals, "")
 		c.Check(innerDaemon, Equals, d)
+		c.Check(innerReq, Equals, req)
 		c.Check(ucred, DeepEquals, data.peerCred)
 		c.Check(allowInteraction, Equals, data.expectedAllowInteraction)
 		access = "read"
 		return data.accessErr
 	})
-	cmd.WriteAccess = mockAccessCheckerFunc(func(innerDaemon *Daemon, ucred *syscall.Ucred, allowInteraction bool) *ApiError {
+	cmd.WriteAccess = mockAccessCheckerFunc(func(innerDaemon *Daemon, innerReq *http.Request, ucred *syscall.Ucred, allowInteraction bool) *ApiError {
 		c.Assert(access, Equals, "")
 		c.Check(innerDaemon, Equals, d)
+		c.Check(innerReq, Equals, req)
 		c.Check(ucred, DeepEquals, data.peerCred)
 		c.Check(allowInteraction, Equals, data.expectedAllowInteraction)
 		access = "write"
@@ -135,7 +147,7 @@ func (s *commandSuite) testCommandMethodDispatch(c *C, data *testCommandMethodDi
 	ctx := context.WithValue(context.Background(), ConnectionKey, conn)
 
 	var err error
-	req, err = http.NewRequestWithContext(ctx, data.method, "", nil)
+	req, err = http.NewRequestWithContext(ctx, data.method, data.target, nil)
 	c.Assert(err, IsNil)
 
 	req.Header = data.headers
@@ -160,6 +172,19 @@ func (s *commandSuite) TestCommandMethodDispatchGet(c *C) {
 		method:         http.MethodGet,
 		peerCred:       &syscall.Ucred{Pid: 100, Uid: 1001, Gid: 1001},
 		expectedMethod: http.MethodGet,
+		expectedQuery:  url.Values{},
+		expectedRsp:    &mockResponse{200},
+	})
+}
+
+func (s *commandSuite) TestCommandMethodDispatchGetWithQuery(c *C) {
+	s.testCommandMethodDispatch(c, &testCommandMethodDispatchData{
+		rsp:            &mockResponse{200},
+		method:         http.MethodGet,
+		target:         "/v1/foo?select=all&bar=1",
+		peerCred:       &syscall.Ucred{Pid: 100, Uid: 1001, Gid: 1001},
+		expectedMethod: http.MethodGet,
+		expectedQuery:  url.Values{"select": []string{"all"}, "bar": []string{"1"}},
 		expectedRsp:    &mockResponse{200},
 	})
 }
@@ -179,6 +204,7 @@ func (s *commandSuite) TestCommandMethodDispatchPost(c *C) {
 		method:         http.MethodPost,
 		peerCred:       &syscall.Ucred{Pid: 100, Uid: 1001, Gid: 1001},
 		expectedMethod: http.MethodPost,
+		expectedQuery:  url.Values{},
 		expectedRsp:    &mockResponse{200},
 	})
 }
@@ -198,6 +224,7 @@ func (s *commandSuite) TestCommandMethodDispatchPut(c *C) {
 		method:         http.MethodPut,
 		peerCred:       &syscall.Ucred{Pid: 100, Uid: 1001, Gid: 1001},
 		expectedMethod: http.MethodPut,
+		expectedQuery:  url.Values{},
 		expectedRsp:    &mockResponse{200},
 	})
 }
@@ -217,6 +244,7 @@ func (s *commandSuite) TestCommandMethodDispatchDifferentCred(c *C) {
 		method:         http.MethodGet,
 		peerCred:       &syscall.Ucred{Pid: 5, Uid: 1, Gid: 1},
 		expectedMethod: http.MethodGet,
+		expectedQuery:  url.Values{},
 		expectedRsp:    &mockResponse{200},
 	})
 }
@@ -245,6 +273,7 @@ func (s *commandSuite) TestCommandMethodDispatchAllowInteractionAuth(c *C) {
 		peerCred:                 &syscall.Ucred{Pid: 100, Uid: 1001, Gid: 1001},
 		expectedAllowInteraction: true,
 		expectedMethod:           http.MethodGet,
+		expectedQuery:            url.Values{},
 		expectedRsp:              &mockResponse{200},
 	})
 }
@@ -269,3 +298,48 @@ func (s *commandSuite) TestCommandMethodDispatchNoLinkedConnection(c *C) {
 	cmd := new(Command)
 	c.Check(func() { cmd.Run(d, req) }, PanicMatches, `no connection associated with request`)
 }
+
+func (s *commandSuite) TestCommandPeerPidfd(c *C) {
+	restore := MockNetutilConnPeerCred(func(net.Conn) (*syscall.Ucred, error) {
+		return &syscall.Ucred{Pid: int32(os.Getpid()), Uid: 1000, Gid: 1000}, nil
+	})
+	defer restore()
+	pidfd, err := netutil.PidfdOpen(int32(os.Getpid()))
+	c.Assert(err, IsNil)
+	restore = MockNetutilConnPeerPidfd(func(conn net.Conn, acceptTime uint64) (*netutil.Pidfd, error) {
+		// the peer is checked against the time the connection
+		// was accepted
+		c.Check(acceptTime, Equals, uint64(4200))
+		return pidfd, nil
+	})
+	defer restore()
+
+	cmd := &Command{
+		GET: func(*Daemon, map[string]string, url.Values, io.Reader, bool) Response {
+			return &mockResponse{200}
+		},
+		ReadAccess: mockAccessCheckerFunc(func(d *Daemon, r *http.Request, ucred *syscall.Ucred, allowInteraction bool) *ApiError {
+			// the pidfd is available to access checkers
+			c.Check(r.Context().Value(PidfdKey), Equals, pidfd)
+			c.Check(pidfd.CheckAlive(), IsNil)
+			return nil
+		}),
+	}
+
+	restore = MockNetutilBootTimeTicks(func() (uint64, error) { return 4200, nil })
+	defer restore()
+	ctx := ConnContext(context.Background(), new(net.UnixConn))
+	c.Check(ctx.Value(AcceptTimeKey), Equals, uint64(4200))
+	// the time of the request doesn't matter
+	restore = MockNetutilBootTimeTicks(func() (uint64, error) { return 9000, nil })
+	defer restore()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/v1/foo", nil)
+	c.Assert(err, IsNil)
+
+	rsp := cmd.Run(nil, req)
+	c.Check(rsp, DeepEquals, &mockResponse{200})
+
+	// and closed once the request is handled
+	c.Check(pidfd.CheckAlive(), Equals, syscall.EBADF)
+}
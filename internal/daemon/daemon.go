@@ -26,11 +26,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/snapcore/fdemanager/internal/audit"
 	"github.com/snapcore/fdemanager/internal/netutil"
 	"github.com/snapcore/fdemanager/internal/overlord"
 	"github.com/snapcore/fdemanager/internal/paths"
@@ -50,12 +53,39 @@ var (
 	ErrRestartSocket = fmt.Errorf("daemon stop requested to wait for socket activation")
 
 	shutdownTimeout = 25 * time.Second
+
+	rebootWaitTimeout      = 10 * time.Minute
+	rebootRetryWaitTimeout = 5 * time.Minute
+	rebootMaxTentatives    = 3
+
+	// reboot schedules a system restart.
+	reboot = boot.Reboot
 )
 
 type contextKey string
 
 var connectionKey contextKey = "net-conn"
 
+// pidfdKey is the context key for the pidfd of the client of a request.
+var pidfdKey contextKey = "peer-pidfd"
+
+// acceptTimeKey is the context key for the time a connection was
+// accepted, as returned by netutil.BootTimeTicks.
+var acceptTimeKey contextKey = "accept-time"
+
+// connContext associates the connection with the context that gets
+// attached to each request, so that we can obtain the connection in the
+// handler. It is called right after the connection is accepted, which
+// is when its accept time is recorded.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	if acceptTime, err := netutilBootTimeTicks(); err != nil {
+		logger.Noticef("cannot obtain boot time: %v", err)
+	} else {
+		ctx = context.WithValue(ctx, acceptTimeKey, acceptTime)
+	}
+	return context.WithValue(ctx, connectionKey, c)
+}
+
 type connTracker struct {
 	mu    sync.Mutex
 	conns map[net.Conn]struct{}
@@ -131,9 +161,17 @@ type Daemon struct {
 	connTracker     *connTracker
 	serve           *http.Server
 	standbyOpinions *standby.StandbyOpinions
+	auditLog        *audit.Log
+	events          *eventHub
 	tomb            tomb.Tomb
 
-	restartSocket bool
+	restartSocket    bool
+	requestedRestart restart.RestartType
+	rebootInfo       *boot.RebootInfo
+
+	// expectedRebootDidNotHappen is set when the daemon was started
+	// again on the same boot after it requested a system restart.
+	expectedRebootDidNotHappen bool
 
 	mu sync.Mutex
 }
@@ -143,11 +181,20 @@ func New() (*Daemon, error) {
 	d := &Daemon{}
 
 	ovld, err := overlord.New(d)
+	if err == errExpectedReboot {
+		// proceed without an overlord, Stop schedules the system
+		// restart again and waits for it.
+		d.expectedRebootDidNotHappen = true
+		return d, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 	d.overlord = ovld
 	d.state = ovld.State()
+	d.auditLog = audit.New(paths.ManagerAuditLogFile, audit.DefaultMaxSize, audit.DefaultKeep)
+	d.events = newEventHub()
+	d.events.watchState(d.state)
 
 	d.addRoutes()
 
@@ -169,6 +216,12 @@ type commandDispatcher struct {
 
 func (cd *commandDispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	rsp := cd.c.Run(cd.d, r)
+	// responses that take their time, such as streams, need to know
+	// when the client goes away
+	if h, ok := rsp.(http.Handler); ok {
+		h.ServeHTTP(w, r)
+		return
+	}
 	rsp.Write(w)
 }
 
@@ -190,24 +243,100 @@ func (d *Daemon) addRoutes() {
 	d.router.NotFoundHandler = statusNotFound("not found")
 }
 
+// HandleRestart implements restart.Handler.
 func (d *Daemon) HandleRestart(t restart.RestartType, rebootInfo *boot.RebootInfo) {
-	if t != restart.RestartSocket {
-		logger.Panicf("unexpected restart type")
-	}
-
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.restartSocket = true
+
+	switch t {
+	case restart.RestartSocket:
+		d.restartSocket = true
+	case restart.RestartSystem, restart.RestartSystemNow:
+		// the system restart is scheduled once the daemon has
+		// stopped
+		d.requestedRestart = t
+		d.rebootInfo = rebootInfo
+	default:
+		logger.Noticef("internal error: restart handler called with unsupported restart type: %v", t)
+	}
 
 	d.tomb.Kill(nil)
 }
 
+func clearReboot(st *state.State) {
+	st.Set("daemon-system-restart-at", nil)
+	st.Set("daemon-system-restart-tentative", nil)
+}
+
+// RebootAsExpected implements restart.Handler.
 func (d *Daemon) RebootAsExpected(st *state.State) error {
+	clearReboot(st)
 	return nil
 }
 
+var errExpectedReboot = errors.New("expected reboot did not happen")
+
+// RebootDidNotHappen implements restart.Handler. The system restart
+// is requested again a few times, after which the tasks that are
+// waiting for it fail.
 func (d *Daemon) RebootDidNotHappen(st *state.State) error {
-	return errors.New("internal error: unexpected RebootDidNotHappen callback")
+	var nTentative int
+	if err := st.Get("daemon-system-restart-tentative", &nTentative); err != nil && !errors.Is(err, state.ErrNoState) {
+		return err
+	}
+	nTentative++
+	if nTentative > rebootMaxTentatives {
+		var fromBootID string
+		if err := st.Get("system-restart-from-boot-id", &fromBootID); err != nil {
+			return err
+		}
+		restart.ClearReboot(st)
+		clearReboot(st)
+		if err := failTasksWaitingForRestart(st, fromBootID); err != nil {
+			return err
+		}
+		logger.Noticef("daemon was restarted while a system restart was expected, giving up after %d attempts", rebootMaxTentatives)
+		return nil
+	}
+	st.Set("daemon-system-restart-tentative", nTentative)
+	d.state = st
+	logger.Noticef("daemon was restarted while a system restart was expected, will try to restart the system again (attempt %d/%d)", nTentative, rebootMaxTentatives)
+	return errExpectedReboot
+}
+
+// failTasksWaitingForRestart fails the tasks that wait for a system
+// restart from the specified boot, which is not going to happen.
+func failTasksWaitingForRestart(st *state.State, bootID string) error {
+	for _, chg := range st.Changes() {
+		if chg.IsReady() || !chg.Has("wait-for-system-restart") {
+			continue
+		}
+		stillWaiting := false
+		for _, t := range chg.Tasks() {
+			if t.Status() != state.WaitStatus {
+				continue
+			}
+			var waitBootID string
+			if err := t.Get("wait-for-system-restart-from-boot-id", &waitBootID); err != nil {
+				if errors.Is(err, state.ErrNoState) {
+					continue
+				}
+				return err
+			}
+			if waitBootID != bootID {
+				stillWaiting = true
+				continue
+			}
+			t.Errorf("expected system restart did not happen")
+			t.Set("wait-for-system-restart-from-boot-id", nil)
+			chg.AbortLanes(t.Lanes())
+			t.SetStatus(state.ErrorStatus)
+		}
+		if !stillWaiting {
+			chg.Set("wait-for-system-restart", nil)
+		}
+	}
+	return nil
 }
 
 func (d *Daemon) CanStandby() bool {
@@ -216,6 +345,11 @@ func (d *Daemon) CanStandby() bool {
 
 // Start starts the daemon.
 func (d *Daemon) Start() error {
+	if d.expectedRebootDidNotHappen {
+		// Stop schedules the system restart again
+		d.tomb.Kill(nil)
+		return nil
+	}
 	if d.overlord == nil {
 		panic("internal error: no Overlord")
 	}
@@ -234,18 +368,16 @@ func (d *Daemon) Start() error {
 
 	d.connTracker = newConnTracker()
 	d.serve = &http.Server{
-		Handler:   logit(d.router),
-		ConnState: d.connTracker.TrackConn,
-		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
-			// associate the connection with the context that gets attached
-			// to each request, so that we can obtain the connection in the
-			// handler.
-			return context.WithValue(ctx, connectionKey, c)
-		},
+		Handler:     logit(d.router),
+		ConnState:   d.connTracker.TrackConn,
+		ConnContext: connContext,
 	}
 
 	d.initStandbyHandling()
 
+	if err := d.overlord.StartUp(); err != nil {
+		return err
+	}
 	d.overlord.Loop()
 
 	d.tomb.Go(func() error {
@@ -259,8 +391,14 @@ func (d *Daemon) Start() error {
 	return nil
 }
 
-// Stop stops the daemon.
-func (d *Daemon) Stop() error {
+// Stop stops the daemon. If a system restart was requested, it is
+// scheduled and Stop waits for it to happen. In this case, sigCh is
+// closed so that signals from the shutdown are no longer handled.
+func (d *Daemon) Stop(sigCh chan<- os.Signal) error {
+	if d.expectedRebootDidNotHappen {
+		// restart the system again, immediately this time
+		return d.doReboot(sigCh, restart.RestartSystemNow, nil, rebootRetryWaitTimeout)
+	}
 	if d.overlord == nil {
 		return errors.New("internal error: no Overlord")
 	}
@@ -269,7 +407,10 @@ func (d *Daemon) Stop() error {
 
 	d.mu.Lock()
 	restartSocket := d.restartSocket
+	requestedRestart := d.requestedRestart
+	rebootInfo := d.rebootInfo
 	d.mu.Unlock()
+	needsReboot := requestedRestart == restart.RestartSystem || requestedRestart == restart.RestartSystemNow
 
 	d.listener.Close()
 	d.standbyOpinions.Stop()
@@ -302,11 +443,19 @@ func (d *Daemon) Stop() error {
 			// the process is shutting down anyway, so we may just
 			// as well close the active connections right now
 			d.serve.Close()
+		} else if needsReboot {
+			// restart the system anyway, as the changes
+			// waiting for it will not make progress otherwise
+			logger.Noticef("WARNING: cannot stop daemon: %v", err)
 		} else {
 			return err
 		}
 	}
 
+	if needsReboot {
+		return d.doReboot(sigCh, requestedRestart, rebootInfo, rebootWaitTimeout)
+	}
+
 	if d.restartSocket {
 		return ErrRestartSocket
 	}
@@ -314,6 +463,52 @@ func (d *Daemon) Stop() error {
 	return nil
 }
 
+// rebootDelay returns the delay before the system restart, which is
+// remembered so that restarting the daemon does not postpone it.
+func (d *Daemon) rebootDelay(immediate bool) (time.Duration, error) {
+	d.state.Lock()
+	defer d.state.Unlock()
+
+	now := timeNow()
+	var rebootAt time.Time
+	err := d.state.Get("daemon-system-restart-at", &rebootAt)
+	if err != nil && !errors.Is(err, state.ErrNoState) {
+		return 0, err
+	}
+	if err == nil {
+		return rebootAt.Sub(now), nil
+	}
+	rebootDelay := 1 * time.Minute
+	if immediate {
+		rebootDelay = 0
+	}
+	d.state.Set("daemon-system-restart-at", now.Add(rebootDelay))
+	return rebootDelay, nil
+}
+
+func (d *Daemon) doReboot(sigCh chan<- os.Signal, t restart.RestartType, rebootInfo *boot.RebootInfo, waitTimeout time.Duration) error {
+	rebootDelay, err := d.rebootDelay(t == restart.RestartSystemNow)
+	if err != nil {
+		return err
+	}
+	if err := reboot(boot.RebootReboot, rebootDelay, rebootInfo); err != nil {
+		return err
+	}
+
+	logger.Noticef("Waiting for system restart")
+	if sigCh != nil {
+		// let the signals from the shutdown terminate us
+		signal.Stop(sigCh)
+		if len(sigCh) > 0 {
+			// a signal arrived in between
+			return nil
+		}
+		close(sigCh)
+	}
+	time.Sleep(waitTimeout)
+	return errors.New("expected system restart did not happen")
+}
+
 // Dying returns a channel that is closed when the daemon is
 // put into a dying state.
 func (d *Daemon) Dying() <-chan struct{} {
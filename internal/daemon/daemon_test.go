@@ -21,9 +21,12 @@ package daemon_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -34,7 +37,12 @@ import (
 
 	. "github.com/snapcore/fdemanager/internal/daemon"
 	"github.com/snapcore/fdemanager/internal/netutil"
+	"github.com/snapcore/fdemanager/internal/overlord/patch"
 	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/snapd/boot"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/overlord/restart"
+	"github.com/snapcore/snapd/overlord/state"
 	"github.com/snapcore/snapd/testutil"
 	. "gopkg.in/check.v1"
 	"gopkg.in/tomb.v2"
@@ -97,7 +105,7 @@ func (s *daemonSuite) TestTrivialStartStop(c *C) {
 
 	c.Check(d.CanStandby(), Equals, false)
 
-	c.Check(d.Stop(), IsNil)
+	c.Check(d.Stop(nil), IsNil)
 	c.Check(tmb.Wait(), IsNil)
 }
 
@@ -136,7 +144,7 @@ func (s *daemonSuite) TestStartAndStopActivated(c *C) {
 	c.Check(d.CanStandby(), Equals, true)
 
 	c.Check(tmb.Wait(), IsNil)
-	c.Check(d.Stop(), Equals, ErrRestartSocket)
+	c.Check(d.Stop(nil), Equals, ErrRestartSocket)
 }
 
 func (s *daemonSuite) TestNotFoundHandler(c *C) {
@@ -157,14 +165,14 @@ func (s *daemonSuite) TestNotFoundHandler(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(rsp.StatusCode, Equals, 404)
 
-	c.Check(d.Stop(), IsNil)
+	c.Check(d.Stop(nil), IsNil)
 }
 
 func (s *daemonSuite) TestBasicCommandRouting(c *C) {
 	restore := MockApiCommands([]*Command{
 		{
 			Path: "/v1/foo",
-			GET: func(innerDaemon *Daemon, params map[string]string, body io.Reader) Response {
+			GET: func(innerDaemon *Daemon, vars map[string]string, query url.Values, body io.Reader, allowInteraction bool) Response {
 				return SyncResponse(nil)
 			},
 			ReadAccess: OpenAccess,
@@ -192,7 +200,7 @@ func (s *daemonSuite) TestBasicCommandRouting(c *C) {
 	c.Check(err, IsNil)
 	c.Check(b, DeepEquals, []byte(`{"type":"sync","status-code":200,"status":"OK","result":null}`))
 
-	c.Check(d.Stop(), IsNil)
+	c.Check(d.Stop(nil), IsNil)
 }
 
 func (s *daemonSuite) TestConnectionRequestBinding(c *C) {
@@ -209,7 +217,7 @@ func (s *daemonSuite) TestConnectionRequestBinding(c *C) {
 	restore = MockApiCommands([]*Command{
 		{
 			Path: "/v1/foo",
-			GET: func(innerDaemon *Daemon, params map[string]string, body io.Reader) Response {
+			GET: func(innerDaemon *Daemon, vars map[string]string, query url.Values, body io.Reader, allowInteraction bool) Response {
 				wg.Done()
 				<-complete
 				return SyncResponse(nil)
@@ -257,5 +265,209 @@ func (s *daemonSuite) TestConnectionRequestBinding(c *C) {
 	close(complete)
 	c.Check(tmb.Wait(), IsNil)
 
-	c.Check(d.Stop(), IsNil)
+	c.Check(d.Stop(nil), IsNil)
+}
+
+type rebootCall struct {
+	action boot.RebootAction
+	delay  time.Duration
+}
+
+func (s *daemonSuite) mockReboot(c *C) *[]rebootCall {
+	var calls []rebootCall
+	s.AddCleanup(MockReboot(func(action boot.RebootAction, delay time.Duration, rebootInfo *boot.RebootInfo) error {
+		calls = append(calls, rebootCall{action, delay})
+		return nil
+	}))
+	s.AddCleanup(MockRebootWaitTimeouts(0, 0))
+	return &calls
+}
+
+// writeState writes the state prepared by fn to the state file.
+func (s *daemonSuite) writeState(c *C, fn func(st *state.State)) {
+	st := state.New(nil)
+	st.Lock()
+	defer st.Unlock()
+	st.Set("patch-level", patch.Level)
+	st.Set("patch-sublevel", patch.Sublevel)
+	fn(st)
+
+	data, err := json.Marshal(st)
+	c.Assert(err, IsNil)
+	c.Assert(os.MkdirAll(filepath.Dir(paths.ManagerStateFile), 0755), IsNil)
+	c.Assert(os.WriteFile(paths.ManagerStateFile, data, 0600), IsNil)
+}
+
+func (s *daemonSuite) testRestartSystem(c *C, t restart.RestartType, expectedDelay time.Duration) {
+	calls := s.mockReboot(c)
+	now := time.Now()
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	d, err := New()
+	c.Assert(err, IsNil)
+	c.Assert(d.Start(), IsNil)
+
+	st := d.Overlord().State()
+	st.Lock()
+	restart.Request(st, t, nil)
+	st.Unlock()
+
+	select {
+	case <-d.Dying():
+	case <-time.After(5 * time.Second):
+		c.Fatal("daemon did not stop")
+	}
+
+	sigCh := make(chan os.Signal, 2)
+	c.Check(d.Stop(sigCh), ErrorMatches, "expected system restart did not happen")
+	c.Check(*calls, DeepEquals, []rebootCall{{boot.RebootReboot, expectedDelay}})
+
+	// signals are no longer handled
+	_, ok := <-sigCh
+	c.Check(ok, Equals, false)
+
+	st.Lock()
+	defer st.Unlock()
+	var rebootAt time.Time
+	c.Assert(st.Get("daemon-system-restart-at", &rebootAt), IsNil)
+	c.Check(rebootAt.Equal(now.Add(expectedDelay)), Equals, true)
+	var fromBootID string
+	c.Check(st.Get("system-restart-from-boot-id", &fromBootID), IsNil)
+}
+
+func (s *daemonSuite) TestRestartSystem(c *C) {
+	s.testRestartSystem(c, restart.RestartSystem, time.Minute)
+}
+
+func (s *daemonSuite) TestRestartSystemNow(c *C) {
+	s.testRestartSystem(c, restart.RestartSystemNow, 0)
+}
+
+func (s *daemonSuite) TestRestartSystemError(c *C) {
+	s.AddCleanup(MockReboot(func(boot.RebootAction, time.Duration, *boot.RebootInfo) error {
+		return errors.New("boom")
+	}))
+
+	d, err := New()
+	c.Assert(err, IsNil)
+	c.Assert(d.Start(), IsNil)
+
+	st := d.Overlord().State()
+	st.Lock()
+	restart.Request(st, restart.RestartSystem, nil)
+	st.Unlock()
+
+	<-d.Dying()
+	c.Check(d.Stop(nil), ErrorMatches, "boom")
+}
+
+func (s *daemonSuite) TestRebootAsExpected(c *C) {
+	var waiting string
+	s.writeState(c, func(st *state.State) {
+		st.Set("system-restart-from-boot-id", "boot-1")
+		st.Set("daemon-system-restart-at", time.Now())
+		st.Set("daemon-system-restart-tentative", 2)
+
+		chg := st.NewChange("change", "...")
+		chg.Set("wait-for-system-restart", true)
+		t := st.NewTask("task", "...")
+		t.Set("wait-for-system-restart-from-boot-id", "boot-1")
+		t.SetToWait(state.DoStatus)
+		chg.AddTask(t)
+		waiting = t.ID()
+	})
+
+	d, err := New()
+	c.Assert(err, IsNil)
+	c.Assert(d.Overlord().StartUp(), IsNil)
+
+	st := d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	// the change continues
+	c.Check(st.Task(waiting).Status(), Equals, state.DoStatus)
+
+	var v interface{}
+	for _, key := range []string{"system-restart-from-boot-id", "daemon-system-restart-at", "daemon-system-restart-tentative"} {
+		c.Check(st.Get(key, &v), testutil.ErrorIs, state.ErrNoState, Commentf(key))
+	}
+}
+
+func (s *daemonSuite) TestRebootDidNotHappen(c *C) {
+	calls := s.mockReboot(c)
+	curBootID, err := osutil.BootID()
+	c.Assert(err, IsNil)
+
+	s.writeState(c, func(st *state.State) {
+		st.Set("system-restart-from-boot-id", curBootID)
+		st.Set("daemon-system-restart-tentative", 1)
+	})
+
+	d, err := New()
+	c.Assert(err, IsNil)
+	c.Check(d.Overlord(), IsNil)
+
+	c.Assert(d.Start(), IsNil)
+	<-d.Dying()
+
+	// the system restart is requested again, immediately
+	c.Check(d.Stop(nil), ErrorMatches, "expected system restart did not happen")
+	c.Check(*calls, DeepEquals, []rebootCall{{boot.RebootReboot, 0}})
+
+	c.Check(paths.ManagerStateFile, testutil.FileContains, `"daemon-system-restart-tentative":2`)
+}
+
+func (s *daemonSuite) TestRebootDidNotHappenGivesUp(c *C) {
+	calls := s.mockReboot(c)
+	curBootID, err := osutil.BootID()
+	c.Assert(err, IsNil)
+
+	var done, waiting, next, other string
+	s.writeState(c, func(st *state.State) {
+		st.Set("system-restart-from-boot-id", curBootID)
+		st.Set("daemon-system-restart-tentative", RebootMaxTentatives)
+
+		chg := st.NewChange("change", "...")
+		chg.Set("wait-for-system-restart", true)
+		t1 := st.NewTask("task", "...")
+		t1.SetStatus(state.DoneStatus)
+		t2 := st.NewTask("task", "...")
+		t2.WaitFor(t1)
+		t2.Set("wait-for-system-restart-from-boot-id", curBootID)
+		t2.SetToWait(state.DoStatus)
+		t3 := st.NewTask("task", "...")
+		t3.WaitFor(t2)
+		chg.AddAll(state.NewTaskSet(t1, t2, t3))
+		done, waiting, next = t1.ID(), t2.ID(), t3.ID()
+
+		// unrelated changes are not affected
+		chg = st.NewChange("other", "...")
+		t4 := st.NewTask("task", "...")
+		chg.AddTask(t4)
+		other = t4.ID()
+	})
+
+	d, err := New()
+	c.Assert(err, IsNil)
+	c.Assert(d.Overlord(), NotNil)
+
+	st := d.Overlord().State()
+	st.Lock()
+	defer st.Unlock()
+
+	// the change fails
+	t := st.Task(waiting)
+	c.Check(t.Status(), Equals, state.ErrorStatus)
+	c.Assert(t.Log(), HasLen, 1)
+	c.Check(t.Log()[0], Matches, `.* ERROR expected system restart did not happen`)
+	c.Check(st.Task(done).Status(), Equals, state.UndoStatus)
+	c.Check(st.Task(next).Status(), Equals, state.HoldStatus)
+	c.Check(st.Task(other).Status(), Equals, state.DoStatus)
+
+	var v interface{}
+	for _, key := range []string{"system-restart-from-boot-id", "daemon-system-restart-tentative"} {
+		c.Check(st.Get(key, &v), testutil.ErrorIs, state.ErrNoState, Commentf(key))
+	}
+	c.Check(*calls, HasLen, 0)
 }
@@ -22,10 +22,21 @@ package daemon
 import (
 	"net"
 	"net/http"
+	"os/user"
 	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snapcore/snapd/boot"
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/internal/netutil"
+	"github.com/snapcore/fdemanager/internal/overlord"
+	"github.com/snapcore/fdemanager/internal/polkit"
 )
 
 type (
+	AccessChain   = accessChain
 	AccessChecker = accessChecker
 	ApiError      = apiError
 	Command       = command
@@ -34,16 +45,70 @@ type (
 )
 
 var (
+	AcceptTimeKey          = acceptTimeKey
+	AccessUnknown          = accessUnknown
+	AuditAccess            = auditAccess
 	AsyncResponse          = asyncResponse
+	ConnContext            = connContext
 	ConnectionKey          = connectionKey
+	FDEActionAccess        = fdeActionAccess
+	ManageKeysAccess       = manageKeysAccess
+	ManageTPMAccess        = manageTPMAccess
+	PidfdKey               = pidfdKey
+	RebootMaxTentatives    = rebootMaxTentatives
+	ResealAccess           = resealAccess
+	SnapNameFromLabel      = snapNameFromLabel
 	NewConnTracker         = newConnTracker
 	OpenAccess             = openAccess
+	RootAccess             = rootAccess
 	StatusUnathorized      = statusUnauthorized
 	StatusMethodNotAllowed = statusMethodNotAllowed
 	StatusInternalError    = statusInternalError
 	SyncResponse           = syncResponse
 )
 
+const PolkitActionManageKeys = polkitActionManageKeys
+
+func NewPolkitAccess(actionID string) AccessChecker {
+	return &polkitAccess{actionID: actionID}
+}
+
+func NewUIDAccess(uids ...uint32) AccessChecker {
+	return &uidAccess{uids: uids}
+}
+
+func NewAppArmorAccess(labels ...string) AccessChecker {
+	return &appArmorAccess{labels: labels}
+}
+
+func MockNetutilConnPeerSecurityLabel(fn func(net.Conn) (string, error)) (restore func()) {
+	orig := netutilConnPeerSecurityLabel
+	netutilConnPeerSecurityLabel = fn
+	return func() {
+		netutilConnPeerSecurityLabel = orig
+	}
+}
+
+func NewGroupAccess(group string) AccessChecker {
+	return &groupAccess{group: group}
+}
+
+func MockUserLookupGroup(fn func(name string) (*user.Group, error)) (restore func()) {
+	orig := userLookupGroup
+	userLookupGroup = fn
+	return func() {
+		userLookupGroup = orig
+	}
+}
+
+func MockPolkitCheckAuthorization(fn func(pid int32, uid uint32, actionID string, details map[string]string, flags polkit.CheckFlags) (bool, error)) (restore func()) {
+	orig := polkitCheckAuthorization
+	polkitCheckAuthorization = fn
+	return func() {
+		polkitCheckAuthorization = orig
+	}
+}
+
 func MockApiCommands(mockApi []*Command) (restore func()) {
 	orig := apiCommands
 	apiCommands = mockApi
@@ -52,6 +117,14 @@ func MockApiCommands(mockApi []*Command) (restore func()) {
 	}
 }
 
+func MockEnsureStateSoon(fn func(*state.State)) (restore func()) {
+	orig := ensureStateSoon
+	ensureStateSoon = fn
+	return func() {
+		ensureStateSoon = orig
+	}
+}
+
 func MockMuxVars(fn func(*http.Request) map[string]string) (restore func()) {
 	orig := muxVars
 	muxVars = fn
@@ -60,6 +133,22 @@ func MockMuxVars(fn func(*http.Request) map[string]string) (restore func()) {
 	}
 }
 
+func MockNetutilBootTimeTicks(fn func() (uint64, error)) (restore func()) {
+	orig := netutilBootTimeTicks
+	netutilBootTimeTicks = fn
+	return func() {
+		netutilBootTimeTicks = orig
+	}
+}
+
+func MockNetutilConnPeerPidfd(fn func(net.Conn, uint64) (*netutil.Pidfd, error)) (restore func()) {
+	orig := netutilConnPeerPidfd
+	netutilConnPeerPidfd = fn
+	return func() {
+		netutilConnPeerPidfd = orig
+	}
+}
+
 func MockNetutilConnPeerCred(fn func(net.Conn) (*syscall.Ucred, error)) (restore func()) {
 	orig := netutilConnPeerCred
 	netutilConnPeerCred = fn
@@ -67,3 +156,56 @@ func MockNetutilConnPeerCred(fn func(net.Conn) (*syscall.Ucred, error)) (restore
 		netutilConnPeerCred = orig
 	}
 }
+
+func MockTimeNow(fn func() time.Time) (restore func()) {
+	orig := timeNow
+	timeNow = fn
+	return func() {
+		timeNow = orig
+	}
+}
+
+func MockEventsProgressInterval(interval time.Duration) (restore func()) {
+	orig := eventsProgressInterval
+	eventsProgressInterval = interval
+	return func() {
+		eventsProgressInterval = orig
+	}
+}
+
+func MockReboot(fn func(boot.RebootAction, time.Duration, *boot.RebootInfo) error) (restore func()) {
+	orig := reboot
+	reboot = fn
+	return func() {
+		reboot = orig
+	}
+}
+
+func MockRebootWaitTimeouts(wait, retryWait time.Duration) (restore func()) {
+	origWait := rebootWaitTimeout
+	origRetryWait := rebootRetryWaitTimeout
+	rebootWaitTimeout = wait
+	rebootRetryWaitTimeout = retryWait
+	return func() {
+		rebootWaitTimeout = origWait
+		rebootRetryWaitTimeout = origRetryWait
+	}
+}
+
+func (d *Daemon) EventSubscribers() int {
+	d.events.mu.Lock()
+	defer d.events.mu.Unlock()
+	return len(d.events.subs)
+}
+
+func (d *Daemon) ConnTracker() *ConnTracker {
+	return d.connTracker
+}
+
+func (d *Daemon) Overlord() *overlord.Overlord {
+	return d.overlord
+}
+
+func (d *Daemon) Router() *mux.Router {
+	return d.router
+}
@@ -0,0 +1,97 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package efi implements the parts of the UEFI and TCG specifications
+// that are needed to predict the PCR values measured during boot.
+package efi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// GUID is an EFI GUID in its binary form.
+type GUID [16]byte
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+var (
+	// GlobalVariable is the vendor GUID of the SecureBoot, PK and KEK
+	// variables.
+	GlobalVariable = GUID{0x61, 0xdf, 0xe4, 0x8b, 0xca, 0x93, 0xd2, 0x11, 0xaa, 0x0d, 0x00, 0xe0, 0x98, 0x03, 0x2b, 0x8c}
+	// ImageSecurityDatabase is the vendor GUID of the db and dbx
+	// variables.
+	ImageSecurityDatabase = GUID{0xcb, 0xb2, 0x19, 0xd7, 0x3a, 0x3d, 0x96, 0x45, 0xa3, 0xbc, 0xda, 0xd0, 0x0e, 0x67, 0x65, 0x6f}
+)
+
+// VariableData is the UEFI_VARIABLE_DATA structure that describes a
+// measured EFI variable.
+type VariableData struct {
+	GUID GUID
+	Name string
+	Data []byte
+}
+
+const variableDataHeaderSize = 16 + 8 + 8
+
+// DecodeVariableData decodes the event data of an EFI variable
+// measurement.
+func DecodeVariableData(b []byte) (*VariableData, error) {
+	if len(b) < variableDataHeaderSize {
+		return nil, errors.New("variable data is too short")
+	}
+	v := &VariableData{}
+	copy(v.GUID[:], b[0:16])
+	nameLen := binary.LittleEndian.Uint64(b[16:24])
+	dataLen := binary.LittleEndian.Uint64(b[24:32])
+	rest := b[variableDataHeaderSize:]
+	if nameLen > uint64(len(rest))/2 || dataLen != uint64(len(rest))-nameLen*2 {
+		return nil, errors.New("variable data has invalid lengths")
+	}
+
+	name := make([]uint16, nameLen)
+	for i := range name {
+		name[i] = binary.LittleEndian.Uint16(rest[i*2:])
+	}
+	v.Name = string(utf16.Decode(name))
+	v.Data = append([]byte(nil), rest[nameLen*2:]...)
+	return v, nil
+}
+
+// Encode returns the UEFI_VARIABLE_DATA encoding of v, which is what
+// is measured for the variable.
+func (v *VariableData) Encode() []byte {
+	name := utf16.Encode([]rune(v.Name))
+	b := make([]byte, variableDataHeaderSize+len(name)*2, variableDataHeaderSize+len(name)*2+len(v.Data))
+	copy(b[0:16], v.GUID[:])
+	binary.LittleEndian.PutUint64(b[16:24], uint64(len(name)))
+	binary.LittleEndian.PutUint64(b[24:32], uint64(len(v.Data)))
+	for i, c := range name {
+		binary.LittleEndian.PutUint16(b[variableDataHeaderSize+i*2:], c)
+	}
+	return append(b, v.Data...)
+}
@@ -0,0 +1,62 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type efiSuite struct{}
+
+var _ = Suite(&efiSuite{})
+
+func (s *efiSuite) TestGUIDString(c *C) {
+	c.Check(efi.GlobalVariable.String(), Equals, "8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	c.Check(efi.ImageSecurityDatabase.String(), Equals, "d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+}
+
+func (s *efiSuite) TestVariableDataRoundTrip(c *C) {
+	v := &efi.VariableData{GUID: efi.ImageSecurityDatabase, Name: "dbx", Data: []byte("revoked")}
+	b := v.Encode()
+	c.Check(b[16:32], DeepEquals, []byte{3, 0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0})
+	c.Check(b[32:38], DeepEquals, []byte{'d', 0, 'b', 0, 'x', 0})
+
+	decoded, err := efi.DecodeVariableData(b)
+	c.Assert(err, IsNil)
+	c.Check(decoded, DeepEquals, v)
+}
+
+func (s *efiSuite) TestDecodeVariableDataErrors(c *C) {
+	_, err := efi.DecodeVariableData(make([]byte, 31))
+	c.Check(err, ErrorMatches, "variable data is too short")
+
+	b := (&efi.VariableData{GUID: efi.GlobalVariable, Name: "PK", Data: []byte("key")}).Encode()
+	_, err = efi.DecodeVariableData(b[:len(b)-1])
+	c.Check(err, ErrorMatches, "variable data has invalid lengths")
+	b[16] = 0xff
+	_, err = efi.DecodeVariableData(b)
+	c.Check(err, ErrorMatches, "variable data has invalid lengths")
+}
@@ -0,0 +1,232 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package efitest provides helpers to create EFI images and TCG event
+// logs for tests.
+package efitest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+)
+
+const (
+	imageHeadersSize = 0x200
+	imageAlignment   = 0x200
+)
+
+// NewImage returns a minimal PE32+ EFI application with a single
+// section that holds content.
+func NewImage(content []byte) []byte {
+	sectionSize := (len(content) + imageAlignment - 1) / imageAlignment * imageAlignment
+
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	binary.Write(&buf, binary.LittleEndian, &pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections:     1,
+		SizeOfOptionalHeader: uint16(binary.Size(pe.OptionalHeader64{})),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE | pe.IMAGE_FILE_LARGE_ADDRESS_AWARE,
+	})
+	binary.Write(&buf, binary.LittleEndian, &pe.OptionalHeader64{
+		Magic:               0x20b,
+		SizeOfCode:          uint32(sectionSize),
+		AddressOfEntryPoint: 0x1000,
+		BaseOfCode:          0x1000,
+		SectionAlignment:    0x1000,
+		FileAlignment:       imageAlignment,
+		SizeOfImage:         0x2000,
+		SizeOfHeaders:       imageHeadersSize,
+		CheckSum:            0x1234,
+		Subsystem:           pe.IMAGE_SUBSYSTEM_EFI_APPLICATION,
+		NumberOfRvaAndSizes: 16,
+	})
+	binary.Write(&buf, binary.LittleEndian, &pe.SectionHeader32{
+		Name:             [8]uint8{'.', 't', 'e', 'x', 't'},
+		VirtualSize:      uint32(len(content)),
+		VirtualAddress:   0x1000,
+		SizeOfRawData:    uint32(sectionSize),
+		PointerToRawData: imageHeadersSize,
+		Characteristics:  pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE | pe.IMAGE_SCN_MEM_READ,
+	})
+	buf.Write(make([]byte, imageHeadersSize-buf.Len()))
+
+	section := make([]byte, sectionSize)
+	copy(section, content)
+	buf.Write(section)
+	return buf.Bytes()
+}
+
+// LogParams describes the boot that is recorded in a log created by
+// NewLog.
+type LogParams struct {
+	// ImageDigests are the Authenticode digests of the images loaded
+	// by the boot manager.
+	ImageDigests [][]byte
+	// KernelCmdline is the kernel command line measured to PCR 12.
+	KernelCmdline string
+	// Variables are the contents of the secure boot configuration
+	// variables, keyed by name. Variables that are not set are
+	// measured as empty.
+	Variables map[string][]byte
+}
+
+// NewLog returns an event log that records a secure boot as measured
+// by the firmware, shim and the EFI stub of the kernel.
+func NewLog(params *LogParams) *efi.Log {
+	l := &efi.Log{}
+	add := func(pcr int, typ efi.EventType, data []byte) {
+		digest := sha256.Sum256(data)
+		l.Events = append(l.Events, &efi.Event{PCR: pcr, Type: typ, Digest: digest[:], Data: data})
+	}
+	separator := []byte{0, 0, 0, 0}
+
+	for _, v := range []struct {
+		name string
+		guid efi.GUID
+	}{
+		{"SecureBoot", efi.GlobalVariable},
+		{"PK", efi.GlobalVariable},
+		{"KEK", efi.GlobalVariable},
+		{"db", efi.ImageSecurityDatabase},
+		{"dbx", efi.ImageSecurityDatabase},
+	} {
+		data := (&efi.VariableData{GUID: v.guid, Name: v.name, Data: params.Variables[v.name]}).Encode()
+		add(7, efi.EventTypeEFIVariableDriverConfig, data)
+	}
+	add(7, efi.EventTypeSeparator, separator)
+
+	add(4, efi.EventTypeEFIAction, []byte("Calling EFI Application from Boot Option"))
+	add(4, efi.EventTypeSeparator, separator)
+	for _, digest := range params.ImageDigests {
+		l.Events = append(l.Events, &efi.Event{PCR: 4, Type: efi.EventTypeEFIBootServicesApplication, Digest: digest})
+	}
+
+	l.Events = append(l.Events, &efi.Event{
+		PCR:    12,
+		Type:   efi.EventTypeIPL,
+		Digest: efi.KernelCmdlineDigest(params.KernelCmdline),
+		Data:   []byte(params.KernelCmdline),
+	})
+
+	return l
+}
+
+// NewSignatureList returns an EFI_SIGNATURE_LIST of the specified type
+// that holds the supplied signatures, which must have the same size,
+// owned by owner.
+func NewSignatureList(typ, owner efi.GUID, sigs ...[]byte) []byte {
+	size := len(owner)
+	if len(sigs) > 0 {
+		size += len(sigs[0])
+	}
+	var buf bytes.Buffer
+	buf.Write(typ[:])
+	binary.Write(&buf, binary.LittleEndian, uint32(28+len(sigs)*size))
+	binary.Write(&buf, binary.LittleEndian, uint32(0))
+	binary.Write(&buf, binary.LittleEndian, uint32(size))
+	for _, sig := range sigs {
+		buf.Write(owner[:])
+		buf.Write(sig)
+	}
+	return buf.Bytes()
+}
+
+// NewAuthenticatedVariable returns the payload of a time based
+// authenticated write of data, with a dummy signature.
+func NewAuthenticatedVariable(data []byte) []byte {
+	sig := []byte("signature")
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xe7, 0x07, 10, 16, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	binary.Write(&buf, binary.LittleEndian, uint32(8+16+len(sig)))
+	binary.Write(&buf, binary.LittleEndian, uint16(0x0200))
+	binary.Write(&buf, binary.LittleEndian, uint16(0x0ef1))
+	buf.Write(efi.CertTypePKCS7[:])
+	buf.Write(sig)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// VariableStore is an efi.VariableWriter that stores variables in a
+// directory in the format used by efivarfs. Like the firmware, it
+// strips the authentication from authenticated writes, without
+// verifying it, and appends to signature databases.
+type VariableStore struct {
+	Dir string
+}
+
+// NewVariableStore returns a VariableStore that stores variables in
+// dir.
+func NewVariableStore(dir string) *VariableStore {
+	return &VariableStore{Dir: dir}
+}
+
+// WriteVariable implements efi.VariableWriter.WriteVariable.
+func (s *VariableStore) WriteVariable(name string, guid efi.GUID, attrs efi.VariableAttributes, data []byte) error {
+	if attrs&efi.AttributeTimeBasedAuthenticatedWriteAccess != 0 {
+		var err error
+		data, err = efi.StripVariableAuthentication(data)
+		if err != nil {
+			return err
+		}
+	}
+	if attrs&efi.AttributeAppendWrite != 0 {
+		_, current, err := s.Variable(name, guid)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		data, err = efi.AppendSignatureDatabase(current, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	b := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(b, uint32(attrs&^efi.AttributeAppendWrite))
+	return os.WriteFile(filepath.Join(s.Dir, efi.VariableFileName(name, guid)), append(b, data...), 0644)
+}
+
+// Variable returns the attributes and the contents of a variable in
+// the store.
+func (s *VariableStore) Variable(name string, guid efi.GUID) (efi.VariableAttributes, []byte, error) {
+	b, err := os.ReadFile(filepath.Join(s.Dir, efi.VariableFileName(name, guid)))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 4 {
+		return 0, nil, fmt.Errorf("variable %s has no attributes", name)
+	}
+	return efi.VariableAttributes(binary.LittleEndian.Uint32(b)), b[4:], nil
+}
@@ -0,0 +1,358 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"unicode/utf16"
+)
+
+// EventType is the type of an event in the TCG event log.
+type EventType uint32
+
+const (
+	EventTypeIPL                        EventType = 0x0000000d
+	EventTypeNoAction                   EventType = 0x00000003
+	EventTypeSeparator                  EventType = 0x00000004
+	EventTypeEFIVariableDriverConfig    EventType = 0x80000001
+	EventTypeEFIBootServicesApplication EventType = 0x80000003
+	EventTypeEFIAction                  EventType = 0x80000007
+	EventTypeEFIVariableAuthority       EventType = 0x800000e0
+)
+
+const (
+	algSHA256 = 0x000b
+
+	// maxEventSize bounds the size of the data of a single event to
+	// protect against corrupt logs.
+	maxEventSize = 1 << 20
+)
+
+var specIDEventSignature = []byte("Spec ID Event03\x00")
+
+// Event is a measurement recorded in the TCG event log. Only the
+// SHA-256 digest of the measurement is retained.
+type Event struct {
+	PCR    int
+	Type   EventType
+	Digest []byte
+	Data   []byte
+}
+
+// Log is a TCG event log in the crypto agile format.
+type Log struct {
+	Events []*Event
+}
+
+// ReadLog decodes a TCG event log in the crypto agile format, as
+// exposed by the kernel in binary_bios_measurements.
+func ReadLog(r io.Reader) (*Log, error) {
+	var hdr struct {
+		PCR    uint32
+		Type   uint32
+		Digest [20]byte
+		Size   uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("cannot read spec ID event: %v", err)
+	}
+	if EventType(hdr.Type) != EventTypeNoAction || hdr.Size > maxEventSize {
+		return nil, errors.New("event log is not in the crypto agile format")
+	}
+	data := make([]byte, hdr.Size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("cannot read spec ID event: %v", err)
+	}
+	digestSizes, err := decodeSpecIDEvent(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := digestSizes[algSHA256]; !ok {
+		return nil, errors.New("event log has no SHA-256 digests")
+	}
+
+	l := &Log{}
+	for {
+		n := len(l.Events)
+		var evHdr struct {
+			PCR   uint32
+			Type  uint32
+			Count uint32
+		}
+		err := binary.Read(r, binary.LittleEndian, &evHdr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read event %d: %v", n, err)
+		}
+		if int(evHdr.Count) > len(digestSizes) {
+			return nil, fmt.Errorf("event %d has too many digests", n)
+		}
+
+		ev := &Event{PCR: int(evHdr.PCR), Type: EventType(evHdr.Type)}
+		for i := uint32(0); i < evHdr.Count; i++ {
+			var alg uint16
+			if err := binary.Read(r, binary.LittleEndian, &alg); err != nil {
+				return nil, fmt.Errorf("cannot read event %d: %v", n, err)
+			}
+			size, ok := digestSizes[alg]
+			if !ok {
+				return nil, fmt.Errorf("event %d has digest with unknown algorithm %#04x", n, alg)
+			}
+			digest := make([]byte, size)
+			if _, err := io.ReadFull(r, digest); err != nil {
+				return nil, fmt.Errorf("cannot read event %d: %v", n, err)
+			}
+			if alg == algSHA256 {
+				ev.Digest = digest
+			}
+		}
+		if ev.Digest == nil {
+			return nil, fmt.Errorf("event %d has no SHA-256 digest", n)
+		}
+
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, fmt.Errorf("cannot read event %d: %v", n, err)
+		}
+		if size > maxEventSize {
+			return nil, fmt.Errorf("event %d is too large", n)
+		}
+		if size > 0 {
+			ev.Data = make([]byte, size)
+			if _, err := io.ReadFull(r, ev.Data); err != nil {
+				return nil, fmt.Errorf("cannot read event %d: %v", n, err)
+			}
+		}
+		l.Events = append(l.Events, ev)
+	}
+	return l, nil
+}
+
+// ReadLogFile decodes the TCG event log in the specified file.
+func ReadLogFile(path string) (*Log, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadLog(f)
+}
+
+// decodeSpecIDEvent returns the digest sizes of the algorithms listed
+// in the spec ID event, keyed by algorithm.
+func decodeSpecIDEvent(data []byte) (map[uint16]int, error) {
+	// signature, platform class, version, errata, uintn size and
+	// the number of algorithms
+	const fixedSize = 16 + 4 + 4 + 4
+	if len(data) < fixedSize || !bytes.Equal(data[:16], specIDEventSignature) {
+		return nil, errors.New("event log is not in the crypto agile format")
+	}
+	count := binary.LittleEndian.Uint32(data[24:28])
+	data = data[fixedSize:]
+	if uint64(count)*4 > uint64(len(data)) {
+		return nil, errors.New("invalid spec ID event")
+	}
+
+	sizes := make(map[uint16]int, count)
+	for i := uint32(0); i < count; i++ {
+		alg := binary.LittleEndian.Uint16(data[i*4:])
+		sizes[alg] = int(binary.LittleEndian.Uint16(data[i*4+2:]))
+	}
+	return sizes, nil
+}
+
+// Write encodes the log in the crypto agile format with only the
+// SHA-256 bank.
+func (l *Log) Write(w io.Writer) error {
+	specID := make([]byte, 0, 16+4+4+4+4+1)
+	specID = append(specID, specIDEventSignature...)
+	// platform class, version 2.0 errata 0 and 8 byte UINTN
+	specID = append(specID, 0, 0, 0, 0, 0, 2, 0, 2)
+	specID = append(specID, 1, 0, 0, 0, algSHA256, 0, sha256.Size, 0)
+	// no vendor info
+	specID = append(specID, 0)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, struct {
+		PCR    uint32
+		Type   uint32
+		Digest [20]byte
+		Size   uint32
+	}{Type: uint32(EventTypeNoAction), Size: uint32(len(specID))})
+	buf.Write(specID)
+
+	for _, ev := range l.Events {
+		if len(ev.Digest) != sha256.Size {
+			return fmt.Errorf("event has invalid SHA-256 digest size %d", len(ev.Digest))
+		}
+		binary.Write(&buf, binary.LittleEndian, []uint32{uint32(ev.PCR), uint32(ev.Type), 1})
+		binary.Write(&buf, binary.LittleEndian, uint16(algSHA256))
+		buf.Write(ev.Digest)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(ev.Data)))
+		buf.Write(ev.Data)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// SecureBootVariables returns the contents of the secure boot
+// configuration variables measured to PCR 7, keyed by name.
+func (l *Log) SecureBootVariables() (map[string][]byte, error) {
+	vars := make(map[string][]byte)
+	for _, ev := range l.Events {
+		if ev.PCR != 7 || ev.Type != EventTypeEFIVariableDriverConfig {
+			continue
+		}
+		v, err := DecodeVariableData(ev.Data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode secure boot variable event: %v", err)
+		}
+		vars[v.Name] = v.Data
+	}
+	return vars, nil
+}
+
+// ReplayParams describes the changes to the boot configuration that
+// are applied when replaying the event log.
+type ReplayParams struct {
+	// ImageDigests are the Authenticode digests of the EFI images
+	// loaded by the boot manager, in the order that they are
+	// loaded. If not nil, they replace the images recorded in the
+	// log.
+	ImageDigests [][]byte
+
+	// KernelCmdline, if not nil, replaces the kernel command line
+	// measured to PCR 12 by the EFI stub of the kernel.
+	KernelCmdline *string
+
+	// Variables replace the contents of the secure boot
+	// configuration variables measured to PCR 7, keyed by name.
+	// Changes to the authorities that verify the images are not
+	// predicted.
+	Variables map[string][]byte
+}
+
+// KernelCmdlineDigest returns the digest that the EFI stub of the
+// kernel measures for the kernel command line, which is the UTF-16
+// encoding of the command line including the terminating NUL.
+func KernelCmdlineDigest(cmdline string) []byte {
+	encoded := utf16.Encode([]rune(cmdline + "\x00"))
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, encoded)
+	return h.Sum(nil)
+}
+
+// Replay returns the values of the specified PCRs that result from
+// replaying the SHA-256 bank of the log with params applied.
+func (l *Log) Replay(pcrs []int, params *ReplayParams) (map[int][]byte, error) {
+	if params == nil {
+		params = &ReplayParams{}
+	}
+
+	measurements := make(map[int][][]byte)
+	// the position in PCR 4 after the last recorded image
+	imagesEnd := -1
+	images := 0
+	cmdlineMeasured := false
+	varsMeasured := make(map[string]bool)
+	for _, ev := range l.Events {
+		if ev.Type == EventTypeNoAction {
+			continue
+		}
+		digest := ev.Digest
+		switch {
+		case ev.PCR == 4 && ev.Type == EventTypeEFIBootServicesApplication && params.ImageDigests != nil:
+			images++
+			if images > len(params.ImageDigests) {
+				// the image is not loaded anymore
+				continue
+			}
+			digest = params.ImageDigests[images-1]
+		case ev.PCR == 7 && ev.Type == EventTypeEFIVariableDriverConfig && params.Variables != nil:
+			v, err := DecodeVariableData(ev.Data)
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode secure boot variable event: %v", err)
+			}
+			data, ok := params.Variables[v.Name]
+			if !ok {
+				break
+			}
+			v.Data = data
+			h := sha256.Sum256(v.Encode())
+			digest = h[:]
+			varsMeasured[v.Name] = true
+		case ev.PCR == 12 && ev.Type == EventTypeIPL && params.KernelCmdline != nil && !cmdlineMeasured:
+			digest = KernelCmdlineDigest(*params.KernelCmdline)
+			cmdlineMeasured = true
+		}
+		measurements[ev.PCR] = append(measurements[ev.PCR], digest)
+		if ev.PCR == 4 && ev.Type == EventTypeEFIBootServicesApplication {
+			imagesEnd = len(measurements[4])
+		}
+	}
+
+	var names []string
+	for name := range params.Variables {
+		if !varsMeasured[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return nil, fmt.Errorf("secure boot variable %q is not measured in the event log", names[0])
+	}
+
+	// images that are not recorded in the log are loaded after the
+	// last recorded one
+	if images < len(params.ImageDigests) {
+		if imagesEnd < 0 {
+			imagesEnd = len(measurements[4])
+		}
+		extra := params.ImageDigests[images:]
+		pcr4 := append([][]byte(nil), measurements[4][:imagesEnd]...)
+		pcr4 = append(pcr4, extra...)
+		measurements[4] = append(pcr4, measurements[4][imagesEnd:]...)
+	}
+	if params.KernelCmdline != nil && !cmdlineMeasured {
+		measurements[12] = append(measurements[12], KernelCmdlineDigest(*params.KernelCmdline))
+	}
+
+	values := make(map[int][]byte, len(pcrs))
+	for _, pcr := range pcrs {
+		value := make([]byte, sha256.Size)
+		for _, digest := range measurements[pcr] {
+			h := sha256.New()
+			h.Write(value)
+			h.Write(digest)
+			value = h.Sum(nil)
+		}
+		values[pcr] = value
+	}
+	return values, nil
+}
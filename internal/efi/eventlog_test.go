@@ -0,0 +1,196 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/efi/efitest"
+)
+
+type eventLogSuite struct {
+	log *efi.Log
+}
+
+var _ = Suite(&eventLogSuite{})
+
+func digest(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+func (s *eventLogSuite) SetUpTest(c *C) {
+	s.log = efitest.NewLog(&efitest.LogParams{
+		ImageDigests:  [][]byte{digest("shim"), digest("grub"), digest("kernel")},
+		KernelCmdline: "snapd_recovery_mode=run console=ttyS0",
+		Variables: map[string][]byte{
+			"SecureBoot": {1},
+			"db":         []byte("db"),
+			"dbx":        []byte("dbx"),
+		},
+	})
+}
+
+// extend returns the PCR value that results from extending the
+// supplied digests.
+func extend(digests ...[]byte) []byte {
+	value := make([]byte, sha256.Size)
+	for _, d := range digests {
+		h := sha256.Sum256(append(value, d...))
+		value = h[:]
+	}
+	return value
+}
+
+// recorded returns the digests recorded in the log for a PCR.
+func (s *eventLogSuite) recorded(pcr int) [][]byte {
+	var digests [][]byte
+	for _, ev := range s.log.Events {
+		if ev.PCR == pcr {
+			digests = append(digests, ev.Digest)
+		}
+	}
+	return digests
+}
+
+func (s *eventLogSuite) TestReadWriteRoundTrip(c *C) {
+	var buf bytes.Buffer
+	c.Assert(s.log.Write(&buf), IsNil)
+
+	path := filepath.Join(c.MkDir(), "binary_bios_measurements")
+	c.Assert(os.WriteFile(path, buf.Bytes(), 0644), IsNil)
+	l, err := efi.ReadLogFile(path)
+	c.Assert(err, IsNil)
+	c.Check(l, DeepEquals, s.log)
+}
+
+func (s *eventLogSuite) TestReadLogErrors(c *C) {
+	var buf bytes.Buffer
+	c.Assert(s.log.Write(&buf), IsNil)
+	b := buf.Bytes()
+
+	_, err := efi.ReadLog(bytes.NewReader(nil))
+	c.Check(err, ErrorMatches, "cannot read spec ID event: EOF")
+
+	_, err = efi.ReadLog(bytes.NewReader(b[:len(b)-1]))
+	c.Check(err, ErrorMatches, "cannot read event 11: unexpected EOF")
+
+	corrupt := append([]byte(nil), b...)
+	// the event type of the spec ID event
+	corrupt[4] = 1
+	_, err = efi.ReadLog(bytes.NewReader(corrupt))
+	c.Check(err, ErrorMatches, "event log is not in the crypto agile format")
+
+	corrupt = append([]byte(nil), b...)
+	// the signature of the spec ID event
+	corrupt[32] = 'X'
+	_, err = efi.ReadLog(bytes.NewReader(corrupt))
+	c.Check(err, ErrorMatches, "event log is not in the crypto agile format")
+
+	corrupt = append([]byte(nil), b...)
+	// the algorithm of the only bank
+	corrupt[32+28] = 0x04
+	_, err = efi.ReadLog(bytes.NewReader(corrupt))
+	c.Check(err, ErrorMatches, "event log has no SHA-256 digests")
+}
+
+func (s *eventLogSuite) TestSecureBootVariables(c *C) {
+	vars, err := s.log.SecureBootVariables()
+	c.Assert(err, IsNil)
+	c.Check(vars, DeepEquals, map[string][]byte{
+		"SecureBoot": {1},
+		"PK":         nil,
+		"KEK":        nil,
+		"db":         []byte("db"),
+		"dbx":        []byte("dbx"),
+	})
+}
+
+func (s *eventLogSuite) TestReplayAsRecorded(c *C) {
+	values, err := s.log.Replay([]int{4, 7, 12}, nil)
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, map[int][]byte{
+		4:  extend(s.recorded(4)...),
+		7:  extend(s.recorded(7)...),
+		12: extend(s.recorded(12)...),
+	})
+	c.Check(values[12], DeepEquals, extend(efi.KernelCmdlineDigest("snapd_recovery_mode=run console=ttyS0")))
+}
+
+func (s *eventLogSuite) TestReplayImages(c *C) {
+	pcr4 := s.recorded(4)
+
+	values, err := s.log.Replay([]int{4}, &efi.ReplayParams{
+		ImageDigests: [][]byte{digest("shim"), digest("grub"), digest("new-kernel")},
+	})
+	c.Assert(err, IsNil)
+	c.Check(values[4], DeepEquals, extend(pcr4[0], pcr4[1], digest("shim"), digest("grub"), digest("new-kernel")))
+
+	// images that were not loaded during the current boot
+	values, err = s.log.Replay([]int{4}, &efi.ReplayParams{
+		ImageDigests: [][]byte{digest("shim"), digest("grub"), digest("kernel"), digest("extra")},
+	})
+	c.Assert(err, IsNil)
+	c.Check(values[4], DeepEquals, extend(append(pcr4, digest("extra"))...))
+
+	// images that are no longer loaded
+	values, err = s.log.Replay([]int{4}, &efi.ReplayParams{
+		ImageDigests: [][]byte{digest("shim"), digest("kernel")},
+	})
+	c.Assert(err, IsNil)
+	c.Check(values[4], DeepEquals, extend(pcr4[0], pcr4[1], digest("shim"), digest("kernel")))
+}
+
+func (s *eventLogSuite) TestReplayKernelCmdline(c *C) {
+	cmdline := "snapd_recovery_mode=recover console=ttyS0"
+	values, err := s.log.Replay([]int{4, 12}, &efi.ReplayParams{KernelCmdline: &cmdline})
+	c.Assert(err, IsNil)
+	c.Check(values[4], DeepEquals, extend(s.recorded(4)...))
+	c.Check(values[12], DeepEquals, extend(efi.KernelCmdlineDigest(cmdline)))
+
+	// the kernel command line is measured even if it wasn't during
+	// the current boot
+	s.log.Events = s.log.Events[:len(s.log.Events)-1]
+	values, err = s.log.Replay([]int{12}, &efi.ReplayParams{KernelCmdline: &cmdline})
+	c.Assert(err, IsNil)
+	c.Check(values[12], DeepEquals, extend(efi.KernelCmdlineDigest(cmdline)))
+}
+
+func (s *eventLogSuite) TestReplayVariables(c *C) {
+	pcr7 := s.recorded(7)
+	newDBX := (&efi.VariableData{GUID: efi.ImageSecurityDatabase, Name: "dbx", Data: []byte("new-dbx")}).Encode()
+
+	values, err := s.log.Replay([]int{7}, &efi.ReplayParams{
+		Variables: map[string][]byte{"dbx": []byte("new-dbx")},
+	})
+	c.Assert(err, IsNil)
+	c.Check(values[7], DeepEquals, extend(pcr7[0], pcr7[1], pcr7[2], pcr7[3], digest(string(newDBX)), pcr7[5]))
+
+	_, err = s.log.Replay([]int{7}, &efi.ReplayParams{
+		Variables: map[string][]byte{"dbt": []byte("dbt"), "dbr": []byte("dbr")},
+	})
+	c.Check(err, ErrorMatches, `secure boot variable "dbr" is not measured in the event log`)
+}
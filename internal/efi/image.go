@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"crypto/sha256"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// certificateTableIndex is the index of the data directory entry
+// that locates the signatures of an image.
+const certificateTableIndex = 4
+
+// ImageDigest returns the SHA-256 Authenticode digest of the PE image
+// in the specified file, which is what the firmware and shim measure
+// to PCR 4 when loading the image.
+func ImageDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return imageDigest(f, fi.Size())
+}
+
+func imageDigest(r io.ReaderAt, size int64) ([]byte, error) {
+	img, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode PE image: %v", err)
+	}
+
+	var peOffset [4]byte
+	if _, err := r.ReadAt(peOffset[:], 0x3c); err != nil {
+		return nil, fmt.Errorf("cannot decode PE image: %v", err)
+	}
+	// the optional header follows the signature and the file header
+	optOffset := int64(binary.LittleEndian.Uint32(peOffset[:])) + 4 + 20
+
+	var (
+		headersSize uint32
+		dirsOffset  int64
+		numDirs     uint32
+		certTable   pe.DataDirectory
+	)
+	switch oh := img.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		headersSize = oh.SizeOfHeaders
+		dirsOffset = optOffset + 96
+		numDirs = oh.NumberOfRvaAndSizes
+		if numDirs > certificateTableIndex {
+			certTable = oh.DataDirectory[certificateTableIndex]
+		}
+	case *pe.OptionalHeader64:
+		headersSize = oh.SizeOfHeaders
+		dirsOffset = optOffset + 112
+		numDirs = oh.NumberOfRvaAndSizes
+		if numDirs > certificateTableIndex {
+			certTable = oh.DataDirectory[certificateTableIndex]
+		}
+	default:
+		return nil, errors.New("PE image has no optional header")
+	}
+
+	h := sha256.New()
+	hashRange := func(start, end int64) error {
+		if start > end || end > size {
+			return errors.New("PE image is truncated")
+		}
+		_, err := io.Copy(h, io.NewSectionReader(r, start, end-start))
+		return err
+	}
+
+	// the headers are hashed without the checksum and the entry of
+	// the certificate table
+	checksumOffset := optOffset + 64
+	ranges := [][2]int64{{0, checksumOffset}}
+	if numDirs > certificateTableIndex {
+		certEntryOffset := dirsOffset + certificateTableIndex*8
+		ranges = append(ranges, [2]int64{checksumOffset + 4, certEntryOffset}, [2]int64{certEntryOffset + 8, int64(headersSize)})
+	} else {
+		ranges = append(ranges, [2]int64{checksumOffset + 4, int64(headersSize)})
+	}
+	for _, rng := range ranges {
+		if err := hashRange(rng[0], rng[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	sections := append([]*pe.Section(nil), img.Sections...)
+	sort.Slice(sections, func(i, j int) bool {
+		return sections[i].Offset < sections[j].Offset
+	})
+	hashed := int64(headersSize)
+	for _, s := range sections {
+		if s.Size == 0 {
+			continue
+		}
+		start := int64(s.Offset)
+		if err := hashRange(start, start+int64(s.Size)); err != nil {
+			return nil, err
+		}
+		hashed += int64(s.Size)
+	}
+
+	// any data following the sections, except for the signatures
+	if end := size - int64(certTable.Size); hashed < end {
+		if err := hashRange(hashed, end); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
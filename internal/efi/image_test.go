@@ -0,0 +1,87 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/efi/efitest"
+)
+
+type imageSuite struct{}
+
+var _ = Suite(&imageSuite{})
+
+func (s *imageSuite) writeImage(c *C, img []byte) string {
+	path := filepath.Join(c.MkDir(), "image.efi")
+	c.Assert(os.WriteFile(path, img, 0644), IsNil)
+	return path
+}
+
+func (s *imageSuite) TestImageDigest(c *C) {
+	img := efitest.NewImage([]byte("kernel"))
+	d1, err := efi.ImageDigest(s.writeImage(c, img))
+	c.Assert(err, IsNil)
+	c.Check(d1, HasLen, 32)
+
+	other, err := efi.ImageDigest(s.writeImage(c, efitest.NewImage([]byte("other kernel"))))
+	c.Assert(err, IsNil)
+	c.Check(other, Not(DeepEquals), d1)
+
+	// the checksum is not part of the digest
+	const checksumOffset = 0x40 + 4 + 20 + 64
+	changed := append([]byte(nil), img...)
+	binary.LittleEndian.PutUint32(changed[checksumOffset:], 0xdeadbeef)
+	d2, err := efi.ImageDigest(s.writeImage(c, changed))
+	c.Assert(err, IsNil)
+	c.Check(d2, DeepEquals, d1)
+
+	// and neither are the signatures
+	const certEntryOffset = 0x40 + 4 + 20 + 112 + 4*8
+	signed := append(append([]byte(nil), img...), []byte("signature")...)
+	binary.LittleEndian.PutUint32(signed[certEntryOffset:], uint32(len(img)))
+	binary.LittleEndian.PutUint32(signed[certEntryOffset+4:], uint32(len("signature")))
+	d3, err := efi.ImageDigest(s.writeImage(c, signed))
+	c.Assert(err, IsNil)
+	c.Check(d3, DeepEquals, d1)
+
+	// but trailing data that isn't a signature is
+	trailing := append(append([]byte(nil), img...), []byte("trailing")...)
+	d4, err := efi.ImageDigest(s.writeImage(c, trailing))
+	c.Assert(err, IsNil)
+	c.Check(d4, Not(DeepEquals), d1)
+}
+
+func (s *imageSuite) TestImageDigestErrors(c *C) {
+	_, err := efi.ImageDigest(filepath.Join(c.MkDir(), "missing.efi"))
+	c.Check(err, ErrorMatches, ".*: no such file or directory")
+
+	_, err = efi.ImageDigest(s.writeImage(c, []byte("not an image")))
+	c.Check(err, ErrorMatches, "cannot decode PE image: .*")
+
+	img := efitest.NewImage([]byte("kernel"))
+	_, err = efi.ImageDigest(s.writeImage(c, img[:len(img)-1]))
+	c.Check(err, ErrorMatches, "PE image is truncated")
+}
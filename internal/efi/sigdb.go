@@ -0,0 +1,170 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// CertSHA256 is the signature type of signature lists that hold
+	// SHA-256 digests of images.
+	CertSHA256 = GUID{0x26, 0x16, 0xc4, 0xc1, 0x4c, 0x50, 0x92, 0x40, 0xac, 0xa9, 0x41, 0xf9, 0x36, 0x93, 0x43, 0x28}
+	// CertTypePKCS7 is the certificate type of the signature that
+	// authenticates a write of a secure boot variable.
+	CertTypePKCS7 = GUID{0x9d, 0xd2, 0xaf, 0x4a, 0xdf, 0x68, 0xee, 0x49, 0x8a, 0xa9, 0x34, 0x7d, 0x37, 0x56, 0x65, 0xa7}
+)
+
+const (
+	// the size of the EFI_TIME that starts EFI_VARIABLE_AUTHENTICATION_2.
+	efiTimeSize = 16
+	// the size of the WIN_CERTIFICATE header, without the GUID of
+	// WIN_CERTIFICATE_UEFI_GUID.
+	winCertificateHeaderSize  = 8
+	winCertificateTypeEFIGUID = 0x0ef1
+
+	signatureListHeaderSize = 16 + 4 + 4 + 4
+)
+
+// StripVariableAuthentication returns the variable data of a time
+// based authenticated write of an EFI variable, which is preceded by
+// an EFI_VARIABLE_AUTHENTICATION_2 structure. The authentication is
+// not verified, which is left to the firmware.
+func StripVariableAuthentication(payload []byte) ([]byte, error) {
+	if len(payload) < efiTimeSize+winCertificateHeaderSize+len(GUID{}) {
+		return nil, errors.New("authentication header is truncated")
+	}
+	cert := payload[efiTimeSize:]
+	length := binary.LittleEndian.Uint32(cert[0:4])
+	certType := binary.LittleEndian.Uint16(cert[6:8])
+	if certType != winCertificateTypeEFIGUID {
+		return nil, fmt.Errorf("unexpected certificate type %#04x", certType)
+	}
+	if length < winCertificateHeaderSize+uint32(len(GUID{})) || uint64(length) > uint64(len(cert)) {
+		return nil, errors.New("authentication header has invalid length")
+	}
+	return cert[length:], nil
+}
+
+// signatureList is an EFI_SIGNATURE_LIST. Each signature includes the
+// GUID of its owner.
+type signatureList struct {
+	Type          GUID
+	Header        []byte
+	SignatureSize uint32
+	Signatures    [][]byte
+}
+
+func (l *signatureList) contains(sig []byte) bool {
+	for _, s := range l.Signatures {
+		if bytes.Equal(s, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSignatureDatabase(b []byte) ([]*signatureList, error) {
+	var db []*signatureList
+	for len(b) > 0 {
+		if len(b) < signatureListHeaderSize {
+			return nil, fmt.Errorf("signature list %d is truncated", len(db))
+		}
+		l := &signatureList{}
+		copy(l.Type[:], b[0:16])
+		listSize := binary.LittleEndian.Uint32(b[16:20])
+		headerSize := binary.LittleEndian.Uint32(b[20:24])
+		sigSize := binary.LittleEndian.Uint32(b[24:28])
+		l.SignatureSize = sigSize
+		if uint64(listSize) > uint64(len(b)) || uint64(listSize) < signatureListHeaderSize+uint64(headerSize) {
+			return nil, fmt.Errorf("signature list %d has invalid size", len(db))
+		}
+		sigs := b[signatureListHeaderSize+headerSize : listSize]
+		if sigSize <= uint32(len(GUID{})) || uint32(len(sigs))%sigSize != 0 {
+			return nil, fmt.Errorf("signature list %d has invalid signature size", len(db))
+		}
+		l.Header = b[signatureListHeaderSize : signatureListHeaderSize+headerSize]
+		for len(sigs) > 0 {
+			l.Signatures = append(l.Signatures, sigs[:sigSize])
+			sigs = sigs[sigSize:]
+		}
+		db = append(db, l)
+		b = b[listSize:]
+	}
+	return db, nil
+}
+
+func encodeSignatureDatabase(db []*signatureList) []byte {
+	var buf bytes.Buffer
+	for _, l := range db {
+		var hdr [signatureListHeaderSize]byte
+		copy(hdr[0:16], l.Type[:])
+		size := signatureListHeaderSize + len(l.Header) + len(l.Signatures)*int(l.SignatureSize)
+		binary.LittleEndian.PutUint32(hdr[16:20], uint32(size))
+		binary.LittleEndian.PutUint32(hdr[20:24], uint32(len(l.Header)))
+		binary.LittleEndian.PutUint32(hdr[24:28], l.SignatureSize)
+		buf.Write(hdr[:])
+		buf.Write(l.Header)
+		for _, sig := range l.Signatures {
+			buf.Write(sig)
+		}
+	}
+	return buf.Bytes()
+}
+
+// AppendSignatureDatabase returns the contents of the signature
+// database current after appending the signature lists in update, as
+// the firmware does for a write with AttributeAppendWrite. Signatures
+// that are already in the database are not appended again, and lists
+// with no signatures left are dropped.
+func AppendSignatureDatabase(current, update []byte) ([]byte, error) {
+	db, err := decodeSignatureDatabase(current)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode signature database: %v", err)
+	}
+	lists, err := decodeSignatureDatabase(update)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode signature database update: %v", err)
+	}
+
+	appended := db
+	for _, l := range lists {
+		filtered := &signatureList{Type: l.Type, Header: l.Header, SignatureSize: l.SignatureSize}
+		for _, sig := range l.Signatures {
+			found := false
+			for _, existing := range db {
+				if existing.Type == l.Type && existing.SignatureSize == l.SignatureSize && existing.contains(sig) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				filtered.Signatures = append(filtered.Signatures, sig)
+			}
+		}
+		if len(filtered.Signatures) > 0 {
+			appended = append(appended, filtered)
+		}
+	}
+	return encodeSignatureDatabase(appended), nil
+}
@@ -0,0 +1,111 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/efi/efitest"
+)
+
+type sigdbSuite struct{}
+
+var _ = Suite(&sigdbSuite{})
+
+var testOwner = efi.GUID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+func sha256Sig(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+func (s *sigdbSuite) TestStripVariableAuthentication(c *C) {
+	data := efitest.NewSignatureList(efi.CertSHA256, testOwner, sha256Sig("a"))
+	stripped, err := efi.StripVariableAuthentication(efitest.NewAuthenticatedVariable(data))
+	c.Assert(err, IsNil)
+	c.Check(stripped, DeepEquals, data)
+}
+
+func (s *sigdbSuite) TestStripVariableAuthenticationErrors(c *C) {
+	payload := efitest.NewAuthenticatedVariable(nil)
+
+	_, err := efi.StripVariableAuthentication(payload[:30])
+	c.Check(err, ErrorMatches, "authentication header is truncated")
+
+	wrongType := append([]byte(nil), payload...)
+	binary.LittleEndian.PutUint16(wrongType[22:], 0x0002)
+	_, err = efi.StripVariableAuthentication(wrongType)
+	c.Check(err, ErrorMatches, "unexpected certificate type 0x0002")
+
+	tooLong := append([]byte(nil), payload...)
+	binary.LittleEndian.PutUint32(tooLong[16:], uint32(len(payload)))
+	_, err = efi.StripVariableAuthentication(tooLong)
+	c.Check(err, ErrorMatches, "authentication header has invalid length")
+}
+
+func (s *sigdbSuite) TestAppendSignatureDatabase(c *C) {
+	current := efitest.NewSignatureList(efi.CertSHA256, testOwner, sha256Sig("a"), sha256Sig("b"))
+
+	// new signatures are appended in a list of their own
+	update := efitest.NewSignatureList(efi.CertSHA256, testOwner, sha256Sig("b"), sha256Sig("c"))
+	appended, err := efi.AppendSignatureDatabase(current, update)
+	c.Assert(err, IsNil)
+	expected := append(append([]byte(nil), current...), efitest.NewSignatureList(efi.CertSHA256, testOwner, sha256Sig("c"))...)
+	c.Check(appended, DeepEquals, expected)
+
+	// appending the same update again changes nothing
+	again, err := efi.AppendSignatureDatabase(appended, update)
+	c.Assert(err, IsNil)
+	c.Check(again, DeepEquals, appended)
+
+	// signatures with a different owner are different signatures
+	other := efi.GUID{0xff}
+	appended, err = efi.AppendSignatureDatabase(current, efitest.NewSignatureList(efi.CertSHA256, other, sha256Sig("a")))
+	c.Assert(err, IsNil)
+	c.Check(appended, HasLen, len(current)+28+16+32)
+
+	// an empty database is appended to
+	appended, err = efi.AppendSignatureDatabase(nil, update)
+	c.Assert(err, IsNil)
+	c.Check(appended, DeepEquals, update)
+}
+
+func (s *sigdbSuite) TestAppendSignatureDatabaseErrors(c *C) {
+	valid := efitest.NewSignatureList(efi.CertSHA256, testOwner, sha256Sig("a"))
+
+	_, err := efi.AppendSignatureDatabase(valid[:20], valid)
+	c.Check(err, ErrorMatches, "cannot decode signature database: signature list 0 is truncated")
+
+	_, err = efi.AppendSignatureDatabase(valid, append(append([]byte(nil), valid...), valid[:40]...))
+	c.Check(err, ErrorMatches, "cannot decode signature database update: signature list 1 has invalid size")
+
+	badSigSize := append([]byte(nil), valid...)
+	binary.LittleEndian.PutUint32(badSigSize[24:], 20)
+	_, err = efi.AppendSignatureDatabase(nil, badSigSize)
+	c.Check(err, ErrorMatches, "cannot decode signature database update: signature list 0 has invalid signature size")
+
+	_, err = efi.AppendSignatureDatabase(nil, bytes.Repeat([]byte{0}, 28))
+	c.Check(err, ErrorMatches, "cannot decode signature database update: signature list 0 has invalid size")
+}
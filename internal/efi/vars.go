@@ -0,0 +1,133 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// VariableAttributes are the attributes of an EFI variable.
+type VariableAttributes uint32
+
+const (
+	AttributeNonVolatile                       VariableAttributes = 0x00000001
+	AttributeBootserviceAccess                 VariableAttributes = 0x00000002
+	AttributeRuntimeAccess                     VariableAttributes = 0x00000004
+	AttributeTimeBasedAuthenticatedWriteAccess VariableAttributes = 0x00000020
+	AttributeAppendWrite                       VariableAttributes = 0x00000040
+)
+
+// VariableWriter writes EFI variables.
+type VariableWriter interface {
+	// WriteVariable writes data to the named variable with the
+	// specified attributes. For authenticated writes, data is the
+	// payload including the authentication header.
+	WriteVariable(name string, guid GUID, attrs VariableAttributes, data []byte) error
+}
+
+// VariableFileName returns the name of the file that represents an
+// EFI variable in efivarfs.
+func VariableFileName(name string, guid GUID) string {
+	return fmt.Sprintf("%s-%s", name, guid)
+}
+
+// fsImmutableFl is FS_IMMUTABLE_FL, which efivarfs sets on variables
+// that are not known to be safe to modify.
+const fsImmutableFl = 0x00000010
+
+type varfsWriter struct {
+	dir string
+}
+
+// NewVarfsWriter returns a VariableWriter that writes variables using
+// the efivarfs filesystem mounted at dir.
+func NewVarfsWriter(dir string) VariableWriter {
+	return &varfsWriter{dir: dir}
+}
+
+func (w *varfsWriter) WriteVariable(name string, guid GUID, attrs VariableAttributes, data []byte) error {
+	path := filepath.Join(w.dir, VariableFileName(name, guid))
+
+	restore, err := makeMutable(path)
+	if err != nil {
+		return fmt.Errorf("cannot make %s mutable: %v", path, err)
+	}
+	defer restore()
+
+	// efivarfs applies appended writes according to the attributes
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	// efivarfs requires the attributes and the data to be written
+	// at once
+	b := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(b, uint32(attrs))
+	b = append(b, data...)
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// makeMutable clears the immutable flag of an existing file and
+// returns a function that sets it again.
+func makeMutable(path string) (restore func(), err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP) {
+		// the filesystem doesn't support flags
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("ioctl", err)
+	}
+	if flags&fsImmutableFl == 0 {
+		return func() {}, nil
+	}
+	if err := unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags&^fsImmutableFl)); err != nil {
+		return nil, os.NewSyscallError("ioctl", err)
+	}
+
+	return func() {
+		f, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags))
+	}, nil
+}
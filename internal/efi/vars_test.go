@@ -0,0 +1,59 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+)
+
+type varsSuite struct{}
+
+var _ = Suite(&varsSuite{})
+
+func (s *varsSuite) TestVariableFileName(c *C) {
+	c.Check(efi.VariableFileName("dbx", efi.ImageSecurityDatabase), Equals, "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+}
+
+func (s *varsSuite) TestVarfsWriter(c *C) {
+	dir := c.MkDir()
+	w := efi.NewVarfsWriter(dir)
+
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+	c.Assert(w.WriteVariable("Test", efi.GlobalVariable, attrs, []byte("data")), IsNil)
+
+	path := filepath.Join(dir, "Test-8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	c.Check(path, testutil.FileEquals, "\x07\x00\x00\x00data")
+
+	// the attributes and the data of every write are written at once
+	c.Assert(w.WriteVariable("Test", efi.GlobalVariable, attrs|efi.AttributeAppendWrite, []byte("more")), IsNil)
+	c.Check(path, testutil.FileEquals, "\x47\x00\x00\x00more")
+}
+
+func (s *varsSuite) TestVarfsWriterError(c *C) {
+	w := efi.NewVarfsWriter(filepath.Join(c.MkDir(), "missing"))
+	err := w.WriteVariable("Test", efi.GlobalVariable, efi.AttributeNonVolatile, nil)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
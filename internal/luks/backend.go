@@ -0,0 +1,135 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks
+
+import "errors"
+
+// ErrTokenNotFound is returned when a container has no token with the
+// requested ID.
+var ErrTokenNotFound = errors.New("token does not exist")
+
+// Backend reads and modifies LUKS2 containers.
+type Backend interface {
+	// ReadHeader reads the header of the container at devicePath.
+	ReadHeader(devicePath string) (*Header, error)
+
+	// ListKeyslots returns the IDs of the used keyslots of the
+	// container at devicePath in ascending order.
+	ListKeyslots(devicePath string) ([]int, error)
+
+	// Format formats devicePath as a new container, adding key to
+	// a keyslot.
+	Format(devicePath, label string, key []byte, opts *FormatOptions) error
+
+	// AddKey adds key to a keyslot, using existingKey, which must
+	// unlock one of the existing keyslots, for authorization.
+	AddKey(devicePath string, existingKey, key []byte, opts *AddKeyOptions) error
+
+	// RemoveKey wipes the specified keyslot. The key must unlock
+	// one of the keyslots.
+	RemoveKey(devicePath string, slot int, key []byte) error
+
+	// TestKey checks whether key unlocks the specified keyslot,
+	// returning ErrIncorrectKey if it doesn't.
+	TestKey(devicePath string, slot int, key []byte) error
+
+	// ReadToken returns the token with the specified ID, or
+	// ErrTokenNotFound.
+	ReadToken(devicePath string, id int) (*Token, error)
+
+	// WriteToken stores token with the specified ID, replacing
+	// any token that already has that ID.
+	WriteToken(devicePath string, id int, token *Token) error
+
+	// RemoveToken removes the token with the specified ID.
+	RemoveToken(devicePath string, id int) error
+}
+
+// cryptsetupBackend parses headers directly and uses cryptsetup to
+// modify containers.
+type cryptsetupBackend struct{}
+
+func (cryptsetupBackend) ReadHeader(devicePath string) (*Header, error) {
+	return ReadHeader(devicePath)
+}
+
+func (cryptsetupBackend) ListKeyslots(devicePath string) ([]int, error) {
+	hdr, err := ReadHeader(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	return hdr.Metadata.KeyslotIDs(), nil
+}
+
+func (cryptsetupBackend) Format(devicePath, label string, key []byte, opts *FormatOptions) error {
+	return Format(devicePath, label, key, opts)
+}
+
+func (cryptsetupBackend) AddKey(devicePath string, existingKey, key []byte, opts *AddKeyOptions) error {
+	return AddKey(devicePath, existingKey, key, opts)
+}
+
+func (cryptsetupBackend) RemoveKey(devicePath string, slot int, key []byte) error {
+	return KillSlot(devicePath, slot, key)
+}
+
+func (cryptsetupBackend) TestKey(devicePath string, slot int, key []byte) error {
+	return TestKey(devicePath, slot, key)
+}
+
+func (cryptsetupBackend) ReadToken(devicePath string, id int) (*Token, error) {
+	hdr, err := ReadHeader(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	tok, ok := hdr.Metadata.Tokens[id]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return tok, nil
+}
+
+func (cryptsetupBackend) WriteToken(devicePath string, id int, token *Token) error {
+	return ImportToken(devicePath, id, token)
+}
+
+func (cryptsetupBackend) RemoveToken(devicePath string, id int) error {
+	return RemoveToken(devicePath, id)
+}
+
+var backendHook Backend
+
+// MockBackend makes DefaultBackend return b, for testing.
+func MockBackend(b Backend) (restore func()) {
+	old := backendHook
+	backendHook = b
+	return func() {
+		backendHook = old
+	}
+}
+
+// DefaultBackend returns the backend that operates on the containers
+// of the system.
+func DefaultBackend() Backend {
+	if backendHook != nil {
+		return backendHook
+	}
+	return cryptsetupBackend{}
+}
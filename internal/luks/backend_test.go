@@ -0,0 +1,83 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/testutil"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+)
+
+type backendSuite struct {
+	testutil.BaseTest
+}
+
+var _ = Suite(&backendSuite{})
+
+func (s *backendSuite) TestCryptsetupBackend(c *C) {
+	path := filepath.Join(c.MkDir(), "disk.img")
+	c.Assert(ioutil.WriteFile(path, makeContainer(c, testMetadata), 0600), IsNil)
+	cmd := testutil.MockCommand(c, "cryptsetup", "")
+	defer cmd.Restore()
+
+	b := luks.DefaultBackend()
+
+	hdr, err := b.ReadHeader(path)
+	c.Assert(err, IsNil)
+	c.Check(hdr.UUID, Equals, "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+
+	slots, err := b.ListKeyslots(path)
+	c.Assert(err, IsNil)
+	c.Check(slots, DeepEquals, []int{0, 1})
+
+	tok, err := b.ReadToken(path, 3)
+	c.Assert(err, IsNil)
+	c.Check(tok.Type, Equals, "ubuntu-fde-recovery")
+	_, err = b.ReadToken(path, 1)
+	c.Check(err, Equals, luks.ErrTokenNotFound)
+
+	c.Check(b.AddKey(path, []byte("old"), []byte("new"), &luks.AddKeyOptions{Slot: 2}), IsNil)
+	c.Check(b.RemoveKey(path, 2, []byte("new")), IsNil)
+	c.Check(b.WriteToken(path, 4, &luks.Token{Type: "example", Keyslots: []int{0}}), IsNil)
+	c.Check(b.RemoveToken(path, 4), IsNil)
+	c.Check(b.TestKey(path, 0, []byte("old")), IsNil)
+	var ops []string
+	for _, call := range cmd.Calls() {
+		ops = append(ops, call[1])
+	}
+	c.Check(ops, DeepEquals, []string{"luksAddKey", "luksKillSlot", "token", "token", "open"})
+}
+
+type fakeBackend struct {
+	luks.Backend
+}
+
+func (s *backendSuite) TestMockBackend(c *C) {
+	fake := &fakeBackend{}
+	restore := luks.MockBackend(fake)
+	c.Check(luks.DefaultBackend(), Equals, fake)
+	restore()
+	c.Check(luks.DefaultBackend(), Not(Equals), fake)
+}
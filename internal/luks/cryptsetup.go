@@ -0,0 +1,142 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// ErrIncorrectKey is returned when a key does not unlock a keyslot.
+var ErrIncorrectKey = errors.New("incorrect key")
+
+// TestKey checks whether key unlocks the specified keyslot of a LUKS2
+// container, without activating it.
+func TestKey(devicePath string, slot int, key []byte) error {
+	cmd := exec.Command("cryptsetup", "open", "--test-passphrase", "--type", "luks2",
+		"--key-slot", strconv.Itoa(slot), "--key-file", "-", devicePath)
+	cmd.Stdin = bytes.NewReader(key)
+
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		// cryptsetup exits with 2 when no key is available with the
+		// supplied passphrase
+		return ErrIncorrectKey
+	}
+	if err != nil {
+		return fmt.Errorf("cryptsetup failed with: %v", osutil.OutputErr(output, err))
+	}
+	return nil
+}
+
+// FormatOptions are the options for formatting a LUKS2 container.
+type FormatOptions struct {
+	// UUID is the UUID of the new container. cryptsetup generates
+	// one if it is empty.
+	UUID string
+	// Slot is the keyslot that the key is added to.
+	Slot int
+}
+
+// Format formats the device or image file at devicePath as a LUKS2
+// container with the specified label, adding key to a keyslot. The
+// key is expected to be a random key rather than a passphrase, so the
+// cost of the key derivation function is kept low.
+func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
+	if opts == nil {
+		opts = &FormatOptions{}
+	}
+	args := []string{"luksFormat", "--type", "luks2", "--batch-mode",
+		"--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32",
+		"--key-slot", strconv.Itoa(opts.Slot), "--key-file", "-"}
+	if label != "" {
+		args = append(args, "--label", label)
+	}
+	if opts.UUID != "" {
+		args = append(args, "--uuid", opts.UUID)
+	}
+	args = append(args, devicePath)
+
+	return cryptsetup(key, args...)
+}
+
+// AddKeyOptions are the options for adding a key to a LUKS2 container.
+type AddKeyOptions struct {
+	// Slot is the keyslot that the key is added to, which must not
+	// be in use.
+	Slot int
+}
+
+// AddKey adds key to a keyslot of a LUKS2 container, using existingKey,
+// which must unlock one of the existing keyslots, for authorization.
+func AddKey(devicePath string, existingKey, key []byte, opts *AddKeyOptions) error {
+	if opts == nil {
+		opts = &AddKeyOptions{}
+	}
+	// both keys are read from stdin, so the size of the existing
+	// key tells cryptsetup where the new key starts
+	stdin := make([]byte, 0, len(existingKey)+len(key))
+	stdin = append(stdin, existingKey...)
+	stdin = append(stdin, key...)
+	return cryptsetup(stdin, "luksAddKey", "--type", "luks2", "--batch-mode",
+		"--key-file", "-", "--keyfile-size", strconv.Itoa(len(existingKey)),
+		"--pbkdf", "argon2i", "--key-slot", strconv.Itoa(opts.Slot), devicePath, "-")
+}
+
+// KillSlot wipes a keyslot of a LUKS2 container. The key must unlock
+// one of the keyslots, which prevents the last keyslot from being
+// wiped.
+func KillSlot(devicePath string, slot int, key []byte) error {
+	return cryptsetup(key, "luksKillSlot", "--type", "luks2", "--key-file", "-", devicePath, strconv.Itoa(slot))
+}
+
+// ImportToken stores token in a LUKS2 container with the specified ID,
+// replacing any token that already has that ID.
+func ImportToken(devicePath string, id int, token *Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("cannot encode token: %v", err)
+	}
+	return cryptsetup(data, "token", "import", "--json-file", "-",
+		"--token-id", strconv.Itoa(id), "--token-replace", devicePath)
+}
+
+// RemoveToken removes the token with the specified ID from a LUKS2
+// container.
+func RemoveToken(devicePath string, id int) error {
+	return cryptsetup(nil, "token", "remove", "--token-id", strconv.Itoa(id), devicePath)
+}
+
+func cryptsetup(stdin []byte, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup failed with: %v", osutil.OutputErr(output, err))
+	}
+	return nil
+}
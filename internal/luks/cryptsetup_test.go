@@ -0,0 +1,149 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/testutil"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+)
+
+type cryptsetupSuite struct {
+	testutil.BaseTest
+}
+
+var _ = Suite(&cryptsetupSuite{})
+
+func (s *cryptsetupSuite) TestTestKey(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `cat > "$(dirname "$0")/stdin"`)
+	defer cmd.Restore()
+
+	c.Check(luks.TestKey("/dev/sda4", 3, []byte("passphrase")), IsNil)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "open", "--test-passphrase", "--type", "luks2", "--key-slot", "3", "--key-file", "-", "/dev/sda4"},
+	})
+	c.Check(cmd.BinDir()+"/stdin", testutil.FileEquals, "passphrase")
+}
+
+func (s *cryptsetupSuite) TestTestKeyIncorrect(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `echo "No key available with this passphrase." >&2; exit 2`)
+	defer cmd.Restore()
+
+	c.Check(luks.TestKey("/dev/sda4", 3, []byte("wrong")), Equals, luks.ErrIncorrectKey)
+}
+
+func (s *cryptsetupSuite) TestTestKeyError(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `echo "Device /dev/sda4 does not exist." >&2; exit 4`)
+	defer cmd.Restore()
+
+	c.Check(luks.TestKey("/dev/sda4", 3, []byte("passphrase")), ErrorMatches, `cryptsetup failed with: Device /dev/sda4 does not exist.`)
+}
+
+func (s *cryptsetupSuite) TestFormat(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `cat > "$(dirname "$0")/stdin"`)
+	defer cmd.Restore()
+
+	err := luks.Format("/tmp/disk.img", "ubuntu-data-enc", []byte("key"), &luks.FormatOptions{
+		UUID: "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+	})
+	c.Check(err, IsNil)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode",
+			"--cipher", "aes-xts-plain64", "--key-size", "512",
+			"--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32",
+			"--key-slot", "0", "--key-file", "-",
+			"--label", "ubuntu-data-enc", "--uuid", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21", "/tmp/disk.img"},
+	})
+	c.Check(cmd.BinDir()+"/stdin", testutil.FileEquals, "key")
+}
+
+func (s *cryptsetupSuite) TestFormatError(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `echo "Cannot format device /dev/sda4 in use." >&2; exit 5`)
+	defer cmd.Restore()
+
+	c.Check(luks.Format("/dev/sda4", "", []byte("key"), nil), ErrorMatches, `cryptsetup failed with: Cannot format device /dev/sda4 in use.`)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode",
+			"--cipher", "aes-xts-plain64", "--key-size", "512",
+			"--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32",
+			"--key-slot", "0", "--key-file", "-", "/dev/sda4"},
+	})
+}
+
+func (s *cryptsetupSuite) TestAddKey(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `cat > "$(dirname "$0")/stdin"`)
+	defer cmd.Restore()
+
+	c.Check(luks.AddKey("/dev/sda4", []byte("old-key"), []byte("new-key"), &luks.AddKeyOptions{Slot: 3}), IsNil)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "luksAddKey", "--type", "luks2", "--batch-mode", "--key-file", "-", "--keyfile-size", "7",
+			"--pbkdf", "argon2i", "--key-slot", "3", "/dev/sda4", "-"},
+	})
+	c.Check(cmd.BinDir()+"/stdin", testutil.FileEquals, "old-keynew-key")
+}
+
+func (s *cryptsetupSuite) TestAddKeyError(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `echo "No key available with this passphrase." >&2; exit 2`)
+	defer cmd.Restore()
+
+	c.Check(luks.AddKey("/dev/sda4", []byte("wrong"), []byte("new-key"), nil), ErrorMatches, `cryptsetup failed with: No key available with this passphrase.`)
+}
+
+func (s *cryptsetupSuite) TestKillSlot(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `cat > "$(dirname "$0")/stdin"`)
+	defer cmd.Restore()
+
+	c.Check(luks.KillSlot("/dev/sda4", 3, []byte("key")), IsNil)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "luksKillSlot", "--type", "luks2", "--key-file", "-", "/dev/sda4", "3"},
+	})
+	c.Check(cmd.BinDir()+"/stdin", testutil.FileEquals, "key")
+}
+
+func (s *cryptsetupSuite) TestImportToken(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `cat > "$(dirname "$0")/stdin"`)
+	defer cmd.Restore()
+
+	tok := &luks.Token{Type: "example", Keyslots: []int{0, 2}, Data: []byte(`{"type":"other","foo":"bar"}`)}
+	c.Check(luks.ImportToken("/dev/sda4", 5, tok), IsNil)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "token", "import", "--json-file", "-", "--token-id", "5", "--token-replace", "/dev/sda4"},
+	})
+	c.Check(cmd.BinDir()+"/stdin", testutil.FileEquals, `{"foo":"bar","keyslots":["0","2"],"type":"example"}`)
+}
+
+func (s *cryptsetupSuite) TestRemoveToken(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", "")
+	defer cmd.Restore()
+
+	c.Check(luks.RemoveToken("/dev/sda4", 5), IsNil)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "token", "remove", "--token-id", "5", "/dev/sda4"},
+	})
+}
+
+func (s *cryptsetupSuite) TestRemoveTokenError(c *C) {
+	cmd := testutil.MockCommand(c, "cryptsetup", `echo "Token 5 is not in use." >&2; exit 1`)
+	defer cmd.Restore()
+
+	c.Check(luks.RemoveToken("/dev/sda4", 5), ErrorMatches, `cryptsetup failed with: Token 5 is not in use.`)
+}
@@ -0,0 +1,322 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package luks provides access to LUKS2 containers and their metadata.
+package luks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	binaryHeaderSize = 4096
+
+	// the largest header size permitted by the specification.
+	maxHeaderSize = 4 * 1024 * 1024
+)
+
+var (
+	primaryMagic   = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+	secondaryMagic = []byte{'S', 'K', 'U', 'L', 0xba, 0xbe}
+)
+
+// ErrNotLUKS2 is returned when a device does not contain a LUKS2
+// header.
+var ErrNotLUKS2 = errors.New("not a LUKS2 container")
+
+// binaryHeader is the on-disk binary header that precedes the JSON
+// metadata area.
+type binaryHeader struct {
+	Magic       [6]byte
+	Version     uint16
+	HdrSize     uint64
+	SeqID       uint64
+	Label       [48]byte
+	CsumAlg     [32]byte
+	Salt        [64]byte
+	UUID        [40]byte
+	Subsystem   [48]byte
+	HdrOffset   uint64
+	Padding     [184]byte
+	Csum        [64]byte
+	Padding4096 [7 * 512]byte
+}
+
+// Header describes the header of a LUKS2 container.
+type Header struct {
+	// Label is the optional label of the container.
+	Label string
+	// Subsystem is the optional secondary label of the container.
+	Subsystem string
+	// UUID is the UUID of the container.
+	UUID string
+	// Metadata is the decoded JSON metadata area.
+	Metadata Metadata
+}
+
+// Metadata is the JSON metadata of a LUKS2 container.
+type Metadata struct {
+	Keyslots map[int]*Keyslot
+	Tokens   map[int]*Token
+	Config   Config
+}
+
+// KeyslotIDs returns the IDs of the used keyslots in ascending
+// order.
+func (m *Metadata) KeyslotIDs() []int {
+	ids := make([]int, 0, len(m.Keyslots))
+	for id := range m.Keyslots {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// TokensForKeyslot returns the tokens that reference the specified
+// keyslot, in ascending order of token ID.
+func (m *Metadata) TokensForKeyslot(slot int) []*Token {
+	ids := make([]int, 0, len(m.Tokens))
+	for id := range m.Tokens {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var tokens []*Token
+	for _, id := range ids {
+		tok := m.Tokens[id]
+		for _, s := range tok.Keyslots {
+			if s == slot {
+				tokens = append(tokens, tok)
+				break
+			}
+		}
+	}
+	return tokens
+}
+
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Keyslots map[string]*Keyslot `json:"keyslots"`
+		Tokens   map[string]*Token   `json:"tokens"`
+		Config   Config              `json:"config"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	m.Keyslots = make(map[int]*Keyslot, len(raw.Keyslots))
+	for k, v := range raw.Keyslots {
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return fmt.Errorf("invalid keyslot id %q", k)
+		}
+		m.Keyslots[id] = v
+	}
+	m.Tokens = make(map[int]*Token, len(raw.Tokens))
+	for k, v := range raw.Tokens {
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return fmt.Errorf("invalid token id %q", k)
+		}
+		m.Tokens[id] = v
+	}
+	m.Config = raw.Config
+	return nil
+}
+
+// KDF describes the key derivation function used by a keyslot.
+type KDF struct {
+	Type string `json:"type"`
+}
+
+// Keyslot describes a LUKS2 keyslot.
+type Keyslot struct {
+	Type     string `json:"type"`
+	KeySize  int    `json:"key_size"`
+	Priority *int   `json:"priority,omitempty"`
+	KDF      KDF    `json:"kdf"`
+}
+
+// Token describes a LUKS2 token. The complete JSON object is
+// retained in Data so that callers can decode type specific fields.
+type Token struct {
+	Type     string
+	Keyslots []int
+	Data     json.RawMessage
+}
+
+func (t *Token) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type     string   `json:"type"`
+		Keyslots []string `json:"keyslots"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	t.Type = raw.Type
+	t.Keyslots = make([]int, 0, len(raw.Keyslots))
+	for _, k := range raw.Keyslots {
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return fmt.Errorf("invalid keyslot id %q in token", k)
+		}
+		t.Keyslots = append(t.Keyslots, id)
+	}
+	t.Data = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// MarshalJSON encodes the token as stored in the metadata. The type
+// and the keyslots override the corresponding fields of Data, and any
+// other fields of Data are retained.
+func (t *Token) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{})
+	if len(t.Data) > 0 {
+		if err := json.Unmarshal(t.Data, &fields); err != nil {
+			return nil, fmt.Errorf("invalid token data: %v", err)
+		}
+	}
+	keyslots := make([]string, 0, len(t.Keyslots))
+	for _, slot := range t.Keyslots {
+		keyslots = append(keyslots, strconv.Itoa(slot))
+	}
+	fields["type"] = t.Type
+	fields["keyslots"] = keyslots
+	return json.Marshal(fields)
+}
+
+// Config is the persistent configuration of a LUKS2 container.
+type Config struct {
+	JSONSize     string `json:"json_size"`
+	KeyslotsSize string `json:"keyslots_size"`
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func decodeHeaderAt(r io.ReaderAt, offset int64, magic []byte) (*Header, uint64, error) {
+	var hdr binaryHeader
+	if err := binary.Read(io.NewSectionReader(r, offset, binaryHeaderSize), binary.BigEndian, &hdr); err != nil {
+		return nil, 0, fmt.Errorf("cannot read binary header: %w", err)
+	}
+	if !bytes.Equal(hdr.Magic[:], magic) || hdr.Version != 2 {
+		return nil, 0, ErrNotLUKS2
+	}
+	if hdr.HdrSize < binaryHeaderSize || hdr.HdrSize > maxHeaderSize {
+		return nil, 0, fmt.Errorf("invalid header size %d", hdr.HdrSize)
+	}
+	if uint64(offset) != hdr.HdrOffset {
+		return nil, 0, fmt.Errorf("unexpected header offset %d", hdr.HdrOffset)
+	}
+
+	buf := make([]byte, hdr.HdrSize)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, 0, fmt.Errorf("cannot read header: %w", err)
+	}
+
+	switch alg := cstring(hdr.CsumAlg[:]); alg {
+	case "sha256":
+		// the checksum is calculated over the whole header with the
+		// checksum field zeroed.
+		csumOffset := 448
+		expected := append([]byte(nil), buf[csumOffset:csumOffset+sha256.Size]...)
+		for i := csumOffset; i < csumOffset+len(hdr.Csum); i++ {
+			buf[i] = 0
+		}
+		h := sha256.Sum256(buf)
+		if !bytes.Equal(h[:], expected) {
+			return nil, 0, fmt.Errorf("invalid header checksum")
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported checksum algorithm %q", alg)
+	}
+
+	jsonData := buf[binaryHeaderSize:]
+	if i := bytes.IndexByte(jsonData, 0); i >= 0 {
+		jsonData = jsonData[:i]
+	}
+
+	h := &Header{
+		Label:     cstring(hdr.Label[:]),
+		Subsystem: cstring(hdr.Subsystem[:]),
+		UUID:      cstring(hdr.UUID[:]),
+	}
+	if err := json.Unmarshal(jsonData, &h.Metadata); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode metadata: %w", err)
+	}
+	return h, hdr.SeqID, nil
+}
+
+// DecodeHeader decodes the LUKS2 header from r. If the primary
+// header is damaged, the secondary header is used instead, and
+// ErrNotLUKS2 is only returned if neither header is found.
+func DecodeHeader(r io.ReaderAt) (*Header, error) {
+	primary, primarySeq, primaryErr := decodeHeaderAt(r, 0, primaryMagic)
+
+	// the secondary header immediately follows the primary header,
+	// but the size of the primary can't be trusted if it is damaged,
+	// so try every offset permitted by the specification.
+	offsets := []int64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+	var secondary *Header
+	var secondarySeq uint64
+	for _, off := range offsets {
+		hdr, seq, err := decodeHeaderAt(r, off, secondaryMagic)
+		if err == nil {
+			secondary, secondarySeq = hdr, seq
+			break
+		}
+	}
+
+	switch {
+	case primaryErr == nil && (secondary == nil || primarySeq >= secondarySeq):
+		return primary, nil
+	case secondary != nil:
+		return secondary, nil
+	case primaryErr == ErrNotLUKS2:
+		return nil, ErrNotLUKS2
+	default:
+		return nil, fmt.Errorf("cannot decode LUKS2 header: %v", primaryErr)
+	}
+}
+
+// ReadHeader reads the LUKS2 header from the device or file at the
+// specified path.
+func ReadHeader(path string) (*Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return DecodeHeader(f)
+}
@@ -0,0 +1,182 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type headerSuite struct{}
+
+var _ = Suite(&headerSuite{})
+
+const testHeaderSize = 0x4000
+
+const testMetadata = `{
+  "keyslots": {
+    "0": {"type": "luks2", "key_size": 64, "kdf": {"type": "argon2i"}},
+    "1": {"type": "luks2", "key_size": 64, "priority": 0, "kdf": {"type": "pbkdf2"}}
+  },
+  "tokens": {
+    "0": {"type": "ubuntu-fde", "keyslots": ["0"], "ubuntu_fde_name": "default"},
+    "3": {"type": "ubuntu-fde-recovery", "keyslots": ["1"], "ubuntu_fde_name": "default-recovery"}
+  },
+  "segments": {},
+  "digests": {},
+  "config": {"json_size": "12288", "keyslots_size": "16744448"}
+}`
+
+// makeHeader returns a single LUKS2 header with the specified magic,
+// sequence ID and JSON metadata, located at offset.
+func makeHeader(c *C, magic string, offset, seqid uint64, metadata string) []byte {
+	buf := make([]byte, testHeaderSize)
+	copy(buf[0:], magic)
+	binary.BigEndian.PutUint16(buf[6:], 2)
+	binary.BigEndian.PutUint64(buf[8:], testHeaderSize)
+	binary.BigEndian.PutUint64(buf[16:], seqid)
+	copy(buf[24:], "data")
+	copy(buf[72:], "sha256")
+	copy(buf[168:], "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	binary.BigEndian.PutUint64(buf[256:], offset)
+	c.Assert(len(metadata) < testHeaderSize-4096, Equals, true)
+	copy(buf[4096:], metadata)
+
+	h := sha256.Sum256(buf)
+	copy(buf[448:], h[:])
+	return buf
+}
+
+func makeContainer(c *C, metadata string) []byte {
+	var b bytes.Buffer
+	b.Write(makeHeader(c, "LUKS\xba\xbe", 0, 1, metadata))
+	b.Write(makeHeader(c, "SKUL\xba\xbe", testHeaderSize, 1, metadata))
+	return b.Bytes()
+}
+
+func (s *headerSuite) TestReadHeader(c *C) {
+	path := filepath.Join(c.MkDir(), "disk.img")
+	c.Assert(ioutil.WriteFile(path, makeContainer(c, testMetadata), 0600), IsNil)
+
+	hdr, err := luks.ReadHeader(path)
+	c.Assert(err, IsNil)
+	c.Check(hdr.Label, Equals, "data")
+	c.Check(hdr.UUID, Equals, "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	c.Check(hdr.Metadata.KeyslotIDs(), DeepEquals, []int{0, 1})
+	c.Check(hdr.Metadata.Keyslots[0].KDF.Type, Equals, "argon2i")
+	c.Check(hdr.Metadata.Keyslots[0].Priority, IsNil)
+	c.Assert(hdr.Metadata.Keyslots[1].Priority, NotNil)
+	c.Check(*hdr.Metadata.Keyslots[1].Priority, Equals, 0)
+	c.Check(hdr.Metadata.Config.JSONSize, Equals, "12288")
+
+	tokens := hdr.Metadata.TokensForKeyslot(1)
+	c.Assert(tokens, HasLen, 1)
+	c.Check(tokens[0].Type, Equals, "ubuntu-fde-recovery")
+	c.Check(tokens[0].Keyslots, DeepEquals, []int{1})
+	c.Check(string(tokens[0].Data), Matches, `.*"ubuntu_fde_name": "default-recovery".*`)
+
+	c.Check(hdr.Metadata.TokensForKeyslot(2), HasLen, 0)
+}
+
+func (s *headerSuite) TestTokenMarshalJSON(c *C) {
+	tok := &luks.Token{Type: "ubuntu-fde", Keyslots: []int{3}}
+	data, err := json.Marshal(tok)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"keyslots":["3"],"type":"ubuntu-fde"}`)
+
+	// fields of the data are retained
+	var decoded luks.Token
+	c.Assert(json.Unmarshal([]byte(`{"type":"ubuntu-fde","keyslots":["0"],"ubuntu_fde_name":"default"}`), &decoded), IsNil)
+	decoded.Keyslots = []int{0, 1}
+	data, err = json.Marshal(&decoded)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"keyslots":["0","1"],"type":"ubuntu-fde","ubuntu_fde_name":"default"}`)
+
+	_, err = json.Marshal(&luks.Token{Type: "foo", Data: []byte("[]")})
+	c.Check(err, ErrorMatches, `json: error calling MarshalJSON for type \*luks.Token: invalid token data: .*`)
+}
+
+func (s *headerSuite) TestDecodeHeaderFallsBackToSecondary(c *C) {
+	data := makeContainer(c, testMetadata)
+	// corrupt the primary metadata
+	data[4096] = 'X'
+
+	hdr, err := luks.DecodeHeader(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Check(hdr.Metadata.KeyslotIDs(), DeepEquals, []int{0, 1})
+}
+
+func (s *headerSuite) TestDecodeHeaderDamagedPrimaryMagic(c *C) {
+	// the secondary header can be at any of the permitted offsets
+	var b bytes.Buffer
+	b.Write(makeHeader(c, "XXXX\xba\xbe", 0, 1, testMetadata))
+	b.Write(make([]byte, 0x8000-testHeaderSize))
+	b.Write(makeHeader(c, "SKUL\xba\xbe", 0x8000, 1, testMetadata))
+
+	hdr, err := luks.DecodeHeader(bytes.NewReader(b.Bytes()))
+	c.Assert(err, IsNil)
+	c.Check(hdr.Metadata.KeyslotIDs(), DeepEquals, []int{0, 1})
+}
+
+func (s *headerSuite) TestDecodeHeaderPrefersNewest(c *C) {
+	var b bytes.Buffer
+	b.Write(makeHeader(c, "LUKS\xba\xbe", 0, 1, testMetadata))
+	b.Write(makeHeader(c, "SKUL\xba\xbe", testHeaderSize, 2, `{"keyslots": {"5": {"type": "luks2"}}}`))
+
+	hdr, err := luks.DecodeHeader(bytes.NewReader(b.Bytes()))
+	c.Assert(err, IsNil)
+	c.Check(hdr.Metadata.KeyslotIDs(), DeepEquals, []int{5})
+}
+
+func (s *headerSuite) TestDecodeHeaderNotLUKS2(c *C) {
+	_, err := luks.DecodeHeader(bytes.NewReader(make([]byte, 2*testHeaderSize)))
+	c.Check(err, Equals, luks.ErrNotLUKS2)
+
+	// shorter than any secondary header offset
+	_, err = luks.DecodeHeader(bytes.NewReader(make([]byte, testHeaderSize/2)))
+	c.Check(err, Equals, luks.ErrNotLUKS2)
+}
+
+func (s *headerSuite) TestDecodeHeaderBothCorrupted(c *C) {
+	data := makeContainer(c, testMetadata)
+	data[4096] = 'X'
+	data[testHeaderSize+4096] = 'X'
+
+	_, err := luks.DecodeHeader(bytes.NewReader(data))
+	c.Check(err, ErrorMatches, `cannot decode LUKS2 header: invalid header checksum`)
+}
+
+func (s *headerSuite) TestDecodeHeaderInvalidMetadata(c *C) {
+	data := makeContainer(c, `{"keyslots": {"foo": {}}}`)
+
+	_, err := luks.DecodeHeader(bytes.NewReader(data))
+	c.Check(err, ErrorMatches, `cannot decode LUKS2 header: cannot decode metadata: invalid keyslot id "foo"`)
+}
@@ -0,0 +1,392 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package lukstest provides an in-memory fake of LUKS2 containers for
+// testing.
+package lukstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+)
+
+const (
+	maxKeyslots = 32
+	maxTokens   = 32
+)
+
+// Call records an operation that modified or tested a container.
+type Call struct {
+	// Op is one of "format", "add-key", "remove-key", "test-key",
+	// "write-token" or "remove-token".
+	Op         string
+	DevicePath string
+	// Slot is the keyslot, or the token ID for token operations.
+	Slot        int
+	Key         string
+	ExistingKey string
+}
+
+type container struct {
+	hdr  *luks.Header
+	keys map[int][]byte
+}
+
+// Backend is a fake luks.Backend that holds containers in memory. Its
+// fields can be modified by tests while no operation is in progress.
+type Backend struct {
+	mu         sync.Mutex
+	containers map[string]*container
+
+	// Calls records the operations that modified or tested a
+	// container, in order.
+	Calls []Call
+	// Err, if set, is returned by every operation.
+	Err error
+}
+
+// New returns a fake backend without containers.
+func New() *Backend {
+	return &Backend{containers: make(map[string]*container)}
+}
+
+// Mock makes luks.DefaultBackend return the fake backend.
+func Mock(b *Backend) (restore func()) {
+	return luks.MockBackend(b)
+}
+
+// AddContainer adds a container at devicePath with the specified
+// header, in which each of keys unlocks the keyslot with the same ID.
+// Keyslots are added to the header for keys that it doesn't have. The
+// header is not copied, so tests can modify it while no operation is
+// in progress.
+func (b *Backend) AddContainer(devicePath string, hdr *luks.Header, keys map[int][]byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if hdr.Metadata.Keyslots == nil {
+		hdr.Metadata.Keyslots = make(map[int]*luks.Keyslot)
+	}
+	if hdr.Metadata.Tokens == nil {
+		hdr.Metadata.Tokens = make(map[int]*luks.Token)
+	}
+	c := &container{hdr: hdr, keys: make(map[int][]byte, len(keys))}
+	for slot, key := range keys {
+		c.keys[slot] = append([]byte(nil), key...)
+		if _, ok := hdr.Metadata.Keyslots[slot]; !ok {
+			hdr.Metadata.Keyslots[slot] = newKeyslot()
+		}
+	}
+	b.containers[devicePath] = c
+}
+
+// Header returns the header of the container at devicePath, or nil if
+// there is no such container. It is not a copy.
+func (b *Backend) Header(devicePath string) *luks.Header {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[devicePath]
+	if !ok {
+		return nil
+	}
+	return c.hdr
+}
+
+// Key returns the key that unlocks the specified keyslot of the
+// container at devicePath, or nil if the keyslot is not in use.
+func (b *Backend) Key(devicePath string, slot int) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[devicePath]
+	if !ok {
+		return nil
+	}
+	return c.keys[slot]
+}
+
+// SetKey makes key unlock the specified keyslot of the container at
+// devicePath, adding the keyslot if it isn't in use.
+func (b *Backend) SetKey(devicePath string, slot int, key []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[devicePath]
+	if !ok {
+		panic("no container at " + devicePath)
+	}
+	c.keys[slot] = append([]byte(nil), key...)
+	if _, ok := c.hdr.Metadata.Keyslots[slot]; !ok {
+		c.hdr.Metadata.Keyslots[slot] = newKeyslot()
+	}
+}
+
+func newKeyslot() *luks.Keyslot {
+	return &luks.Keyslot{Type: "luks2", KeySize: 64, KDF: luks.KDF{Type: "argon2i"}}
+}
+
+func copyToken(tok *luks.Token) *luks.Token {
+	return &luks.Token{
+		Type:     tok.Type,
+		Keyslots: append([]int(nil), tok.Keyslots...),
+		Data:     append(json.RawMessage(nil), tok.Data...),
+	}
+}
+
+func copyHeader(hdr *luks.Header) *luks.Header {
+	cpy := &luks.Header{
+		Label:     hdr.Label,
+		Subsystem: hdr.Subsystem,
+		UUID:      hdr.UUID,
+		Metadata: luks.Metadata{
+			Keyslots: make(map[int]*luks.Keyslot, len(hdr.Metadata.Keyslots)),
+			Tokens:   make(map[int]*luks.Token, len(hdr.Metadata.Tokens)),
+			Config:   hdr.Metadata.Config,
+		},
+	}
+	for id, ks := range hdr.Metadata.Keyslots {
+		k := *ks
+		if ks.Priority != nil {
+			priority := *ks.Priority
+			k.Priority = &priority
+		}
+		cpy.Metadata.Keyslots[id] = &k
+	}
+	for id, tok := range hdr.Metadata.Tokens {
+		cpy.Metadata.Tokens[id] = copyToken(tok)
+	}
+	return cpy
+}
+
+// container must be called with the mutex held.
+func (b *Backend) container(devicePath string) (*container, error) {
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	c, ok := b.containers[devicePath]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: devicePath, Err: os.ErrNotExist}
+	}
+	return c, nil
+}
+
+func (c *container) unlocks(key []byte) bool {
+	for _, k := range c.keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Backend) ReadHeader(devicePath string) (*luks.Header, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, err := b.container(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	return copyHeader(c.hdr), nil
+}
+
+func (b *Backend) ListKeyslots(devicePath string) ([]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, err := b.container(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	return c.hdr.Metadata.KeyslotIDs(), nil
+}
+
+func (b *Backend) Format(devicePath, label string, key []byte, opts *luks.FormatOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if opts == nil {
+		opts = &luks.FormatOptions{}
+	}
+	b.Calls = append(b.Calls, Call{Op: "format", DevicePath: devicePath, Slot: opts.Slot, Key: string(key)})
+	if b.Err != nil {
+		return b.Err
+	}
+	if opts.Slot < 0 || opts.Slot >= maxKeyslots {
+		return fmt.Errorf("invalid keyslot %d", opts.Slot)
+	}
+
+	uuid := opts.UUID
+	if uuid == "" {
+		uuid = fmt.Sprintf("00000000-0000-4000-8000-%012x", len(b.Calls))
+	}
+	b.containers[devicePath] = &container{
+		hdr: &luks.Header{
+			Label: label,
+			UUID:  uuid,
+			Metadata: luks.Metadata{
+				Keyslots: map[int]*luks.Keyslot{opts.Slot: newKeyslot()},
+				Tokens:   make(map[int]*luks.Token),
+			},
+		},
+		keys: map[int][]byte{opts.Slot: append([]byte(nil), key...)},
+	}
+	return nil
+}
+
+func (b *Backend) AddKey(devicePath string, existingKey, key []byte, opts *luks.AddKeyOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if opts == nil {
+		opts = &luks.AddKeyOptions{}
+	}
+	b.Calls = append(b.Calls, Call{Op: "add-key", DevicePath: devicePath, Slot: opts.Slot, Key: string(key), ExistingKey: string(existingKey)})
+	c, err := b.container(devicePath)
+	if err != nil {
+		return err
+	}
+	if !c.unlocks(existingKey) {
+		return luks.ErrIncorrectKey
+	}
+	if opts.Slot < 0 || opts.Slot >= maxKeyslots {
+		return fmt.Errorf("invalid keyslot %d", opts.Slot)
+	}
+	if _, ok := c.hdr.Metadata.Keyslots[opts.Slot]; ok {
+		return fmt.Errorf("keyslot %d is in use", opts.Slot)
+	}
+	c.hdr.Metadata.Keyslots[opts.Slot] = newKeyslot()
+	c.keys[opts.Slot] = append([]byte(nil), key...)
+	return nil
+}
+
+func (b *Backend) RemoveKey(devicePath string, slot int, key []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Calls = append(b.Calls, Call{Op: "remove-key", DevicePath: devicePath, Slot: slot, Key: string(key)})
+	c, err := b.container(devicePath)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.hdr.Metadata.Keyslots[slot]; !ok {
+		return fmt.Errorf("keyslot %d is not in use", slot)
+	}
+	if !c.unlocks(key) {
+		return luks.ErrIncorrectKey
+	}
+	delete(c.hdr.Metadata.Keyslots, slot)
+	delete(c.keys, slot)
+
+	// like cryptsetup, tokens no longer reference the wiped keyslot
+	for _, tok := range c.hdr.Metadata.Tokens {
+		keyslots := tok.Keyslots[:0]
+		for _, s := range tok.Keyslots {
+			if s != slot {
+				keyslots = append(keyslots, s)
+			}
+		}
+		tok.Keyslots = keyslots
+	}
+	return nil
+}
+
+func (b *Backend) TestKey(devicePath string, slot int, key []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Calls = append(b.Calls, Call{Op: "test-key", DevicePath: devicePath, Slot: slot, Key: string(key)})
+	c, err := b.container(devicePath)
+	if err != nil {
+		return err
+	}
+	k, ok := c.keys[slot]
+	if !ok || !bytes.Equal(k, key) {
+		return luks.ErrIncorrectKey
+	}
+	return nil
+}
+
+func (b *Backend) ReadToken(devicePath string, id int) (*luks.Token, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, err := b.container(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	tok, ok := c.hdr.Metadata.Tokens[id]
+	if !ok {
+		return nil, luks.ErrTokenNotFound
+	}
+	return copyToken(tok), nil
+}
+
+func (b *Backend) WriteToken(devicePath string, id int, token *luks.Token) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Calls = append(b.Calls, Call{Op: "write-token", DevicePath: devicePath, Slot: id})
+	c, err := b.container(devicePath)
+	if err != nil {
+		return err
+	}
+	if id < 0 || id >= maxTokens {
+		return fmt.Errorf("invalid token ID %d", id)
+	}
+	for _, slot := range token.Keyslots {
+		if _, ok := c.hdr.Metadata.Keyslots[slot]; !ok {
+			return fmt.Errorf("keyslot %d is not in use", slot)
+		}
+	}
+
+	// store the token as it would be decoded from the metadata
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	var stored luks.Token
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	c.hdr.Metadata.Tokens[id] = &stored
+	return nil
+}
+
+func (b *Backend) RemoveToken(devicePath string, id int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Calls = append(b.Calls, Call{Op: "remove-token", DevicePath: devicePath, Slot: id})
+	c, err := b.container(devicePath)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.hdr.Metadata.Tokens[id]; !ok {
+		return luks.ErrTokenNotFound
+	}
+	delete(c.hdr.Metadata.Tokens, id)
+	return nil
+}
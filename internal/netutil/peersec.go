@@ -0,0 +1,89 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package netutil
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrNoPeerSecurityLabel = errors.New("connection has no peer security label")
+
+// maxSecurityLabelSize is large enough for any security label seen in
+// practice, the buffer is grown if the kernel asks for more.
+const maxSecurityLabelSize = 256
+
+func getsockoptPeerSec(fd int) (string, error) {
+	buf := make([]byte, maxSecurityLabelSize)
+	for {
+		size := uint32(len(buf))
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_PEERSEC,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+		switch {
+		case errno == unix.ERANGE && int(size) > len(buf):
+			buf = make([]byte, size)
+			continue
+		case errno != 0:
+			return "", errno
+		}
+		// depending on the LSM, the label may or may not be
+		// terminated
+		return strings.TrimRight(string(buf[:size]), "\x00\n"), nil
+	}
+}
+
+// ConnPeerSecurityLabel obtains the security label of the peer of a
+// connection, such as its AppArmor profile and mode, where this is
+// supported. If a connection or the kernel does not support obtaining
+// security labels, ErrNoPeerSecurityLabel is returned.
+func ConnPeerSecurityLabel(conn net.Conn) (string, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return "", ErrNoPeerSecurityLabel
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var label string
+	scErr := raw.Control(func(fd uintptr) {
+		label, err = getsockoptPeerSec(int(fd))
+	})
+	if scErr != nil {
+		return "", scErr
+	}
+	if errors.Is(err, unix.ENOPROTOOPT) || errors.Is(err, unix.EOPNOTSUPP) {
+		return "", ErrNoPeerSecurityLabel
+	}
+	if err != nil {
+		return "", err
+	}
+	if label == "" {
+		return "", ErrNoPeerSecurityLabel
+	}
+	return label, nil
+}
@@ -0,0 +1,69 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package netutil_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/fdemanager/internal/netutil"
+)
+
+type peersecSuite struct{}
+
+var _ = Suite(&peersecSuite{})
+
+func (s *peersecSuite) TestUnixSocket(c *C) {
+	socket := filepath.Join(c.MkDir(), "socket")
+
+	l, err := net.Listen("unix", socket)
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("unix", socket)
+		c.Assert(err, IsNil)
+		conn.Close()
+	}()
+
+	conn, err := l.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	label, err := ConnPeerSecurityLabel(conn)
+	if err == ErrNoPeerSecurityLabel {
+		c.Skip("security labels are not supported")
+	}
+	c.Assert(err, IsNil)
+
+	// the peer is this process
+	current, err := os.ReadFile("/proc/self/attr/current")
+	c.Assert(err, IsNil)
+	c.Check(label, Equals, strings.TrimRight(string(current), "\x00\n"))
+}
+
+func (s *peersecSuite) TestNonSyscallConn(c *C) {
+	_, err := ConnPeerSecurityLabel(new(nonSyscallConn))
+	c.Check(err, Equals, ErrNoPeerSecurityLabel)
+}
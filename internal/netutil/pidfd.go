@@ -0,0 +1,173 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package netutil
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/snapcore/fdemanager/internal/procfs"
+)
+
+// soPeerPidfd is SO_PEERPIDFD, which is not known to x/sys yet.
+const soPeerPidfd = 77
+
+// clockTicksPerSecond is USER_HZ, the unit of process start times.
+const clockTicksPerSecond = 100
+
+var (
+	ErrNoPeerPidfd     = errors.New("connection has no peer pidfd")
+	ErrProcessNotFound = errors.New("process no longer exists")
+)
+
+// Pidfd refers to a process independently of the reuse of its pid.
+type Pidfd struct {
+	fd  int
+	pid int32
+}
+
+// PidfdOpen returns a pidfd for the process with the specified pid.
+func PidfdOpen(pid int32) (*Pidfd, error) {
+	fd, err := unix.PidfdOpen(int(pid), 0)
+	if errors.Is(err, unix.ESRCH) {
+		return nil, ErrProcessNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open pidfd for process %d: %v", pid, err)
+	}
+	return &Pidfd{fd: fd, pid: pid}, nil
+}
+
+// Pid returns the pid of the process.
+func (p *Pidfd) Pid() int32 {
+	return p.pid
+}
+
+// Fd returns the file descriptor of the pidfd.
+func (p *Pidfd) Fd() int {
+	return p.fd
+}
+
+// Close closes the pidfd.
+func (p *Pidfd) Close() error {
+	return unix.Close(p.fd)
+}
+
+// CheckAlive returns ErrProcessNotFound if the process has exited.
+// While the process is alive its pid cannot be reused, so information
+// obtained through its pid before CheckAlive succeeds describes this
+// process.
+func (p *Pidfd) CheckAlive() error {
+	err := unix.PidfdSendSignal(p.fd, 0, nil, 0)
+	if errors.Is(err, unix.ESRCH) {
+		return ErrProcessNotFound
+	}
+	return err
+}
+
+var getsockoptPeerPidfd = func(fd int) (int, error) {
+	return unix.GetsockoptInt(fd, unix.SOL_SOCKET, soPeerPidfd)
+}
+
+// BootTimeTicks returns the time since boot in clock ticks, the unit of
+// process start times. It is recorded when a connection is accepted,
+// for ConnPeerPidfd.
+func BootTimeTicks() (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return 0, err
+	}
+	return uint64(ts.Nano()) / (1e9 / clockTicksPerSecond), nil
+}
+
+// ConnPeerPidfd returns a pidfd for the process at the other end of a
+// connection, which was accepted at acceptTime as returned by
+// BootTimeTicks.
+//
+// If the kernel does not support SO_PEERPIDFD, the pidfd is opened for
+// the pid in the peer credentials instead. The peer could have exited
+// and its pid been reused by then, so the process is required to have
+// started before the connection was accepted.
+func ConnPeerPidfd(conn net.Conn, acceptTime uint64) (*Pidfd, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, ErrNoPeerPidfd
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *unix.Ucred
+	pidfd := -1
+	var pidfdErr error
+	scErr := raw.Control(func(fd uintptr) {
+		ucred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+		if err != nil {
+			return
+		}
+		pidfd, pidfdErr = getsockoptPeerPidfd(int(fd))
+	})
+	if scErr != nil {
+		return nil, scErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ucred.Pid == 0 {
+		return nil, ErrNoPeerPidfd
+	}
+
+	if pidfdErr == nil {
+		p := &Pidfd{fd: pidfd, pid: ucred.Pid}
+		// the pidfd refers to the peer, which is only known by its
+		// pid as long as it is alive
+		if err := p.CheckAlive(); err != nil {
+			p.Close()
+			return nil, err
+		}
+		return p, nil
+	}
+	if !errors.Is(pidfdErr, unix.ENOPROTOOPT) {
+		return nil, fmt.Errorf("cannot obtain peer pidfd: %v", pidfdErr)
+	}
+
+	p, err := PidfdOpen(ucred.Pid)
+	if err != nil {
+		return nil, err
+	}
+	startTime, err := procfs.StartTime(ucred.Pid)
+	if err == nil {
+		err = p.CheckAlive()
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	if startTime > acceptTime {
+		p.Close()
+		return nil, fmt.Errorf("process %d started after the connection was accepted", ucred.Pid)
+	}
+	return p, nil
+}
@@ -0,0 +1,143 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package netutil_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/fdemanager/internal/netutil"
+)
+
+type pidfdSuite struct{}
+
+var _ = Suite(&pidfdSuite{})
+
+func (s *pidfdSuite) connect(c *C) (conn net.Conn, cleanup func()) {
+	socket := filepath.Join(c.MkDir(), "socket")
+
+	l, err := net.Listen("unix", socket)
+	c.Assert(err, IsNil)
+
+	client := make(chan net.Conn, 1)
+	go func() {
+		conn, err := net.Dial("unix", socket)
+		c.Check(err, IsNil)
+		client <- conn
+	}()
+
+	conn, err = l.Accept()
+	c.Assert(err, IsNil)
+	return conn, func() {
+		conn.Close()
+		if cc := <-client; cc != nil {
+			cc.Close()
+		}
+		l.Close()
+	}
+}
+
+func (s *pidfdSuite) checkSelf(c *C, pidfd *Pidfd) {
+	c.Check(pidfd.Pid(), Equals, int32(os.Getpid()))
+	c.Check(pidfd.CheckAlive(), IsNil)
+
+	// the pidfd refers to this process
+	self, err := PidfdOpen(int32(os.Getpid()))
+	c.Assert(err, IsNil)
+	defer self.Close()
+	var st1, st2 unix.Stat_t
+	c.Assert(unix.Fstat(pidfd.Fd(), &st1), IsNil)
+	c.Assert(unix.Fstat(self.Fd(), &st2), IsNil)
+	c.Check(st1.Ino, Equals, st2.Ino)
+}
+
+func (s *pidfdSuite) TestConnPeerPidfd(c *C) {
+	conn, cleanup := s.connect(c)
+	defer cleanup()
+
+	pidfd, err := ConnPeerPidfd(conn, s.acceptTime(c))
+	c.Assert(err, IsNil)
+	defer pidfd.Close()
+	s.checkSelf(c, pidfd)
+}
+
+func (s *pidfdSuite) acceptTime(c *C) uint64 {
+	acceptTime, err := BootTimeTicks()
+	c.Assert(err, IsNil)
+	return acceptTime
+}
+
+func (s *pidfdSuite) TestConnPeerPidfdFallback(c *C) {
+	restore := MockGetsockoptPeerPidfd(func(fd int) (int, error) {
+		return -1, unix.ENOPROTOOPT
+	})
+	defer restore()
+
+	conn, cleanup := s.connect(c)
+	defer cleanup()
+
+	pidfd, err := ConnPeerPidfd(conn, s.acceptTime(c))
+	c.Assert(err, IsNil)
+	defer pidfd.Close()
+	s.checkSelf(c, pidfd)
+}
+
+func (s *pidfdSuite) TestConnPeerPidfdFallbackReusedPid(c *C) {
+	restore := MockGetsockoptPeerPidfd(func(fd int) (int, error) {
+		return -1, unix.ENOPROTOOPT
+	})
+	defer restore()
+
+	conn, cleanup := s.connect(c)
+	defer cleanup()
+
+	// pretend that the connection was accepted before this process
+	// started
+	_, err := ConnPeerPidfd(conn, 0)
+	c.Check(err, ErrorMatches, `process [0-9]+ started after the connection was accepted`)
+}
+
+func (s *pidfdSuite) TestConnPeerPidfdError(c *C) {
+	restore := MockGetsockoptPeerPidfd(func(fd int) (int, error) {
+		return -1, unix.EPERM
+	})
+	defer restore()
+
+	conn, cleanup := s.connect(c)
+	defer cleanup()
+
+	_, err := ConnPeerPidfd(conn, s.acceptTime(c))
+	c.Check(err, ErrorMatches, `cannot obtain peer pidfd: operation not permitted`)
+}
+
+func (s *pidfdSuite) TestNonSyscallConn(c *C) {
+	_, err := ConnPeerPidfd(new(nonSyscallConn), 0)
+	c.Check(err, Equals, ErrNoPeerPidfd)
+}
+
+func (s *pidfdSuite) TestPidfdOpenNotFound(c *C) {
+	// pids are never larger than 2^22
+	_, err := PidfdOpen(1 << 23)
+	c.Check(err, Equals, ErrProcessNotFound)
+}
@@ -0,0 +1,155 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/snapcore/snapd/bootloader"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/randutil"
+	"github.com/snapcore/snapd/secboot"
+	"github.com/snapcore/snapd/secboot/keys"
+	"golang.org/x/sys/unix"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/tpm"
+)
+
+var (
+	secbootSealKeys                  = secboot.SealKeys
+	secbootResealKeys                = secboot.ResealKeys
+	secbootReleasePCRResourceHandles = secboot.ReleasePCRResourceHandles
+
+	secbootResealKeysWithDBXUpdates = resealKeysWithDBXUpdates
+
+	newRecoveryKey = keys.NewRecoveryKey
+
+	newContainerUUID = randutil.RandomKernelUUID
+
+	diskUnlockKey = diskUnlockKeyFromKernel
+
+	newEFIVariableWriter = func() efi.VariableWriter {
+		return efi.NewVarfsWriter(paths.EFIVarsDir)
+	}
+
+	tpmConnect = tpm.Connect
+
+	bootID  = osutil.BootID
+	timeNow = time.Now
+)
+
+const (
+	// the first handle used for the NV indices that revoke old PCR
+	// policies. It follows the handles reserved by snapd.
+	pcrPolicyCounterHandleStart = uint32(0x01880010)
+	pcrPolicyCounterHandleEnd   = uint32(0x018800ff)
+)
+
+// sealedObjectPath returns the path of the sealed key object for the
+// named keyslot of a container.
+func sealedObjectPath(uuid, name string) string {
+	return filepath.Join(paths.ManagerKeysDir, fmt.Sprintf("%s-%s.sealed-key", uuid, name))
+}
+
+// policyAuthKeyPath returns the path of the key that authorizes
+// updates to the PCR policy of a sealed key object.
+func policyAuthKeyPath(sealedObject string) string {
+	return sealedObject + ".policy-auth-key"
+}
+
+// modelParams converts a PCR profile into the parameters used by
+// secboot to compute the PCR protection profile, with one set of
+// parameters for each boot chain.
+func modelParams(profile *PCRProfile) ([]*secboot.SealKeyModelParams, error) {
+	if profile == nil || len(profile.BootChains) == 0 {
+		return nil, fmt.Errorf("PCR profile has no boot chains")
+	}
+
+	var params []*secboot.SealKeyModelParams
+	for _, chain := range profile.BootChains {
+		if len(chain.Images) == 0 {
+			return nil, fmt.Errorf("boot chain has no images")
+		}
+		var lc *secboot.LoadChain
+		for i := len(chain.Images) - 1; i >= 0; i-- {
+			bf := bootloader.NewBootFile("", chain.Images[i].Path, bootloader.RoleRunMode)
+			if lc == nil {
+				lc = secboot.NewLoadChain(bf)
+			} else {
+				lc = secboot.NewLoadChain(bf, lc)
+			}
+		}
+		params = append(params, &secboot.SealKeyModelParams{
+			EFILoadChains:  []*secboot.LoadChain{lc},
+			KernelCmdlines: chain.KernelCmdlines,
+		})
+	}
+	return params, nil
+}
+
+// resealKeys reseals sealed key objects against the model parameters,
+// also accepting the secure boot policies that result from applying
+// the forbidden signature database updates in keystores.
+func resealKeys(params *secboot.ResealKeysParams, keystores []string) error {
+	if len(keystores) == 0 {
+		return secbootResealKeys(params)
+	}
+	return secbootResealKeysWithDBXUpdates(params, keystores)
+}
+
+// diskUnlockKeyFromKernel returns the key that was used to unlock the
+// specified container during boot. Sealed key objects cannot be
+// unsealed once the system has booted because access to them is
+// blocked by extending a PCR, but secboot leaves the unlock key in the
+// user keyring so that it can be used to manage the keyslots.
+func diskUnlockKeyFromKernel(c *Container) ([]byte, error) {
+	candidates := []string{c.DevicePath}
+	for _, dir := range []string{"/dev/disk/by-partuuid", "/dev/disk/by-uuid"} {
+		links, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for _, link := range links {
+			if target, err := filepath.EvalSymlinks(link); err == nil && target == c.DevicePath {
+				candidates = append(candidates, link)
+			}
+		}
+	}
+
+	for _, path := range candidates {
+		desc := fmt.Sprintf("ubuntu-fde:%s:unlock", path)
+		id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", desc, 0)
+		if err != nil {
+			continue
+		}
+		sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("keyctl", err)
+		}
+		key := make([]byte, sz)
+		if _, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, key, 0); err != nil {
+			return nil, os.NewSyscallError("keyctl", err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("cannot find unlock key for %s in the kernel keyring", c.DevicePath)
+}
@@ -0,0 +1,164 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+//go:build !nosecboot
+// +build !nosecboot
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	sb_efi "github.com/snapcore/secboot/efi"
+	sb_tpm2 "github.com/snapcore/secboot/tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/secboot"
+)
+
+// initramfsPCR is the PCR that the EFI stub of the kernel measures the
+// kernel command line to.
+const initramfsPCR = 12
+
+// resealKeysWithDBXUpdates is secboot.ResealKeys with the forbidden
+// signature database updates in keystores added to the secure boot
+// policy profile, which the snapd secboot package doesn't support yet.
+func resealKeysWithDBXUpdates(params *secboot.ResealKeysParams, keystores []string) error {
+	if len(params.ModelParams) == 0 {
+		return fmt.Errorf("at least one set of model-specific parameters is required")
+	}
+	if len(params.KeyFiles) == 0 {
+		return fmt.Errorf("at least one key file is required")
+	}
+
+	tpm, err := sb_tpm2.ConnectToDefaultTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+	if !tpm.IsEnabled() {
+		return fmt.Errorf("TPM device is not enabled")
+	}
+
+	pcrProfile, err := pcrProtectionProfile(params.ModelParams, keystores)
+	if err != nil {
+		return err
+	}
+
+	authKey, err := os.ReadFile(params.TPMPolicyAuthKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the policy auth key file: %v", err)
+	}
+
+	sealedKeyObjects := make([]*sb_tpm2.SealedKeyObject, 0, len(params.KeyFiles))
+	for _, keyfile := range params.KeyFiles {
+		sko, err := sb_tpm2.ReadSealedKeyObjectFromFile(keyfile)
+		if err != nil {
+			return err
+		}
+		sealedKeyObjects = append(sealedKeyObjects, sko)
+	}
+
+	if err := sb_tpm2.UpdateKeyPCRProtectionPolicyMultiple(tpm, sealedKeyObjects, authKey, pcrProfile); err != nil {
+		return err
+	}
+	for i, sko := range sealedKeyObjects {
+		w := sb_tpm2.NewFileSealedKeyObjectWriter(params.KeyFiles[i])
+		if err := sko.WriteAtomic(w); err != nil {
+			return fmt.Errorf("cannot write key data file: %v", err)
+		}
+	}
+
+	// revoke old policies via the primary key object
+	return sealedKeyObjects[0].RevokeOldPCRProtectionPolicies(tpm, authKey)
+}
+
+// pcrProtectionProfile builds the PCR protection profile for the model
+// parameters in the same way as secboot.ResealKeys.
+func pcrProtectionProfile(modelParams []*secboot.SealKeyModelParams, keystores []string) (*sb_tpm2.PCRProtectionProfile, error) {
+	profiles := make([]*sb_tpm2.PCRProtectionProfile, 0, len(modelParams))
+	for _, mp := range modelParams {
+		profile := sb_tpm2.NewPCRProtectionProfile()
+
+		var loadSequences []*sb_efi.ImageLoadEvent
+		for _, chain := range mp.EFILoadChains {
+			ev, err := loadEvent(chain, sb_efi.Firmware)
+			if err != nil {
+				return nil, fmt.Errorf("cannot build EFI image load sequences: %v", err)
+			}
+			loadSequences = append(loadSequences, ev)
+		}
+
+		err := sb_efi.AddSecureBootPolicyProfile(profile, &sb_efi.SecureBootPolicyProfileParams{
+			PCRAlgorithm:               tpm2.HashAlgorithmSHA256,
+			LoadSequences:              loadSequences,
+			SignatureDbUpdateKeystores: keystores,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot add EFI secure boot policy profile: %v", err)
+		}
+
+		err = sb_efi.AddBootManagerProfile(profile, &sb_efi.BootManagerProfileParams{
+			PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+			LoadSequences: loadSequences,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot add EFI boot manager profile: %v", err)
+		}
+
+		if len(mp.KernelCmdlines) != 0 {
+			err := sb_efi.AddSystemdStubProfile(profile, &sb_efi.SystemdStubProfileParams{
+				PCRAlgorithm:   tpm2.HashAlgorithmSHA256,
+				PCRIndex:       initramfsPCR,
+				KernelCmdlines: mp.KernelCmdlines,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("cannot add systemd EFI stub profile: %v", err)
+			}
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	if len(profiles) == 1 {
+		return profiles[0], nil
+	}
+	return sb_tpm2.NewPCRProtectionProfile().AddProfileOR(profiles...), nil
+}
+
+// loadEvent builds the EFI image load event tree of a load chain.
+func loadEvent(lc *secboot.LoadChain, source sb_efi.ImageLoadEventSource) (*sb_efi.ImageLoadEvent, error) {
+	var next []*sb_efi.ImageLoadEvent
+	for _, chain := range lc.Next {
+		// everything that is not the root is loaded by shim
+		ev, err := loadEvent(chain, sb_efi.Shim)
+		if err != nil {
+			return nil, err
+		}
+		next = append(next, ev)
+	}
+	if !osutil.FileExists(lc.Path) {
+		return nil, fmt.Errorf("file %s does not exist", lc.Path)
+	}
+	return &sb_efi.ImageLoadEvent{
+		Source: source,
+		Image:  sb_efi.FileImage(lc.Path),
+		Next:   next,
+	}, nil
+}
@@ -0,0 +1,155 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/snapcore/snapd/logger"
+
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+// UnlockMethod describes how a container was unlocked at boot.
+type UnlockMethod string
+
+const (
+	UnlockTPM         UnlockMethod = "tpm"
+	UnlockTPMWithPIN  UnlockMethod = "tpm-pin"
+	UnlockPassphrase  UnlockMethod = "passphrase"
+	UnlockRecoveryKey UnlockMethod = "recovery-key"
+)
+
+// BootUnlock records how a container was unlocked at boot.
+type BootUnlock struct {
+	// BootID is the ID of the boot during which the container was
+	// unlocked.
+	BootID string       `json:"boot-id"`
+	Method UnlockMethod `json:"method"`
+	// Keyslot is the number of the keyslot that was used, if known.
+	Keyslot *int `json:"keyslot,omitempty"`
+}
+
+// BootUnlockMetadata is recorded during boot for each container that
+// is unlocked. Either the method or the keyslot that was used must be
+// known, as the method can be derived from what protects the keyslot.
+type BootUnlockMetadata struct {
+	Method  UnlockMethod `json:"method,omitempty"`
+	Keyslot *int         `json:"keyslot,omitempty"`
+}
+
+// readBootUnlockMetadata returns the metadata recorded during the
+// current boot, keyed by container UUID. It is the source of how the
+// containers were unlocked and can be replaced.
+var readBootUnlockMetadata = readBootUnlockStateFile
+
+func readBootUnlockStateFile() (map[string]*BootUnlockMetadata, error) {
+	f, err := os.Open(paths.BootUnlockStateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var state struct {
+		Containers map[string]*BootUnlockMetadata `json:"containers"`
+	}
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %v", paths.BootUnlockStateFile, err)
+	}
+	return state.Containers, nil
+}
+
+// unlockMethod determines how the container was unlocked from the
+// metadata recorded during boot.
+func (c *Container) unlockMethod(md *BootUnlockMetadata) (UnlockMethod, error) {
+	switch md.Method {
+	case UnlockTPM, UnlockTPMWithPIN, UnlockPassphrase, UnlockRecoveryKey:
+		return md.Method, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown unlock method %q", md.Method)
+	}
+
+	if md.Keyslot == nil {
+		return "", fmt.Errorf("neither the unlock method nor the keyslot is known")
+	}
+	ks := c.Keyslot(*md.Keyslot)
+	if ks == nil {
+		return "", fmt.Errorf("keyslot %d is not in use", *md.Keyslot)
+	}
+	switch ks.Protector {
+	case ProtectorTPM:
+		if ks.PIN {
+			return UnlockTPMWithPIN, nil
+		}
+		return UnlockTPM, nil
+	case ProtectorRecoveryKey:
+		return UnlockRecoveryKey, nil
+	case ProtectorPassphrase:
+		return UnlockPassphrase, nil
+	}
+	return "", fmt.Errorf("keyslot %d is protected by an unknown method", *md.Keyslot)
+}
+
+// updateBootUnlock records how the container was unlocked during the
+// current boot, adding a notice the first time that a recovery key is
+// found to have been used. It must be called with the state locked.
+func (m *FDEManager) updateBootUnlock(c *Container, md *BootUnlockMetadata, currentBootID string) {
+	if c.BootUnlock != nil && c.BootUnlock.BootID != currentBootID {
+		c.BootUnlock = nil
+	}
+	if md == nil || currentBootID == "" {
+		return
+	}
+
+	method, err := c.unlockMethod(md)
+	if err != nil {
+		logger.Noticef("cannot determine how %s was unlocked: %v", c.DevicePath, err)
+		return
+	}
+	previous := c.BootUnlock
+	c.BootUnlock = &BootUnlock{
+		BootID:  currentBootID,
+		Method:  method,
+		Keyslot: md.Keyslot,
+	}
+	if method != UnlockRecoveryKey || (previous != nil && previous.Method == method) {
+		return
+	}
+
+	data := map[string]string{
+		"device-path": c.DevicePath,
+		"boot-id":     currentBootID,
+	}
+	if md.Keyslot != nil {
+		if ks := c.Keyslot(*md.Keyslot); ks != nil && ks.Name != "" {
+			data["keyslot"] = ks.Name
+		}
+	}
+	if _, err := noticestate.AddNotice(m.state, noticestate.RecoveryKeyUsed, c.UUID, &noticestate.AddOptions{Data: data}); err != nil {
+		logger.Noticef("cannot record recovery key used notice for %s: %v", c.DevicePath, err)
+	}
+}
@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+type bootSuite struct {
+	fdeMgrBaseSuite
+
+	bootID string
+}
+
+var _ = Suite(&bootSuite{})
+
+const bootTestUUID = "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"
+
+func (s *bootSuite) SetUpTest(c *C) {
+	s.fdeMgrBaseSuite.SetUpTest(c)
+
+	s.bootID = "boot-1"
+	s.AddCleanup(fdestate.MockBootID(func() (string, error) {
+		return s.bootID, nil
+	}))
+
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	s.mockHeader(c, "/dev/sda4", bootTestUUID)
+}
+
+func (s *bootSuite) mockBootUnlockState(c *C, content string) {
+	c.Assert(os.MkdirAll(filepath.Dir(paths.BootUnlockStateFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(paths.BootUnlockStateFile, []byte(content), 0644), IsNil)
+}
+
+func (s *bootSuite) bootUnlock(c *C) *fdestate.BootUnlock {
+	containers := s.containers(c)
+	c.Assert(containers, HasLen, 1)
+	return containers[0].BootUnlock
+}
+
+func (s *bootSuite) notices(c *C) []*noticestate.Notice {
+	s.st.Lock()
+	defer s.st.Unlock()
+	notices, err := noticestate.Notices(s.st, nil)
+	c.Assert(err, IsNil)
+	return notices
+}
+
+func (s *bootSuite) TestBootUnlockMethod(c *C) {
+	s.mockBootUnlockState(c, `{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{"method":"passphrase"}}}`)
+
+	s.ensure(c)
+
+	c.Check(s.bootUnlock(c), DeepEquals, &fdestate.BootUnlock{
+		BootID: "boot-1",
+		Method: fdestate.UnlockPassphrase,
+	})
+	c.Check(s.notices(c), HasLen, 0)
+}
+
+func (s *bootSuite) TestBootUnlockMethodFromKeyslot(c *C) {
+	s.mockBootUnlockState(c, `{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{"keyslot":0}}}`)
+
+	s.ensure(c)
+
+	slot := 0
+	c.Check(s.bootUnlock(c), DeepEquals, &fdestate.BootUnlock{
+		BootID:  "boot-1",
+		Method:  fdestate.UnlockTPM,
+		Keyslot: &slot,
+	})
+
+	// a PIN is required for the keyslot
+	s.st.Lock()
+	container, err := fdestate.ContainerByUUID(s.st, bootTestUUID)
+	c.Assert(err, IsNil)
+	container.Keyslots[0].PIN = true
+	c.Assert(fdestate.SetContainer(s.st, container), IsNil)
+	s.st.Unlock()
+
+	s.ensure(c)
+
+	c.Check(s.bootUnlock(c).Method, Equals, fdestate.UnlockTPMWithPIN)
+}
+
+func (s *bootSuite) TestBootUnlockRecoveryKeyNotice(c *C) {
+	s.mockBootUnlockState(c, `{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{"keyslot":1}}}`)
+
+	s.ensure(c)
+
+	c.Check(s.bootUnlock(c).Method, Equals, fdestate.UnlockRecoveryKey)
+	notices := s.notices(c)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, noticestate.RecoveryKeyUsed)
+	c.Check(notices[0].Key, Equals, bootTestUUID)
+	c.Check(notices[0].LastData, DeepEquals, map[string]string{
+		"device-path": "/dev/sda4",
+		"boot-id":     "boot-1",
+		"keyslot":     "default-recovery",
+	})
+
+	// the notice is added once per boot
+	s.ensure(c)
+	notices = s.notices(c)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Occurrences, Equals, 1)
+
+	s.bootID = "boot-2"
+	s.mockBootUnlockState(c, `{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{"method":"tpm"}}}`)
+	s.ensure(c)
+	c.Check(s.bootUnlock(c).Method, Equals, fdestate.UnlockTPM)
+	c.Check(s.notices(c)[0].Occurrences, Equals, 1)
+
+	s.bootID = "boot-3"
+	s.mockBootUnlockState(c, `{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{"method":"recovery-key"}}}`)
+	s.ensure(c)
+	notices = s.notices(c)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Occurrences, Equals, 2)
+	c.Check(notices[0].LastData, DeepEquals, map[string]string{
+		"device-path": "/dev/sda4",
+		"boot-id":     "boot-3",
+	})
+}
+
+func (s *bootSuite) TestBootUnlockClearedOnNewBoot(c *C) {
+	s.mockBootUnlockState(c, `{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{"method":"tpm"}}}`)
+	s.ensure(c)
+	c.Check(s.bootUnlock(c), NotNil)
+
+	// nothing was recorded during the new boot
+	s.bootID = "boot-2"
+	c.Assert(os.Remove(paths.BootUnlockStateFile), IsNil)
+	s.ensure(c)
+	c.Check(s.bootUnlock(c), IsNil)
+}
+
+func (s *bootSuite) TestBootUnlockUnknown(c *C) {
+	for _, content := range []string{
+		`{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{"method":"fido2"}}}`,
+		`{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{"keyslot":5}}}`,
+		`{"containers":{"7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21":{}}}`,
+		`{"containers":{"5a5ae4a0-d9b6-477f-9b0b-2bcd0cc9dc4d":{"method":"tpm"}}}`,
+		`garbage`,
+	} {
+		s.mockBootUnlockState(c, content)
+		s.ensure(c)
+		c.Check(s.bootUnlock(c), IsNil, Commentf(content))
+	}
+}
+
+func (s *bootSuite) TestBootUnlockSource(c *C) {
+	slot := 1
+	restore := fdestate.MockReadBootUnlockMetadata(func() (map[string]*fdestate.BootUnlockMetadata, error) {
+		return map[string]*fdestate.BootUnlockMetadata{
+			bootTestUUID: {Keyslot: &slot},
+		}, nil
+	})
+	defer restore()
+
+	s.ensure(c)
+	c.Check(s.bootUnlock(c).Method, Equals, fdestate.UnlockRecoveryKey)
+
+	fdestate.MockReadBootUnlockMetadata(func() (map[string]*fdestate.BootUnlockMetadata, error) {
+		return nil, errors.New("boom")
+	})
+	s.ensure(c)
+	// the metadata of the current boot is retained
+	c.Check(s.bootUnlock(c).Method, Equals, fdestate.UnlockRecoveryKey)
+}
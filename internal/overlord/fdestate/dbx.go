@@ -0,0 +1,334 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/overlord/restart"
+	"github.com/snapcore/snapd/overlord/state"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+// dbxUpdateAttributes are the attributes of an authenticated write
+// that appends to the forbidden signature database.
+const dbxUpdateAttributes = efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess |
+	efi.AttributeTimeBasedAuthenticatedWriteAccess | efi.AttributeAppendWrite
+
+// dbxUpdateKeystore returns the directory that holds the update
+// applied by the change with the specified prepare-dbx-update task, in
+// the layout used by sbkeysync.
+func dbxUpdateKeystore(prepareTaskID string) string {
+	return filepath.Join(paths.ManagerDBXUpdatesDir, prepareTaskID)
+}
+
+func dbxUpdateFile(keystore string) string {
+	return filepath.Join(keystore, "dbx", "update.auth")
+}
+
+// checkDBXUpdateConflict returns a *ChangeConflictError if there is an
+// in-progress change that updates the forbidden signature database.
+func checkDBXUpdateConflict(st *state.State) error {
+	for _, chg := range st.Changes() {
+		if chg.IsReady() {
+			continue
+		}
+		for _, t := range chg.Tasks() {
+			if t.Kind() == "prepare-dbx-update" {
+				return &ChangeConflictError{ChangeKind: chg.Kind(), ChangeID: chg.ID()}
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateDBX returns the tasks that append an update to the secure boot
+// forbidden signature database, where payload is an authenticated
+// write of the dbx variable. The TPM protected keyslots of every
+// container are first resealed so that they can be unsealed with both
+// the current and the updated database. The update is applied by the
+// firmware on the next boot, after which the keyslots are resealed
+// against the updated database only.
+func UpdateDBX(st *state.State, payload []byte) (*state.TaskSet, error) {
+	update, err := efi.StripVariableAuthentication(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dbx update: %v", err)
+	}
+	if len(update) == 0 {
+		return nil, fmt.Errorf("invalid dbx update: no signatures")
+	}
+	if _, err := efi.AppendSignatureDatabase(nil, update); err != nil {
+		return nil, fmt.Errorf("invalid dbx update: %v", err)
+	}
+
+	if err := checkDBXUpdateConflict(st); err != nil {
+		return nil, err
+	}
+	containers, err := Containers(st)
+	if err != nil {
+		return nil, err
+	}
+	var sealed []*Container
+	for _, c := range containers {
+		if !c.hasSealedKeys() {
+			continue
+		}
+		if c.PendingPCRProfile != nil {
+			return nil, fmt.Errorf("cannot update dbx: PCR profile of %s is not committed yet", c.DevicePath)
+		}
+		if _, err := modelParams(c.PCRProfile); err != nil {
+			return nil, fmt.Errorf("cannot update dbx: cannot reseal keys for %s: %v", c.DevicePath, err)
+		}
+		if err := checkChangeConflict(st, c.UUID); err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, c)
+	}
+
+	prepare := st.NewTask("prepare-dbx-update", "Prepare update of the forbidden signature database")
+	prepare.Set("payload", payload)
+	keystore := dbxUpdateKeystore(prepare.ID())
+	ts := state.NewTaskSet(prepare)
+
+	write := st.NewTask("write-dbx-update", "Write update of the forbidden signature database")
+	write.Set("prepare-task", prepare.ID())
+	write.WaitFor(prepare)
+
+	finalize := st.NewTask("finalize-dbx-update", "Verify that the firmware applied the forbidden signature database update")
+	finalize.Set("prepare-task", prepare.ID())
+	finalize.Set("write-task", write.ID())
+	finalize.WaitFor(write)
+
+	// the keys are resealed against the current boot chains, first
+	// also accepting the updated database and then only that
+	for _, c := range sealed {
+		reseal := st.NewTask("reseal-key", fmt.Sprintf("Reseal keys for %s to allow the dbx update", c.DevicePath))
+		reseal.Set("container", c.UUID)
+		reseal.Set("pcr-profile", &PCRProfile{
+			PCRs:               c.PCRProfile.PCRs,
+			BootChains:         c.PCRProfile.BootChains,
+			DBXUpdateKeystores: []string{keystore},
+		})
+		reseal.WaitFor(prepare)
+		write.WaitFor(reseal)
+		ts.AddTask(reseal)
+	}
+	ts.AddTask(write)
+	ts.AddTask(finalize)
+	for _, c := range sealed {
+		reseal := st.NewTask("reseal-key", fmt.Sprintf("Reseal keys for %s after the dbx update", c.DevicePath))
+		reseal.Set("container", c.UUID)
+		reseal.Set("pcr-profile", &PCRProfile{
+			PCRs:       c.PCRProfile.PCRs,
+			BootChains: c.PCRProfile.BootChains,
+		})
+		reseal.WaitFor(finalize)
+		ts.AddTask(reseal)
+	}
+
+	return ts, nil
+}
+
+// predictDBXUpdate returns the current value of PCR 7 and the value it
+// will have once update is appended to the forbidden signature
+// database, by replaying the event log of the current boot.
+func predictDBXUpdate(update []byte) (current, updated []byte, err error) {
+	log, err := efi.ReadLogFile(paths.EventLogFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read TCG event log: %v", err)
+	}
+	vars, err := log.SecureBootVariables()
+	if err != nil {
+		return nil, nil, err
+	}
+	dbx, err := efi.AppendSignatureDatabase(vars["dbx"], update)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	before, err := log.Replay([]int{7}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := log.Replay([]int{7}, &efi.ReplayParams{Variables: map[string][]byte{"dbx": dbx}})
+	if err != nil {
+		return nil, nil, err
+	}
+	return before[7], after[7], nil
+}
+
+func (m *FDEManager) doPrepareDBXUpdate(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	var payload []byte
+	if err := t.Get("payload", &payload); err != nil {
+		return err
+	}
+	keystore := dbxUpdateKeystore(t.ID())
+
+	st.Unlock()
+	err := func() error {
+		path := dbxUpdateFile(keystore)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		return osutil.AtomicWriteFile(path, payload, 0600, 0)
+	}()
+	var current, updated []byte
+	var predictErr error
+	if err == nil {
+		var update []byte
+		update, predictErr = efi.StripVariableAuthentication(payload)
+		if predictErr == nil {
+			current, updated, predictErr = predictDBXUpdate(update)
+		}
+	}
+	st.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot store dbx update: %v", err)
+	}
+
+	if predictErr != nil {
+		t.Logf("Cannot predict PCR 7 value after the update: %v", predictErr)
+	} else {
+		t.Logf("PCR 7 value will change from %x to %x", current, updated)
+	}
+	return nil
+}
+
+func (m *FDEManager) undoPrepareDBXUpdate(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	keystore := dbxUpdateKeystore(t.ID())
+	st.Unlock()
+
+	return os.RemoveAll(keystore)
+}
+
+func (m *FDEManager) doWriteDBXUpdate(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	var prepareID string
+	if err := t.Get("prepare-task", &prepareID); err != nil {
+		return err
+	}
+	keystore := dbxUpdateKeystore(prepareID)
+
+	st.Unlock()
+	err := func() error {
+		payload, err := os.ReadFile(dbxUpdateFile(keystore))
+		if err != nil {
+			return err
+		}
+		return newEFIVariableWriter().WriteVariable("dbx", efi.ImageSecurityDatabase, dbxUpdateAttributes, payload)
+	}()
+	st.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot write dbx update: %v", err)
+	}
+
+	// the update is applied by the firmware on the next boot
+	id, err := bootID()
+	if err != nil {
+		return fmt.Errorf("cannot obtain boot ID: %v", err)
+	}
+	t.Set("boot-id", id)
+	if _, err := noticestate.AddNotice(st, noticestate.DBXUpdatePending, t.Change().ID(), nil); err != nil {
+		logger.Noticef("cannot record dbx update pending notice: %v", err)
+	}
+	return nil
+}
+
+func (m *FDEManager) doFinalizeDBXUpdate(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	var prepareID, writeID string
+	if err := t.Get("prepare-task", &prepareID); err != nil {
+		return err
+	}
+	if err := t.Get("write-task", &writeID); err != nil {
+		return err
+	}
+	wt := st.Task(writeID)
+	if wt == nil {
+		return fmt.Errorf("internal error: cannot find task %s", writeID)
+	}
+	var writeBootID string
+	if err := wt.Get("boot-id", &writeBootID); err != nil {
+		return err
+	}
+	currentBootID, err := bootID()
+	if err != nil {
+		return fmt.Errorf("cannot obtain boot ID: %v", err)
+	}
+	if currentBootID == writeBootID {
+		// this runs again once the system has rebooted
+		return restart.TaskWaitForRestart(t)
+	}
+	keystore := dbxUpdateKeystore(prepareID)
+
+	st.Unlock()
+	err = func() error {
+		payload, err := os.ReadFile(dbxUpdateFile(keystore))
+		if err != nil {
+			return err
+		}
+		update, err := efi.StripVariableAuthentication(payload)
+		if err != nil {
+			return err
+		}
+		log, err := efi.ReadLogFile(paths.EventLogFile)
+		if err != nil {
+			return fmt.Errorf("cannot read TCG event log: %v", err)
+		}
+		vars, err := log.SecureBootVariables()
+		if err != nil {
+			return err
+		}
+		// the measured database already has every signature of
+		// the update if it was applied
+		updated, err := efi.AppendSignatureDatabase(vars["dbx"], update)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(updated, vars["dbx"]) {
+			return errors.New("dbx update was not applied by the firmware")
+		}
+		return os.RemoveAll(keystore)
+	}()
+	st.Lock()
+	return err
+}
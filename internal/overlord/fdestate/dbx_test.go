@@ -0,0 +1,333 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/overlord/restart"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot"
+	"github.com/snapcore/snapd/testutil"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/efi/efitest"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+type dbxSuite struct {
+	fdeMgrBaseSuite
+
+	bootID   string
+	rm       *restart.RestartManager
+	varStore *efitest.VariableStore
+
+	dbx     []byte
+	payload []byte
+
+	resealCalls    []*secboot.ResealKeysParams
+	dbxResealCalls []*secboot.ResealKeysParams
+	dbxKeystores   [][]string
+	dbxResealErr   error
+}
+
+var _ = Suite(&dbxSuite{})
+
+var dbxOwner = efi.GUID{0x77, 0xfa, 0x9a, 0xbd, 0x03, 0x59, 0xb6, 0x4d, 0x80, 0x04, 0x7c, 0x0c, 0xa3, 0x3e, 0xec, 0x8e}
+
+const dbxAttributes = efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess | efi.AttributeTimeBasedAuthenticatedWriteAccess
+
+func revoked(name string) []byte {
+	h := sha256.Sum256([]byte(name))
+	return h[:]
+}
+
+func (s *dbxSuite) SetUpTest(c *C) {
+	s.fdeMgrBaseSuite.SetUpTest(c)
+
+	s.bootID = "boot-1"
+	s.resealCalls = nil
+	s.dbxResealCalls = nil
+	s.dbxKeystores = nil
+	s.dbxResealErr = nil
+
+	s.st.Lock()
+	rm, err := restart.Manager(s.st, "boot-1", nil)
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+	s.rm = rm
+
+	s.varStore = efitest.NewVariableStore(filepath.Join(c.MkDir(), "efivars"))
+	s.AddCleanup(fdestate.MockEFIVariableWriter(s.varStore))
+	s.AddCleanup(fdestate.MockBootID(func() (string, error) {
+		return s.bootID, nil
+	}))
+	s.AddCleanup(fdestate.MockSecbootResealKeys(func(params *secboot.ResealKeysParams) error {
+		s.resealCalls = append(s.resealCalls, params)
+		return nil
+	}))
+	s.AddCleanup(fdestate.MockSecbootResealKeysWithDBXUpdates(func(params *secboot.ResealKeysParams, keystores []string) error {
+		s.dbxResealCalls = append(s.dbxResealCalls, params)
+		s.dbxKeystores = append(s.dbxKeystores, keystores)
+		return s.dbxResealErr
+	}))
+
+	s.dbx = efitest.NewSignatureList(efi.CertSHA256, dbxOwner, revoked("shim-1"))
+	s.payload = efitest.NewAuthenticatedVariable(efitest.NewSignatureList(efi.CertSHA256, dbxOwner, revoked("shim-2")))
+	s.writeEventLog(c, s.dbx)
+	c.Assert(s.varStore.WriteVariable("dbx", efi.ImageSecurityDatabase, dbxAttributes, efitest.NewAuthenticatedVariable(s.dbx)), IsNil)
+
+	s.st.Lock()
+	defer s.st.Unlock()
+	c.Assert(fdestate.SetContainer(s.st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       testUUID,
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "run", Protector: fdestate.ProtectorTPM, SealedObject: s.sealedObject()},
+			{Slot: 1, Name: "recovery", Protector: fdestate.ProtectorRecoveryKey},
+		},
+		PCRProfile: s.profile(),
+	}), IsNil)
+}
+
+func (s *dbxSuite) sealedObject() string {
+	return filepath.Join(paths.ManagerKeysDir, testUUID+"-run.sealed-key")
+}
+
+func (s *dbxSuite) profile() *fdestate.PCRProfile {
+	return &fdestate.PCRProfile{
+		PCRs: fdestate.DefaultPCRs,
+		BootChains: []*fdestate.BootChain{
+			{
+				Images: []*fdestate.BootImage{
+					{Path: "/boot/efi/EFI/ubuntu/shimx64.efi", Digest: digest("shimx64.efi")},
+					{Path: "/boot/efi/EFI/ubuntu/grubx64.efi", Digest: digest("grubx64.efi")},
+					{Path: "/boot/efi/EFI/ubuntu/kernel.efi", Digest: digest("kernel.efi")},
+				},
+				KernelCmdlines: []string{"console=ttyS0 quiet"},
+			},
+		},
+	}
+}
+
+func (s *dbxSuite) container(c *C) *fdestate.Container {
+	s.st.Lock()
+	defer s.st.Unlock()
+	container, err := fdestate.ContainerByUUID(s.st, testUUID)
+	c.Assert(err, IsNil)
+	return container
+}
+
+// writeEventLog writes the event log of a boot that measured the
+// specified forbidden signature database.
+func (s *dbxSuite) writeEventLog(c *C, dbx []byte) {
+	log := efitest.NewLog(&efitest.LogParams{
+		KernelCmdline: "console=ttyS0 quiet",
+		Variables: map[string][]byte{
+			"SecureBoot": {1},
+			"dbx":        dbx,
+		},
+	})
+	var buf bytes.Buffer
+	c.Assert(log.Write(&buf), IsNil)
+	c.Assert(os.MkdirAll(filepath.Dir(paths.EventLogFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(paths.EventLogFile, buf.Bytes(), 0444), IsNil)
+}
+
+// reboot simulates a reboot of the system, after which the firmware
+// measured the specified forbidden signature database.
+func (s *dbxSuite) reboot(c *C, bootID string, dbx []byte) {
+	s.writeEventLog(c, dbx)
+	s.bootID = bootID
+	s.st.Lock()
+	restart.ReplaceBootID(s.st, bootID)
+	s.st.Unlock()
+	c.Assert(s.rm.StartUp(), IsNil)
+}
+
+func (s *dbxSuite) runUpdateDBX(c *C) *state.Change {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	ts, err := fdestate.UpdateDBX(s.st, s.payload)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("update-dbx", "...")
+	chg.AddAll(ts)
+
+	s.st.Unlock()
+	s.settle(c)
+	s.st.Lock()
+
+	return chg
+}
+
+func (s *dbxSuite) taskOfKind(chg *state.Change, kind string) *state.Task {
+	for _, t := range chg.Tasks() {
+		if t.Kind() == kind {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *dbxSuite) TestUpdateDBX(c *C) {
+	chg := s.runUpdateDBX(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	var kinds []string
+	for _, t := range chg.Tasks() {
+		kinds = append(kinds, t.Kind())
+	}
+	c.Check(kinds, DeepEquals, []string{"prepare-dbx-update", "reseal-key", "write-dbx-update", "finalize-dbx-update", "reseal-key"})
+
+	// the keys are resealed to also accept the updated database
+	prepare := s.taskOfKind(chg, "prepare-dbx-update")
+	keystore := filepath.Join(paths.ManagerDBXUpdatesDir, prepare.ID())
+	c.Check(filepath.Join(keystore, "dbx/update.auth"), testutil.FileEquals, s.payload)
+	c.Check(s.dbxKeystores, DeepEquals, [][]string{{keystore}})
+	c.Assert(s.dbxResealCalls, HasLen, 1)
+	c.Check(s.dbxResealCalls[0].KeyFiles, DeepEquals, []string{s.sealedObject()})
+	c.Check(s.resealCalls, HasLen, 0)
+	c.Check(strings.Join(prepare.Log(), "\n"), Matches, `(?s).*PCR 7 value will change from [0-9a-f]{64} to [0-9a-f]{64}`)
+
+	// the update is written
+	updated := append(append([]byte(nil), s.dbx...), efitest.NewSignatureList(efi.CertSHA256, dbxOwner, revoked("shim-2"))...)
+	attrs, dbx, err := s.varStore.Variable("dbx", efi.ImageSecurityDatabase)
+	c.Assert(err, IsNil)
+	c.Check(attrs, Equals, dbxAttributes)
+	c.Check(dbx, DeepEquals, updated)
+
+	// and the change waits for a reboot
+	c.Check(s.taskOfKind(chg, "finalize-dbx-update").Status(), Equals, state.WaitStatus)
+	c.Check(chg.Status(), Equals, state.WaitStatus)
+	notices, err := noticestate.Notices(s.st, &noticestate.Filter{Types: []noticestate.Type{noticestate.DBXUpdatePending}})
+	c.Assert(err, IsNil)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Key, Equals, chg.ID())
+	s.st.Unlock()
+
+	container := s.container(c)
+	c.Check(container.PCRProfile.DBXUpdateKeystores, DeepEquals, []string{keystore})
+
+	// restarting the daemon doesn't complete the change
+	c.Assert(s.rm.StartUp(), IsNil)
+	s.settle(c)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.WaitStatus)
+	s.st.Unlock()
+
+	s.reboot(c, "boot-2", updated)
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	c.Check(chg.Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+
+	// the keys are resealed against the updated database only
+	c.Check(s.dbxResealCalls, HasLen, 1)
+	c.Assert(s.resealCalls, HasLen, 1)
+	c.Check(s.resealCalls[0].KeyFiles, DeepEquals, []string{s.sealedObject()})
+	c.Check(s.container(c).PCRProfile.DBXUpdateKeystores, HasLen, 0)
+	c.Check(osutil.FileExists(keystore), Equals, false)
+}
+
+func (s *dbxSuite) TestUpdateDBXNotApplied(c *C) {
+	chg := s.runUpdateDBX(c)
+
+	s.reboot(c, "boot-2", s.dbx)
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*dbx update was not applied by the firmware.*`)
+	reseal := chg.Tasks()[len(chg.Tasks())-1]
+	c.Check(reseal.Kind(), Equals, "reseal-key")
+	c.Check(reseal.Status(), Equals, state.HoldStatus)
+	s.st.Unlock()
+
+	// the keys still accept both databases
+	c.Check(s.resealCalls, HasLen, 0)
+	c.Check(s.container(c).PCRProfile.DBXUpdateKeystores, HasLen, 1)
+}
+
+func (s *dbxSuite) TestUpdateDBXResealError(c *C) {
+	s.dbxResealErr = errors.New("boom")
+
+	chg := s.runUpdateDBX(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot reseal .*: boom.*`)
+	c.Check(s.taskOfKind(chg, "prepare-dbx-update").Status(), Equals, state.UndoneStatus)
+	c.Check(s.taskOfKind(chg, "write-dbx-update").Status(), Equals, state.HoldStatus)
+	s.st.Unlock()
+
+	// the update is neither kept nor written
+	dirs, err := ioutil.ReadDir(paths.ManagerDBXUpdatesDir)
+	c.Assert(err, IsNil)
+	c.Check(dirs, HasLen, 0)
+	_, dbx, err := s.varStore.Variable("dbx", efi.ImageSecurityDatabase)
+	c.Assert(err, IsNil)
+	c.Check(dbx, DeepEquals, s.dbx)
+}
+
+func (s *dbxSuite) TestUpdateDBXErrors(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	_, err := fdestate.UpdateDBX(s.st, []byte("payload"))
+	c.Check(err, ErrorMatches, "invalid dbx update: authentication header is truncated")
+	_, err = fdestate.UpdateDBX(s.st, efitest.NewAuthenticatedVariable(nil))
+	c.Check(err, ErrorMatches, "invalid dbx update: no signatures")
+	_, err = fdestate.UpdateDBX(s.st, efitest.NewAuthenticatedVariable([]byte("garbage")))
+	c.Check(err, ErrorMatches, "invalid dbx update: cannot decode signature database update: .*")
+
+	// only one update is applied at a time
+	ts, err := fdestate.UpdateDBX(s.st, s.payload)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("update-dbx", "...")
+	chg.AddAll(ts)
+	_, err = fdestate.UpdateDBX(s.st, s.payload)
+	c.Check(err, FitsTypeOf, &fdestate.ChangeConflictError{})
+	c.Check(err, ErrorMatches, `"update-dbx" change in progress`)
+
+	// and containers cannot be modified meanwhile
+	_, err = fdestate.Reseal(s.st, testUUID, s.profile())
+	c.Check(err, ErrorMatches, `container .* has "update-dbx" change in progress`)
+	chg.Abort()
+
+	container, err := fdestate.ContainerByUUID(s.st, testUUID)
+	c.Assert(err, IsNil)
+	container.PendingPCRProfile = s.profile()
+	c.Assert(fdestate.SetContainer(s.st, container), IsNil)
+	_, err = fdestate.UpdateDBX(s.st, s.payload)
+	c.Check(err, ErrorMatches, "cannot update dbx: PCR profile of /dev/sda4 is not committed yet")
+}
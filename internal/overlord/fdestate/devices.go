@@ -0,0 +1,62 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+// activeContainers returns the paths of the block devices that back
+// the currently active LUKS2 device mapper volumes.
+func activeContainers() ([]string, error) {
+	uuids, err := filepath.Glob(filepath.Join(paths.SysfsDir, "block", "dm-*", "dm", "uuid"))
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for _, uuidFile := range uuids {
+		uuid, err := ioutil.ReadFile(uuidFile)
+		if err != nil {
+			return nil, err
+		}
+		// cryptsetup sets the device mapper UUID of LUKS2 volumes to
+		// CRYPT-LUKS2-<container uuid without dashes>-<name>
+		if !strings.HasPrefix(string(uuid), "CRYPT-LUKS2-") {
+			continue
+		}
+
+		slaves, err := ioutil.ReadDir(filepath.Join(filepath.Dir(filepath.Dir(uuidFile)), "slaves"))
+		if err != nil {
+			return nil, err
+		}
+		if len(slaves) != 1 {
+			continue
+		}
+		devices = append(devices, filepath.Join("/dev", slaves[0].Name()))
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
@@ -0,0 +1,165 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"time"
+
+	"github.com/snapcore/snapd/secboot"
+	"github.com/snapcore/snapd/secboot/keys"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+)
+
+var ActiveContainers = activeContainers
+
+func MockSecbootSealKeys(f func(keys []secboot.SealKeyRequest, params *secboot.SealKeysParams) error) (restore func()) {
+	old := secbootSealKeys
+	secbootSealKeys = f
+	return func() {
+		secbootSealKeys = old
+	}
+}
+
+func MockSecbootResealKeys(f func(params *secboot.ResealKeysParams) error) (restore func()) {
+	old := secbootResealKeys
+	secbootResealKeys = f
+	return func() {
+		secbootResealKeys = old
+	}
+}
+
+func MockSecbootResealKeysWithDBXUpdates(f func(params *secboot.ResealKeysParams, keystores []string) error) (restore func()) {
+	old := secbootResealKeysWithDBXUpdates
+	secbootResealKeysWithDBXUpdates = f
+	return func() {
+		secbootResealKeysWithDBXUpdates = old
+	}
+}
+
+func MockEFIVariableWriter(w efi.VariableWriter) (restore func()) {
+	old := newEFIVariableWriter
+	newEFIVariableWriter = func() efi.VariableWriter {
+		return w
+	}
+	return func() {
+		newEFIVariableWriter = old
+	}
+}
+
+func MockSecbootReleasePCRResourceHandles(f func(handles ...uint32) error) (restore func()) {
+	old := secbootReleasePCRResourceHandles
+	secbootReleasePCRResourceHandles = f
+	return func() {
+		secbootReleasePCRResourceHandles = old
+	}
+}
+
+func MockDiskUnlockKey(f func(c *Container) ([]byte, error)) (restore func()) {
+	old := diskUnlockKey
+	diskUnlockKey = f
+	return func() {
+		diskUnlockKey = old
+	}
+}
+
+func (m *FDEManager) UnlockKeys() map[string][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make(map[string][]byte, len(m.unlockKeys))
+	for k, v := range m.unlockKeys {
+		keys[k] = v
+	}
+	return keys
+}
+
+var ModelParams = modelParams
+
+func MockBootID(f func() (string, error)) (restore func()) {
+	old := bootID
+	bootID = f
+	return func() {
+		bootID = old
+	}
+}
+
+func MockNewRecoveryKey(f func() (keys.RecoveryKey, error)) (restore func()) {
+	old := newRecoveryKey
+	newRecoveryKey = f
+	return func() {
+		newRecoveryKey = old
+	}
+}
+
+func MockTimeNow(f func() time.Time) (restore func()) {
+	old := timeNow
+	timeNow = f
+	return func() {
+		timeNow = old
+	}
+}
+
+func (m *FDEManager) RecoveryKeys() map[string]keys.RecoveryKey {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	recoveryKeys := make(map[string]keys.RecoveryKey, len(m.recoveryKeys))
+	for id, key := range m.recoveryKeys {
+		recoveryKeys[id] = *key
+	}
+	return recoveryKeys
+}
+
+var RecoveryKeyString = recoveryKeyString
+
+func MockPromptTimeout(timeout time.Duration) (restore func()) {
+	old := promptTimeout
+	promptTimeout = timeout
+	return func() {
+		promptTimeout = old
+	}
+}
+
+func (m *FDEManager) Secrets() map[string]*Secrets {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	secrets := make(map[string]*Secrets, len(m.secrets))
+	for id, s := range m.secrets {
+		secrets[id] = s
+	}
+	return secrets
+}
+
+func MockReadBootUnlockMetadata(f func() (map[string]*BootUnlockMetadata, error)) (restore func()) {
+	old := readBootUnlockMetadata
+	readBootUnlockMetadata = f
+	return func() {
+		readBootUnlockMetadata = old
+	}
+}
+
+func MockNewContainerUUID(f func() (string, error)) (restore func()) {
+	old := newContainerUUID
+	newContainerUUID = f
+	return func() {
+		newContainerUUID = old
+	}
+}
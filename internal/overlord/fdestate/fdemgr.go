@@ -0,0 +1,465 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot/keys"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+)
+
+// FDEManager is responsible for tracking the encrypted containers of
+// the system and for the lifecycle of the keys that protect them.
+type FDEManager struct {
+	state *state.State
+
+	mu         sync.Mutex
+	refreshing bool
+	stopped    bool
+	wg         sync.WaitGroup
+
+	// unlockKeys holds the keys obtained by unseal-key tasks, keyed
+	// by change ID and container UUID. They are never written to
+	// the state.
+	unlockKeys map[string][]byte
+	// recoveryKeys holds the recovery keys generated for
+	// add-recovery-key tasks, keyed by task ID, until they are added
+	// to the container. They are never written to the state.
+	recoveryKeys map[string]*keys.RecoveryKey
+	// secrets holds the passphrases and PINs supplied for
+	// update-protector tasks, keyed by task ID. They are never
+	// written to the state.
+	secrets map[string]*Secrets
+
+	// digests holds the digests of the boot images computed by the
+	// last refresh, keyed by path. It is only accessed by refresh.
+	digests map[string]*cachedDigest
+}
+
+type fdeManagerKey struct{}
+
+func fdeManager(st *state.State) *FDEManager {
+	m, _ := st.Cached(fdeManagerKey{}).(*FDEManager)
+	if m == nil {
+		panic("internal error: FDE manager is not initialized")
+	}
+	return m
+}
+
+// Manager returns a new FDEManager.
+func Manager(st *state.State, runner *state.TaskRunner) (*FDEManager, error) {
+	m := &FDEManager{
+		state:        st,
+		unlockKeys:   make(map[string][]byte),
+		recoveryKeys: make(map[string]*keys.RecoveryKey),
+		secrets:      make(map[string]*Secrets),
+	}
+
+	st.Lock()
+	st.Cache(fdeManagerKey{}, m)
+	st.AddChangeStatusChangedHandler(ensureCleanOnReady)
+	st.Unlock()
+
+	runner.AddHandler("unseal-key", m.doUnsealKey, nil)
+	runner.AddHandler("seal-key", m.doSealKey, m.undoSealKey)
+	runner.AddHandler("compute-pcr-profile", m.doComputePCRProfile, nil)
+	runner.AddHandler("reseal-key", m.doResealKey, nil)
+	runner.AddHandler("add-recovery-key", m.doAddRecoveryKey, m.undoAddRecoveryKey)
+	runner.AddHandler("remove-keyslot", m.doRemoveKeyslot, nil)
+	runner.AddHandler("update-protector", m.doUpdateProtector, nil)
+	runner.AddHandler("prepare-dbx-update", m.doPrepareDBXUpdate, m.undoPrepareDBXUpdate)
+	runner.AddHandler("write-dbx-update", m.doWriteDBXUpdate, nil)
+	runner.AddHandler("finalize-dbx-update", m.doFinalizeDBXUpdate, nil)
+	runner.AddHandler("format-container", m.doFormatContainer, m.undoFormatContainer)
+	runner.AddHandler("seal-install-key", m.doSealInstallKey, m.undoSealInstallKey)
+	runner.AddHandler("repair-state", m.doRepairState, nil)
+	runner.AddHandler("verify-state", m.doVerifyState, nil)
+
+	return m, nil
+}
+
+// Ensure implements StateManager.Ensure. It starts a refresh of the
+// recorded status of the encrypted containers in the background, if
+// one isn't already running.
+func (m *FDEManager) Ensure() error {
+	m.pruneUnlockKeys()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.refreshing || m.stopped {
+		return nil
+	}
+	m.refreshing = true
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if err := m.refresh(); err != nil {
+			logger.Noticef("cannot refresh status of encrypted containers: %v", err)
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.refreshing = false
+	}()
+	return nil
+}
+
+// Wait implements StateWaiter.Wait. It waits for a running refresh to
+// complete.
+func (m *FDEManager) Wait() {
+	m.wg.Wait()
+}
+
+// Stop implements StateStopper.Stop. It waits for a running refresh to
+// complete, prevents new ones from starting and wipes any keys and
+// secrets held in memory.
+func (m *FDEManager) Stop() {
+	m.mu.Lock()
+	m.stopped = true
+	m.mu.Unlock()
+
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, key := range m.unlockKeys {
+		wipe(key)
+		delete(m.unlockKeys, k)
+	}
+	for k, key := range m.recoveryKeys {
+		wipe(key[:])
+		delete(m.recoveryKeys, k)
+	}
+	for k, secrets := range m.secrets {
+		secrets.wipe()
+		delete(m.secrets, k)
+	}
+}
+
+// protectorFromTokens determines what protects a keyslot from the
+// tokens that reference it, as created by secboot or
+// systemd-cryptenroll.
+func protectorFromTokens(tokens []*luks.Token) (kind ProtectorKind, name string) {
+	for _, tok := range tokens {
+		switch tok.Type {
+		case "ubuntu-fde", "systemd-tpm2":
+			kind = ProtectorTPM
+		case "ubuntu-fde-recovery", "systemd-recovery":
+			kind = ProtectorRecoveryKey
+		default:
+			continue
+		}
+
+		var data struct {
+			Name string `json:"ubuntu_fde_name"`
+		}
+		// the name is optional
+		json.Unmarshal(tok.Data, &data)
+		return kind, data.Name
+	}
+	return ProtectorUnknown, ""
+}
+
+// mergeKeyslots returns the keyslots that are in use according to the
+// supplied metadata, retaining what is already recorded about each of
+// them. Keyslots that are not recorded, which is the case for all of
+// them if the state was lost, are restored from the tokens written by
+// the manager where possible.
+func mergeKeyslots(recorded []*Keyslot, md *luks.Metadata) []*Keyslot {
+	var keyslots []*Keyslot
+	for _, slot := range md.KeyslotIDs() {
+		var ks *Keyslot
+		for _, r := range recorded {
+			if r.Slot == slot {
+				ks = r
+				break
+			}
+		}
+		tokens := md.TokensForKeyslot(slot)
+		if ks == nil {
+			ks = keyslotFromTokens(slot, tokens)
+		}
+		if ks == nil {
+			ks = &Keyslot{Slot: slot, Protector: ProtectorUnknown}
+		}
+
+		kind, name := protectorFromTokens(tokens)
+		if ks.Protector == ProtectorUnknown {
+			ks.Protector = kind
+		}
+		if ks.Name == "" {
+			ks.Name = name
+		}
+		keyslots = append(keyslots, ks)
+	}
+	return keyslots
+}
+
+type cachedDigest struct {
+	size    int64
+	modTime time.Time
+	digest  string
+}
+
+// imageDigest returns the digest of the image at the supplied path.
+// The digest computed by the previous refresh is reused unless the
+// size or modification time of the image changed since, and the
+// result is stored in the supplied cache.
+func (m *FDEManager) imageDigest(path string, cache map[string]*cachedDigest) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if cached := m.digests[path]; cached != nil && cached.size == fi.Size() && cached.modTime.Equal(fi.ModTime()) {
+		cache[path] = cached
+		return cached.digest, nil
+	}
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", err
+	}
+	cache[path] = &cachedDigest{size: fi.Size(), modTime: fi.ModTime(), digest: digest}
+	return digest, nil
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// willUnseal determines whether a key sealed against the supplied
+// profile is expected to unseal on the next boot, which is the case
+// if the images of at least one of the boot chains are unchanged. The
+// digests map contains the current digest of each image, keyed by
+// path.
+func willUnseal(profile *PCRProfile, digests map[string]string) *bool {
+	if profile == nil {
+		return nil
+	}
+
+	result := false
+	for _, chain := range profile.BootChains {
+		match := true
+		for _, img := range chain.Images {
+			digest, ok := digests[img.Path]
+			if !ok {
+				// the profile changed since the digests were
+				// computed
+				return nil
+			}
+			if img.Digest == "" || img.Digest != digest {
+				match = false
+			}
+		}
+		if match {
+			result = true
+		}
+	}
+	return &result
+}
+
+// refresh updates the recorded status of the containers that are
+// currently active and the containers that are already known.
+func (m *FDEManager) refresh() error {
+	m.state.Lock()
+	known, err := allContainers(m.state)
+	m.state.Unlock()
+	if err != nil {
+		return err
+	}
+
+	devices, err := activeContainers()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(devices))
+	for _, dev := range devices {
+		seen[dev] = true
+	}
+	for _, c := range known {
+		if !seen[c.DevicePath] {
+			devices = append(devices, c.DevicePath)
+			seen[c.DevicePath] = true
+		}
+	}
+
+	// reading headers and hashing images is done without holding
+	// the state lock. Images are only hashed again when they are
+	// modified.
+	headers := make(map[string]*luks.Header, len(devices))
+	for _, dev := range devices {
+		hdr, err := luks.DefaultBackend().ReadHeader(dev)
+		if err != nil {
+			logger.Noticef("cannot read LUKS2 header of %s: %v", dev, err)
+			continue
+		}
+		headers[dev] = hdr
+	}
+
+	digests := make(map[string]string)
+	cache := make(map[string]*cachedDigest)
+	for _, c := range known {
+		for _, profile := range []*PCRProfile{c.PCRProfile, c.PendingPCRProfile} {
+			if profile == nil {
+				continue
+			}
+			for _, chain := range profile.BootChains {
+				for _, img := range chain.Images {
+					if _, ok := digests[img.Path]; ok {
+						continue
+					}
+					digest, err := m.imageDigest(img.Path, cache)
+					if err != nil && !os.IsNotExist(err) {
+						logger.Noticef("cannot compute digest of %s: %v", img.Path, err)
+					}
+					digests[img.Path] = digest
+				}
+			}
+		}
+	}
+	m.digests = cache
+
+	currentBootID, err := bootID()
+	if err != nil {
+		logger.Noticef("cannot obtain boot ID: %v", err)
+	}
+	unlocked, err := readBootUnlockMetadata()
+	if err != nil {
+		logger.Noticef("cannot read boot unlock metadata: %v", err)
+	}
+
+	m.state.Lock()
+	defer m.state.Unlock()
+
+	containers, err := allContainers(m.state)
+	if err != nil {
+		return err
+	}
+	for dev, hdr := range headers {
+		// the header may be out of date if a change operates on
+		// the container, or did so since the header was read, in
+		// which case the keyslots it recorded must not be dropped.
+		// The container is refreshed again on the next Ensure.
+		if checkChangeConflict(m.state, hdr.UUID) != nil {
+			continue
+		}
+		c, prev := containers[hdr.UUID], known[hdr.UUID]
+		if (c == nil) != (prev == nil) || (c != nil && !reflect.DeepEqual(c.Keyslots, prev.Keyslots)) {
+			continue
+		}
+		if c == nil {
+			c = &Container{UUID: hdr.UUID}
+		}
+		c.DevicePath = dev
+		c.Label = hdr.Label
+		c.Keyslots = mergeKeyslots(c.Keyslots, &hdr.Metadata)
+		c.WillUnseal = nil
+		if c.hasProtector(ProtectorTPM) {
+			c.WillUnseal = willUnseal(c.PCRProfile, digests)
+		}
+		containers[c.UUID] = c
+		if c.WillUnseal != nil && !*c.WillUnseal {
+			addResealRequiredNotice(m.state, c)
+		}
+	}
+	for uuid, c := range containers {
+		m.updateBootUnlock(c, unlocked[uuid], currentBootID)
+	}
+	m.state.Set("fde-containers", containers)
+
+	for _, c := range containers {
+		m.maybeCommitPendingProfile(c, currentBootID, digests)
+	}
+	return nil
+}
+
+// resealRequiredRepeatAfter is how often the reseal required notice
+// of a container is repeated while its sealed keys cannot be unsealed.
+const resealRequiredRepeatAfter = 24 * time.Hour
+
+// addResealRequiredNotice records that the TPM sealed keys of the
+// container will not unseal on the next boot. It must be called with
+// the state locked.
+func addResealRequiredNotice(st *state.State, c *Container) {
+	_, err := noticestate.AddNotice(st, noticestate.ResealRequired, c.UUID, &noticestate.AddOptions{
+		Data:        map[string]string{"device-path": c.DevicePath},
+		RepeatAfter: resealRequiredRepeatAfter,
+	})
+	if err != nil {
+		logger.Noticef("cannot record reseal required notice for %s: %v", c.DevicePath, err)
+	}
+}
+
+// maybeCommitPendingProfile creates a change that reseals the keys of
+// a container against its pending profile, dropping the previous boot
+// chains, once the system has rebooted and the images of one of the
+// new boot chains are installed. It is attempted once per boot, so
+// that a failing reseal is not repeated on every refresh. It must be
+// called with the state locked.
+func (m *FDEManager) maybeCommitPendingProfile(c *Container, currentBootID string, digests map[string]string) {
+	if c.PendingPCRProfile == nil || currentBootID == "" || c.PendingBootID == currentBootID {
+		return
+	}
+	if c.PendingCommitBootID == currentBootID {
+		return
+	}
+	if installed := willUnseal(c.PendingPCRProfile, digests); installed == nil || !*installed {
+		return
+	}
+	if err := checkChangeConflict(m.state, c.UUID); err != nil {
+		return
+	}
+	ts, err := Reseal(m.state, c.UUID, c.PendingPCRProfile)
+	if err != nil {
+		logger.Noticef("cannot commit PCR profile for %s: %v", c.DevicePath, err)
+		return
+	}
+	c.PendingCommitBootID = currentBootID
+	if err := SetContainer(m.state, c); err != nil {
+		logger.Noticef("cannot commit PCR profile for %s: %v", c.DevicePath, err)
+		return
+	}
+	chg := m.state.NewChange("commit-pcr-profile", fmt.Sprintf("Commit PCR profile for %s", c.DevicePath))
+	chg.AddAll(ts)
+	m.state.EnsureBefore(0)
+}
@@ -0,0 +1,387 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/testutil"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/luks/lukstest"
+	"github.com/snapcore/fdemanager/internal/overlord"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+func TestFDEState(t *testing.T) { TestingT(t) }
+
+type fdeMgrBaseSuite struct {
+	testutil.BaseTest
+
+	o   *overlord.Overlord
+	st  *state.State
+	mgr *fdestate.FDEManager
+
+	luks *lukstest.Backend
+}
+
+func (s *fdeMgrBaseSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.AddCleanup(paths.MockRootDir(c.MkDir()))
+
+	s.luks = lukstest.New()
+	s.AddCleanup(lukstest.Mock(s.luks))
+
+	s.o = overlord.Mock()
+	s.st = s.o.State()
+	mgr, err := fdestate.Manager(s.st, s.o.TaskRunner())
+	c.Assert(err, IsNil)
+	s.mgr = mgr
+	s.o.AddManager(s.mgr)
+	s.o.AddManager(s.o.TaskRunner())
+}
+
+func (s *fdeMgrBaseSuite) ensure(c *C) {
+	c.Assert(s.mgr.Ensure(), IsNil)
+	s.mgr.Wait()
+}
+
+func (s *fdeMgrBaseSuite) settle(c *C) {
+	err := s.o.Settle(testutil.HostScaledTimeout(15 * time.Second))
+	c.Assert(err, IsNil)
+}
+
+func (s *fdeMgrBaseSuite) mockDMDevice(c *C, name, uuid, slave string) {
+	dir := filepath.Join(paths.SysfsDir, "block", name)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "dm"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "slaves", slave), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "dm", "uuid"), []byte(uuid+"\n"), 0644), IsNil)
+}
+
+func mockToken(c *C, typ string, slot int, name string) *luks.Token {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":            typ,
+		"keyslots":        []string{fmt.Sprint(slot)},
+		"ubuntu_fde_name": name,
+	})
+	c.Assert(err, IsNil)
+	return &luks.Token{Type: typ, Keyslots: []int{slot}, Data: data}
+}
+
+func (s *fdeMgrBaseSuite) mockHeader(c *C, path, uuid string) *luks.Header {
+	hdr := &luks.Header{
+		Label: "ubuntu-data-enc",
+		UUID:  uuid,
+		Metadata: luks.Metadata{
+			Keyslots: map[int]*luks.Keyslot{
+				0: {Type: "luks2"},
+				1: {Type: "luks2"},
+			},
+			Tokens: map[int]*luks.Token{
+				0: mockToken(c, "ubuntu-fde", 0, "default"),
+				1: mockToken(c, "ubuntu-fde-recovery", 1, "default-recovery"),
+			},
+		},
+	}
+	s.luks.AddContainer(path, hdr, map[int][]byte{
+		0: []byte("unlock-key"),
+		1: []byte("recovery-key"),
+	})
+	return hdr
+}
+
+// luksCalls returns the device paths and slots of the operations of
+// the specified kind that were performed on the fake containers.
+func (s *fdeMgrBaseSuite) luksCalls(op string) []string {
+	var calls []string
+	for _, call := range s.luks.Calls {
+		if call.Op == op {
+			calls = append(calls, fmt.Sprintf("%s:%d", call.DevicePath, call.Slot))
+		}
+	}
+	return calls
+}
+
+func (s *fdeMgrBaseSuite) containers(c *C) []*fdestate.Container {
+	s.st.Lock()
+	defer s.st.Unlock()
+	containers, err := fdestate.Containers(s.st)
+	c.Assert(err, IsNil)
+	return containers
+}
+
+type fdeMgrSuite struct {
+	fdeMgrBaseSuite
+}
+
+var _ = Suite(&fdeMgrSuite{})
+
+func digest(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+func (s *fdeMgrSuite) TestActiveContainers(c *C) {
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	s.mockDMDevice(c, "dm-1", "CRYPT-LUKS2-5a5ae4a0d9b6477f9b0b2bcd0cc9dc4d-ubuntu-save", "sda3")
+	s.mockDMDevice(c, "dm-2", "LVM-aaaa", "sda5")
+
+	devices, err := fdestate.ActiveContainers()
+	c.Assert(err, IsNil)
+	c.Check(devices, DeepEquals, []string{"/dev/sda3", "/dev/sda4"})
+}
+
+func (s *fdeMgrSuite) TestActiveContainersNone(c *C) {
+	devices, err := fdestate.ActiveContainers()
+	c.Assert(err, IsNil)
+	c.Check(devices, HasLen, 0)
+}
+
+func (s *fdeMgrSuite) TestEnsureDiscoversContainers(c *C) {
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	s.mockHeader(c, "/dev/sda4", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+
+	s.ensure(c)
+
+	c.Check(s.containers(c), DeepEquals, []*fdestate.Container{
+		{
+			DevicePath: "/dev/sda4",
+			UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+			Label:      "ubuntu-data-enc",
+			Keyslots: []*fdestate.Keyslot{
+				{Slot: 0, Name: "default", Protector: fdestate.ProtectorTPM},
+				{Slot: 1, Name: "default-recovery", Protector: fdestate.ProtectorRecoveryKey},
+			},
+		},
+	})
+}
+
+func (s *fdeMgrSuite) TestEnsureUnknownProtector(c *C) {
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	hdr := s.mockHeader(c, "/dev/sda4", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	hdr.Metadata.Tokens = map[int]*luks.Token{
+		0: mockToken(c, "systemd-fido2", 0, ""),
+	}
+
+	s.ensure(c)
+
+	containers := s.containers(c)
+	c.Assert(containers, HasLen, 1)
+	c.Check(containers[0].Keyslots, DeepEquals, []*fdestate.Keyslot{
+		{Slot: 0, Protector: fdestate.ProtectorUnknown},
+		{Slot: 1, Protector: fdestate.ProtectorUnknown},
+	})
+	c.Check(containers[0].WillUnseal, IsNil)
+}
+
+func (s *fdeMgrSuite) TestEnsureRetainsRecordedState(c *C) {
+	hdr := s.mockHeader(c, "/dev/sda4", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	hdr.Metadata.Tokens = nil
+	hdr.Metadata.Keyslots[2] = &luks.Keyslot{Type: "luks2"}
+
+	s.st.Lock()
+	err := fdestate.SetContainer(s.st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 1, Name: "mine", Protector: fdestate.ProtectorPassphrase},
+			// removed outside of the manager
+			{Slot: 3, Name: "gone", Protector: fdestate.ProtectorRecoveryKey},
+		},
+	})
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+
+	// the container is known but not active
+	s.ensure(c)
+
+	containers := s.containers(c)
+	c.Assert(containers, HasLen, 1)
+	c.Check(containers[0].Label, Equals, "ubuntu-data-enc")
+	c.Check(containers[0].Keyslots, DeepEquals, []*fdestate.Keyslot{
+		{Slot: 0, Protector: fdestate.ProtectorUnknown},
+		{Slot: 1, Name: "mine", Protector: fdestate.ProtectorPassphrase},
+		{Slot: 2, Protector: fdestate.ProtectorUnknown},
+	})
+}
+
+func (s *fdeMgrSuite) TestEnsureUnreadableHeader(c *C) {
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+
+	s.ensure(c)
+	c.Check(s.containers(c), HasLen, 0)
+}
+
+func (s *fdeMgrSuite) testEnsureWillUnseal(c *C, modify bool, expected bool) {
+	dir := c.MkDir()
+	shim := filepath.Join(dir, "shimx64.efi")
+	grub := filepath.Join(dir, "grubx64.efi")
+	kernel := filepath.Join(dir, "kernel.efi")
+	for _, p := range []string{shim, grub, kernel} {
+		c.Assert(ioutil.WriteFile(p, []byte(filepath.Base(p)), 0644), IsNil)
+	}
+
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	s.mockHeader(c, "/dev/sda4", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+
+	s.st.Lock()
+	err := fdestate.SetContainer(s.st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		PCRProfile: &fdestate.PCRProfile{
+			PCRs: []int{4, 7, 12},
+			BootChains: []*fdestate.BootChain{
+				{
+					Images: []*fdestate.BootImage{
+						{Path: shim, Digest: digest("shimx64.efi")},
+						{Path: grub, Digest: digest("grubx64.efi")},
+						{Path: kernel, Digest: digest("kernel.efi")},
+					},
+					KernelCmdlines: []string{"snapd_recovery_mode=run"},
+				},
+			},
+		},
+	})
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+
+	if modify {
+		c.Assert(ioutil.WriteFile(kernel, []byte("new kernel"), 0644), IsNil)
+	}
+
+	s.ensure(c)
+
+	containers := s.containers(c)
+	c.Assert(containers, HasLen, 1)
+	c.Assert(containers[0].WillUnseal, NotNil)
+	c.Check(*containers[0].WillUnseal, Equals, expected)
+	c.Check(containers[0].PCRProfile.PCRs, DeepEquals, []int{4, 7, 12})
+
+	s.st.Lock()
+	notices, err := noticestate.Notices(s.st, nil)
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+	if expected {
+		c.Check(notices, HasLen, 0)
+		return
+	}
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, noticestate.ResealRequired)
+	c.Check(notices[0].Key, Equals, "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	c.Check(notices[0].LastData, DeepEquals, map[string]string{"device-path": "/dev/sda4"})
+	c.Check(notices[0].RepeatAfter, Equals, 24*time.Hour)
+
+	// the notice is not repeated on every refresh
+	s.ensure(c)
+	s.st.Lock()
+	notices, err = noticestate.Notices(s.st, nil)
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Occurrences, Equals, 2)
+	c.Check(notices[0].LastRepeated, Equals, notices[0].FirstOccurred)
+}
+
+func (s *fdeMgrSuite) TestEnsureWillUnseal(c *C) {
+	s.testEnsureWillUnseal(c, false, true)
+}
+
+func (s *fdeMgrSuite) TestEnsureWillNotUnsealAfterImageChange(c *C) {
+	s.testEnsureWillUnseal(c, true, false)
+}
+
+func (s *fdeMgrSuite) TestEnsureWillUnsealUnknownWithoutProfile(c *C) {
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	s.mockHeader(c, "/dev/sda4", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+
+	s.ensure(c)
+
+	containers := s.containers(c)
+	c.Assert(containers, HasLen, 1)
+	c.Check(containers[0].WillUnseal, IsNil)
+}
+
+func (s *fdeMgrSuite) TestEnsureReusesImageDigests(c *C) {
+	s.testEnsureWillUnseal(c, false, true)
+
+	kernel := s.containers(c)[0].PCRProfile.BootChains[0].Images[2].Path
+	fi, err := os.Stat(kernel)
+	c.Assert(err, IsNil)
+
+	// the image is not hashed again while its size and modification
+	// time are unchanged
+	c.Assert(ioutil.WriteFile(kernel, []byte("kernel.EFI"), 0644), IsNil)
+	c.Assert(os.Chtimes(kernel, fi.ModTime(), fi.ModTime()), IsNil)
+	s.ensure(c)
+	c.Check(*s.containers(c)[0].WillUnseal, Equals, true)
+
+	mtime := fi.ModTime().Add(time.Second)
+	c.Assert(os.Chtimes(kernel, mtime, mtime), IsNil)
+	s.ensure(c)
+	c.Check(*s.containers(c)[0].WillUnseal, Equals, false)
+}
+
+func (s *fdeMgrSuite) TestEnsureSkipsContainersWithChanges(c *C) {
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	s.mockHeader(c, "/dev/sda4", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+
+	keyslots := []*fdestate.Keyslot{
+		{Slot: 0, Name: "default", Protector: fdestate.ProtectorTPM},
+		{Slot: 1, Name: "default-recovery", Protector: fdestate.ProtectorRecoveryKey},
+		// recorded by a task before the header was written
+		{Slot: 2, Name: "run", Protector: fdestate.ProtectorTPM},
+	}
+	s.st.Lock()
+	err := fdestate.SetContainer(s.st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Keyslots:   keyslots,
+	})
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("seal", "...")
+	t := s.st.NewTask("seal-key", "...")
+	t.Set("container", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	chg.AddTask(t)
+	s.st.Unlock()
+
+	s.ensure(c)
+	c.Check(s.containers(c)[0].Keyslots, DeepEquals, keyslots)
+
+	s.st.Lock()
+	t.SetStatus(state.HoldStatus)
+	s.st.Unlock()
+
+	s.ensure(c)
+	c.Check(s.containers(c)[0].Keyslots, DeepEquals, keyslots[:2])
+}
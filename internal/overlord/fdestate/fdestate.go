@@ -0,0 +1,470 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package fdestate implements the manager and state aspects
+// responsible for the full disk encryption of the system.
+package fdestate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+)
+
+// DefaultPCRs are the PCRs that sealed keys are bound to: the boot
+// manager code (4), the secure boot policy (7) and the kernel command
+// line (12).
+var DefaultPCRs = []int{4, 7, 12}
+
+// ProtectorKind describes what protects a keyslot.
+type ProtectorKind string
+
+const (
+	ProtectorTPM         ProtectorKind = "tpm"
+	ProtectorRecoveryKey ProtectorKind = "recovery-key"
+	ProtectorPassphrase  ProtectorKind = "passphrase"
+	ProtectorUnknown     ProtectorKind = "unknown"
+)
+
+// Keyslot holds the state of a used keyslot in an encrypted
+// container.
+type Keyslot struct {
+	Slot      int           `json:"slot"`
+	Name      string        `json:"name,omitempty"`
+	Protector ProtectorKind `json:"protector"`
+
+	// SealedObject is the path of the TPM sealed key object for
+	// keyslots created by the manager.
+	SealedObject string `json:"sealed-object,omitempty"`
+	// PCRPolicyCounter is the handle of the NV index used to revoke
+	// old PCR policies of the sealed key object.
+	PCRPolicyCounter uint32 `json:"pcr-policy-counter,omitempty"`
+	// PCRProfileGeneration identifies the PCR profile of the
+	// container that the sealed key object was last sealed against.
+	// It is incremented whenever keys are sealed against a new
+	// profile.
+	PCRProfileGeneration uint64 `json:"pcr-profile-generation,omitempty"`
+
+	// PIN indicates whether a PIN is required in addition to the TPM
+	// to unseal the sealed key object.
+	PIN bool `json:"pin,omitempty"`
+
+	// CreationTime is the time at which the keyslot was created by
+	// the manager. It is zero for keyslots created by other means.
+	CreationTime time.Time `json:"creation-time,omitempty"`
+}
+
+// BootImage is an EFI image that is part of a boot chain. Digest is
+// the hex encoded SHA-256 digest of the image file.
+type BootImage struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// BootChain is a sequence of EFI images loaded during boot and the
+// kernel command lines that the last image may be started with.
+type BootChain struct {
+	Images         []*BootImage `json:"images"`
+	KernelCmdlines []string     `json:"kernel-cmdlines,omitempty"`
+}
+
+// PCRProfile holds the PCRs and the boot chains that a sealed key is
+// bound to.
+type PCRProfile struct {
+	PCRs       []int        `json:"pcrs"`
+	BootChains []*BootChain `json:"boot-chains"`
+
+	// DBXUpdateKeystores are directories that hold updates of the
+	// forbidden signature database that are being applied, in the
+	// layout used by sbkeysync. The sealed keys also accept the
+	// secure boot policy that results from applying them.
+	DBXUpdateKeystores []string `json:"dbx-update-keystores,omitempty"`
+}
+
+// Container holds the state of an encrypted container.
+type Container struct {
+	DevicePath string     `json:"device-path"`
+	UUID       string     `json:"uuid"`
+	Label      string     `json:"label,omitempty"`
+	Keyslots   []*Keyslot `json:"keyslots,omitempty"`
+
+	PCRProfile *PCRProfile `json:"pcr-profile,omitempty"`
+
+	// PendingPCRProfile is the profile that the sealed keys will be
+	// resealed against once the system has booted using one of its
+	// boot chains. Until then, PCRProfile also includes the boot
+	// chains that the keys were previously sealed against.
+	PendingPCRProfile *PCRProfile `json:"pending-pcr-profile,omitempty"`
+	// PendingBootID is the ID of the boot during which the pending
+	// profile was recorded.
+	PendingBootID string `json:"pending-boot-id,omitempty"`
+	// PendingCommitBootID is the ID of the boot during which the
+	// pending profile was last attempted to be committed. An attempt
+	// that failed is not repeated until the next boot, or until the
+	// pending profile is replaced.
+	PendingCommitBootID string `json:"pending-commit-boot-id,omitempty"`
+
+	// WillUnseal is nil if it is not known whether the TPM sealed
+	// key will unseal on the next boot.
+	WillUnseal *bool `json:"will-unseal,omitempty"`
+
+	// BootUnlock records how the container was unlocked during the
+	// current boot, if it is known.
+	BootUnlock *BootUnlock `json:"boot-unlock,omitempty"`
+}
+
+// Keyslot returns the keyslot with the specified number, or nil if it
+// isn't in use.
+func (c *Container) Keyslot(slot int) *Keyslot {
+	for _, ks := range c.Keyslots {
+		if ks.Slot == slot {
+			return ks
+		}
+	}
+	return nil
+}
+
+// KeyslotByName returns the keyslot with the specified name, or nil if
+// there isn't one.
+func (c *Container) KeyslotByName(name string) *Keyslot {
+	for _, ks := range c.Keyslots {
+		if ks.Name == name {
+			return ks
+		}
+	}
+	return nil
+}
+
+// setKeyslot replaces the record of the keyslot with the same number
+// as ks, adding it if there isn't one.
+func (c *Container) setKeyslot(ks *Keyslot) {
+	for i, existing := range c.Keyslots {
+		if existing.Slot == ks.Slot {
+			c.Keyslots[i] = ks
+			return
+		}
+	}
+	c.Keyslots = append(c.Keyslots, ks)
+}
+
+func (c *Container) removeKeyslot(slot int) {
+	for i, ks := range c.Keyslots {
+		if ks.Slot == slot {
+			c.Keyslots = append(c.Keyslots[:i], c.Keyslots[i+1:]...)
+			return
+		}
+	}
+}
+
+// nextPCRProfileGeneration returns the generation of the next PCR
+// profile that keys of the container are sealed against.
+func (c *Container) nextPCRProfileGeneration() uint64 {
+	var gen uint64
+	for _, ks := range c.Keyslots {
+		if ks.PCRProfileGeneration > gen {
+			gen = ks.PCRProfileGeneration
+		}
+	}
+	return gen + 1
+}
+
+func (c *Container) hasSealedKeys() bool {
+	for _, ks := range c.Keyslots {
+		if ks.Protector == ProtectorTPM && ks.SealedObject != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Container) hasProtector(kind ProtectorKind) bool {
+	for _, ks := range c.Keyslots {
+		if ks.Protector == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func allContainers(st *state.State) (map[string]*Container, error) {
+	var containers map[string]*Container
+	err := st.Get("fde-containers", &containers)
+	if err != nil && !errors.Is(err, state.ErrNoState) {
+		return nil, err
+	}
+	if containers == nil {
+		containers = make(map[string]*Container)
+	}
+	return containers, nil
+}
+
+// ContainerByUUID returns the container with the specified UUID.
+func ContainerByUUID(st *state.State, uuid string) (*Container, error) {
+	containers, err := allContainers(st)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := containers[uuid]
+	if !ok {
+		return nil, &ContainerNotFoundError{UUID: uuid}
+	}
+	return c, nil
+}
+
+// Containers returns the encrypted containers known to the manager,
+// ordered by device path.
+func Containers(st *state.State) ([]*Container, error) {
+	containers, err := allContainers(st)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]*Container, 0, len(containers))
+	for _, c := range containers {
+		l = append(l, c)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].DevicePath < l[j].DevicePath
+	})
+	return l, nil
+}
+
+// SetContainer records the state of the specified container, which is
+// identified by its UUID.
+func SetContainer(st *state.State, c *Container) error {
+	containers, err := allContainers(st)
+	if err != nil {
+		return err
+	}
+	containers[c.UUID] = c
+	st.Set("fde-containers", containers)
+	return nil
+}
+
+// ContainerNotFoundError is returned when a container is not known to
+// the manager.
+type ContainerNotFoundError struct {
+	UUID string
+}
+
+func (e *ContainerNotFoundError) Error() string {
+	return fmt.Sprintf("cannot find container with UUID %q", e.UUID)
+}
+
+// ErrNoSealedKeys is returned when there are no TPM sealed keys that
+// are managed by the manager.
+var ErrNoSealedKeys = errors.New("no TPM sealed keys to reseal")
+
+// ChangeConflictError is returned when a change cannot be created
+// because another change is already operating on the same container.
+// UUID is empty if the other change operates on the whole system.
+type ChangeConflictError struct {
+	UUID       string
+	ChangeKind string
+	ChangeID   string
+}
+
+func (e *ChangeConflictError) Error() string {
+	if e.UUID == "" {
+		return fmt.Sprintf("%q change in progress", e.ChangeKind)
+	}
+	return fmt.Sprintf("container %s has %q change in progress", e.UUID, e.ChangeKind)
+}
+
+// tpmTaskKinds are the kinds of the tasks of the TPM manager, which
+// modify the TPM that the sealed keys of every container depend on.
+var tpmTaskKinds = map[string]bool{
+	"provision-tpm":     true,
+	"reset-tpm-lockout": true,
+	"clear-tpm":         true,
+}
+
+// checkChangeConflict returns a *ChangeConflictError if there is an
+// in-progress change that operates on the specified container, or on
+// the TPM.
+func checkChangeConflict(st *state.State, uuid string) error {
+	for _, chg := range st.Changes() {
+		if chg.IsReady() {
+			continue
+		}
+		for _, t := range chg.Tasks() {
+			if t.Kind() == "repair-state" || tpmTaskKinds[t.Kind()] {
+				// a repair operates on every container
+				// and the TPM is used by all of them
+				return &ChangeConflictError{UUID: uuid, ChangeKind: chg.Kind(), ChangeID: chg.ID()}
+			}
+			var taskUUID string
+			if err := t.Get("container", &taskUUID); err != nil {
+				continue
+			}
+			if taskUUID == uuid {
+				return &ChangeConflictError{UUID: uuid, ChangeKind: chg.Kind(), ChangeID: chg.ID()}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckChangeConflict returns a *ChangeConflictError if there is an
+// in-progress change that operates on any of the containers, or that
+// repairs the state. Changes to the TPM that the sealed keys depend on
+// must not race with them.
+func CheckChangeConflict(st *state.State) error {
+	return checkRepairConflict(st)
+}
+
+// TPMCleared records that the TPM sealed keys of every container are
+// lost after the TPM was cleared, by adding a sealed keys lost notice
+// for each container that has any. Resealing cannot recover them, the
+// keyslots need to be sealed anew once the TPM is provisioned. It must
+// be called with the state locked.
+func TPMCleared(st *state.State) error {
+	containers, err := Containers(st)
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		var names []string
+		for _, ks := range c.Keyslots {
+			if ks.Protector == ProtectorTPM {
+				names = append(names, ks.Name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		_, err := noticestate.AddNotice(st, noticestate.SealedKeysLost, c.UUID, &noticestate.AddOptions{
+			Data: map[string]string{
+				"device-path": c.DevicePath,
+				"keyslots":    strings.Join(names, ","),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Seal returns a set of tasks that adds a new TPM protected keyslot
+// with the specified name to a container. The new key is sealed against
+// profile, or against the profile that the container was last sealed
+// against if profile is nil.
+func Seal(st *state.State, uuid, name string, profile *PCRProfile) (*state.TaskSet, error) {
+	c, err := ContainerByUUID(st, uuid)
+	if err != nil {
+		return nil, err
+	}
+	if c.KeyslotByName(name) != nil {
+		return nil, fmt.Errorf("container %s already has a keyslot named %q", uuid, name)
+	}
+	if profile == nil {
+		profile = c.PCRProfile
+	}
+	if _, err := modelParams(profile); err != nil {
+		return nil, fmt.Errorf("cannot seal key: %v", err)
+	}
+	if err := checkChangeConflict(st, uuid); err != nil {
+		return nil, err
+	}
+
+	unseal := st.NewTask("unseal-key", fmt.Sprintf("Obtain unlock key for %s", c.DevicePath))
+	unseal.Set("container", uuid)
+
+	seal := st.NewTask("seal-key", fmt.Sprintf("Seal new key %q for %s", name, c.DevicePath))
+	seal.Set("container", uuid)
+	seal.Set("keyslot-name", name)
+	seal.Set("pcr-profile", profile)
+	seal.WaitFor(unseal)
+
+	return state.NewTaskSet(unseal, seal), nil
+}
+
+// Reseal returns a set of tasks that reseals the TPM protected
+// keyslots of a container against the supplied profile.
+func Reseal(st *state.State, uuid string, profile *PCRProfile) (*state.TaskSet, error) {
+	c, err := ContainerByUUID(st, uuid)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := modelParams(profile); err != nil {
+		return nil, fmt.Errorf("cannot reseal keys: %v", err)
+	}
+	if err := checkChangeConflict(st, uuid); err != nil {
+		return nil, err
+	}
+
+	reseal := st.NewTask("reseal-key", fmt.Sprintf("Reseal keys for %s", c.DevicePath))
+	reseal.Set("container", uuid)
+	reseal.Set("pcr-profile", profile)
+
+	return state.NewTaskSet(reseal), nil
+}
+
+// ResealForBootChains returns the tasks that reseal the TPM protected
+// keyslots of every container against the supplied boot chains, with
+// one task set per container. The boot chains that the keys are
+// currently sealed against remain valid until the system has booted
+// using one of the new boot chains.
+func ResealForBootChains(st *state.State, chains []*BootChain) ([]*state.TaskSet, error) {
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("no boot chains")
+	}
+	for _, chain := range chains {
+		if len(chain.Images) == 0 {
+			return nil, fmt.Errorf("boot chain has no images")
+		}
+	}
+
+	containers, err := Containers(st)
+	if err != nil {
+		return nil, err
+	}
+
+	var tss []*state.TaskSet
+	for _, c := range containers {
+		if !c.hasSealedKeys() {
+			continue
+		}
+		if err := checkChangeConflict(st, c.UUID); err != nil {
+			return nil, err
+		}
+
+		compute := st.NewTask("compute-pcr-profile", fmt.Sprintf("Compute PCR profile for %s", c.DevicePath))
+		compute.Set("container", c.UUID)
+		compute.Set("boot-chains", chains)
+
+		reseal := st.NewTask("reseal-key", fmt.Sprintf("Reseal keys for %s", c.DevicePath))
+		reseal.Set("container", c.UUID)
+		reseal.Set("pcr-profile-task", compute.ID())
+		reseal.WaitFor(compute)
+
+		tss = append(tss, state.NewTaskSet(compute, reseal))
+	}
+	if len(tss) == 0 {
+		return nil, ErrNoSealedKeys
+	}
+	return tss, nil
+}
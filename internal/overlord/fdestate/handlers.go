@@ -0,0 +1,546 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot"
+	"github.com/snapcore/snapd/secboot/keys"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+// the number of keyslots supported by LUKS2.
+const maxKeyslots = 32
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func unlockKeyID(t *state.Task, uuid string) string {
+	return t.Change().ID() + ":" + uuid
+}
+
+// pendingTask returns whether the specified task may still run.
+func (m *FDEManager) pendingTask(id string) bool {
+	t := m.state.Task(id)
+	return t != nil && t.Change() != nil && !t.Change().IsReady()
+}
+
+// pruneUnlockKeys wipes the unlock keys held for changes that are
+// ready or that no longer exist, and the recovery keys and secrets held
+// for tasks that will not run anymore.
+func (m *FDEManager) pruneUnlockKeys() {
+	m.state.Lock()
+	defer m.state.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, key := range m.unlockKeys {
+		chgID := id[:strings.IndexByte(id, ':')]
+		if chg := m.state.Change(chgID); chg != nil && !chg.IsReady() {
+			continue
+		}
+		wipe(key)
+		delete(m.unlockKeys, id)
+	}
+	for id, key := range m.recoveryKeys {
+		if m.pendingTask(id) {
+			continue
+		}
+		wipe(key[:])
+		delete(m.recoveryKeys, id)
+	}
+	for id, secrets := range m.secrets {
+		if m.pendingTask(id) {
+			continue
+		}
+		secrets.wipe()
+		delete(m.secrets, id)
+	}
+}
+
+// unlockKey returns the unlock key of a container for use by a task,
+// obtaining it again if it isn't held already, which happens if the
+// daemon restarted since the unseal-key task ran. It must be called
+// with the state locked.
+func (m *FDEManager) unlockKey(t *state.Task, c *Container) ([]byte, error) {
+	id := unlockKeyID(t, c.UUID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if key, ok := m.unlockKeys[id]; ok {
+		return key, nil
+	}
+	key, err := diskUnlockKey(c)
+	if err != nil {
+		return nil, err
+	}
+	m.unlockKeys[id] = key
+	return key, nil
+}
+
+func taskContainer(t *state.Task) (*Container, error) {
+	var uuid string
+	if err := t.Get("container", &uuid); err != nil {
+		return nil, err
+	}
+	return ContainerByUUID(t.State(), uuid)
+}
+
+// completeProfile returns a copy of profile in which the digest of
+// every boot image that doesn't have one is set to the current digest
+// of the image file.
+func completeProfile(profile *PCRProfile) (*PCRProfile, error) {
+	completed := &PCRProfile{PCRs: profile.PCRs, DBXUpdateKeystores: profile.DBXUpdateKeystores}
+	for _, chain := range profile.BootChains {
+		c := &BootChain{KernelCmdlines: chain.KernelCmdlines}
+		for _, img := range chain.Images {
+			digest := img.Digest
+			if digest == "" {
+				var err error
+				digest, err = fileDigest(img.Path)
+				if err != nil {
+					return nil, fmt.Errorf("cannot compute digest of boot image: %v", err)
+				}
+			}
+			c.Images = append(c.Images, &BootImage{Path: img.Path, Digest: digest})
+		}
+		completed.BootChains = append(completed.BootChains, c)
+	}
+	return completed, nil
+}
+
+// bootableChains returns the boot chains of profile for which the
+// images on disk still match the recorded digests.
+func bootableChains(profile *PCRProfile) []*BootChain {
+	if profile == nil {
+		return nil
+	}
+
+	var chains []*BootChain
+	for _, chain := range profile.BootChains {
+		bootable := true
+		for _, img := range chain.Images {
+			if digest, err := fileDigest(img.Path); err != nil || digest != img.Digest {
+				bootable = false
+				break
+			}
+		}
+		if bootable {
+			chains = append(chains, chain)
+		}
+	}
+	return chains
+}
+
+// freePolicyCounterHandle returns a handle for a new PCR policy
+// counter that is not used by any recorded keyslot.
+func freePolicyCounterHandle(st *state.State) (uint32, error) {
+	containers, err := allContainers(st)
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[uint32]bool)
+	for _, c := range containers {
+		for _, ks := range c.Keyslots {
+			used[ks.PCRPolicyCounter] = true
+		}
+	}
+	for h := pcrPolicyCounterHandleStart; h <= pcrPolicyCounterHandleEnd; h++ {
+		if !used[h] {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("no free PCR policy counter handle")
+}
+
+func freeKeyslot(c *Container) (int, error) {
+	for slot := 0; slot < maxKeyslots; slot++ {
+		if c.Keyslot(slot) == nil {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no free keyslot in %s", c.DevicePath)
+}
+
+func (m *FDEManager) doUnsealKey(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.unlockKey(t, c); err != nil {
+		return fmt.Errorf("cannot obtain unlock key: %v", err)
+	}
+	return nil
+}
+
+func (m *FDEManager) doSealKey(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var name string
+	if err := t.Get("keyslot-name", &name); err != nil {
+		return err
+	}
+	var profile *PCRProfile
+	if err := t.Get("pcr-profile", &profile); err != nil {
+		return err
+	}
+	unlockKey, err := m.unlockKey(t, c)
+	if err != nil {
+		return fmt.Errorf("cannot obtain unlock key: %v", err)
+	}
+
+	// a previous attempt may have been interrupted after adding the
+	// keyslot
+	var slot int
+	if err := t.Get("slot", &slot); err == nil {
+		st.Unlock()
+		err := luks.DefaultBackend().RemoveKey(c.DevicePath, slot, unlockKey)
+		if err == nil {
+			forgetKeyslotToken(c.DevicePath, slot)
+		}
+		st.Lock()
+		if err != nil {
+			logger.Noticef("cannot remove keyslot %d of %s left by a previous attempt: %v", slot, c.DevicePath, err)
+		}
+	} else {
+		if slot, err = freeKeyslot(c); err != nil {
+			return err
+		}
+	}
+	// likewise it may have defined the PCR policy counter, which is
+	// released so that the same handle can be defined again
+	var handle uint32
+	if err := t.Get("pcr-policy-counter", &handle); err == nil {
+		st.Unlock()
+		err := secbootReleasePCRResourceHandles(handle)
+		st.Lock()
+		if err != nil {
+			logger.Noticef("cannot release PCR policy counter %#x left by a previous attempt: %v", handle, err)
+		}
+	} else {
+		if handle, err = freePolicyCounterHandle(st); err != nil {
+			return err
+		}
+	}
+	t.Set("slot", slot)
+	t.Set("pcr-policy-counter", handle)
+	sealedObject := sealedObjectPath(c.UUID, name)
+	devicePath := c.DevicePath
+	ks := &Keyslot{
+		Slot:                 slot,
+		Name:                 name,
+		Protector:            ProtectorTPM,
+		SealedObject:         sealedObject,
+		PCRPolicyCounter:     handle,
+		PCRProfileGeneration: c.nextPCRProfileGeneration(),
+	}
+
+	st.Unlock()
+	err = func() error {
+		profile, err = completeProfile(profile)
+		if err != nil {
+			return err
+		}
+		params, err := modelParams(profile)
+		if err != nil {
+			return err
+		}
+
+		key, err := keys.NewEncryptionKey()
+		if err != nil {
+			return fmt.Errorf("cannot create key: %v", err)
+		}
+		defer wipe(key)
+
+		if err := luks.DefaultBackend().AddKey(devicePath, unlockKey, key, &luks.AddKeyOptions{Slot: slot}); err != nil {
+			return fmt.Errorf("cannot add key to %s: %v", devicePath, err)
+		}
+		if err := os.MkdirAll(paths.ManagerKeysDir, 0700); err != nil {
+			return err
+		}
+		err = secbootSealKeys([]secboot.SealKeyRequest{{
+			Key:     key,
+			KeyName: name,
+			KeyFile: sealedObject,
+		}}, &secboot.SealKeysParams{
+			ModelParams:            params,
+			TPMPolicyAuthKeyFile:   policyAuthKeyPath(sealedObject),
+			PCRPolicyCounterHandle: handle,
+		})
+		if err != nil {
+			if err := luks.DefaultBackend().RemoveKey(devicePath, slot, unlockKey); err != nil {
+				logger.Noticef("cannot remove keyslot %d of %s: %v", slot, devicePath, err)
+			}
+			return fmt.Errorf("cannot seal key: %v", err)
+		}
+		ks.CreationTime = timeNow()
+		recordKeyslotToken(devicePath, ks)
+		return nil
+	}()
+	st.Lock()
+	if err != nil {
+		return err
+	}
+
+	// the container may have been refreshed in the meantime
+	c, err = taskContainer(t)
+	if err != nil {
+		return err
+	}
+	c.setKeyslot(ks)
+	c.PCRProfile = profile
+	return SetContainer(st, c)
+}
+
+func (m *FDEManager) undoSealKey(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var slot int
+	if err := t.Get("slot", &slot); err != nil {
+		return err
+	}
+	var handle uint32
+	if err := t.Get("pcr-policy-counter", &handle); err != nil {
+		return err
+	}
+	unlockKey, err := m.unlockKey(t, c)
+	if err != nil {
+		return fmt.Errorf("cannot obtain unlock key: %v", err)
+	}
+
+	var sealedObject string
+	if ks := c.Keyslot(slot); ks != nil {
+		sealedObject = ks.SealedObject
+	}
+	devicePath := c.DevicePath
+
+	st.Unlock()
+	err = luks.DefaultBackend().RemoveKey(devicePath, slot, unlockKey)
+	if err == nil {
+		forgetKeyslotToken(devicePath, slot)
+		if err := secbootReleasePCRResourceHandles(handle); err != nil {
+			logger.Noticef("cannot release PCR policy counter %#x: %v", handle, err)
+		}
+		if sealedObject != "" {
+			os.Remove(sealedObject)
+			os.Remove(policyAuthKeyPath(sealedObject))
+		}
+	}
+	st.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot remove keyslot %d of %s: %v", slot, devicePath, err)
+	}
+
+	c, err = taskContainer(t)
+	if err != nil {
+		return err
+	}
+	c.removeKeyslot(slot)
+	return SetContainer(st, c)
+}
+
+func (m *FDEManager) doComputePCRProfile(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var chains []*BootChain
+	if err := t.Get("boot-chains", &chains); err != nil {
+		return err
+	}
+	current := c.PCRProfile
+
+	st.Unlock()
+	profile, err := completeProfile(&PCRProfile{PCRs: DefaultPCRs, BootChains: chains})
+	var oldChains []*BootChain
+	if err == nil {
+		oldChains = bootableChains(current)
+	}
+	st.Lock()
+	if err != nil {
+		return err
+	}
+
+	// keep the current boot chains that can still be booted valid
+	// until the new profile is committed
+	combined := &PCRProfile{PCRs: profile.PCRs, BootChains: profile.BootChains}
+	for _, old := range oldChains {
+		found := false
+		for _, chain := range profile.BootChains {
+			if reflect.DeepEqual(old, chain) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			combined.BootChains = append(combined.BootChains, old)
+		}
+	}
+
+	t.Set("pcr-profile", combined)
+	if len(combined.BootChains) != len(profile.BootChains) {
+		t.Set("pending-pcr-profile", profile)
+	}
+	return nil
+}
+
+// resealProfiles returns the profile that a reseal-key task reseals
+// against and the profile to commit later, if any.
+func resealProfiles(t *state.Task) (profile, pending *PCRProfile, err error) {
+	var id string
+	if err := t.Get("pcr-profile-task", &id); err != nil {
+		if !errors.Is(err, state.ErrNoState) {
+			return nil, nil, err
+		}
+		if err := t.Get("pcr-profile", &profile); err != nil {
+			return nil, nil, err
+		}
+		return profile, nil, nil
+	}
+
+	pt := t.State().Task(id)
+	if pt == nil {
+		return nil, nil, fmt.Errorf("internal error: cannot find task %s", id)
+	}
+	if err := pt.Get("pcr-profile", &profile); err != nil {
+		return nil, nil, err
+	}
+	if err := pt.Get("pending-pcr-profile", &pending); err != nil && !errors.Is(err, state.ErrNoState) {
+		return nil, nil, err
+	}
+	return profile, pending, nil
+}
+
+func (m *FDEManager) doResealKey(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	profile, pending, err := resealProfiles(t)
+	if err != nil {
+		return err
+	}
+
+	var sealed []*Keyslot
+	for _, ks := range c.Keyslots {
+		if ks.Protector == ProtectorTPM && ks.SealedObject != "" {
+			copied := *ks
+			sealed = append(sealed, &copied)
+		}
+	}
+	if len(sealed) == 0 {
+		return fmt.Errorf("container %s has no sealed keys", c.DevicePath)
+	}
+	gen := c.nextPCRProfileGeneration()
+	devicePath := c.DevicePath
+
+	st.Unlock()
+	err = func() error {
+		profile, err = completeProfile(profile)
+		if err != nil {
+			return err
+		}
+		params, err := modelParams(profile)
+		if err != nil {
+			return err
+		}
+
+		// every sealed key object has its own policy auth key
+		for _, ks := range sealed {
+			err := resealKeys(&secboot.ResealKeysParams{
+				ModelParams:          params,
+				KeyFiles:             []string{ks.SealedObject},
+				TPMPolicyAuthKeyFile: policyAuthKeyPath(ks.SealedObject),
+			}, profile.DBXUpdateKeystores)
+			if err != nil {
+				return fmt.Errorf("cannot reseal %s: %v", ks.SealedObject, err)
+			}
+		}
+		for _, ks := range sealed {
+			ks.PCRProfileGeneration = gen
+			recordKeyslotToken(devicePath, ks)
+		}
+		return nil
+	}()
+	st.Lock()
+	if err != nil {
+		return err
+	}
+
+	c, err = taskContainer(t)
+	if err != nil {
+		return err
+	}
+	for _, resealed := range sealed {
+		if ks := c.Keyslot(resealed.Slot); ks != nil && ks.SealedObject == resealed.SealedObject {
+			ks.PCRProfileGeneration = gen
+		}
+	}
+	c.PCRProfile = profile
+	c.PendingPCRProfile = pending
+	c.PendingBootID = ""
+	c.PendingCommitBootID = ""
+	if pending != nil {
+		if c.PendingBootID, err = bootID(); err != nil {
+			return fmt.Errorf("cannot obtain boot ID: %v", err)
+		}
+	}
+	return SetContainer(st, c)
+}
@@ -0,0 +1,615 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot"
+
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+const testUUID = "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"
+
+var testTime = time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC)
+
+type handlersSuite struct {
+	fdeMgrBaseSuite
+
+	bootDir string
+
+	sealCalls   []*secboot.SealKeysParams
+	sealedKeys  []secboot.SealKeyRequest
+	resealCalls []*secboot.ResealKeysParams
+	released    []uint32
+
+	bootID string
+
+	sealErr   error
+	resealErr error
+}
+
+var _ = Suite(&handlersSuite{})
+
+func (s *handlersSuite) SetUpTest(c *C) {
+	s.fdeMgrBaseSuite.SetUpTest(c)
+
+	s.sealCalls = nil
+	s.sealedKeys = nil
+	s.resealCalls = nil
+	s.released = nil
+	s.sealErr = nil
+	s.resealErr = nil
+	s.bootID = "boot-1"
+
+	s.bootDir = c.MkDir()
+	for _, name := range []string{"shimx64.efi", "grubx64.efi", "kernel.efi"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(s.bootDir, name), []byte(name), 0644), IsNil)
+	}
+
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	s.mockHeader(c, "/dev/sda4", testUUID)
+
+	s.AddCleanup(fdestate.MockTimeNow(func() time.Time {
+		return testTime
+	}))
+	s.AddCleanup(fdestate.MockBootID(func() (string, error) {
+		return s.bootID, nil
+	}))
+	s.AddCleanup(fdestate.MockDiskUnlockKey(func(c *fdestate.Container) ([]byte, error) {
+		return []byte("unlock-key"), nil
+	}))
+	s.AddCleanup(fdestate.MockSecbootSealKeys(func(keys []secboot.SealKeyRequest, params *secboot.SealKeysParams) error {
+		s.sealedKeys = append(s.sealedKeys, keys...)
+		s.sealCalls = append(s.sealCalls, params)
+		return s.sealErr
+	}))
+	s.AddCleanup(fdestate.MockSecbootResealKeys(func(params *secboot.ResealKeysParams) error {
+		s.resealCalls = append(s.resealCalls, params)
+		return s.resealErr
+	}))
+	s.AddCleanup(fdestate.MockSecbootReleasePCRResourceHandles(func(handles ...uint32) error {
+		s.released = append(s.released, handles...)
+		return nil
+	}))
+
+	// discover the container
+	s.ensure(c)
+}
+
+func (s *handlersSuite) profile() *fdestate.PCRProfile {
+	return &fdestate.PCRProfile{
+		PCRs: []int{4, 7, 12},
+		BootChains: []*fdestate.BootChain{
+			{
+				Images: []*fdestate.BootImage{
+					{Path: filepath.Join(s.bootDir, "shimx64.efi")},
+					{Path: filepath.Join(s.bootDir, "grubx64.efi")},
+					{Path: filepath.Join(s.bootDir, "kernel.efi")},
+				},
+				KernelCmdlines: []string{"console=ttyS0 quiet"},
+			},
+		},
+	}
+}
+
+func (s *handlersSuite) completedProfile() *fdestate.PCRProfile {
+	profile := s.profile()
+	for _, img := range profile.BootChains[0].Images {
+		img.Digest = digest(filepath.Base(img.Path))
+	}
+	return profile
+}
+
+func (s *handlersSuite) container(c *C) *fdestate.Container {
+	s.st.Lock()
+	defer s.st.Unlock()
+	container, err := fdestate.ContainerByUUID(s.st, testUUID)
+	c.Assert(err, IsNil)
+	return container
+}
+
+func (s *handlersSuite) runSeal(c *C, name string) *state.Change {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	ts, err := fdestate.Seal(s.st, testUUID, name, s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("seal", "...")
+	chg.AddAll(ts)
+
+	s.st.Unlock()
+	s.settle(c)
+	s.st.Lock()
+
+	return chg
+}
+
+func (s *handlersSuite) TestSealKey(c *C) {
+	chg := s.runSeal(c, "run")
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	c.Check(chg.Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+
+	c.Check(s.luksCalls("add-key"), DeepEquals, []string{"/dev/sda4:2"})
+	c.Check(s.luks.Key("/dev/sda4", 2), HasLen, 32)
+	sealedObject := filepath.Join(paths.ManagerKeysDir, testUUID+"-run.sealed-key")
+	c.Assert(s.sealedKeys, HasLen, 1)
+	c.Check(s.sealedKeys[0].KeyName, Equals, "run")
+	c.Check(s.sealedKeys[0].KeyFile, Equals, sealedObject)
+	c.Assert(s.sealCalls, HasLen, 1)
+	c.Check(s.sealCalls[0].PCRPolicyCounterHandle, Equals, uint32(0x01880010))
+	c.Check(s.sealCalls[0].TPMPolicyAuthKeyFile, Equals, sealedObject+".policy-auth-key")
+	c.Assert(s.sealCalls[0].ModelParams, HasLen, 1)
+	c.Check(s.sealCalls[0].ModelParams[0].KernelCmdlines, DeepEquals, []string{"console=ttyS0 quiet"})
+
+	container := s.container(c)
+	c.Check(container.Keyslot(2), DeepEquals, &fdestate.Keyslot{
+		Slot:                 2,
+		Name:                 "run",
+		Protector:            fdestate.ProtectorTPM,
+		SealedObject:         sealedObject,
+		PCRPolicyCounter:     0x01880010,
+		PCRProfileGeneration: 1,
+		CreationTime:         testTime,
+	})
+	c.Check(container.PCRProfile, DeepEquals, s.completedProfile())
+	c.Assert(container.WillUnseal, NotNil)
+	c.Check(*container.WillUnseal, Equals, true)
+
+	// the unlock key is not retained once the change is ready
+	c.Check(s.mgr.UnlockKeys(), HasLen, 0)
+}
+
+func (s *handlersSuite) TestSealKeyAllocatesNewPolicyCounter(c *C) {
+	s.runSeal(c, "run")
+	s.runSeal(c, "fallback")
+
+	c.Check(s.luksCalls("add-key"), DeepEquals, []string{"/dev/sda4:2", "/dev/sda4:3"})
+	c.Assert(s.sealCalls, HasLen, 2)
+	c.Check(s.sealCalls[1].PCRPolicyCounterHandle, Equals, uint32(0x01880011))
+}
+
+func (s *handlersSuite) TestSealKeyRetryReusesPolicyCounter(c *C) {
+	s.st.Lock()
+	ts, err := fdestate.Seal(s.st, testUUID, "run", s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("seal", "...")
+	chg.AddAll(ts)
+	// simulate an attempt interrupted after defining the counter
+	seal := ts.Tasks()[1]
+	c.Assert(seal.Kind(), Equals, "seal-key")
+	seal.Set("slot", 2)
+	seal.Set("pcr-policy-counter", uint32(0x01880012))
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	c.Check(s.released, DeepEquals, []uint32{0x01880012})
+	c.Assert(s.sealCalls, HasLen, 1)
+	c.Check(s.sealCalls[0].PCRPolicyCounterHandle, Equals, uint32(0x01880012))
+	c.Check(s.container(c).Keyslot(2).PCRPolicyCounter, Equals, uint32(0x01880012))
+}
+
+func (s *handlersSuite) TestSealKeyError(c *C) {
+	s.sealErr = errors.New("boom")
+
+	chg := s.runSeal(c, "run")
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot seal key: boom.*`)
+	s.st.Unlock()
+
+	c.Check(s.luksCalls("add-key"), DeepEquals, []string{"/dev/sda4:2"})
+	c.Check(s.luksCalls("remove-key"), DeepEquals, []string{"/dev/sda4:2"})
+	c.Check(s.container(c).Keyslot(2), IsNil)
+}
+
+func (s *handlersSuite) TestSealKeyUndo(c *C) {
+	s.o.TaskRunner().AddHandler("error-trigger", func(t *state.Task, _ *tomb.Tomb) error {
+		return errors.New("trigger")
+	}, nil)
+
+	s.st.Lock()
+	ts, err := fdestate.Seal(s.st, testUUID, "run", s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("seal", "...")
+	chg.AddAll(ts)
+	trigger := s.st.NewTask("error-trigger", "...")
+	trigger.WaitAll(ts)
+	chg.AddTask(trigger)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*trigger.*`)
+	c.Check(ts.Tasks()[1].Status(), Equals, state.UndoneStatus)
+	s.st.Unlock()
+
+	c.Check(s.luksCalls("remove-key"), DeepEquals, []string{"/dev/sda4:2"})
+	c.Check(s.released, DeepEquals, []uint32{0x01880010})
+	c.Check(s.container(c).Keyslot(2), IsNil)
+}
+
+func (s *handlersSuite) TestSealNoUnlockKey(c *C) {
+	s.AddCleanup(fdestate.MockDiskUnlockKey(func(c *fdestate.Container) ([]byte, error) {
+		return nil, errors.New("not in keyring")
+	}))
+
+	chg := s.runSeal(c, "run")
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot obtain unlock key: not in keyring.*`)
+	s.st.Unlock()
+	c.Check(s.luksCalls("add-key"), HasLen, 0)
+}
+
+func (s *handlersSuite) TestSealErrors(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	_, err := fdestate.Seal(s.st, "not-a-uuid", "run", s.profile())
+	c.Check(err, ErrorMatches, `cannot find container with UUID "not-a-uuid"`)
+	c.Check(err, FitsTypeOf, &fdestate.ContainerNotFoundError{})
+
+	_, err = fdestate.Seal(s.st, testUUID, "default", s.profile())
+	c.Check(err, ErrorMatches, `container .* already has a keyslot named "default"`)
+
+	_, err = fdestate.Seal(s.st, testUUID, "run", nil)
+	c.Check(err, ErrorMatches, `cannot seal key: PCR profile has no boot chains`)
+
+	ts, err := fdestate.Seal(s.st, testUUID, "run", s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("seal", "...")
+	chg.AddAll(ts)
+
+	_, err = fdestate.Seal(s.st, testUUID, "other", s.profile())
+	c.Check(err, ErrorMatches, `container .* has "seal" change in progress`)
+	c.Check(err, FitsTypeOf, &fdestate.ChangeConflictError{})
+}
+
+func (s *handlersSuite) TestSealTPMChangeConflict(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	chg := s.st.NewChange("clear-tpm", "...")
+	chg.AddTask(s.st.NewTask("clear-tpm", "..."))
+
+	_, err := fdestate.Seal(s.st, testUUID, "run", s.profile())
+	c.Check(err, ErrorMatches, `container .* has "clear-tpm" change in progress`)
+	c.Check(err, FitsTypeOf, &fdestate.ChangeConflictError{})
+	_, err = fdestate.Reseal(s.st, testUUID, s.profile())
+	c.Check(err, ErrorMatches, `container .* has "clear-tpm" change in progress`)
+}
+
+func (s *handlersSuite) TestResealKey(c *C) {
+	s.runSeal(c, "run")
+	s.runSeal(c, "fallback")
+
+	profile := s.profile()
+	profile.BootChains[0].KernelCmdlines = []string{"console=ttyS0"}
+
+	s.st.Lock()
+	ts, err := fdestate.Reseal(s.st, testUUID, profile)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("reseal", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	c.Assert(s.resealCalls, HasLen, 2)
+	for i, name := range []string{"run", "fallback"} {
+		sealedObject := filepath.Join(paths.ManagerKeysDir, testUUID+"-"+name+".sealed-key")
+		c.Check(s.resealCalls[i].KeyFiles, DeepEquals, []string{sealedObject})
+		c.Check(s.resealCalls[i].TPMPolicyAuthKeyFile, Equals, sealedObject+".policy-auth-key")
+		c.Assert(s.resealCalls[i].ModelParams, HasLen, 1)
+		c.Check(s.resealCalls[i].ModelParams[0].KernelCmdlines, DeepEquals, []string{"console=ttyS0"})
+	}
+
+	c.Check(s.container(c).PCRProfile.BootChains[0].KernelCmdlines, DeepEquals, []string{"console=ttyS0"})
+}
+
+func (s *handlersSuite) TestResealKeyNoSealedKeys(c *C) {
+	s.st.Lock()
+	ts, err := fdestate.Reseal(s.st, testUUID, s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("reseal", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*container /dev/sda4 has no sealed keys.*`)
+	s.st.Unlock()
+	c.Check(s.resealCalls, HasLen, 0)
+}
+
+// newKernelChain returns a boot chain for a new kernel image, which is
+// installed if requested.
+func (s *handlersSuite) newKernelChain(c *C, install bool) *fdestate.BootChain {
+	if install {
+		c.Assert(ioutil.WriteFile(filepath.Join(s.bootDir, "kernel-new.efi"), []byte("kernel-new.efi"), 0644), IsNil)
+	}
+	return &fdestate.BootChain{
+		Images: []*fdestate.BootImage{
+			{Path: filepath.Join(s.bootDir, "shimx64.efi")},
+			{Path: filepath.Join(s.bootDir, "grubx64.efi")},
+			{Path: filepath.Join(s.bootDir, "kernel-new.efi"), Digest: digest("kernel-new.efi")},
+		},
+		KernelCmdlines: []string{"console=ttyS0 quiet"},
+	}
+}
+
+func (s *handlersSuite) runResealForBootChains(c *C, chains ...*fdestate.BootChain) *state.Change {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	tss, err := fdestate.ResealForBootChains(s.st, chains)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("reseal", "...")
+	for _, ts := range tss {
+		chg.AddAll(ts)
+	}
+
+	s.st.Unlock()
+	s.settle(c)
+	s.st.Lock()
+
+	c.Check(chg.Err(), IsNil)
+	return chg
+}
+
+func (s *handlersSuite) changesOfKind(kind string) []*state.Change {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	var chgs []*state.Change
+	for _, chg := range s.st.Changes() {
+		if chg.Kind() == kind {
+			chgs = append(chgs, chg)
+		}
+	}
+	return chgs
+}
+
+func (s *handlersSuite) TestResealForBootChainsKeepsCurrentChain(c *C) {
+	s.runSeal(c, "run")
+
+	chain := s.newKernelChain(c, false)
+	s.runResealForBootChains(c, chain)
+
+	newProfile := &fdestate.PCRProfile{
+		PCRs: []int{4, 7, 12},
+		BootChains: []*fdestate.BootChain{{
+			Images: []*fdestate.BootImage{
+				{Path: filepath.Join(s.bootDir, "shimx64.efi"), Digest: digest("shimx64.efi")},
+				{Path: filepath.Join(s.bootDir, "grubx64.efi"), Digest: digest("grubx64.efi")},
+				{Path: filepath.Join(s.bootDir, "kernel-new.efi"), Digest: digest("kernel-new.efi")},
+			},
+			KernelCmdlines: []string{"console=ttyS0 quiet"},
+		}},
+	}
+
+	// the keys are resealed against both the new and the current
+	// boot chains
+	c.Assert(s.resealCalls, HasLen, 1)
+	c.Check(s.resealCalls[0].ModelParams, HasLen, 2)
+
+	container := s.container(c)
+	c.Check(container.PCRProfile, DeepEquals, &fdestate.PCRProfile{
+		PCRs:       []int{4, 7, 12},
+		BootChains: append(newProfile.BootChains, s.completedProfile().BootChains...),
+	})
+	c.Check(container.PendingPCRProfile, DeepEquals, newProfile)
+	c.Check(container.PendingBootID, Equals, "boot-1")
+	c.Check(s.changesOfKind("commit-pcr-profile"), HasLen, 0)
+}
+
+func (s *handlersSuite) TestResealForBootChainsCommitsAfterReboot(c *C) {
+	s.runSeal(c, "run")
+	s.runResealForBootChains(c, s.newKernelChain(c, true))
+	c.Assert(s.resealCalls, HasLen, 1)
+
+	// the new profile is committed once the system boots with the
+	// new boot chain installed
+	s.bootID = "boot-2"
+	s.settle(c)
+
+	chgs := s.changesOfKind("commit-pcr-profile")
+	c.Assert(chgs, HasLen, 1)
+	s.st.Lock()
+	c.Check(chgs[0].Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+
+	c.Assert(s.resealCalls, HasLen, 2)
+	c.Check(s.resealCalls[1].ModelParams, HasLen, 1)
+
+	container := s.container(c)
+	c.Check(container.PCRProfile.BootChains, HasLen, 1)
+	c.Check(container.PCRProfile.BootChains[0].Images[2].Path, Equals, filepath.Join(s.bootDir, "kernel-new.efi"))
+	c.Check(container.PendingPCRProfile, IsNil)
+	c.Check(container.PendingBootID, Equals, "")
+}
+
+func (s *handlersSuite) TestResealForBootChainsCommitOncePerBoot(c *C) {
+	s.runSeal(c, "run")
+	s.runResealForBootChains(c, s.newKernelChain(c, true))
+	c.Assert(s.resealCalls, HasLen, 1)
+
+	s.resealErr = errors.New("boom")
+	s.bootID = "boot-2"
+	s.settle(c)
+
+	chgs := s.changesOfKind("commit-pcr-profile")
+	c.Assert(chgs, HasLen, 1)
+	s.st.Lock()
+	c.Check(chgs[0].Status(), Equals, state.ErrorStatus)
+	s.st.Unlock()
+	c.Check(s.container(c).PendingCommitBootID, Equals, "boot-2")
+
+	// the failed commit is not repeated during the same boot
+	s.ensure(c)
+	s.settle(c)
+	c.Check(s.changesOfKind("commit-pcr-profile"), HasLen, 1)
+	c.Check(s.resealCalls, HasLen, 2)
+
+	s.resealErr = nil
+	s.bootID = "boot-3"
+	s.settle(c)
+
+	chgs = s.changesOfKind("commit-pcr-profile")
+	c.Assert(chgs, HasLen, 2)
+	s.st.Lock()
+	c.Check(chgs[1].Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+	container := s.container(c)
+	c.Check(container.PendingPCRProfile, IsNil)
+	c.Check(container.PendingCommitBootID, Equals, "")
+}
+
+func (s *handlersSuite) TestResealForBootChainsNoCommitWithoutNewImages(c *C) {
+	s.runSeal(c, "run")
+	s.runResealForBootChains(c, s.newKernelChain(c, false))
+
+	s.bootID = "boot-2"
+	s.settle(c)
+
+	c.Check(s.changesOfKind("commit-pcr-profile"), HasLen, 0)
+	c.Check(s.resealCalls, HasLen, 1)
+	c.Check(s.container(c).PendingPCRProfile, NotNil)
+}
+
+func (s *handlersSuite) TestResealForBootChainsDropsUnbootableChain(c *C) {
+	s.runSeal(c, "run")
+
+	// the current kernel is replaced in place
+	kernel := filepath.Join(s.bootDir, "kernel.efi")
+	c.Assert(ioutil.WriteFile(kernel, []byte("kernel-2.efi"), 0644), IsNil)
+	s.runResealForBootChains(c, s.profile().BootChains...)
+
+	c.Assert(s.resealCalls, HasLen, 1)
+	c.Check(s.resealCalls[0].ModelParams, HasLen, 1)
+
+	container := s.container(c)
+	c.Assert(container.PCRProfile.BootChains, HasLen, 1)
+	c.Check(container.PCRProfile.BootChains[0].Images[2].Digest, Equals, digest("kernel-2.efi"))
+	c.Check(container.PendingPCRProfile, IsNil)
+}
+
+func (s *handlersSuite) TestResealForBootChainsErrors(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	_, err := fdestate.ResealForBootChains(s.st, nil)
+	c.Check(err, ErrorMatches, `no boot chains`)
+
+	_, err = fdestate.ResealForBootChains(s.st, []*fdestate.BootChain{{}})
+	c.Check(err, ErrorMatches, `boot chain has no images`)
+
+	_, err = fdestate.ResealForBootChains(s.st, s.profile().BootChains)
+	c.Check(err, Equals, fdestate.ErrNoSealedKeys)
+
+	s.st.Unlock()
+	s.runSeal(c, "run")
+	s.st.Lock()
+
+	tss, err := fdestate.ResealForBootChains(s.st, s.profile().BootChains)
+	c.Assert(err, IsNil)
+	c.Assert(tss, HasLen, 1)
+	c.Check(tss[0].Tasks(), HasLen, 2)
+	chg := s.st.NewChange("reseal", "...")
+	chg.AddAll(tss[0])
+
+	_, err = fdestate.ResealForBootChains(s.st, s.profile().BootChains)
+	c.Check(err, ErrorMatches, `container .* has "reseal" change in progress`)
+}
+
+func (s *handlersSuite) TestStopWipesUnlockKeys(c *C) {
+	s.st.Lock()
+	ts, err := fdestate.Seal(s.st, testUUID, "run", s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("seal", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	// only run the unseal-key task
+	runner := s.o.TaskRunner()
+	c.Assert(runner.Ensure(), IsNil)
+	runner.Wait()
+
+	keys := s.mgr.UnlockKeys()
+	c.Assert(keys, HasLen, 1)
+	var key []byte
+	for _, k := range keys {
+		key = k
+	}
+	c.Check(key, DeepEquals, []byte("unlock-key"))
+
+	s.mgr.Stop()
+	c.Check(s.mgr.UnlockKeys(), HasLen, 0)
+	c.Check(key, DeepEquals, make([]byte, len("unlock-key")))
+}
+
+func (s *handlersSuite) TestModelParams(c *C) {
+	profile := s.profile()
+	profile.BootChains = append(profile.BootChains, &fdestate.BootChain{
+		Images: []*fdestate.BootImage{{Path: "/boot/efi/EFI/BOOT/BOOTX64.EFI"}},
+	})
+
+	params, err := fdestate.ModelParams(profile)
+	c.Assert(err, IsNil)
+	c.Assert(params, HasLen, 2)
+
+	lc := params[0].EFILoadChains
+	var images []string
+	for len(lc) > 0 {
+		c.Assert(lc, HasLen, 1)
+		images = append(images, filepath.Base(lc[0].Path))
+		lc = lc[0].Next
+	}
+	c.Check(images, DeepEquals, []string{"shimx64.efi", "grubx64.efi", "kernel.efi"})
+	c.Check(params[1].EFILoadChains[0].Path, Equals, "/boot/efi/EFI/BOOT/BOOTX64.EFI")
+	c.Check(params[1].KernelCmdlines, HasLen, 0)
+
+	_, err = fdestate.ModelParams(&fdestate.PCRProfile{BootChains: []*fdestate.BootChain{{}}})
+	c.Check(err, ErrorMatches, `boot chain has no images`)
+}
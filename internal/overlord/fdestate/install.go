@@ -0,0 +1,394 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot"
+	"github.com/snapcore/snapd/secboot/keys"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+const (
+	// the keyslot that the key sealed during installation is added
+	// to when formatting a container.
+	installKeyslot = 0
+
+	installKeyslotName         = "default"
+	installRecoveryKeyslotName = "default-recovery"
+)
+
+// ErrNotInstallMode is returned when installing is requested while the
+// manager is not running in install mode.
+var ErrNotInstallMode = errors.New("cannot install outside of install mode")
+
+// InstallDevice is a block device, or an image file, of the target
+// system that is encrypted during installation.
+type InstallDevice struct {
+	DevicePath string
+	Label      string
+}
+
+// InstalledContainer describes a container that is created during
+// installation.
+type InstalledContainer struct {
+	DevicePath  string
+	UUID        string
+	RecoveryKey string
+}
+
+// checkInstallConflict returns a *ChangeConflictError if there is an
+// in-progress change that formats containers.
+func checkInstallConflict(st *state.State) error {
+	for _, chg := range st.Changes() {
+		if chg.IsReady() {
+			continue
+		}
+		for _, t := range chg.Tasks() {
+			if t.Kind() == "format-container" {
+				return &ChangeConflictError{ChangeKind: chg.Kind(), ChangeID: chg.ID()}
+			}
+		}
+	}
+	return nil
+}
+
+// Install returns a set of tasks that encrypts the specified devices
+// of the target system, and the containers that will be created. Each
+// device is formatted as a LUKS2 container with a key that is sealed
+// against the supplied boot chains and a recovery key, which is only
+// returned here to be shown to the user exactly once. The state and
+// the sealed key objects are written to the target system, so that the
+// manager of the installed system takes them over.
+func Install(st *state.State, devices []*InstallDevice, chains []*BootChain) (*state.TaskSet, []*InstalledContainer, error) {
+	if paths.TargetRootDir() == "" {
+		return nil, nil, ErrNotInstallMode
+	}
+	if len(devices) == 0 {
+		return nil, nil, fmt.Errorf("no devices to encrypt")
+	}
+	profile := &PCRProfile{PCRs: DefaultPCRs, BootChains: chains}
+	if _, err := modelParams(profile); err != nil {
+		return nil, nil, fmt.Errorf("cannot seal keys: %v", err)
+	}
+
+	known, err := allContainers(st)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool, len(devices))
+	for _, dev := range devices {
+		if dev.DevicePath == "" {
+			return nil, nil, fmt.Errorf("device path must be specified")
+		}
+		if seen[dev.DevicePath] {
+			return nil, nil, fmt.Errorf("device %s is specified more than once", dev.DevicePath)
+		}
+		seen[dev.DevicePath] = true
+		for _, c := range known {
+			if c.DevicePath == dev.DevicePath {
+				return nil, nil, fmt.Errorf("device %s is already an encrypted container", dev.DevicePath)
+			}
+		}
+	}
+	if err := checkInstallConflict(st); err != nil {
+		return nil, nil, err
+	}
+
+	// generate everything that can fail before creating any tasks
+	uuids := make([]string, len(devices))
+	recoveryKeys := make([]keys.RecoveryKey, len(devices))
+	for i := range devices {
+		uuids[i], err = newContainerUUID()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create container UUID: %v", err)
+		}
+		recoveryKeys[i], err = newRecoveryKey()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create recovery key: %v", err)
+		}
+	}
+
+	ts := state.NewTaskSet()
+	var installed []*InstalledContainer
+	pending := make(map[string]*keys.RecoveryKey, len(devices))
+	for i, dev := range devices {
+		uuid := uuids[i]
+
+		format := st.NewTask("format-container", fmt.Sprintf("Format %s", dev.DevicePath))
+		format.Set("container", uuid)
+		format.Set("device-path", dev.DevicePath)
+		format.Set("label", dev.Label)
+
+		seal := st.NewTask("seal-install-key", fmt.Sprintf("Seal key %q for %s", installKeyslotName, dev.DevicePath))
+		seal.Set("container", uuid)
+		seal.Set("keyslot-name", installKeyslotName)
+		seal.Set("pcr-profile", profile)
+		seal.WaitFor(format)
+
+		add := st.NewTask("add-recovery-key", fmt.Sprintf("Add recovery key %q to %s", installRecoveryKeyslotName, dev.DevicePath))
+		add.Set("container", uuid)
+		add.Set("keyslot-name", installRecoveryKeyslotName)
+		add.WaitFor(seal)
+
+		ts.AddAll(state.NewTaskSet(format, seal, add))
+		installed = append(installed, &InstalledContainer{
+			DevicePath:  dev.DevicePath,
+			UUID:        uuid,
+			RecoveryKey: recoveryKeyString(&recoveryKeys[i]),
+		})
+		pending[add.ID()] = &recoveryKeys[i]
+	}
+
+	m := fdeManager(st)
+	m.mu.Lock()
+	for id, key := range pending {
+		m.recoveryKeys[id] = key
+	}
+	m.mu.Unlock()
+
+	return ts, installed, nil
+}
+
+func removeContainer(st *state.State, uuid string) error {
+	containers, err := allContainers(st)
+	if err != nil {
+		return err
+	}
+	delete(containers, uuid)
+	st.Set("fde-containers", containers)
+	return nil
+}
+
+func (m *FDEManager) doFormatContainer(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	var uuid, devicePath, label string
+	if err := t.Get("container", &uuid); err != nil {
+		return err
+	}
+	if err := t.Get("device-path", &devicePath); err != nil {
+		return err
+	}
+	if err := t.Get("label", &label); err != nil {
+		return err
+	}
+
+	// the key of a previous attempt is lost if the manager restarted,
+	// so the device is always formatted with a new key
+	st.Unlock()
+	key, err := keys.NewEncryptionKey()
+	if err == nil {
+		err = luks.DefaultBackend().Format(devicePath, label, key, &luks.FormatOptions{UUID: uuid, Slot: installKeyslot})
+		if err != nil {
+			wipe(key)
+			err = fmt.Errorf("cannot format %s: %v", devicePath, err)
+		}
+	} else {
+		err = fmt.Errorf("cannot create key: %v", err)
+	}
+	st.Lock()
+	if err != nil {
+		return err
+	}
+
+	id := unlockKeyID(t, uuid)
+	m.mu.Lock()
+	if old, ok := m.unlockKeys[id]; ok {
+		wipe(old)
+	}
+	m.unlockKeys[id] = key
+	m.mu.Unlock()
+
+	return SetContainer(st, &Container{
+		DevicePath: devicePath,
+		UUID:       uuid,
+		Label:      label,
+		Keyslots:   []*Keyslot{{Slot: installKeyslot, Protector: ProtectorUnknown}},
+	})
+}
+
+func (m *FDEManager) undoFormatContainer(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	var uuid string
+	if err := t.Get("container", &uuid); err != nil {
+		return err
+	}
+
+	id := unlockKeyID(t, uuid)
+	m.mu.Lock()
+	if key, ok := m.unlockKeys[id]; ok {
+		wipe(key)
+		delete(m.unlockKeys, id)
+	}
+	m.mu.Unlock()
+
+	// the data on the device is gone already, so the container is
+	// just forgotten
+	return removeContainer(st, uuid)
+}
+
+// installedProfile returns a copy of profile with the paths of the
+// boot images as seen by the installed system.
+func installedProfile(profile *PCRProfile) *PCRProfile {
+	installed := &PCRProfile{PCRs: profile.PCRs, DBXUpdateKeystores: profile.DBXUpdateKeystores}
+	for _, chain := range profile.BootChains {
+		c := &BootChain{KernelCmdlines: chain.KernelCmdlines}
+		for _, img := range chain.Images {
+			c.Images = append(c.Images, &BootImage{Path: paths.InstalledPath(img.Path), Digest: img.Digest})
+		}
+		installed.BootChains = append(installed.BootChains, c)
+	}
+	return installed
+}
+
+func (m *FDEManager) doSealInstallKey(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var name string
+	if err := t.Get("keyslot-name", &name); err != nil {
+		return err
+	}
+	var profile *PCRProfile
+	if err := t.Get("pcr-profile", &profile); err != nil {
+		return err
+	}
+	// this is the key that the container was formatted with
+	unlockKey, err := m.unlockKey(t, c)
+	if err != nil {
+		return fmt.Errorf("cannot obtain unlock key: %v", err)
+	}
+	handle, err := freePolicyCounterHandle(st)
+	if err != nil {
+		return err
+	}
+	t.Set("pcr-policy-counter", handle)
+	sealedObject := sealedObjectPath(c.UUID, name)
+	devicePath := c.DevicePath
+	ks := &Keyslot{
+		Slot:                 installKeyslot,
+		Name:                 name,
+		Protector:            ProtectorTPM,
+		SealedObject:         paths.InstalledPath(sealedObject),
+		PCRPolicyCounter:     handle,
+		PCRProfileGeneration: c.nextPCRProfileGeneration(),
+	}
+
+	st.Unlock()
+	err = func() error {
+		profile, err = completeProfile(profile)
+		if err != nil {
+			return err
+		}
+		params, err := modelParams(profile)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(paths.ManagerKeysDir, 0700); err != nil {
+			return err
+		}
+		err = secbootSealKeys([]secboot.SealKeyRequest{{
+			Key:     unlockKey,
+			KeyName: name,
+			KeyFile: sealedObject,
+		}}, &secboot.SealKeysParams{
+			ModelParams:            params,
+			TPMPolicyAuthKeyFile:   policyAuthKeyPath(sealedObject),
+			PCRPolicyCounterHandle: handle,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot seal key: %v", err)
+		}
+		ks.CreationTime = timeNow()
+		recordKeyslotToken(devicePath, ks)
+		return nil
+	}()
+	st.Lock()
+	if err != nil {
+		return err
+	}
+
+	c, err = taskContainer(t)
+	if err != nil {
+		return err
+	}
+	c.setKeyslot(ks)
+	c.PCRProfile = installedProfile(profile)
+	return SetContainer(st, c)
+}
+
+func (m *FDEManager) undoSealInstallKey(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var name string
+	if err := t.Get("keyslot-name", &name); err != nil {
+		return err
+	}
+	var handle uint32
+	if err := t.Get("pcr-policy-counter", &handle); err != nil {
+		return err
+	}
+	sealedObject := sealedObjectPath(c.UUID, name)
+	devicePath := c.DevicePath
+
+	st.Unlock()
+	forgetKeyslotToken(devicePath, installKeyslot)
+	if err := secbootReleasePCRResourceHandles(handle); err != nil {
+		logger.Noticef("cannot release PCR policy counter %#x: %v", handle, err)
+	}
+	os.Remove(sealedObject)
+	os.Remove(policyAuthKeyPath(sealedObject))
+	st.Lock()
+
+	c, err = taskContainer(t)
+	if err != nil {
+		return err
+	}
+	if ks := c.Keyslot(installKeyslot); ks != nil {
+		*ks = Keyslot{Slot: installKeyslot, Protector: ProtectorUnknown}
+	}
+	c.PCRProfile = nil
+	return SetContainer(st, c)
+}
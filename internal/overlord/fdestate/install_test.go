@@ -0,0 +1,267 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot"
+
+	"github.com/snapcore/fdemanager/internal/luks/lukstest"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+const installTestUUID = "0b6b3c8e-8d3a-4a55-9c6e-0f1d9b2a7c55"
+
+// mockInstall enters install mode with a target system that has its
+// own boot images, and returns the path of an image file to encrypt.
+func (s *handlersSuite) mockInstall(c *C) (target, image string) {
+	target = c.MkDir()
+	paths.SetTargetRootDir(target)
+	s.AddCleanup(func() { paths.SetTargetRootDir("") })
+
+	bootDir := filepath.Join(target, "boot/efi")
+	c.Assert(os.MkdirAll(bootDir, 0755), IsNil)
+	for _, name := range []string{"shimx64.efi", "grubx64.efi", "kernel.efi"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(bootDir, name), []byte(name), 0644), IsNil)
+	}
+	s.bootDir = bootDir
+
+	image = filepath.Join(c.MkDir(), "disk.img")
+	c.Assert(ioutil.WriteFile(image, nil, 0600), IsNil)
+
+	s.AddCleanup(fdestate.MockNewContainerUUID(func() (string, error) {
+		return installTestUUID, nil
+	}))
+	s.mockRecoveryKey(c)
+	return target, image
+}
+
+func (s *handlersSuite) TestInstall(c *C) {
+	target, image := s.mockInstall(c)
+
+	var sealedKey []byte
+	s.AddCleanup(fdestate.MockSecbootSealKeys(func(keys []secboot.SealKeyRequest, params *secboot.SealKeysParams) error {
+		// the key is wiped once the change is ready
+		sealedKey = append([]byte(nil), keys[0].Key...)
+		s.sealedKeys = append(s.sealedKeys, keys...)
+		s.sealCalls = append(s.sealCalls, params)
+		return nil
+	}))
+
+	s.st.Lock()
+	ts, installed, err := fdestate.Install(s.st, []*fdestate.InstallDevice{
+		{DevicePath: image, Label: "ubuntu-data-enc"},
+	}, s.profile().BootChains)
+	c.Assert(err, IsNil)
+	c.Check(installed, DeepEquals, []*fdestate.InstalledContainer{{
+		DevicePath:  image,
+		UUID:        installTestUUID,
+		RecoveryKey: "00001-65535-12345-00000-10000-00010-00128-04660",
+	}})
+	var kinds []string
+	for _, t := range ts.Tasks() {
+		kinds = append(kinds, t.Kind())
+	}
+	c.Check(kinds, DeepEquals, []string{"format-container", "seal-install-key", "add-recovery-key"})
+	chg := s.st.NewChange("install", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	var data map[string][]string
+	c.Check(chg.Get("api-data", &data), IsNil)
+	s.st.Unlock()
+	// the recovery key returned by Install is enrolled
+	c.Check(data, DeepEquals, map[string][]string{"recovery-keys-enrolled": {installTestUUID}})
+
+	c.Assert(s.luks.Calls, HasLen, 4)
+	format := s.luks.Calls[0]
+	c.Check(format.Op, Equals, "format")
+	c.Check(format.DevicePath, Equals, image)
+	c.Check(format.Key, HasLen, 32)
+	formatKey := []byte(format.Key)
+	hdr := s.luks.Header(image)
+	c.Check(hdr.UUID, Equals, installTestUUID)
+	c.Check(hdr.Label, Equals, "ubuntu-data-enc")
+	c.Check(s.luks.Key(image, 0), DeepEquals, formatKey)
+	// the recovery key is added with the key that the container
+	// was formatted with
+	c.Check(s.luks.Calls[2], DeepEquals, lukstest.Call{
+		Op:          "add-key",
+		DevicePath:  image,
+		Slot:        1,
+		Key:         string(testRecoveryKey[:]),
+		ExistingKey: format.Key,
+	})
+
+	// the key that the container was formatted with is sealed
+	sealedObject := filepath.Join(target, "var/lib/fdemanagerd/keys", installTestUUID+"-default.sealed-key")
+	c.Assert(s.sealedKeys, HasLen, 1)
+	c.Check(sealedKey, DeepEquals, formatKey)
+	c.Check(s.sealedKeys[0].KeyName, Equals, "default")
+	c.Check(s.sealedKeys[0].KeyFile, Equals, sealedObject)
+	c.Assert(s.sealCalls, HasLen, 1)
+	c.Check(s.sealCalls[0].TPMPolicyAuthKeyFile, Equals, sealedObject+".policy-auth-key")
+
+	s.st.Lock()
+	container, err := fdestate.ContainerByUUID(s.st, installTestUUID)
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+	c.Check(container.DevicePath, Equals, image)
+	c.Check(container.Label, Equals, "ubuntu-data-enc")
+	// paths are recorded as seen by the installed system
+	c.Check(container.Keyslots, DeepEquals, []*fdestate.Keyslot{
+		{
+			Slot:                 0,
+			Name:                 "default",
+			Protector:            fdestate.ProtectorTPM,
+			SealedObject:         "/var/lib/fdemanagerd/keys/" + installTestUUID + "-default.sealed-key",
+			PCRPolicyCounter:     0x01880010,
+			PCRProfileGeneration: 1,
+			CreationTime:         testTime,
+		},
+		{
+			Slot:         1,
+			Name:         "default-recovery",
+			Protector:    fdestate.ProtectorRecoveryKey,
+			CreationTime: testTime,
+		},
+	})
+	tokens := s.keyslotTokens(c, image)
+	c.Check(tokens[0]["sealed_object"], Equals, "/var/lib/fdemanagerd/keys/"+installTestUUID+"-default.sealed-key")
+	c.Check(tokens[1]["role"], Equals, "recovery")
+	c.Assert(container.PCRProfile, NotNil)
+	c.Assert(container.PCRProfile.BootChains, HasLen, 1)
+	var imagePaths []string
+	for _, img := range container.PCRProfile.BootChains[0].Images {
+		imagePaths = append(imagePaths, img.Path)
+		c.Check(img.Digest, Equals, digest(filepath.Base(img.Path)))
+	}
+	c.Check(imagePaths, DeepEquals, []string{"/boot/efi/shimx64.efi", "/boot/efi/grubx64.efi", "/boot/efi/kernel.efi"})
+
+	// the format key is not held once the change is ready
+	s.ensure(c)
+	c.Check(s.mgr.UnlockKeys(), HasLen, 0)
+}
+
+func (s *handlersSuite) TestInstallUndo(c *C) {
+	_, image := s.mockInstall(c)
+
+	s.o.TaskRunner().AddHandler("error-trigger", func(t *state.Task, _ *tomb.Tomb) error {
+		return errors.New("trigger")
+	}, nil)
+
+	s.st.Lock()
+	ts, _, err := fdestate.Install(s.st, []*fdestate.InstallDevice{{DevicePath: image}}, s.profile().BootChains)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("install", "...")
+	chg.AddAll(ts)
+	trigger := s.st.NewTask("error-trigger", "...")
+	trigger.WaitAll(ts)
+	chg.AddTask(trigger)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*trigger.*`)
+	for _, t := range ts.Tasks() {
+		c.Check(t.Status(), Equals, state.UndoneStatus, Commentf(t.Kind()))
+	}
+	_, err = fdestate.ContainerByUUID(s.st, installTestUUID)
+	c.Check(err, FitsTypeOf, &fdestate.ContainerNotFoundError{})
+	s.st.Unlock()
+
+	c.Check(s.luksCalls("remove-key"), DeepEquals, []string{image + ":1"})
+	c.Check(s.released, DeepEquals, []uint32{0x01880010})
+	c.Check(s.mgr.UnlockKeys(), HasLen, 0)
+}
+
+func (s *handlersSuite) TestInstallFormatError(c *C) {
+	_, image := s.mockInstall(c)
+
+	s.luks.Err = errors.New("cryptsetup failed with: boom")
+
+	s.st.Lock()
+	ts, _, err := fdestate.Install(s.st, []*fdestate.InstallDevice{{DevicePath: image}}, s.profile().BootChains)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("install", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot format .*disk.img: cryptsetup failed with: boom.*`)
+	_, err = fdestate.ContainerByUUID(s.st, installTestUUID)
+	c.Check(err, FitsTypeOf, &fdestate.ContainerNotFoundError{})
+	s.st.Unlock()
+
+	c.Check(s.sealCalls, HasLen, 0)
+	c.Check(s.mgr.RecoveryKeys(), HasLen, 0)
+}
+
+func (s *handlersSuite) TestInstallErrors(c *C) {
+	s.st.Lock()
+	_, _, err := fdestate.Install(s.st, []*fdestate.InstallDevice{{DevicePath: "/dev/vda"}}, s.profile().BootChains)
+	s.st.Unlock()
+	c.Check(err, Equals, fdestate.ErrNotInstallMode)
+
+	_, image := s.mockInstall(c)
+
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	for _, t := range []struct {
+		devices []*fdestate.InstallDevice
+		chains  []*fdestate.BootChain
+		err     string
+	}{
+		{nil, s.profile().BootChains, `no devices to encrypt`},
+		{[]*fdestate.InstallDevice{{DevicePath: image}}, nil, `cannot seal keys: PCR profile has no boot chains`},
+		{[]*fdestate.InstallDevice{{Label: "foo"}}, s.profile().BootChains, `device path must be specified`},
+		{[]*fdestate.InstallDevice{{DevicePath: image}, {DevicePath: image}}, s.profile().BootChains, `device .*disk.img is specified more than once`},
+		{[]*fdestate.InstallDevice{{DevicePath: "/dev/sda4"}}, s.profile().BootChains, `device /dev/sda4 is already an encrypted container`},
+	} {
+		_, _, err := fdestate.Install(s.st, t.devices, t.chains)
+		c.Check(err, ErrorMatches, t.err)
+	}
+
+	ts, _, err := fdestate.Install(s.st, []*fdestate.InstallDevice{{DevicePath: image}}, s.profile().BootChains)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("install", "...")
+	chg.AddAll(ts)
+
+	_, _, err = fdestate.Install(s.st, []*fdestate.InstallDevice{{DevicePath: "/dev/vdb"}}, s.profile().BootChains)
+	c.Check(err, ErrorMatches, `"install" change in progress`)
+	c.Check(err, FitsTypeOf, &fdestate.ChangeConflictError{})
+}
@@ -0,0 +1,364 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/strutil"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+// PreviewParams describes a boot configuration to preview the PCR
+// profile of.
+type PreviewParams struct {
+	// BootChain is the boot chain to predict PCR 4 and PCR 12 for.
+	// If it is nil, they are predicted for the current boot.
+	BootChain *BootChain
+	// SecureBootVariables are the contents of the secure boot
+	// configuration variables to predict PCR 7 for, keyed by name.
+	// Variables that are not supplied are unchanged.
+	SecureBootVariables map[string][]byte
+}
+
+// PCRPreview is the predicted value of a PCR and the value that was
+// measured during the current boot, encoded in hex.
+type PCRPreview struct {
+	PCR int
+	// KernelCmdline is the kernel command line that the value of
+	// PCR 12 is predicted for.
+	KernelCmdline string
+	Measured      string
+	Predicted     string
+}
+
+// ProfileDifferenceKind describes what differs between a previewed
+// boot configuration and a sealed PCR profile.
+type ProfileDifferenceKind string
+
+const (
+	DifferenceBootImage          ProfileDifferenceKind = "boot-image"
+	DifferenceKernelCmdline      ProfileDifferenceKind = "kernel-cmdline"
+	DifferenceSecureBootVariable ProfileDifferenceKind = "secure-boot-variable"
+)
+
+// ProfileDifference describes an input to a PCR that differs between
+// a previewed boot configuration and a sealed PCR profile.
+type ProfileDifference struct {
+	PCR  int
+	Kind ProfileDifferenceKind
+
+	// Path, Digest and SealedDigest describe a boot image that is not
+	// part of the sealed boot chain at the same position. Digest is
+	// empty for images that are missing from the previewed boot
+	// chain and SealedDigest is empty for images that are missing
+	// from the sealed one.
+	Path         string
+	Digest       string
+	SealedDigest string
+
+	// KernelCmdline is a kernel command line that the sealed boot
+	// chain cannot be started with.
+	KernelCmdline string
+
+	// Variable is the name of a secure boot variable that differs
+	// from the one measured during the current boot.
+	Variable string
+}
+
+// ContainerPreview describes whether the TPM sealed keys of a container
+// would unseal with a previewed boot configuration.
+type ContainerPreview struct {
+	UUID        string
+	DevicePath  string
+	WillUnseal  bool
+	Differences []*ProfileDifference
+
+	// WillUnsealAfterCommit indicates whether the sealed keys would
+	// still unseal once the pending PCR profile of the container is
+	// committed, which drops the boot chains that are not part of it.
+	// It is nil if the container has no pending profile.
+	WillUnsealAfterCommit *bool
+}
+
+// ProfilePreview is the result of previewing the PCR profile of a boot
+// configuration.
+type ProfilePreview struct {
+	PCRs       []*PCRPreview
+	Containers []*ContainerPreview
+}
+
+// PreviewProfile predicts the values of the default PCRs for a boot
+// configuration by replaying the TCG event log of the current boot,
+// and compares the boot configuration with the PCR profiles that the
+// TPM sealed keys are sealed against, and with the pending profiles
+// that will replace them. It doesn't modify the state and must be
+// called without holding the state lock.
+func PreviewProfile(st *state.State, params *PreviewParams) (*ProfilePreview, error) {
+	log, err := efi.ReadLogFile(paths.EventLogFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read TCG event log: %v", err)
+	}
+	measuredVars, err := log.SecureBootVariables()
+	if err != nil {
+		return nil, err
+	}
+	replayParams := &efi.ReplayParams{Variables: params.SecureBootVariables}
+
+	var chain *BootChain
+	cmdlines := []*string{nil}
+	if params.BootChain != nil {
+		if len(params.BootChain.Images) == 0 {
+			return nil, fmt.Errorf("boot chain has no images")
+		}
+		chain = &BootChain{KernelCmdlines: params.BootChain.KernelCmdlines}
+		for _, img := range params.BootChain.Images {
+			digest, err := fileDigest(img.Path)
+			if err != nil {
+				return nil, fmt.Errorf("cannot compute digest of boot image: %v", err)
+			}
+			chain.Images = append(chain.Images, &BootImage{Path: img.Path, Digest: digest})
+
+			imageDigest, err := efi.ImageDigest(img.Path)
+			if err != nil {
+				return nil, fmt.Errorf("cannot compute Authenticode digest of %s: %v", img.Path, err)
+			}
+			replayParams.ImageDigests = append(replayParams.ImageDigests, imageDigest)
+		}
+		if len(chain.KernelCmdlines) > 0 {
+			cmdlines = nil
+			for i := range chain.KernelCmdlines {
+				cmdlines = append(cmdlines, &chain.KernelCmdlines[i])
+			}
+		}
+	}
+
+	measured, err := log.Replay(DefaultPCRs, nil)
+	if err != nil {
+		return nil, err
+	}
+	preview := &ProfilePreview{}
+	for i, cmdline := range cmdlines {
+		replayParams.KernelCmdline = cmdline
+		predicted, err := log.Replay(DefaultPCRs, replayParams)
+		if err != nil {
+			return nil, err
+		}
+		for _, pcr := range DefaultPCRs {
+			// only PCR 12 depends on the kernel command line
+			if pcr != 12 && i > 0 {
+				continue
+			}
+			p := &PCRPreview{
+				PCR:       pcr,
+				Measured:  hex.EncodeToString(measured[pcr]),
+				Predicted: hex.EncodeToString(predicted[pcr]),
+			}
+			if pcr == 12 && cmdline != nil {
+				p.KernelCmdline = *cmdline
+			}
+			preview.PCRs = append(preview.PCRs, p)
+		}
+	}
+	sort.SliceStable(preview.PCRs, func(i, j int) bool {
+		return preview.PCRs[i].PCR < preview.PCRs[j].PCR
+	})
+
+	st.Lock()
+	containers, err := Containers(st)
+	st.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	preview.Containers = []*ContainerPreview{}
+	for _, c := range containers {
+		if !c.hasSealedKeys() || c.PCRProfile == nil {
+			continue
+		}
+		accepted, err := acceptedVariables(c.PCRProfile, measuredVars)
+		if err != nil {
+			return nil, fmt.Errorf("cannot preview PCR profile of %s: %v", c.DevicePath, err)
+		}
+		diffs := profileDifferences(c.PCRProfile, chain, params.SecureBootVariables, accepted)
+		cp := &ContainerPreview{
+			UUID:        c.UUID,
+			DevicePath:  c.DevicePath,
+			WillUnseal:  len(diffs) == 0,
+			Differences: diffs,
+		}
+		if c.PendingPCRProfile != nil {
+			accepted, err := acceptedVariables(c.PendingPCRProfile, measuredVars)
+			if err != nil {
+				return nil, fmt.Errorf("cannot preview pending PCR profile of %s: %v", c.DevicePath, err)
+			}
+			pendingDiffs := profileDifferences(c.PendingPCRProfile, chain, params.SecureBootVariables, accepted)
+			willUnseal := len(pendingDiffs) == 0
+			cp.WillUnsealAfterCommit = &willUnseal
+		}
+		preview.Containers = append(preview.Containers, cp)
+	}
+	return preview, nil
+}
+
+// acceptedVariables returns the values of the secure boot variables
+// that profile accepts, keyed by name. These are the values measured
+// during the current boot and, for the forbidden signature database,
+// also the values that result from applying the updates in the dbx
+// update keystores of the profile.
+func acceptedVariables(profile *PCRProfile, measuredVars map[string][]byte) (map[string][][]byte, error) {
+	accepted := make(map[string][][]byte, len(measuredVars))
+	for name, data := range measuredVars {
+		accepted[name] = [][]byte{data}
+	}
+	for _, keystore := range profile.DBXUpdateKeystores {
+		payload, err := os.ReadFile(dbxUpdateFile(keystore))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read dbx update: %v", err)
+		}
+		update, err := efi.StripVariableAuthentication(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dbx update in %s: %v", keystore, err)
+		}
+		dbx, err := efi.AppendSignatureDatabase(measuredVars["dbx"], update)
+		if err != nil {
+			return nil, fmt.Errorf("cannot apply dbx update in %s: %v", keystore, err)
+		}
+		accepted["dbx"] = append(accepted["dbx"], dbx)
+	}
+	return accepted, nil
+}
+
+// closestBootChain returns the boot chain of profile that has the most
+// images in common with chain.
+func closestBootChain(profile *PCRProfile, chain *BootChain) *BootChain {
+	var closest *BootChain
+	best := -1
+	for _, sealed := range profile.BootChains {
+		common := 0
+		for i, img := range chain.Images {
+			if i < len(sealed.Images) && sealed.Images[i].Digest == img.Digest {
+				common++
+			}
+		}
+		if common > best {
+			closest, best = sealed, common
+		}
+	}
+	return closest
+}
+
+// profileDifferences returns the inputs to the PCRs of profile that
+// differ for the supplied boot chain and secure boot variables. The
+// variables are compared with the values that the profile accepts, as
+// returned by acceptedVariables. A nil boot chain stands for the boot
+// chain of the current boot.
+func profileDifferences(profile *PCRProfile, chain *BootChain, vars map[string][]byte, accepted map[string][][]byte) []*ProfileDifference {
+	pcrs := make(map[int]bool, len(profile.PCRs))
+	for _, pcr := range profile.PCRs {
+		pcrs[pcr] = true
+	}
+
+	diffs := []*ProfileDifference{}
+	if chain != nil {
+		sealed := closestBootChain(profile, chain)
+		if sealed == nil {
+			sealed = &BootChain{}
+		}
+		if pcrs[4] {
+			diffs = append(diffs, imageDifferences(chain, sealed)...)
+		}
+		if pcrs[12] && len(sealed.KernelCmdlines) > 0 {
+			for _, cmdline := range chain.KernelCmdlines {
+				if !strutil.ListContains(sealed.KernelCmdlines, cmdline) {
+					diffs = append(diffs, &ProfileDifference{
+						PCR:           12,
+						Kind:          DifferenceKernelCmdline,
+						KernelCmdline: cmdline,
+					})
+				}
+			}
+		}
+	}
+
+	if pcrs[7] {
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !containsValue(accepted[name], vars[name]) {
+				diffs = append(diffs, &ProfileDifference{
+					PCR:      7,
+					Kind:     DifferenceSecureBootVariable,
+					Variable: name,
+				})
+			}
+		}
+	}
+	return diffs
+}
+
+func containsValue(values [][]byte, value []byte) bool {
+	for _, v := range values {
+		if bytes.Equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageDifferences returns the images of chain that are not part of
+// the sealed boot chain at the same position, followed by the images of
+// the sealed boot chain that chain doesn't have.
+func imageDifferences(chain, sealed *BootChain) []*ProfileDifference {
+	var diffs []*ProfileDifference
+	for i, img := range chain.Images {
+		var sealedDigest string
+		if i < len(sealed.Images) {
+			sealedDigest = sealed.Images[i].Digest
+		}
+		if img.Digest != sealedDigest {
+			diffs = append(diffs, &ProfileDifference{
+				PCR:          4,
+				Kind:         DifferenceBootImage,
+				Path:         img.Path,
+				Digest:       img.Digest,
+				SealedDigest: sealedDigest,
+			})
+		}
+	}
+	for i := len(chain.Images); i < len(sealed.Images); i++ {
+		diffs = append(diffs, &ProfileDifference{
+			PCR:          4,
+			Kind:         DifferenceBootImage,
+			Path:         sealed.Images[i].Path,
+			SealedDigest: sealed.Images[i].Digest,
+		})
+	}
+	return diffs
+}
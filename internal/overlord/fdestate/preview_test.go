@@ -0,0 +1,415 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/efi"
+	"github.com/snapcore/fdemanager/internal/efi/efitest"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+type previewSuite struct {
+	fdeMgrBaseSuite
+
+	dir  string
+	vars map[string][]byte
+}
+
+var _ = Suite(&previewSuite{})
+
+const (
+	previewTestUUID = "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21"
+	runCmdline      = "snapd_recovery_mode=run console=ttyS0"
+	recoverCmdline  = "snapd_recovery_mode=recover console=ttyS0"
+)
+
+func (s *previewSuite) SetUpTest(c *C) {
+	s.fdeMgrBaseSuite.SetUpTest(c)
+
+	s.dir = c.MkDir()
+	for _, name := range []string{"shim", "grub", "kernel"} {
+		s.writeImage(c, name, name)
+	}
+	s.vars = map[string][]byte{
+		"SecureBoot": {1},
+		"db":         []byte("db"),
+		"dbx":        []byte("dbx"),
+	}
+
+	s.writeEventLog(c)
+
+	s.st.Lock()
+	defer s.st.Unlock()
+	c.Assert(fdestate.SetContainer(s.st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       previewTestUUID,
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "default", Protector: fdestate.ProtectorTPM, SealedObject: "/var/lib/fdemanagerd/keys/default.sealed-key"},
+		},
+		PCRProfile: &fdestate.PCRProfile{
+			PCRs: fdestate.DefaultPCRs,
+			BootChains: []*fdestate.BootChain{
+				{
+					Images:         s.images(c, "shim", "grub", "kernel"),
+					KernelCmdlines: []string{runCmdline, recoverCmdline},
+				},
+			},
+		},
+	}), IsNil)
+	c.Assert(fdestate.SetContainer(s.st, &fdestate.Container{
+		DevicePath: "/dev/sda3",
+		UUID:       "5a5ae4a0-d9b6-477f-9b0b-2bcd0cc9dc4d",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Protector: fdestate.ProtectorPassphrase},
+		},
+	}), IsNil)
+}
+
+// writeEventLog writes the event log of a boot using the sealed boot
+// chain and the current secure boot variables.
+func (s *previewSuite) writeEventLog(c *C) {
+	log := s.bootLog(c, []string{"shim", "grub", "kernel"}, runCmdline, s.vars)
+	var buf bytes.Buffer
+	c.Assert(log.Write(&buf), IsNil)
+	c.Assert(os.MkdirAll(filepath.Dir(paths.EventLogFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(paths.EventLogFile, buf.Bytes(), 0644), IsNil)
+}
+
+func (s *previewSuite) imagePath(name string) string {
+	return filepath.Join(s.dir, name+".efi")
+}
+
+func (s *previewSuite) writeImage(c *C, name, content string) {
+	c.Assert(ioutil.WriteFile(s.imagePath(name), efitest.NewImage([]byte(content)), 0644), IsNil)
+}
+
+// images returns the boot images with the specified names and their
+// current digests.
+func (s *previewSuite) images(c *C, names ...string) []*fdestate.BootImage {
+	var images []*fdestate.BootImage
+	for _, name := range names {
+		data, err := ioutil.ReadFile(s.imagePath(name))
+		c.Assert(err, IsNil)
+		digest := sha256.Sum256(data)
+		images = append(images, &fdestate.BootImage{Path: s.imagePath(name), Digest: hex.EncodeToString(digest[:])})
+	}
+	return images
+}
+
+// bootLog returns the event log that a boot using the specified
+// images, kernel command line and secure boot variables records.
+func (s *previewSuite) bootLog(c *C, images []string, cmdline string, vars map[string][]byte) *efi.Log {
+	params := &efitest.LogParams{KernelCmdline: cmdline, Variables: vars}
+	for _, name := range images {
+		digest, err := efi.ImageDigest(s.imagePath(name))
+		c.Assert(err, IsNil)
+		params.ImageDigests = append(params.ImageDigests, digest)
+	}
+	return efitest.NewLog(params)
+}
+
+// pcrs returns the hex encoded values of the default PCRs after a boot
+// using the specified images, kernel command line and secure boot
+// variables.
+func (s *previewSuite) pcrs(c *C, images []string, cmdline string, vars map[string][]byte) map[int]string {
+	values, err := s.bootLog(c, images, cmdline, vars).Replay(fdestate.DefaultPCRs, nil)
+	c.Assert(err, IsNil)
+	encoded := make(map[int]string, len(values))
+	for pcr, value := range values {
+		encoded[pcr] = hex.EncodeToString(value)
+	}
+	return encoded
+}
+
+func (s *previewSuite) bootChain(names []string, cmdlines ...string) *fdestate.BootChain {
+	chain := &fdestate.BootChain{KernelCmdlines: cmdlines}
+	for _, name := range names {
+		chain.Images = append(chain.Images, &fdestate.BootImage{Path: s.imagePath(name)})
+	}
+	return chain
+}
+
+func (s *previewSuite) TestPreviewUnchanged(c *C) {
+	images := []string{"shim", "grub", "kernel"}
+	preview, err := fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{
+		BootChain: s.bootChain(images, runCmdline),
+	})
+	c.Assert(err, IsNil)
+
+	current := s.pcrs(c, images, runCmdline, s.vars)
+	c.Check(preview, DeepEquals, &fdestate.ProfilePreview{
+		PCRs: []*fdestate.PCRPreview{
+			{PCR: 4, Measured: current[4], Predicted: current[4]},
+			{PCR: 7, Measured: current[7], Predicted: current[7]},
+			{PCR: 12, KernelCmdline: runCmdline, Measured: current[12], Predicted: current[12]},
+		},
+		Containers: []*fdestate.ContainerPreview{
+			{
+				UUID:        previewTestUUID,
+				DevicePath:  "/dev/sda4",
+				WillUnseal:  true,
+				Differences: []*fdestate.ProfileDifference{},
+			},
+		},
+	})
+}
+
+func (s *previewSuite) TestPreviewNewKernel(c *C) {
+	s.writeImage(c, "new-kernel", "new kernel")
+	sealed := s.images(c, "kernel")[0]
+	newKernel := s.images(c, "new-kernel")[0]
+
+	s.st.Lock()
+	before, err := fdestate.ContainerByUUID(s.st, previewTestUUID)
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+
+	images := []string{"shim", "grub", "new-kernel"}
+	preview, err := fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{
+		BootChain: s.bootChain(images, runCmdline, recoverCmdline),
+	})
+	c.Assert(err, IsNil)
+
+	current := s.pcrs(c, []string{"shim", "grub", "kernel"}, runCmdline, s.vars)
+	run := s.pcrs(c, images, runCmdline, s.vars)
+	recover := s.pcrs(c, images, recoverCmdline, s.vars)
+	c.Check(preview.PCRs, DeepEquals, []*fdestate.PCRPreview{
+		{PCR: 4, Measured: current[4], Predicted: run[4]},
+		{PCR: 7, Measured: current[7], Predicted: current[7]},
+		{PCR: 12, KernelCmdline: runCmdline, Measured: current[12], Predicted: run[12]},
+		{PCR: 12, KernelCmdline: recoverCmdline, Measured: current[12], Predicted: recover[12]},
+	})
+	c.Check(preview.PCRs[0].Predicted, Not(Equals), preview.PCRs[0].Measured)
+	c.Check(preview.Containers, DeepEquals, []*fdestate.ContainerPreview{
+		{
+			UUID:       previewTestUUID,
+			DevicePath: "/dev/sda4",
+			WillUnseal: false,
+			Differences: []*fdestate.ProfileDifference{
+				{
+					PCR:          4,
+					Kind:         fdestate.DifferenceBootImage,
+					Path:         newKernel.Path,
+					Digest:       newKernel.Digest,
+					SealedDigest: sealed.Digest,
+				},
+			},
+		},
+	})
+
+	// the state is not modified
+	s.st.Lock()
+	defer s.st.Unlock()
+	after, err := fdestate.ContainerByUUID(s.st, previewTestUUID)
+	c.Assert(err, IsNil)
+	c.Check(after, DeepEquals, before)
+	c.Check(s.st.Changes(), HasLen, 0)
+}
+
+func (s *previewSuite) TestPreviewBootChainDifferences(c *C) {
+	kernel := s.images(c, "kernel")[0]
+
+	// grub is no longer loaded and the kernel is started with a new
+	// command line
+	preview, err := fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{
+		BootChain: s.bootChain([]string{"shim", "kernel"}, "console=tty1"),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(preview.Containers, HasLen, 1)
+	c.Check(preview.Containers[0].WillUnseal, Equals, false)
+	c.Check(preview.Containers[0].Differences, DeepEquals, []*fdestate.ProfileDifference{
+		{
+			PCR:          4,
+			Kind:         fdestate.DifferenceBootImage,
+			Path:         kernel.Path,
+			Digest:       kernel.Digest,
+			SealedDigest: s.images(c, "grub")[0].Digest,
+		},
+		{
+			PCR:          4,
+			Kind:         fdestate.DifferenceBootImage,
+			Path:         kernel.Path,
+			SealedDigest: kernel.Digest,
+		},
+		{
+			PCR:           12,
+			Kind:          fdestate.DifferenceKernelCmdline,
+			KernelCmdline: "console=tty1",
+		},
+	})
+}
+
+func (s *previewSuite) TestPreviewSecureBootVariables(c *C) {
+	vars := map[string][]byte{
+		"db":  []byte("db"),
+		"dbx": []byte("new dbx"),
+	}
+	preview, err := fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{
+		SecureBootVariables: vars,
+	})
+	c.Assert(err, IsNil)
+
+	images := []string{"shim", "grub", "kernel"}
+	current := s.pcrs(c, images, runCmdline, s.vars)
+	updated := s.pcrs(c, images, runCmdline, map[string][]byte{
+		"SecureBoot": {1},
+		"db":         []byte("db"),
+		"dbx":        []byte("new dbx"),
+	})
+	c.Check(preview.PCRs, DeepEquals, []*fdestate.PCRPreview{
+		{PCR: 4, Measured: current[4], Predicted: current[4]},
+		{PCR: 7, Measured: current[7], Predicted: updated[7]},
+		{PCR: 12, Measured: current[12], Predicted: current[12]},
+	})
+	c.Check(preview.Containers, DeepEquals, []*fdestate.ContainerPreview{
+		{
+			UUID:       previewTestUUID,
+			DevicePath: "/dev/sda4",
+			WillUnseal: false,
+			Differences: []*fdestate.ProfileDifference{
+				{PCR: 7, Kind: fdestate.DifferenceSecureBootVariable, Variable: "dbx"},
+			},
+		},
+	})
+}
+
+func (s *previewSuite) TestPreviewDBXUpdateKeystore(c *C) {
+	s.vars["dbx"] = efitest.NewSignatureList(efi.CertSHA256, dbxOwner, revoked("shim-1"))
+	s.writeEventLog(c)
+
+	update := efitest.NewSignatureList(efi.CertSHA256, dbxOwner, revoked("shim-2"))
+	keystore := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(keystore, "dbx"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(keystore, "dbx/update.auth"), efitest.NewAuthenticatedVariable(update), 0644), IsNil)
+	updated, err := efi.AppendSignatureDatabase(s.vars["dbx"], update)
+	c.Assert(err, IsNil)
+
+	preview, err := fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{
+		SecureBootVariables: map[string][]byte{"dbx": updated},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(preview.Containers, HasLen, 1)
+	c.Check(preview.Containers[0].WillUnseal, Equals, false)
+
+	// the keys are sealed to also accept the update
+	s.st.Lock()
+	container, err := fdestate.ContainerByUUID(s.st, previewTestUUID)
+	c.Assert(err, IsNil)
+	container.PCRProfile.DBXUpdateKeystores = []string{keystore}
+	c.Assert(fdestate.SetContainer(s.st, container), IsNil)
+	s.st.Unlock()
+
+	for _, dbx := range [][]byte{updated, s.vars["dbx"]} {
+		preview, err = fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{
+			SecureBootVariables: map[string][]byte{"dbx": dbx},
+		})
+		c.Assert(err, IsNil)
+		c.Assert(preview.Containers, HasLen, 1)
+		c.Check(preview.Containers[0].WillUnseal, Equals, true)
+		c.Check(preview.Containers[0].Differences, HasLen, 0)
+	}
+}
+
+func (s *previewSuite) TestPreviewPendingProfile(c *C) {
+	s.writeImage(c, "new-kernel", "new kernel")
+	newChain := &fdestate.BootChain{
+		Images:         s.images(c, "shim", "grub", "new-kernel"),
+		KernelCmdlines: []string{runCmdline},
+	}
+
+	// the old boot chain stays valid until the new one is committed
+	s.st.Lock()
+	container, err := fdestate.ContainerByUUID(s.st, previewTestUUID)
+	c.Assert(err, IsNil)
+	container.PendingPCRProfile = &fdestate.PCRProfile{
+		PCRs:       fdestate.DefaultPCRs,
+		BootChains: []*fdestate.BootChain{newChain},
+	}
+	container.PCRProfile.BootChains = append(container.PCRProfile.BootChains, newChain)
+	c.Assert(fdestate.SetContainer(s.st, container), IsNil)
+	s.st.Unlock()
+
+	for _, t := range []struct {
+		images      []string
+		afterCommit bool
+	}{
+		{[]string{"shim", "grub", "new-kernel"}, true},
+		{[]string{"shim", "grub", "kernel"}, false},
+	} {
+		preview, err := fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{
+			BootChain: s.bootChain(t.images, runCmdline),
+		})
+		c.Assert(err, IsNil)
+		c.Assert(preview.Containers, HasLen, 1)
+		c.Check(preview.Containers[0].WillUnseal, Equals, true)
+		c.Check(preview.Containers[0].Differences, HasLen, 0)
+		c.Assert(preview.Containers[0].WillUnsealAfterCommit, NotNil)
+		c.Check(*preview.Containers[0].WillUnsealAfterCommit, Equals, t.afterCommit)
+	}
+}
+
+func (s *previewSuite) TestPreviewOnlyBoundPCRs(c *C) {
+	s.st.Lock()
+	container, err := fdestate.ContainerByUUID(s.st, previewTestUUID)
+	c.Assert(err, IsNil)
+	container.PCRProfile.PCRs = []int{7}
+	c.Assert(fdestate.SetContainer(s.st, container), IsNil)
+	s.st.Unlock()
+
+	s.writeImage(c, "new-kernel", "new kernel")
+	preview, err := fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{
+		BootChain: s.bootChain([]string{"shim", "grub", "new-kernel"}, "console=tty1"),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(preview.Containers, HasLen, 1)
+	c.Check(preview.Containers[0].WillUnseal, Equals, true)
+	c.Check(preview.Containers[0].Differences, HasLen, 0)
+}
+
+func (s *previewSuite) TestPreviewErrors(c *C) {
+	c.Assert(ioutil.WriteFile(s.imagePath("not-an-image"), []byte("text"), 0644), IsNil)
+
+	for _, t := range []struct {
+		params *fdestate.PreviewParams
+		err    string
+	}{
+		{&fdestate.PreviewParams{BootChain: &fdestate.BootChain{}}, "boot chain has no images"},
+		{&fdestate.PreviewParams{BootChain: s.bootChain([]string{"shim", "missing"})}, "cannot compute digest of boot image: .*: no such file or directory"},
+		{&fdestate.PreviewParams{BootChain: s.bootChain([]string{"not-an-image"})}, "cannot compute Authenticode digest of .*/not-an-image.efi: cannot decode PE image: .*"},
+		{&fdestate.PreviewParams{SecureBootVariables: map[string][]byte{"dbt": nil}}, `secure boot variable "dbt" is not measured in the event log`},
+	} {
+		_, err := fdestate.PreviewProfile(s.st, t.params)
+		c.Check(err, ErrorMatches, t.err)
+	}
+
+	c.Assert(os.Remove(paths.EventLogFile), IsNil)
+	_, err := fdestate.PreviewProfile(s.st, &fdestate.PreviewParams{})
+	c.Check(err, ErrorMatches, "cannot read TCG event log: .*: no such file or directory")
+}
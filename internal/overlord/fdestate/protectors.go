@@ -0,0 +1,499 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+)
+
+// promptTimeout is how long an update-protector task waits for the
+// secrets of an interactive user before failing.
+var promptTimeout = 5 * time.Minute
+
+// ProtectorOp is an operation on a passphrase protected keyslot.
+type ProtectorOp string
+
+const (
+	AddPassphrase    ProtectorOp = "add-passphrase"
+	ChangePassphrase ProtectorOp = "change-passphrase"
+	RemovePassphrase ProtectorOp = "remove-passphrase"
+)
+
+func (op ProtectorOp) valid() bool {
+	switch op {
+	case AddPassphrase, ChangePassphrase, RemovePassphrase:
+		return true
+	}
+	return false
+}
+
+func (op ProtectorOp) needsOld() bool {
+	switch op {
+	case ChangePassphrase, RemovePassphrase:
+		return true
+	}
+	return false
+}
+
+func (op ProtectorOp) needsNew() bool {
+	switch op {
+	case AddPassphrase, ChangePassphrase:
+		return true
+	}
+	return false
+}
+
+// needsUnlockKey returns whether the operation modifies the keyslots of
+// the container using the key that unlocked it during boot.
+func (op ProtectorOp) needsUnlockKey() bool {
+	return op == AddPassphrase || op == RemovePassphrase
+}
+
+// Secrets holds the current and the new passphrase for a protector
+// operation.
+type Secrets struct {
+	Old []byte
+	New []byte
+}
+
+func (s *Secrets) wipe() {
+	wipe(s.Old)
+	wipe(s.New)
+}
+
+func (s *Secrets) check(op ProtectorOp) error {
+	if op.needsOld() && len(s.Old) == 0 {
+		return fmt.Errorf("current secret must be provided")
+	}
+	if op.needsNew() && len(s.New) == 0 {
+		return fmt.Errorf("new secret must be provided")
+	}
+	return nil
+}
+
+// Prompt describes the secrets that a change is waiting for. It is
+// stored in the "prompt" entry of the API data of the change.
+type Prompt struct {
+	Container string      `json:"container"`
+	Keyslot   string      `json:"keyslot"`
+	Op        ProtectorOp `json:"op"`
+	Old       bool        `json:"old"`
+	New       bool        `json:"new"`
+	Expires   time.Time   `json:"expires"`
+}
+
+// ErrNoPrompt is returned when secrets are provided for a change that
+// isn't waiting for them.
+var ErrNoPrompt = errors.New("change is not waiting for secrets")
+
+// UpdateProtector returns a set of tasks that performs an operation on
+// the passphrase protected keyslot with the specified name. The current
+// passphrase is verified before the new one is accepted.
+//
+// If secrets is nil, the tasks wait for them to be supplied with
+// ProvideSecrets, which is only allowed if interactive is true.
+func UpdateProtector(st *state.State, uuid, name string, op ProtectorOp, secrets *Secrets, interactive bool) (*state.TaskSet, error) {
+	if !op.valid() {
+		return nil, fmt.Errorf("invalid protector operation %q", op)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("keyslot name must be specified")
+	}
+	c, err := ContainerByUUID(st, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := c.KeyslotByName(name)
+	switch op {
+	case AddPassphrase:
+		if ks != nil {
+			return nil, fmt.Errorf("container %s already has a keyslot named %q", uuid, name)
+		}
+	default:
+		if ks == nil || ks.Protector != ProtectorPassphrase {
+			return nil, fmt.Errorf("container %s has no passphrase keyslot named %q", uuid, name)
+		}
+		if op == RemovePassphrase && len(c.Keyslots) == 1 {
+			return nil, fmt.Errorf("cannot remove the last keyslot of container %s", uuid)
+		}
+	}
+
+	if secrets != nil {
+		if err := secrets.check(op); err != nil {
+			return nil, err
+		}
+	} else if !interactive {
+		return nil, fmt.Errorf("secrets must be provided if interaction is not allowed")
+	}
+	if err := checkChangeConflict(st, uuid); err != nil {
+		return nil, err
+	}
+
+	update := st.NewTask("update-protector", fmt.Sprintf("Perform %s on keyslot %q of %s", op, name, c.DevicePath))
+	update.Set("container", uuid)
+	update.Set("keyslot-name", name)
+	update.Set("op", op)
+	update.Set("interactive", interactive)
+
+	ts := state.NewTaskSet()
+	if op.needsUnlockKey() {
+		unseal := st.NewTask("unseal-key", fmt.Sprintf("Obtain unlock key for %s", c.DevicePath))
+		unseal.Set("container", uuid)
+		update.WaitFor(unseal)
+		ts.AddTask(unseal)
+	}
+	ts.AddTask(update)
+
+	if secrets != nil {
+		m := fdeManager(st)
+		m.mu.Lock()
+		m.secrets[update.ID()] = secrets
+		m.mu.Unlock()
+	}
+
+	return ts, nil
+}
+
+// ProvideSecrets supplies the secrets that the specified change is
+// waiting for to update the named keyslot.
+func ProvideSecrets(st *state.State, chgID, name string, secrets *Secrets) error {
+	chg := st.Change(chgID)
+	if chg == nil {
+		return fmt.Errorf("cannot find change with id %q", chgID)
+	}
+
+	m := fdeManager(st)
+	for _, t := range chg.Tasks() {
+		if t.Kind() != "update-protector" || t.Status() != state.DoingStatus {
+			continue
+		}
+		var promptTime time.Time
+		if err := t.Get("prompt-time", &promptTime); err != nil {
+			continue
+		}
+		var keyslotName string
+		if err := t.Get("keyslot-name", &keyslotName); err != nil || keyslotName != name {
+			continue
+		}
+		var op ProtectorOp
+		if err := t.Get("op", &op); err != nil {
+			return err
+		}
+		if err := secrets.check(op); err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		_, ok := m.secrets[t.ID()]
+		if !ok {
+			m.secrets[t.ID()] = secrets
+		}
+		m.mu.Unlock()
+		if ok {
+			return ErrNoPrompt
+		}
+
+		clearPrompt(chg)
+		// run the task again now rather than when it would time out
+		t.At(time.Time{})
+		return nil
+	}
+	return ErrNoPrompt
+}
+
+func clearPrompt(chg *state.Change) {
+	chg.Set("api-data", nil)
+}
+
+// waitForSecrets records that the task is waiting for secrets and
+// returns an error that makes it run again once they are provided, or
+// fails the task once the prompt times out.
+func waitForSecrets(t *state.Task, c *Container, name string, op ProtectorOp) error {
+	var promptTime time.Time
+	err := t.Get("prompt-time", &promptTime)
+	if errors.Is(err, state.ErrNoState) {
+		promptTime = timeNow()
+		t.Set("prompt-time", promptTime)
+		t.Change().Set("api-data", map[string]interface{}{
+			"prompt": &Prompt{
+				Container: c.UUID,
+				Keyslot:   name,
+				Op:        op,
+				Old:       op.needsOld(),
+				New:       op.needsNew(),
+				Expires:   promptTime.Add(promptTimeout),
+			},
+		})
+		t.Logf("Waiting for secrets")
+	} else if err != nil {
+		return err
+	}
+
+	remaining := promptTime.Add(promptTimeout).Sub(timeNow())
+	if remaining <= 0 {
+		clearPrompt(t.Change())
+		return fmt.Errorf("timed out waiting for secrets")
+	}
+	return &state.Retry{After: remaining, Reason: "waiting for secrets"}
+}
+
+func (m *FDEManager) taskSecrets(t *state.Task) *Secrets {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.secrets[t.ID()]
+}
+
+func (m *FDEManager) dropSecrets(t *state.Task) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if secrets, ok := m.secrets[t.ID()]; ok {
+		secrets.wipe()
+		delete(m.secrets, t.ID())
+	}
+}
+
+func (m *FDEManager) doUpdateProtector(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var name string
+	if err := t.Get("keyslot-name", &name); err != nil {
+		return err
+	}
+	var op ProtectorOp
+	if err := t.Get("op", &op); err != nil {
+		return err
+	}
+	var interactive bool
+	if err := t.Get("interactive", &interactive); err != nil {
+		return err
+	}
+
+	if op == ChangePassphrase {
+		var newSlot int
+		err := t.Get("new-slot", &newSlot)
+		if err == nil {
+			done, err := m.completeChangePassphrase(t, c, name, newSlot)
+			if err != nil || done {
+				return err
+			}
+			// the new keyslot was never added, so start again
+			t.Set("new-slot", nil)
+		} else if !errors.Is(err, state.ErrNoState) {
+			return err
+		}
+	}
+
+	secrets := m.taskSecrets(t)
+	if secrets == nil {
+		if !interactive {
+			return fmt.Errorf("secrets are no longer available")
+		}
+		return waitForSecrets(t, c, name, op)
+	}
+	defer m.dropSecrets(t)
+
+	var unlockKey []byte
+	if op.needsUnlockKey() {
+		if unlockKey, err = m.unlockKey(t, c); err != nil {
+			return fmt.Errorf("cannot obtain unlock key: %v", err)
+		}
+	}
+
+	ks := c.KeyslotByName(name)
+	if ks == nil && op != AddPassphrase {
+		return fmt.Errorf("container %s has no keyslot named %q", c.DevicePath, name)
+	}
+	switch op {
+	case AddPassphrase:
+		slot, err := freeKeyslot(c)
+		if err != nil {
+			return err
+		}
+		added := &Keyslot{Slot: slot, Name: name, Protector: ProtectorPassphrase}
+		if err := runUnlocked(st, func() error {
+			if err := luks.DefaultBackend().AddKey(c.DevicePath, unlockKey, secrets.New, &luks.AddKeyOptions{Slot: slot}); err != nil {
+				return err
+			}
+			added.CreationTime = timeNow()
+			recordKeyslotToken(c.DevicePath, added)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("cannot add passphrase to %s: %v", c.DevicePath, err)
+		}
+		return recordKeyslot(t, slot, added)
+	case ChangePassphrase:
+		slot, err := freeKeyslot(c)
+		if err != nil {
+			return err
+		}
+		oldSlot := ks.Slot
+		added := &Keyslot{Slot: slot, Name: name, Protector: ProtectorPassphrase}
+		// the secrets are lost on a restart, so the new keyslot is
+		// recorded before it is added for the change to be completed
+		// without them
+		t.Set("new-slot", slot)
+		if err := runUnlocked(st, func() error {
+			if err := verifyPassphrase(c.DevicePath, oldSlot, secrets.Old); err != nil {
+				return err
+			}
+			if err := luks.DefaultBackend().AddKey(c.DevicePath, secrets.Old, secrets.New, &luks.AddKeyOptions{Slot: slot}); err != nil {
+				return err
+			}
+			if err := luks.DefaultBackend().RemoveKey(c.DevicePath, oldSlot, secrets.New); err != nil {
+				return err
+			}
+			forgetKeyslotToken(c.DevicePath, oldSlot)
+			added.CreationTime = timeNow()
+			recordKeyslotToken(c.DevicePath, added)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("cannot change passphrase of %s: %v", c.DevicePath, err)
+		}
+		if err := recordKeyslot(t, oldSlot, nil); err != nil {
+			return err
+		}
+		return recordKeyslot(t, slot, added)
+	case RemovePassphrase:
+		slot := ks.Slot
+		if err := runUnlocked(st, func() error {
+			if err := verifyPassphrase(c.DevicePath, slot, secrets.Old); err != nil {
+				return err
+			}
+			if err := luks.DefaultBackend().RemoveKey(c.DevicePath, slot, unlockKey); err != nil {
+				return err
+			}
+			forgetKeyslotToken(c.DevicePath, slot)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("cannot remove passphrase from %s: %v", c.DevicePath, err)
+		}
+		return recordKeyslot(t, slot, nil)
+	default:
+		return fmt.Errorf("invalid protector operation %q", op)
+	}
+}
+
+// completeChangePassphrase completes a passphrase change that was
+// interrupted after its new keyslot was recorded. The old keyslot is
+// removed with the unlock key of the container, as the secrets are no
+// longer available. It returns false if the new keyslot was never
+// added.
+func (m *FDEManager) completeChangePassphrase(t *state.Task, c *Container, name string, slot int) (done bool, err error) {
+	ks := c.KeyslotByName(name)
+	if ks == nil {
+		return false, fmt.Errorf("container %s has no keyslot named %q", c.DevicePath, name)
+	}
+	if ks.Slot == slot {
+		// the state was updated before the restart
+		return true, nil
+	}
+	oldSlot := ks.Slot
+
+	st := t.State()
+	var used []int
+	if err := runUnlocked(st, func() error {
+		used, err = luks.DefaultBackend().ListKeyslots(c.DevicePath)
+		return err
+	}); err != nil {
+		return false, fmt.Errorf("cannot list keyslots of %s: %v", c.DevicePath, err)
+	}
+	if !containsSlot(used, slot) {
+		return false, nil
+	}
+
+	t.Logf("Completing interrupted change of passphrase in keyslot %d", oldSlot)
+	var unlockKey []byte
+	if containsSlot(used, oldSlot) {
+		if unlockKey, err = m.unlockKey(t, c); err != nil {
+			return false, fmt.Errorf("cannot obtain unlock key: %v", err)
+		}
+	}
+	added := &Keyslot{Slot: slot, Name: name, Protector: ProtectorPassphrase}
+	if err := runUnlocked(st, func() error {
+		if unlockKey != nil {
+			if err := luks.DefaultBackend().RemoveKey(c.DevicePath, oldSlot, unlockKey); err != nil {
+				return err
+			}
+		}
+		forgetKeyslotToken(c.DevicePath, oldSlot)
+		added.CreationTime = timeNow()
+		recordKeyslotToken(c.DevicePath, added)
+		return nil
+	}); err != nil {
+		return false, fmt.Errorf("cannot change passphrase of %s: %v", c.DevicePath, err)
+	}
+	if err := recordKeyslot(t, oldSlot, nil); err != nil {
+		return false, err
+	}
+	return true, recordKeyslot(t, slot, added)
+}
+
+func containsSlot(slots []int, slot int) bool {
+	for _, s := range slots {
+		if s == slot {
+			return true
+		}
+	}
+	return false
+}
+
+// runUnlocked runs f without holding the state lock.
+func runUnlocked(st *state.State, f func() error) error {
+	st.Unlock()
+	defer st.Lock()
+	return f()
+}
+
+func verifyPassphrase(devicePath string, slot int, passphrase []byte) error {
+	err := luks.DefaultBackend().TestKey(devicePath, slot, passphrase)
+	if errors.Is(err, luks.ErrIncorrectKey) {
+		return fmt.Errorf("current passphrase is incorrect")
+	}
+	return err
+}
+
+// recordKeyslot replaces the record of the specified keyslot of the
+// container of a task, removing it if ks is nil. It must be called with
+// the state locked.
+func recordKeyslot(t *state.Task, slot int, ks *Keyslot) error {
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	c.removeKeyslot(slot)
+	if ks != nil {
+		c.Keyslots = append(c.Keyslots, ks)
+	}
+	return SetContainer(t.State(), c)
+}
@@ -0,0 +1,375 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/testutil"
+
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+)
+
+type luksCall struct {
+	op       string
+	slot     int
+	key      string
+	existing string
+}
+
+// mockPassphrases adds a passphrase protected keyslot named "user" in
+// slot 2 to the container, and returns a function that returns the
+// LUKS2 operations performed since.
+func (s *handlersSuite) mockPassphrases(c *C) func() []luksCall {
+	ops := map[string]string{"add-key": "add", "remove-key": "kill", "test-key": "test"}
+	calls := func() []luksCall {
+		var result []luksCall
+		for _, call := range s.luks.Calls {
+			c.Check(call.DevicePath, Equals, "/dev/sda4")
+			op, ok := ops[call.Op]
+			if !ok {
+				// token updates are checked separately
+				continue
+			}
+			result = append(result, luksCall{op: op, slot: call.Slot, key: call.Key, existing: call.ExistingKey})
+		}
+		return result
+	}
+
+	s.luks.SetKey("/dev/sda4", 2, []byte("old"))
+
+	s.st.Lock()
+	defer s.st.Unlock()
+	container, err := fdestate.ContainerByUUID(s.st, testUUID)
+	c.Assert(err, IsNil)
+	container.Keyslots = append(container.Keyslots, &fdestate.Keyslot{
+		Slot:      2,
+		Name:      "user",
+		Protector: fdestate.ProtectorPassphrase,
+	})
+	c.Assert(fdestate.SetContainer(s.st, container), IsNil)
+
+	return calls
+}
+
+func (s *handlersSuite) runUpdateProtector(c *C, name string, op fdestate.ProtectorOp, secrets *fdestate.Secrets) *state.Change {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	ts, err := fdestate.UpdateProtector(s.st, testUUID, name, op, secrets, false)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("update-protector", "...")
+	chg.AddAll(ts)
+
+	s.st.Unlock()
+	s.settle(c)
+	s.st.Lock()
+
+	return chg
+}
+
+func (s *handlersSuite) TestAddPassphrase(c *C) {
+	calls := s.mockPassphrases(c)
+
+	chg := s.runUpdateProtector(c, "other", fdestate.AddPassphrase, &fdestate.Secrets{New: []byte("secret")})
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	c.Check(chg.Tasks(), HasLen, 2)
+	s.st.Unlock()
+
+	c.Check(calls(), DeepEquals, []luksCall{
+		{op: "add", slot: 3, key: "secret", existing: "unlock-key"},
+	})
+	c.Check(s.container(c).KeyslotByName("other"), DeepEquals, &fdestate.Keyslot{
+		Slot:         3,
+		Name:         "other",
+		Protector:    fdestate.ProtectorPassphrase,
+		CreationTime: testTime,
+	})
+	c.Check(s.mgr.Secrets(), HasLen, 0)
+}
+
+func (s *handlersSuite) TestChangePassphrase(c *C) {
+	calls := s.mockPassphrases(c)
+
+	secrets := &fdestate.Secrets{Old: []byte("old"), New: []byte("new")}
+	chg := s.runUpdateProtector(c, "user", fdestate.ChangePassphrase, secrets)
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	// no unlock key is needed
+	c.Check(chg.Tasks(), HasLen, 1)
+	s.st.Unlock()
+
+	c.Check(calls(), DeepEquals, []luksCall{
+		{op: "test", slot: 2, key: "old"},
+		{op: "add", slot: 3, key: "new", existing: "old"},
+		{op: "kill", slot: 2, key: "new"},
+	})
+	container := s.container(c)
+	c.Check(container.Keyslot(2), IsNil)
+	c.Check(container.KeyslotByName("user"), DeepEquals, &fdestate.Keyslot{
+		Slot:         3,
+		Name:         "user",
+		Protector:    fdestate.ProtectorPassphrase,
+		CreationTime: testTime,
+	})
+
+	// the secrets are wiped once used
+	c.Check(secrets.Old, DeepEquals, make([]byte, 3))
+	c.Check(secrets.New, DeepEquals, make([]byte, 3))
+	c.Check(s.mgr.Secrets(), HasLen, 0)
+}
+
+func (s *handlersSuite) TestChangePassphraseIncorrect(c *C) {
+	calls := s.mockPassphrases(c)
+
+	chg := s.runUpdateProtector(c, "user", fdestate.ChangePassphrase, &fdestate.Secrets{Old: []byte("wrong"), New: []byte("new")})
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot change passphrase of /dev/sda4: current passphrase is incorrect.*`)
+	s.st.Unlock()
+
+	c.Check(calls(), DeepEquals, []luksCall{
+		{op: "test", slot: 2, key: "wrong"},
+	})
+	c.Check(s.container(c).KeyslotByName("user").Slot, Equals, 2)
+}
+
+// startInterruptedChangePassphrase returns an interactive change of
+// the passphrase of the "user" keyslot whose task recorded slot 3 as
+// its new keyslot before the secrets were lost.
+func (s *handlersSuite) startInterruptedChangePassphrase(c *C) *state.Task {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	ts, err := fdestate.UpdateProtector(s.st, testUUID, "user", fdestate.ChangePassphrase, nil, true)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("update-protector", "...")
+	chg.AddAll(ts)
+	task := ts.Tasks()[0]
+	task.Set("new-slot", 3)
+	return task
+}
+
+func (s *handlersSuite) TestChangePassphraseInterruptedAfterAdd(c *C) {
+	calls := s.mockPassphrases(c)
+	s.luks.SetKey("/dev/sda4", 3, []byte("new"))
+	task := s.startInterruptedChangePassphrase(c)
+
+	s.runTasks()
+
+	s.st.Lock()
+	c.Check(task.Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+
+	// the old keyslot is removed without the secrets
+	c.Check(calls(), DeepEquals, []luksCall{
+		{op: "kill", slot: 2, key: "unlock-key"},
+	})
+	container := s.container(c)
+	c.Check(container.Keyslot(2), IsNil)
+	c.Check(container.KeyslotByName("user"), DeepEquals, &fdestate.Keyslot{
+		Slot:         3,
+		Name:         "user",
+		Protector:    fdestate.ProtectorPassphrase,
+		CreationTime: testTime,
+	})
+}
+
+func (s *handlersSuite) TestChangePassphraseInterruptedAfterRemove(c *C) {
+	calls := s.mockPassphrases(c)
+	s.luks.SetKey("/dev/sda4", 3, []byte("new"))
+	c.Assert(s.luks.RemoveKey("/dev/sda4", 2, []byte("new")), IsNil)
+	task := s.startInterruptedChangePassphrase(c)
+
+	s.runTasks()
+
+	s.st.Lock()
+	c.Check(task.Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+
+	// only the removal before the interruption
+	c.Check(calls(), DeepEquals, []luksCall{
+		{op: "kill", slot: 2, key: "new"},
+	})
+	c.Check(s.container(c).Keyslot(2), IsNil)
+	c.Check(s.container(c).KeyslotByName("user").Slot, Equals, 3)
+}
+
+func (s *handlersSuite) TestChangePassphraseInterruptedBeforeAdd(c *C) {
+	calls := s.mockPassphrases(c)
+	task := s.startInterruptedChangePassphrase(c)
+
+	s.runTasks()
+
+	// the change starts again and prompts for the secrets
+	s.st.Lock()
+	c.Check(task.Status(), Equals, state.DoingStatus)
+	c.Check(task.Has("new-slot"), Equals, false)
+	var data map[string]*json.RawMessage
+	c.Check(task.Change().Get("api-data", &data), IsNil)
+	c.Check(data["prompt"], NotNil)
+	s.st.Unlock()
+
+	c.Check(calls(), HasLen, 0)
+	c.Check(s.container(c).KeyslotByName("user").Slot, Equals, 2)
+}
+
+func (s *handlersSuite) TestRemovePassphrase(c *C) {
+	calls := s.mockPassphrases(c)
+
+	chg := s.runUpdateProtector(c, "user", fdestate.RemovePassphrase, &fdestate.Secrets{Old: []byte("old")})
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	c.Check(calls(), DeepEquals, []luksCall{
+		{op: "test", slot: 2, key: "old"},
+		{op: "kill", slot: 2, key: "unlock-key"},
+	})
+	c.Check(s.container(c).KeyslotByName("user"), IsNil)
+}
+
+// runTasks runs the tasks that are ready to run once.
+func (s *handlersSuite) runTasks() {
+	runner := s.o.TaskRunner()
+	runner.Ensure()
+	runner.Wait()
+}
+
+func (s *handlersSuite) TestUpdateProtectorInteractive(c *C) {
+	calls := s.mockPassphrases(c)
+
+	s.st.Lock()
+	ts, err := fdestate.UpdateProtector(s.st, testUUID, "user", fdestate.ChangePassphrase, nil, true)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("update-protector", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.runTasks()
+
+	s.st.Lock()
+	task := ts.Tasks()[0]
+	c.Check(task.Status(), Equals, state.DoingStatus)
+	var data map[string]*json.RawMessage
+	c.Assert(chg.Get("api-data", &data), IsNil)
+	var prompt *fdestate.Prompt
+	c.Assert(json.Unmarshal(*data["prompt"], &prompt), IsNil)
+	c.Check(prompt, DeepEquals, &fdestate.Prompt{
+		Container: testUUID,
+		Keyslot:   "user",
+		Op:        fdestate.ChangePassphrase,
+		Old:       true,
+		New:       true,
+		Expires:   testTime.Add(5 * time.Minute),
+	})
+
+	err = fdestate.ProvideSecrets(s.st, chg.ID(), "other", &fdestate.Secrets{Old: []byte("old"), New: []byte("new")})
+	c.Check(err, Equals, fdestate.ErrNoPrompt)
+	err = fdestate.ProvideSecrets(s.st, chg.ID(), "user", &fdestate.Secrets{Old: []byte("old")})
+	c.Check(err, ErrorMatches, `new secret must be provided`)
+	c.Assert(fdestate.ProvideSecrets(s.st, chg.ID(), "user", &fdestate.Secrets{Old: []byte("old"), New: []byte("new")}), IsNil)
+	c.Check(fdestate.ProvideSecrets(s.st, chg.ID(), "user", &fdestate.Secrets{Old: []byte("old"), New: []byte("new")}), Equals, fdestate.ErrNoPrompt)
+	c.Check(chg.Get("api-data", &data), testutil.ErrorIs, state.ErrNoState)
+	s.st.Unlock()
+
+	s.runTasks()
+
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+	c.Check(calls(), HasLen, 3)
+	c.Check(s.container(c).KeyslotByName("user").Slot, Equals, 3)
+}
+
+func (s *handlersSuite) TestUpdateProtectorInteractiveTimeout(c *C) {
+	s.mockPassphrases(c)
+
+	now := testTime
+	s.AddCleanup(fdestate.MockTimeNow(func() time.Time {
+		return now
+	}))
+
+	s.st.Lock()
+	ts, err := fdestate.UpdateProtector(s.st, testUUID, "user", fdestate.RemovePassphrase, nil, true)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("update-protector", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.runTasks()
+	s.runTasks()
+
+	s.st.Lock()
+	c.Check(ts.Tasks()[1].Status(), Equals, state.DoingStatus)
+	now = now.Add(5 * time.Minute)
+	ts.Tasks()[1].At(time.Time{})
+	s.st.Unlock()
+
+	s.runTasks()
+	// undo the unseal-key task
+	s.runTasks()
+
+	s.st.Lock()
+	defer s.st.Unlock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*timed out waiting for secrets.*`)
+	var data map[string]*json.RawMessage
+	c.Check(chg.Get("api-data", &data), testutil.ErrorIs, state.ErrNoState)
+	c.Check(fdestate.ProvideSecrets(s.st, chg.ID(), "user", &fdestate.Secrets{Old: []byte("old")}), Equals, fdestate.ErrNoPrompt)
+}
+
+func (s *handlersSuite) TestUpdateProtectorErrors(c *C) {
+	s.mockPassphrases(c)
+	s.runSeal(c, "run")
+
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	secrets := &fdestate.Secrets{Old: []byte("old"), New: []byte("new")}
+	for _, t := range []struct {
+		name    string
+		op      fdestate.ProtectorOp
+		secrets *fdestate.Secrets
+		err     string
+	}{
+		{"user", "frobnicate", secrets, `invalid protector operation "frobnicate"`},
+		{"", fdestate.AddPassphrase, secrets, `keyslot name must be specified`},
+		{"user", fdestate.AddPassphrase, secrets, `container .* already has a keyslot named "user"`},
+		{"default", fdestate.ChangePassphrase, secrets, `container .* has no passphrase keyslot named "default"`},
+		{"user", "add-pin", secrets, `invalid protector operation "add-pin"`},
+		{"run", fdestate.RemovePassphrase, secrets, `container .* has no passphrase keyslot named "run"`},
+		{"user", fdestate.ChangePassphrase, &fdestate.Secrets{New: []byte("new")}, `current secret must be provided`},
+		{"other", fdestate.AddPassphrase, &fdestate.Secrets{}, `new secret must be provided`},
+		{"user", fdestate.ChangePassphrase, nil, `secrets must be provided if interaction is not allowed`},
+	} {
+		_, err := fdestate.UpdateProtector(s.st, testUUID, t.name, t.op, t.secrets, false)
+		c.Check(err, ErrorMatches, t.err, Commentf("%s %s", t.name, t.op))
+	}
+
+	_, err := fdestate.UpdateProtector(s.st, "missing", "user", fdestate.ChangePassphrase, secrets, false)
+	c.Check(errors.As(err, new(*fdestate.ContainerNotFoundError)), Equals, true)
+
+	c.Check(fdestate.ProvideSecrets(s.st, "42", "user", secrets), ErrorMatches, `cannot find change with id "42"`)
+}
@@ -0,0 +1,278 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot/keys"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+)
+
+// recoveryKeyString returns the representation of a recovery key that
+// is shown to the user: 8 groups of 5 decimal digits, each encoding 2
+// bytes of the key in little-endian order.
+func recoveryKeyString(key *keys.RecoveryKey) string {
+	groups := make([]string, 0, len(key)/2)
+	for i := 0; i < len(key); i += 2 {
+		groups = append(groups, fmt.Sprintf("%05d", binary.LittleEndian.Uint16(key[i:])))
+	}
+	return strings.Join(groups, "-")
+}
+
+// AddRecoveryKey returns a set of tasks that adds a new recovery key
+// keyslot with the specified name to a container, and the new recovery
+// key. The key is only held in memory until it is added, so it is
+// returned here to be shown to the user exactly once.
+func AddRecoveryKey(st *state.State, uuid, name string) (*state.TaskSet, string, error) {
+	if name == "" {
+		return nil, "", fmt.Errorf("recovery key name must be specified")
+	}
+	c, err := ContainerByUUID(st, uuid)
+	if err != nil {
+		return nil, "", err
+	}
+	if c.KeyslotByName(name) != nil {
+		return nil, "", fmt.Errorf("container %s already has a keyslot named %q", uuid, name)
+	}
+	if err := checkChangeConflict(st, uuid); err != nil {
+		return nil, "", err
+	}
+
+	key, err := newRecoveryKey()
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot create recovery key: %v", err)
+	}
+
+	unseal := st.NewTask("unseal-key", fmt.Sprintf("Obtain unlock key for %s", c.DevicePath))
+	unseal.Set("container", uuid)
+
+	add := st.NewTask("add-recovery-key", fmt.Sprintf("Add recovery key %q to %s", name, c.DevicePath))
+	add.Set("container", uuid)
+	add.Set("keyslot-name", name)
+	add.WaitFor(unseal)
+
+	m := fdeManager(st)
+	m.mu.Lock()
+	m.recoveryKeys[add.ID()] = &key
+	m.mu.Unlock()
+
+	return state.NewTaskSet(unseal, add), recoveryKeyString(&key), nil
+}
+
+// RemoveRecoveryKey returns a set of tasks that revokes the named
+// recovery key of a container by wiping its keyslot.
+func RemoveRecoveryKey(st *state.State, uuid, name string) (*state.TaskSet, error) {
+	c, err := ContainerByUUID(st, uuid)
+	if err != nil {
+		return nil, err
+	}
+	ks := c.KeyslotByName(name)
+	if ks == nil || ks.Protector != ProtectorRecoveryKey {
+		return nil, fmt.Errorf("container %s has no recovery key named %q", uuid, name)
+	}
+	if len(c.Keyslots) == 1 {
+		return nil, fmt.Errorf("cannot remove the last keyslot of container %s", uuid)
+	}
+	if err := checkChangeConflict(st, uuid); err != nil {
+		return nil, err
+	}
+
+	unseal := st.NewTask("unseal-key", fmt.Sprintf("Obtain unlock key for %s", c.DevicePath))
+	unseal.Set("container", uuid)
+
+	remove := st.NewTask("remove-keyslot", fmt.Sprintf("Remove recovery key %q from %s", name, c.DevicePath))
+	remove.Set("container", uuid)
+	remove.Set("keyslot-name", name)
+	remove.WaitFor(unseal)
+
+	return state.NewTaskSet(unseal, remove), nil
+}
+
+// takeRecoveryKey returns the recovery key generated for the specified
+// add-recovery-key task, which is no longer held by the manager
+// afterwards.
+func (m *FDEManager) takeRecoveryKey(t *state.Task) (*keys.RecoveryKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.recoveryKeys[t.ID()]
+	if !ok {
+		return nil, fmt.Errorf("recovery key is no longer available, a new one must be generated")
+	}
+	delete(m.recoveryKeys, t.ID())
+	return key, nil
+}
+
+func (m *FDEManager) doAddRecoveryKey(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var name string
+	if err := t.Get("keyslot-name", &name); err != nil {
+		return err
+	}
+	unlockKey, err := m.unlockKey(t, c)
+	if err != nil {
+		return fmt.Errorf("cannot obtain unlock key: %v", err)
+	}
+	key, err := m.takeRecoveryKey(t)
+	if err != nil {
+		return err
+	}
+	defer wipe(key[:])
+
+	slot, err := freeKeyslot(c)
+	if err != nil {
+		return err
+	}
+	t.Set("slot", slot)
+	devicePath := c.DevicePath
+	ks := &Keyslot{Slot: slot, Name: name, Protector: ProtectorRecoveryKey}
+
+	st.Unlock()
+	err = luks.DefaultBackend().AddKey(devicePath, unlockKey, key[:], &luks.AddKeyOptions{Slot: slot})
+	if err == nil {
+		ks.CreationTime = timeNow()
+		recordKeyslotToken(devicePath, ks)
+	}
+	st.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot add recovery key to %s: %v", devicePath, err)
+	}
+
+	// the container may have been refreshed in the meantime
+	c, err = taskContainer(t)
+	if err != nil {
+		return err
+	}
+	c.setKeyslot(ks)
+	if err := SetContainer(st, c); err != nil {
+		return err
+	}
+	setRecoveryKeyEnrolled(t.Change(), c.UUID, true)
+	return nil
+}
+
+func (m *FDEManager) undoAddRecoveryKey(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var slot int
+	if err := t.Get("slot", &slot); err != nil {
+		return err
+	}
+	if err := m.killKeyslot(t, c, slot); err != nil {
+		return err
+	}
+	setRecoveryKeyEnrolled(t.Change(), c.UUID, false)
+	return nil
+}
+
+// setRecoveryKeyEnrolled records in the data of the change whether the
+// recovery key of a container is enrolled. The recovery keys are
+// returned to the client before the change runs, so they are only
+// provisional until then.
+func setRecoveryKeyEnrolled(chg *state.Change, uuid string, enrolled bool) {
+	var uuids []string
+	if err := chg.Get("recovery-keys-enrolled", &uuids); err != nil && !errors.Is(err, state.ErrNoState) {
+		logger.Noticef("cannot obtain enrolled recovery keys of change %s: %v", chg.ID(), err)
+	}
+	updated := make([]string, 0, len(uuids)+1)
+	for _, u := range uuids {
+		if u != uuid {
+			updated = append(updated, u)
+		}
+	}
+	if enrolled {
+		updated = append(updated, uuid)
+	}
+	chg.Set("recovery-keys-enrolled", updated)
+	chg.Set("api-data", map[string]interface{}{
+		"recovery-keys-enrolled": updated,
+	})
+}
+
+func (m *FDEManager) doRemoveKeyslot(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	c, err := taskContainer(t)
+	if err != nil {
+		return err
+	}
+	var name string
+	if err := t.Get("keyslot-name", &name); err != nil {
+		return err
+	}
+	ks := c.KeyslotByName(name)
+	if ks == nil {
+		// already removed by a previous attempt
+		logger.Noticef("keyslot %q of %s is already removed", name, c.DevicePath)
+		return nil
+	}
+	return m.killKeyslot(t, c, ks.Slot)
+}
+
+// killKeyslot wipes a keyslot of a container and removes its record.
+// It must be called with the state locked.
+func (m *FDEManager) killKeyslot(t *state.Task, c *Container, slot int) error {
+	unlockKey, err := m.unlockKey(t, c)
+	if err != nil {
+		return fmt.Errorf("cannot obtain unlock key: %v", err)
+	}
+	devicePath := c.DevicePath
+
+	st := t.State()
+	st.Unlock()
+	err = luks.DefaultBackend().RemoveKey(devicePath, slot, unlockKey)
+	if err == nil {
+		forgetKeyslotToken(devicePath, slot)
+	}
+	st.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot remove keyslot %d of %s: %v", slot, devicePath, err)
+	}
+
+	c, err = taskContainer(t)
+	if err != nil {
+		return err
+	}
+	c.removeKeyslot(slot)
+	return SetContainer(st, c)
+}
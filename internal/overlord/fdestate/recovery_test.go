@@ -0,0 +1,231 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot/keys"
+
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+)
+
+var testRecoveryKey = keys.RecoveryKey{
+	0x01, 0x00, 0xff, 0xff, 0x39, 0x30, 0x00, 0x00,
+	0x10, 0x27, 0x0a, 0x00, 0x80, 0x00, 0x34, 0x12,
+}
+
+func (s *handlersSuite) mockRecoveryKey(c *C) {
+	s.AddCleanup(fdestate.MockNewRecoveryKey(func() (keys.RecoveryKey, error) {
+		return testRecoveryKey, nil
+	}))
+}
+
+func (s *handlersSuite) TestRecoveryKeyString(c *C) {
+	c.Check(fdestate.RecoveryKeyString(&testRecoveryKey), Equals, "00001-65535-12345-00000-10000-00010-00128-04660")
+}
+
+func (s *handlersSuite) TestAddRecoveryKey(c *C) {
+	s.mockRecoveryKey(c)
+
+	s.st.Lock()
+	ts, recoveryKey, err := fdestate.AddRecoveryKey(s.st, testUUID, "helpdesk")
+	c.Assert(err, IsNil)
+	c.Check(recoveryKey, Equals, "00001-65535-12345-00000-10000-00010-00128-04660")
+	chg := s.st.NewChange("add-recovery-key", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	c.Check(s.mgr.RecoveryKeys(), HasLen, 1)
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	c.Check(s.luksCalls("add-key"), DeepEquals, []string{"/dev/sda4:2"})
+	c.Check(s.luks.Key("/dev/sda4", 2), DeepEquals, testRecoveryKey[:])
+	c.Check(s.container(c).Keyslot(2), DeepEquals, &fdestate.Keyslot{
+		Slot:         2,
+		Name:         "helpdesk",
+		Protector:    fdestate.ProtectorRecoveryKey,
+		CreationTime: testTime,
+	})
+
+	// the recovery key is only enrolled now
+	s.st.Lock()
+	var data map[string][]string
+	c.Check(chg.Get("api-data", &data), IsNil)
+	s.st.Unlock()
+	c.Check(data, DeepEquals, map[string][]string{"recovery-keys-enrolled": {testUUID}})
+
+	// the recovery key is not retained once it is added
+	c.Check(s.mgr.RecoveryKeys(), HasLen, 0)
+}
+
+func (s *handlersSuite) TestAddRecoveryKeyUndo(c *C) {
+	s.mockRecoveryKey(c)
+	s.o.TaskRunner().AddHandler("error-trigger", func(t *state.Task, _ *tomb.Tomb) error {
+		return errors.New("trigger")
+	}, nil)
+
+	s.st.Lock()
+	ts, _, err := fdestate.AddRecoveryKey(s.st, testUUID, "helpdesk")
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("add-recovery-key", "...")
+	chg.AddAll(ts)
+	trigger := s.st.NewTask("error-trigger", "...")
+	trigger.WaitAll(ts)
+	chg.AddTask(trigger)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*trigger.*`)
+	s.st.Unlock()
+
+	c.Check(s.luksCalls("remove-key"), DeepEquals, []string{"/dev/sda4:2"})
+	c.Check(s.container(c).KeyslotByName("helpdesk"), IsNil)
+
+	// the recovery key is no longer enrolled
+	s.st.Lock()
+	var data map[string][]string
+	c.Check(chg.Get("api-data", &data), IsNil)
+	s.st.Unlock()
+	c.Check(data, DeepEquals, map[string][]string{"recovery-keys-enrolled": {}})
+}
+
+func (s *handlersSuite) TestAddRecoveryKeyAborted(c *C) {
+	s.mockRecoveryKey(c)
+
+	s.st.Lock()
+	ts, _, err := fdestate.AddRecoveryKey(s.st, testUUID, "helpdesk")
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("add-recovery-key", "...")
+	chg.AddAll(ts)
+	chg.Abort()
+	s.st.Unlock()
+
+	s.settle(c)
+
+	c.Check(s.luksCalls("add-key"), HasLen, 0)
+	c.Check(s.mgr.RecoveryKeys(), HasLen, 0)
+}
+
+func (s *handlersSuite) TestAddRecoveryKeyLost(c *C) {
+	s.mockRecoveryKey(c)
+
+	s.st.Lock()
+	ts, _, err := fdestate.AddRecoveryKey(s.st, testUUID, "helpdesk")
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("add-recovery-key", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	// the manager is restarted before the key is added
+	s.mgr.Stop()
+	mgr, err := fdestate.Manager(s.st, s.o.TaskRunner())
+	c.Assert(err, IsNil)
+	s.mgr = mgr
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*recovery key is no longer available, a new one must be generated.*`)
+	s.st.Unlock()
+	c.Check(s.luksCalls("add-key"), HasLen, 0)
+}
+
+func (s *handlersSuite) TestAddRecoveryKeyErrors(c *C) {
+	s.mockRecoveryKey(c)
+
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	_, _, err := fdestate.AddRecoveryKey(s.st, testUUID, "")
+	c.Check(err, ErrorMatches, `recovery key name must be specified`)
+
+	_, _, err = fdestate.AddRecoveryKey(s.st, "not-a-uuid", "helpdesk")
+	c.Check(err, FitsTypeOf, &fdestate.ContainerNotFoundError{})
+
+	_, _, err = fdestate.AddRecoveryKey(s.st, testUUID, "default-recovery")
+	c.Check(err, ErrorMatches, `container .* already has a keyslot named "default-recovery"`)
+
+	ts, _, err := fdestate.AddRecoveryKey(s.st, testUUID, "helpdesk")
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("add-recovery-key", "...")
+	chg.AddAll(ts)
+
+	_, _, err = fdestate.AddRecoveryKey(s.st, testUUID, "other")
+	c.Check(err, FitsTypeOf, &fdestate.ChangeConflictError{})
+
+	restore := fdestate.MockNewRecoveryKey(func() (keys.RecoveryKey, error) {
+		return keys.RecoveryKey{}, errors.New("no entropy")
+	})
+	defer restore()
+	chg.SetStatus(state.DoneStatus)
+	_, _, err = fdestate.AddRecoveryKey(s.st, testUUID, "other")
+	c.Check(err, ErrorMatches, `cannot create recovery key: no entropy`)
+}
+
+func (s *handlersSuite) TestRemoveRecoveryKey(c *C) {
+	s.st.Lock()
+	ts, err := fdestate.RemoveRecoveryKey(s.st, testUUID, "default-recovery")
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("remove-recovery-key", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	c.Check(s.luksCalls("remove-key"), DeepEquals, []string{"/dev/sda4:1"})
+	container := s.container(c)
+	c.Check(container.KeyslotByName("default-recovery"), IsNil)
+	c.Check(container.Keyslots, HasLen, 1)
+}
+
+func (s *handlersSuite) TestRemoveRecoveryKeyErrors(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	_, err := fdestate.RemoveRecoveryKey(s.st, testUUID, "missing")
+	c.Check(err, ErrorMatches, `container .* has no recovery key named "missing"`)
+
+	// TPM protected keyslots are not recovery keys
+	_, err = fdestate.RemoveRecoveryKey(s.st, testUUID, "default")
+	c.Check(err, ErrorMatches, `container .* has no recovery key named "default"`)
+
+	container, err := fdestate.ContainerByUUID(s.st, testUUID)
+	c.Assert(err, IsNil)
+	container.Keyslots = container.Keyslots[1:]
+	c.Assert(fdestate.SetContainer(s.st, container), IsNil)
+	_, err = fdestate.RemoveRecoveryKey(s.st, testUUID, "default-recovery")
+	c.Check(err, ErrorMatches, `cannot remove the last keyslot of container .*`)
+}
@@ -0,0 +1,191 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/snapcore/snapd/logger"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+)
+
+// keyslotTokenType is the type of the LUKS2 tokens in which the
+// manager records the metadata of the keyslots that it creates, so
+// that its state can be rebuilt from the containers themselves.
+const keyslotTokenType = "fdemanager"
+
+// the number of tokens supported by LUKS2.
+const maxTokens = 32
+
+// KeyslotRole describes what a keyslot is used for.
+type KeyslotRole string
+
+const (
+	// RoleRun keyslots unlock the container during normal boots.
+	RoleRun KeyslotRole = "run"
+	// RoleRecovery keyslots unlock the container when the run
+	// keyslots cannot be used.
+	RoleRecovery KeyslotRole = "recovery"
+	// RoleFallback keyslots are unlocked with a secret that is
+	// supplied by the user.
+	RoleFallback KeyslotRole = "fallback"
+)
+
+func (ks *Keyslot) role() KeyslotRole {
+	switch ks.Protector {
+	case ProtectorTPM:
+		return RoleRun
+	case ProtectorRecoveryKey:
+		return RoleRecovery
+	default:
+		return RoleFallback
+	}
+}
+
+// keyslotTokenData is the content of a token of type keyslotTokenType,
+// in addition to its type and keyslots.
+type keyslotTokenData struct {
+	Role                 KeyslotRole   `json:"role"`
+	Name                 string        `json:"name,omitempty"`
+	Protector            ProtectorKind `json:"protector"`
+	SealedObject         string        `json:"sealed_object,omitempty"`
+	PCRPolicyCounter     uint32        `json:"pcr_policy_counter,omitempty"`
+	PCRProfileGeneration uint64        `json:"pcr_profile_generation,omitempty"`
+	PIN                  bool          `json:"pin,omitempty"`
+	CreationTime         time.Time     `json:"creation_time"`
+}
+
+func keyslotToken(ks *Keyslot) (*luks.Token, error) {
+	data, err := json.Marshal(&keyslotTokenData{
+		Role:                 ks.role(),
+		Name:                 ks.Name,
+		Protector:            ks.Protector,
+		SealedObject:         ks.SealedObject,
+		PCRPolicyCounter:     ks.PCRPolicyCounter,
+		PCRProfileGeneration: ks.PCRProfileGeneration,
+		PIN:                  ks.PIN,
+		CreationTime:         ks.CreationTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &luks.Token{Type: keyslotTokenType, Keyslots: []int{ks.Slot}, Data: data}, nil
+}
+
+// keyslotFromTokens returns the keyslot recorded by the first token of
+// type keyslotTokenType among the tokens that reference it, or nil if
+// there isn't one.
+func keyslotFromTokens(slot int, tokens []*luks.Token) *Keyslot {
+	for _, tok := range tokens {
+		if tok.Type != keyslotTokenType {
+			continue
+		}
+		var data keyslotTokenData
+		if err := json.Unmarshal(tok.Data, &data); err != nil {
+			logger.Noticef("cannot decode %s token of keyslot %d: %v", keyslotTokenType, slot, err)
+			continue
+		}
+		return &Keyslot{
+			Slot:                 slot,
+			Name:                 data.Name,
+			Protector:            data.Protector,
+			SealedObject:         data.SealedObject,
+			PCRPolicyCounter:     data.PCRPolicyCounter,
+			PCRProfileGeneration: data.PCRProfileGeneration,
+			PIN:                  data.PIN,
+			CreationTime:         data.CreationTime,
+		}
+	}
+	return nil
+}
+
+// writeKeyslotToken records the metadata of a keyslot in a token of
+// type keyslotTokenType that is bound to it, replacing the token that
+// was written for the keyslot previously, if any.
+func writeKeyslotToken(devicePath string, ks *Keyslot) error {
+	hdr, err := luks.DefaultBackend().ReadHeader(devicePath)
+	if err != nil {
+		return err
+	}
+	id := -1
+	for tokID, tok := range hdr.Metadata.Tokens {
+		if tok.Type == keyslotTokenType && len(tok.Keyslots) == 1 && tok.Keyslots[0] == ks.Slot {
+			id = tokID
+			break
+		}
+	}
+	for tokID := 0; id < 0 && tokID < maxTokens; tokID++ {
+		if _, ok := hdr.Metadata.Tokens[tokID]; !ok {
+			id = tokID
+		}
+	}
+	if id < 0 {
+		return fmt.Errorf("no free token in %s", devicePath)
+	}
+
+	tok, err := keyslotToken(ks)
+	if err != nil {
+		return err
+	}
+	return luks.DefaultBackend().WriteToken(devicePath, id, tok)
+}
+
+// removeKeyslotTokens removes the tokens of type keyslotTokenType that
+// are bound to the specified keyslot, and those that are not bound to
+// any keyslot anymore, which is the case once their keyslot is wiped.
+func removeKeyslotTokens(devicePath string, slot int) error {
+	hdr, err := luks.DefaultBackend().ReadHeader(devicePath)
+	if err != nil {
+		return err
+	}
+	for id, tok := range hdr.Metadata.Tokens {
+		if tok.Type != keyslotTokenType {
+			continue
+		}
+		if len(tok.Keyslots) > 0 && (len(tok.Keyslots) != 1 || tok.Keyslots[0] != slot) {
+			continue
+		}
+		if err := luks.DefaultBackend().RemoveToken(devicePath, id); err != nil && !errors.Is(err, luks.ErrTokenNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordKeyslotToken writes the token of a keyslot, only logging a
+// failure as the keyslot remains usable and is still recorded in the
+// state.
+func recordKeyslotToken(devicePath string, ks *Keyslot) {
+	if err := writeKeyslotToken(devicePath, ks); err != nil {
+		logger.Noticef("cannot record metadata of keyslot %d of %s: %v", ks.Slot, devicePath, err)
+	}
+}
+
+// forgetKeyslotToken removes the tokens of a keyslot, only logging a
+// failure.
+func forgetKeyslotToken(devicePath string, slot int) {
+	if err := removeKeyslotTokens(devicePath, slot); err != nil {
+		logger.Noticef("cannot remove metadata of keyslot %d of %s: %v", slot, devicePath, err)
+	}
+}
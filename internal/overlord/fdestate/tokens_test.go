@@ -0,0 +1,213 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+// keyslotTokens returns the content of the fdemanager tokens of a fake
+// container, keyed by the keyslot that they are bound to. Tokens that
+// are not bound to exactly one keyslot are keyed by -1.
+func (s *fdeMgrBaseSuite) keyslotTokens(c *C, devicePath string) map[int]map[string]interface{} {
+	tokens := make(map[int]map[string]interface{})
+	for _, tok := range s.luks.Header(devicePath).Metadata.Tokens {
+		if tok.Type != "fdemanager" {
+			continue
+		}
+		var data map[string]interface{}
+		c.Assert(json.Unmarshal(tok.Data, &data), IsNil)
+		slot := -1
+		if len(tok.Keyslots) == 1 {
+			slot = tok.Keyslots[0]
+		}
+		c.Assert(tokens[slot], IsNil, Commentf("keyslot %d has more than one token", slot))
+		tokens[slot] = data
+	}
+	return tokens
+}
+
+func (s *handlersSuite) TestSealKeyWritesToken(c *C) {
+	s.runSeal(c, "run")
+
+	sealedObject := filepath.Join(paths.ManagerKeysDir, testUUID+"-run.sealed-key")
+	c.Check(s.keyslotTokens(c, "/dev/sda4"), DeepEquals, map[int]map[string]interface{}{
+		2: {
+			"type":                   "fdemanager",
+			"keyslots":               []interface{}{"2"},
+			"role":                   "run",
+			"name":                   "run",
+			"protector":              "tpm",
+			"sealed_object":          sealedObject,
+			"pcr_policy_counter":     float64(0x01880010),
+			"pcr_profile_generation": float64(1),
+			"creation_time":          "2023-10-16T12:00:00Z",
+		},
+	})
+}
+
+func (s *handlersSuite) TestResealKeyUpdatesTokens(c *C) {
+	s.runSeal(c, "run")
+	s.runSeal(c, "fallback")
+
+	// each key is sealed against a new profile
+	tokens := s.keyslotTokens(c, "/dev/sda4")
+	c.Check(tokens[2]["pcr_profile_generation"], Equals, float64(1))
+	c.Check(tokens[3]["pcr_profile_generation"], Equals, float64(2))
+
+	s.st.Lock()
+	ts, err := fdestate.Reseal(s.st, testUUID, s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("reseal", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	// the tokens are replaced
+	tokens = s.keyslotTokens(c, "/dev/sda4")
+	c.Check(tokens, HasLen, 2)
+	c.Check(tokens[2]["pcr_profile_generation"], Equals, float64(3))
+	c.Check(tokens[3]["pcr_profile_generation"], Equals, float64(3))
+	container := s.container(c)
+	c.Check(container.Keyslot(2).PCRProfileGeneration, Equals, uint64(3))
+	c.Check(container.Keyslot(3).PCRProfileGeneration, Equals, uint64(3))
+}
+
+func (s *handlersSuite) TestRecoveryKeyTokens(c *C) {
+	s.mockRecoveryKey(c)
+
+	s.st.Lock()
+	ts, _, err := fdestate.AddRecoveryKey(s.st, testUUID, "helpdesk")
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("add-recovery-key", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	c.Check(s.keyslotTokens(c, "/dev/sda4"), DeepEquals, map[int]map[string]interface{}{
+		2: {
+			"type":          "fdemanager",
+			"keyslots":      []interface{}{"2"},
+			"role":          "recovery",
+			"name":          "helpdesk",
+			"protector":     "recovery-key",
+			"creation_time": "2023-10-16T12:00:00Z",
+		},
+	})
+
+	s.st.Lock()
+	ts, err = fdestate.RemoveRecoveryKey(s.st, testUUID, "helpdesk")
+	c.Assert(err, IsNil)
+	chg = s.st.NewChange("remove-recovery-key", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	// the token does not outlive the keyslot
+	c.Check(s.keyslotTokens(c, "/dev/sda4"), HasLen, 0)
+	// tokens of other types are left alone
+	c.Check(s.luks.Header("/dev/sda4").Metadata.Tokens, HasLen, 2)
+}
+
+func (s *handlersSuite) TestChangePassphraseMovesToken(c *C) {
+	s.mockPassphrases(c)
+
+	chg := s.runUpdateProtector(c, "user", fdestate.ChangePassphrase, &fdestate.Secrets{Old: []byte("old"), New: []byte("new")})
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+	c.Check(s.keyslotTokens(c, "/dev/sda4")[3]["role"], Equals, "fallback")
+
+	chg = s.runUpdateProtector(c, "user", fdestate.ChangePassphrase, &fdestate.Secrets{Old: []byte("new"), New: []byte("newer")})
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	tokens := s.keyslotTokens(c, "/dev/sda4")
+	c.Check(tokens, HasLen, 1)
+	c.Check(tokens[2], DeepEquals, map[string]interface{}{
+		"type":          "fdemanager",
+		"keyslots":      []interface{}{"2"},
+		"role":          "fallback",
+		"name":          "user",
+		"protector":     "passphrase",
+		"creation_time": "2023-10-16T12:00:00Z",
+	})
+}
+
+func (s *fdeMgrSuite) TestEnsureRebuildsStateFromTokens(c *C) {
+	s.mockDMDevice(c, "dm-0", "CRYPT-LUKS2-7eebd2a44e454c1aa8d13f0d4e5b8a21-ubuntu-data", "sda4")
+	hdr := s.mockHeader(c, "/dev/sda4", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	hdr.Metadata.Keyslots[2] = &luks.Keyslot{Type: "luks2"}
+	for id, tok := range map[int]string{
+		2: `{"type":"fdemanager","keyslots":["0"],"role":"run","name":"default","protector":"tpm","sealed_object":"/var/lib/fdemanagerd/keys/default.sealed-key","pcr_policy_counter":25690128,"pcr_profile_generation":4,"pin":true,"creation_time":"2023-10-16T12:00:00Z"}`,
+		3: `{"type":"fdemanager","keyslots":["1"],"role":"recovery","name":"default-recovery","protector":"recovery-key","creation_time":"2023-10-17T12:00:00Z"}`,
+		// not bound to a keyslot
+		4: `{"type":"fdemanager","keyslots":[],"role":"fallback","name":"gone","protector":"passphrase","creation_time":"2023-10-17T12:00:00Z"}`,
+	} {
+		var t luks.Token
+		c.Assert(json.Unmarshal([]byte(tok), &t), IsNil)
+		hdr.Metadata.Tokens[id] = &t
+	}
+
+	// the state is empty, as if state.json was lost
+	s.ensure(c)
+
+	containers := s.containers(c)
+	c.Assert(containers, HasLen, 1)
+	c.Check(containers[0].Keyslots, DeepEquals, []*fdestate.Keyslot{
+		{
+			Slot:                 0,
+			Name:                 "default",
+			Protector:            fdestate.ProtectorTPM,
+			SealedObject:         "/var/lib/fdemanagerd/keys/default.sealed-key",
+			PCRPolicyCounter:     0x01880010,
+			PCRProfileGeneration: 4,
+			PIN:                  true,
+			CreationTime:         testTime,
+		},
+		{
+			Slot:         1,
+			Name:         "default-recovery",
+			Protector:    fdestate.ProtectorRecoveryKey,
+			CreationTime: testTime.AddDate(0, 0, 1),
+		},
+		// not created by the manager
+		{Slot: 2, Protector: fdestate.ProtectorUnknown},
+	})
+}
@@ -0,0 +1,551 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/state"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/tpm"
+)
+
+// FindingKind describes an inconsistency between the state of the
+// manager and the containers, the sealed key objects or the TPM.
+type FindingKind string
+
+const (
+	// FindingOrphanedKeyslot is a used keyslot that is not recorded
+	// in the state.
+	FindingOrphanedKeyslot FindingKind = "orphaned-keyslot"
+	// FindingMissingKeyslot is a keyslot that is recorded in the
+	// state but is no longer used in the container.
+	FindingMissingKeyslot FindingKind = "missing-keyslot"
+	// FindingOrphanedToken is a token written by the manager that is
+	// no longer bound to a keyslot.
+	FindingOrphanedToken FindingKind = "orphaned-token"
+	// FindingMissingToken is a keyslot created by the manager that
+	// has no token recording its metadata.
+	FindingMissingToken FindingKind = "missing-token"
+	// FindingMissingSealedObject is a TPM protected keyslot whose
+	// sealed key object, or the key that authorizes updates to its
+	// PCR policy, does not exist.
+	FindingMissingSealedObject FindingKind = "missing-sealed-object"
+	// FindingUnownedNVIndex is an NV index in the range used by the
+	// manager for PCR policy counters that no keyslot refers to. It
+	// is never repaired, as it is only inferred that the manager
+	// defined it.
+	FindingUnownedNVIndex FindingKind = "unowned-nv-index"
+	// FindingStalePolicyCounter is a PCR policy counter of a keyslot
+	// that is not defined in the TPM, so that its sealed key object
+	// cannot be unsealed anymore.
+	FindingStalePolicyCounter FindingKind = "stale-policy-counter"
+)
+
+// Finding is an inconsistency detected by Verify. Only the fields
+// relevant to its kind are set.
+type Finding struct {
+	Kind       FindingKind `json:"kind"`
+	Container  string      `json:"container,omitempty"`
+	DevicePath string      `json:"device-path,omitempty"`
+	Keyslot    *int        `json:"keyslot,omitempty"`
+	Token      *int        `json:"token,omitempty"`
+	Path       string      `json:"path,omitempty"`
+	Handle     uint32      `json:"handle,omitempty"`
+	Message    string      `json:"message"`
+
+	// Repairable indicates whether the inconsistency can be fixed
+	// without risking access to any container.
+	Repairable bool `json:"repairable"`
+	// Repaired indicates whether the inconsistency was fixed by
+	// Repair.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// verifyInputs is what the consistency of the state is checked
+// against, which is obtained without holding the state lock.
+type verifyInputs struct {
+	headers map[string]*luks.Header
+	// missing holds the sealed key object files that do not exist.
+	missing map[string]bool
+	// nvIndices is nil if there is no TPM.
+	nvIndices []uint32
+}
+
+func readVerifyInputs(containers map[string]*Container) (*verifyInputs, error) {
+	in := &verifyInputs{
+		headers: make(map[string]*luks.Header, len(containers)),
+		missing: make(map[string]bool),
+	}
+	for _, c := range containers {
+		hdr, err := luks.DefaultBackend().ReadHeader(c.DevicePath)
+		if err != nil {
+			logger.Noticef("cannot read LUKS2 header of %s: %v", c.DevicePath, err)
+			continue
+		}
+		if hdr.UUID != c.UUID {
+			logger.Noticef("%s is not container %s anymore", c.DevicePath, c.UUID)
+			continue
+		}
+		in.headers[c.DevicePath] = hdr
+
+		for _, ks := range c.Keyslots {
+			if ks.Protector != ProtectorTPM || ks.SealedObject == "" {
+				continue
+			}
+			for _, path := range []string{ks.SealedObject, policyAuthKeyPath(ks.SealedObject)} {
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					in.missing[path] = true
+				}
+			}
+		}
+	}
+
+	conn, err := tpmConnect()
+	if errors.Is(err, tpm.ErrNoTPM) {
+		return in, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer conn.Close()
+	if in.nvIndices, err = conn.NVIndices(); err != nil {
+		return nil, err
+	}
+	if in.nvIndices == nil {
+		in.nvIndices = []uint32{}
+	}
+	return in, nil
+}
+
+// checkConsistency returns the inconsistencies between the supplied
+// containers and the inputs, ordered by container.
+func checkConsistency(containers []*Container, in *verifyInputs) []*Finding {
+	var findings []*Finding
+	owned := make(map[uint32]bool)
+
+	for _, c := range containers {
+		for _, ks := range c.Keyslots {
+			if ks.PCRPolicyCounter != 0 {
+				owned[ks.PCRPolicyCounter] = true
+			}
+		}
+
+		hdr := in.headers[c.DevicePath]
+		if hdr == nil {
+			continue
+		}
+		newFinding := func(kind FindingKind, repairable bool, format string, args ...interface{}) *Finding {
+			f := &Finding{
+				Kind:       kind,
+				Container:  c.UUID,
+				DevicePath: c.DevicePath,
+				Message:    fmt.Sprintf(format, args...),
+				Repairable: repairable,
+			}
+			findings = append(findings, f)
+			return f
+		}
+
+		for _, slot := range hdr.Metadata.KeyslotIDs() {
+			if c.Keyslot(slot) == nil {
+				f := newFinding(FindingOrphanedKeyslot, true, "keyslot %d of %s is not recorded", slot, c.DevicePath)
+				f.Keyslot = intPtr(slot)
+			}
+		}
+		for _, ks := range c.Keyslots {
+			if _, ok := hdr.Metadata.Keyslots[ks.Slot]; !ok {
+				f := newFinding(FindingMissingKeyslot, true, "keyslot %d (%q) of %s is not in use anymore", ks.Slot, ks.Name, c.DevicePath)
+				f.Keyslot = intPtr(ks.Slot)
+				continue
+			}
+			if !ks.CreationTime.IsZero() && keyslotFromTokens(ks.Slot, hdr.Metadata.TokensForKeyslot(ks.Slot)) == nil {
+				f := newFinding(FindingMissingToken, true, "keyslot %d (%q) of %s has no %s token", ks.Slot, ks.Name, c.DevicePath, keyslotTokenType)
+				f.Keyslot = intPtr(ks.Slot)
+			}
+			if ks.Protector == ProtectorTPM && ks.SealedObject != "" {
+				for _, path := range []string{ks.SealedObject, policyAuthKeyPath(ks.SealedObject)} {
+					if in.missing[path] {
+						f := newFinding(FindingMissingSealedObject, false, "%s of keyslot %d (%q) does not exist", path, ks.Slot, ks.Name)
+						f.Keyslot = intPtr(ks.Slot)
+						f.Path = path
+					}
+				}
+			}
+			if ks.PCRPolicyCounter != 0 && in.nvIndices != nil && !containsHandle(in.nvIndices, ks.PCRPolicyCounter) {
+				f := newFinding(FindingStalePolicyCounter, false, "PCR policy counter %#x of keyslot %d (%q) is not defined in the TPM", ks.PCRPolicyCounter, ks.Slot, ks.Name)
+				f.Keyslot = intPtr(ks.Slot)
+				f.Handle = ks.PCRPolicyCounter
+			}
+		}
+
+		ids := make([]int, 0, len(hdr.Metadata.Tokens))
+		for id := range hdr.Metadata.Tokens {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			tok := hdr.Metadata.Tokens[id]
+			if tok.Type != keyslotTokenType {
+				continue
+			}
+			var data keyslotTokenData
+			json.Unmarshal(tok.Data, &data)
+			if data.PCRPolicyCounter != 0 {
+				owned[data.PCRPolicyCounter] = true
+			}
+			if len(tok.Keyslots) == 0 {
+				f := newFinding(FindingOrphanedToken, true, "%s token %d of %s is not bound to a keyslot", keyslotTokenType, id, c.DevicePath)
+				f.Token = intPtr(id)
+				// what is left of the wiped keyslot
+				f.Path = data.SealedObject
+				f.Handle = data.PCRPolicyCounter
+			}
+		}
+	}
+
+	for _, h := range in.nvIndices {
+		if h < pcrPolicyCounterHandleStart || h > pcrPolicyCounterHandleEnd || owned[h] {
+			continue
+		}
+		findings = append(findings, &Finding{
+			Kind:    FindingUnownedNVIndex,
+			Handle:  h,
+			Message: fmt.Sprintf("NV index %#x is not used by any keyslot", h),
+		})
+	}
+	return findings
+}
+
+func containsHandle(handles []uint32, h uint32) bool {
+	for _, handle := range handles {
+		if handle == h {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify cross-checks the state of the manager against the headers
+// of the containers, the sealed key objects and the NV indices of the
+// TPM, and returns the inconsistencies that it finds. It must be
+// called without holding the state lock.
+func Verify(st *state.State) ([]*Finding, error) {
+	st.Lock()
+	containers, err := Containers(st)
+	st.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]*Container, len(containers))
+	for _, c := range containers {
+		known[c.UUID] = c
+	}
+	in, err := readVerifyInputs(known)
+	if err != nil {
+		return nil, err
+	}
+	return checkConsistency(containers, in), nil
+}
+
+// checkRepairConflict returns a *ChangeConflictError if there is an
+// in-progress change that repairs the state, or that operates on any
+// of the containers.
+func checkRepairConflict(st *state.State) error {
+	for _, chg := range st.Changes() {
+		if chg.IsReady() {
+			continue
+		}
+		for _, t := range chg.Tasks() {
+			if t.Kind() == "repair-state" {
+				return &ChangeConflictError{ChangeKind: chg.Kind(), ChangeID: chg.ID()}
+			}
+		}
+	}
+	containers, err := allContainers(st)
+	if err != nil {
+		return err
+	}
+	for uuid := range containers {
+		if err := checkChangeConflict(st, uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Repair returns a task that verifies the consistency of the state
+// and fixes the inconsistencies that are safe to fix, recording the
+// findings in the data of its change.
+func Repair(st *state.State) (*state.TaskSet, error) {
+	if err := checkRepairConflict(st); err != nil {
+		return nil, err
+	}
+	t := st.NewTask("repair-state", "Repair the FDE state")
+	return state.NewTaskSet(t), nil
+}
+
+func (m *FDEManager) doRepairState(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+
+	findings, err := Verify(st)
+	if err != nil {
+		return err
+	}
+	for _, f := range findings {
+		if !f.Repairable {
+			continue
+		}
+		if err := m.repairFinding(f); err != nil {
+			logger.Noticef("cannot repair FDE state: %s: %v", f.Message, err)
+			continue
+		}
+		f.Repaired = true
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	for _, f := range findings {
+		if f.Repaired {
+			t.Logf("Repaired: %s", f.Message)
+		} else {
+			t.Logf("Not repaired: %s", f.Message)
+		}
+	}
+	if findings == nil {
+		findings = []*Finding{}
+	}
+	t.Change().Set("api-data", map[string]interface{}{
+		"findings": findings,
+	})
+	return nil
+}
+
+// repairFinding fixes a repairable inconsistency. It must be called
+// without holding the state lock.
+func (m *FDEManager) repairFinding(f *Finding) error {
+	st := m.state
+
+	if f.Kind == FindingOrphanedToken {
+		m.releaseOrphanedSealedObject(f.Path, f.Handle)
+		err := luks.DefaultBackend().RemoveToken(f.DevicePath, *f.Token)
+		if errors.Is(err, luks.ErrTokenNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	st.Lock()
+	c, err := ContainerByUUID(st, f.Container)
+	st.Unlock()
+	if err != nil {
+		return err
+	}
+	slot := *f.Keyslot
+
+	switch f.Kind {
+	case FindingOrphanedKeyslot:
+		hdr, err := luks.DefaultBackend().ReadHeader(c.DevicePath)
+		if err != nil {
+			return err
+		}
+		if _, ok := hdr.Metadata.Keyslots[slot]; !ok {
+			return fmt.Errorf("keyslot %d is not in use anymore", slot)
+		}
+		st.Lock()
+		defer st.Unlock()
+		if c, err = ContainerByUUID(st, f.Container); err != nil {
+			return err
+		}
+		if c.Keyslot(slot) == nil {
+			// recorded like the refresh of the container does
+			c.Keyslots = mergeKeyslots(c.Keyslots, &hdr.Metadata)
+		}
+		return SetContainer(st, c)
+	case FindingMissingKeyslot:
+		ks := c.Keyslot(slot)
+		if ks == nil {
+			return nil
+		}
+		// the key is gone from the container, so what is left of
+		// it is of no use
+		if ks.PCRPolicyCounter != 0 {
+			if err := secbootReleasePCRResourceHandles(ks.PCRPolicyCounter); err != nil {
+				logger.Noticef("cannot release PCR policy counter %#x: %v", ks.PCRPolicyCounter, err)
+			}
+		}
+		if ks.SealedObject != "" {
+			os.Remove(ks.SealedObject)
+			os.Remove(policyAuthKeyPath(ks.SealedObject))
+		}
+		st.Lock()
+		defer st.Unlock()
+		if c, err = ContainerByUUID(st, f.Container); err != nil {
+			return err
+		}
+		c.removeKeyslot(slot)
+		return SetContainer(st, c)
+	case FindingMissingToken:
+		ks := c.Keyslot(slot)
+		if ks == nil {
+			return fmt.Errorf("keyslot %d is not recorded anymore", slot)
+		}
+		return writeKeyslotToken(c.DevicePath, ks)
+	}
+	return fmt.Errorf("internal error: %s cannot be repaired", f.Kind)
+}
+
+// releaseOrphanedSealedObject removes the sealed key object recorded
+// by a token whose keyslot was wiped, and releases its PCR policy
+// counter. Nothing is done if the sealed key object is gone already,
+// which is the case once the keyslot was forgotten by a repair, or if
+// a recorded keyslot still uses it.
+func (m *FDEManager) releaseOrphanedSealedObject(sealedObject string, handle uint32) {
+	if sealedObject == "" {
+		return
+	}
+	if _, err := os.Stat(sealedObject); os.IsNotExist(err) {
+		return
+	}
+	st := m.state
+	st.Lock()
+	containers, err := Containers(st)
+	st.Unlock()
+	if err != nil {
+		logger.Noticef("cannot obtain encrypted containers: %v", err)
+		return
+	}
+	for _, c := range containers {
+		for _, ks := range c.Keyslots {
+			if ks.SealedObject == sealedObject || (handle != 0 && ks.PCRPolicyCounter == handle) {
+				return
+			}
+		}
+	}
+
+	if handle != 0 {
+		if err := secbootReleasePCRResourceHandles(handle); err != nil {
+			logger.Noticef("cannot release PCR policy counter %#x: %v", handle, err)
+		}
+	}
+	os.Remove(sealedObject)
+	os.Remove(policyAuthKeyPath(sealedObject))
+}
+
+// StartUp implements StateStarterUp.StartUp. It queues a change that
+// verifies the consistency of the state once the daemon starts, as the
+// containers, the sealed key objects and the TPM may have been
+// modified by other means in the meantime. Nothing is queued while
+// changes that operate on the containers are in progress, as the state
+// does not match them until they are done.
+func (m *FDEManager) StartUp() error {
+	st := m.state
+	st.Lock()
+	defer st.Unlock()
+
+	if err := checkRepairConflict(st); err != nil {
+		logger.Debugf("not verifying FDE state: %v", err)
+		return nil
+	}
+	for _, chg := range st.Changes() {
+		if chg.Kind() == verifyChangeKind && !chg.IsReady() {
+			// left over from before a restart
+			return nil
+		}
+	}
+	t := st.NewTask("verify-state", "Verify the FDE state")
+	chg := st.NewChange(verifyChangeKind, "Verify the FDE state on start up")
+	chg.AddTask(t)
+	return nil
+}
+
+// verifyChangeKind is the kind of the change queued by StartUp.
+const verifyChangeKind = "verify-fde-state"
+
+// doVerifyState logs the inconsistencies of the state, records them in
+// the data of its change and in a notice, so that they can be repaired.
+func (m *FDEManager) doVerifyState(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+
+	findings, err := Verify(st)
+	if err != nil {
+		return fmt.Errorf("cannot verify FDE state: %v", err)
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	if findings == nil {
+		findings = []*Finding{}
+	}
+	t.Change().Set("api-data", map[string]interface{}{
+		"findings": findings,
+	})
+	if len(findings) == 0 {
+		return nil
+	}
+	// changes that started in the meantime may be what the state
+	// doesn't match
+	if err := checkRepairConflict(st); err != nil {
+		t.Logf("Not reporting %d inconsistencies: %v", len(findings), err)
+		return nil
+	}
+
+	repairable := 0
+	for _, f := range findings {
+		logger.Noticef("inconsistent FDE state: %s", f.Message)
+		t.Logf("Inconsistent: %s", f.Message)
+		if f.Repairable {
+			repairable++
+		}
+	}
+	_, err = noticestate.AddNotice(st, noticestate.StateInconsistent, "fde", &noticestate.AddOptions{
+		Data: map[string]string{
+			"findings":   strconv.Itoa(len(findings)),
+			"repairable": strconv.Itoa(repairable),
+		},
+	})
+	if err != nil {
+		logger.Noticef("cannot record inconsistent state notice: %v", err)
+	}
+	return nil
+}
+
+// ensureCleanOnReady makes the task runner clean the change queued by
+// StartUp right after it is ready. It is otherwise only cleaned by the
+// next ensure, and keeps the daemon from going into standby until then.
+func ensureCleanOnReady(chg *state.Change, old, new state.Status) {
+	if chg.Kind() == verifyChangeKind && new.Ready() {
+		chg.State().EnsureBefore(0)
+	}
+}
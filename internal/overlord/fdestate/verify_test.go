@@ -0,0 +1,354 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fdestate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/secboot"
+	"github.com/snapcore/snapd/testutil"
+
+	"github.com/snapcore/fdemanager/internal/luks"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/tpm/tpmtest"
+)
+
+// mockTPMSealing makes sealing keys write their sealed key objects and
+// define their PCR policy counters in a fake TPM, and releasing the
+// counters undefine them.
+func (s *handlersSuite) mockTPMSealing(c *C) *tpmtest.TPM {
+	t := tpmtest.New()
+	s.AddCleanup(tpmtest.Mock(t))
+
+	s.AddCleanup(fdestate.MockSecbootSealKeys(func(keys []secboot.SealKeyRequest, params *secboot.SealKeysParams) error {
+		for _, key := range keys {
+			c.Assert(ioutil.WriteFile(key.KeyFile, []byte("sealed"), 0600), IsNil)
+		}
+		c.Assert(ioutil.WriteFile(params.TPMPolicyAuthKeyFile, []byte("auth"), 0600), IsNil)
+		t.NVIndices = append(t.NVIndices, params.PCRPolicyCounterHandle)
+		s.sealCalls = append(s.sealCalls, params)
+		return nil
+	}))
+	s.AddCleanup(fdestate.MockSecbootReleasePCRResourceHandles(func(handles ...uint32) error {
+		s.released = append(s.released, handles...)
+		for _, h := range handles {
+			for i, index := range t.NVIndices {
+				if index == h {
+					t.NVIndices = append(t.NVIndices[:i], t.NVIndices[i+1:]...)
+					break
+				}
+			}
+		}
+		return nil
+	}))
+	return t
+}
+
+// mockDrift seals two keys and then modifies the container, the sealed
+// key objects and the TPM as if by hand.
+func (s *handlersSuite) mockDrift(c *C) *tpmtest.TPM {
+	t := s.mockTPMSealing(c)
+	s.runSeal(c, "run")
+	s.runSeal(c, "fallback")
+
+	// the keyslot of the fallback key is wiped, which unbinds its
+	// token
+	c.Assert(luks.DefaultBackend().RemoveKey("/dev/sda4", 3, s.luks.Key("/dev/sda4", 3)), IsNil)
+	// a keyslot is added
+	c.Assert(luks.DefaultBackend().AddKey("/dev/sda4", []byte("unlock-key"), []byte("other"), &luks.AddKeyOptions{Slot: 5}), IsNil)
+	// the token of the run key is removed
+	c.Assert(luks.DefaultBackend().RemoveToken("/dev/sda4", 2), IsNil)
+	// the PCR policy counter of the run key is undefined and an
+	// unrelated one is left over
+	t.NVIndices = []uint32{0x01880011, 0x01880012, 0x01000001}
+	return t
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func (s *handlersSuite) TestVerifyConsistent(c *C) {
+	s.mockTPMSealing(c)
+	s.runSeal(c, "run")
+
+	findings, err := fdestate.Verify(s.st)
+	c.Assert(err, IsNil)
+	c.Check(findings, HasLen, 0)
+}
+
+func (s *handlersSuite) TestVerify(c *C) {
+	s.mockDrift(c)
+
+	findings, err := fdestate.Verify(s.st)
+	c.Assert(err, IsNil)
+	c.Check(findings, DeepEquals, []*fdestate.Finding{
+		{
+			Kind:       fdestate.FindingOrphanedKeyslot,
+			Container:  testUUID,
+			DevicePath: "/dev/sda4",
+			Keyslot:    intPtr(5),
+			Message:    "keyslot 5 of /dev/sda4 is not recorded",
+			Repairable: true,
+		},
+		{
+			Kind:       fdestate.FindingMissingToken,
+			Container:  testUUID,
+			DevicePath: "/dev/sda4",
+			Keyslot:    intPtr(2),
+			Message:    `keyslot 2 ("run") of /dev/sda4 has no fdemanager token`,
+			Repairable: true,
+		},
+		{
+			Kind:       fdestate.FindingStalePolicyCounter,
+			Container:  testUUID,
+			DevicePath: "/dev/sda4",
+			Keyslot:    intPtr(2),
+			Handle:     0x01880010,
+			Message:    `PCR policy counter 0x1880010 of keyslot 2 ("run") is not defined in the TPM`,
+		},
+		{
+			Kind:       fdestate.FindingMissingKeyslot,
+			Container:  testUUID,
+			DevicePath: "/dev/sda4",
+			Keyslot:    intPtr(3),
+			Message:    `keyslot 3 ("fallback") of /dev/sda4 is not in use anymore`,
+			Repairable: true,
+		},
+		{
+			Kind:       fdestate.FindingOrphanedToken,
+			Container:  testUUID,
+			DevicePath: "/dev/sda4",
+			Token:      intPtr(3),
+			Path:       filepath.Join(paths.ManagerKeysDir, testUUID+"-fallback.sealed-key"),
+			Handle:     0x01880011,
+			Message:    "fdemanager token 3 of /dev/sda4 is not bound to a keyslot",
+			Repairable: true,
+		},
+		{
+			// the index may belong to something else
+			Kind:    fdestate.FindingUnownedNVIndex,
+			Handle:  0x01880012,
+			Message: "NV index 0x1880012 is not used by any keyslot",
+		},
+	})
+}
+
+func (s *handlersSuite) TestVerifyMissingSealedObject(c *C) {
+	s.mockTPMSealing(c)
+	s.runSeal(c, "run")
+
+	sealedObject := filepath.Join(paths.ManagerKeysDir, testUUID+"-run.sealed-key")
+	c.Assert(os.Remove(sealedObject+".policy-auth-key"), IsNil)
+
+	findings, err := fdestate.Verify(s.st)
+	c.Assert(err, IsNil)
+	c.Check(findings, DeepEquals, []*fdestate.Finding{{
+		Kind:       fdestate.FindingMissingSealedObject,
+		Container:  testUUID,
+		DevicePath: "/dev/sda4",
+		Keyslot:    intPtr(2),
+		Path:       sealedObject + ".policy-auth-key",
+		Message:    sealedObject + `.policy-auth-key of keyslot 2 ("run") does not exist`,
+	}})
+}
+
+func (s *handlersSuite) TestVerifyUnreadableContainer(c *C) {
+	t := s.mockTPMSealing(c)
+	t.NVIndices = []uint32{0x01880010}
+
+	// the counter may belong to a keyslot of the container that
+	// cannot be read
+	s.luks.Header("/dev/sda4").UUID = "5a5ae4a0-d9b6-477f-9b0b-2bcd0cc9dc4d"
+
+	findings, err := fdestate.Verify(s.st)
+	c.Assert(err, IsNil)
+	c.Check(findings, DeepEquals, []*fdestate.Finding{{
+		Kind:    fdestate.FindingUnownedNVIndex,
+		Handle:  0x01880010,
+		Message: "NV index 0x1880010 is not used by any keyslot",
+	}})
+}
+
+func (s *handlersSuite) TestRepair(c *C) {
+	t := s.mockDrift(c)
+	sealedObject := filepath.Join(paths.ManagerKeysDir, testUUID+"-fallback.sealed-key")
+
+	s.st.Lock()
+	ts, err := fdestate.Repair(s.st)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("repair-fde-state", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.settle(c)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	var data struct {
+		Findings []*fdestate.Finding `json:"findings"`
+	}
+	c.Assert(chg.Get("api-data", &data), IsNil)
+	s.st.Unlock()
+
+	// the status of the container may be refreshed before the
+	// keyslots are checked, which records them like the repair does
+	c.Assert(len(data.Findings) >= 5, Equals, true)
+	for _, f := range data.Findings {
+		c.Check(f.Repaired, Equals, f.Repairable, Commentf(f.Message))
+	}
+
+	container := s.container(c)
+	c.Check(container.Keyslot(3), IsNil)
+	c.Check(container.Keyslot(5), DeepEquals, &fdestate.Keyslot{Slot: 5, Protector: fdestate.ProtectorUnknown})
+	c.Check(sealedObject, testutil.FileAbsent)
+	c.Check(sealedObject+".policy-auth-key", testutil.FileAbsent)
+	c.Check(s.released, DeepEquals, []uint32{0x01880011})
+	c.Check(t.NVIndices, DeepEquals, []uint32{0x01880012, 0x01000001})
+	tokens := s.keyslotTokens(c, "/dev/sda4")
+	c.Check(tokens, HasLen, 1)
+	c.Check(tokens[2]["name"], Equals, "run")
+
+	// what cannot be repaired is left
+	findings, err := fdestate.Verify(s.st)
+	c.Assert(err, IsNil)
+	c.Assert(findings, HasLen, 2)
+	c.Check(findings[0].Kind, Equals, fdestate.FindingStalePolicyCounter)
+	c.Check(findings[1].Kind, Equals, fdestate.FindingUnownedNVIndex)
+}
+
+func (s *handlersSuite) TestRepairConflict(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	ts, err := fdestate.Seal(s.st, testUUID, "run", s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("seal", "...")
+	chg.AddAll(ts)
+
+	_, err = fdestate.Repair(s.st)
+	c.Check(err, ErrorMatches, `container .* has "seal" change in progress`)
+	c.Check(err, FitsTypeOf, &fdestate.ChangeConflictError{})
+
+	for _, t := range ts.Tasks() {
+		t.SetStatus(state.DoneStatus)
+	}
+	ts, err = fdestate.Repair(s.st)
+	c.Assert(err, IsNil)
+	chg = s.st.NewChange("repair-fde-state", "...")
+	chg.AddAll(ts)
+
+	_, err = fdestate.Seal(s.st, testUUID, "run", s.profile())
+	c.Check(err, ErrorMatches, `container .* has "repair-fde-state" change in progress`)
+	_, err = fdestate.Repair(s.st)
+	c.Check(err, ErrorMatches, `"repair-fde-state" change in progress`)
+}
+
+// startUp runs the change that StartUp queues, which is returned.
+func (s *handlersSuite) startUp(c *C) *state.Change {
+	c.Assert(s.mgr.StartUp(), IsNil)
+
+	s.st.Lock()
+	var chg *state.Change
+	for _, ch := range s.st.Changes() {
+		if ch.Kind() == "verify-fde-state" {
+			c.Assert(chg, IsNil)
+			chg = ch
+		}
+	}
+	s.st.Unlock()
+	if chg == nil {
+		return nil
+	}
+
+	s.settle(c)
+
+	s.st.Lock()
+	defer s.st.Unlock()
+	c.Check(chg.Err(), IsNil)
+	c.Check(chg.IsReady(), Equals, true)
+	c.Check(chg.IsClean(), Equals, true)
+	return chg
+}
+
+func (s *handlersSuite) TestStartUpAddsNotice(c *C) {
+	s.mockDrift(c)
+
+	chg := s.startUp(c)
+	c.Assert(chg, NotNil)
+
+	s.st.Lock()
+	notices, err := noticestate.Notices(s.st, &noticestate.Filter{Types: []noticestate.Type{noticestate.StateInconsistent}})
+	c.Assert(err, IsNil)
+	var data struct {
+		Findings []*fdestate.Finding `json:"findings"`
+	}
+	c.Assert(chg.Get("api-data", &data), IsNil)
+	s.st.Unlock()
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Key, Equals, "fde")
+	c.Check(notices[0].LastData, DeepEquals, map[string]string{
+		"findings":   "6",
+		"repairable": "4",
+	})
+	c.Check(data.Findings, HasLen, 6)
+
+	// nothing is repaired
+	c.Check(filepath.Join(paths.ManagerKeysDir, testUUID+"-fallback.sealed-key"), testutil.FilePresent)
+	c.Check(s.released, HasLen, 0)
+}
+
+func (s *handlersSuite) TestStartUpConsistent(c *C) {
+	s.mockTPMSealing(c)
+	s.runSeal(c, "run")
+
+	chg := s.startUp(c)
+	c.Assert(chg, NotNil)
+
+	s.st.Lock()
+	notices, err := noticestate.Notices(s.st, nil)
+	var data map[string][]*fdestate.Finding
+	c.Assert(chg.Get("api-data", &data), IsNil)
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+	c.Check(notices, HasLen, 0)
+	c.Check(data["findings"], HasLen, 0)
+}
+
+func (s *handlersSuite) TestStartUpChangesInProgress(c *C) {
+	s.mockDrift(c)
+
+	s.st.Lock()
+	ts, err := fdestate.Seal(s.st, testUUID, "other", s.profile())
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("seal", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	// the state is not verified while it is being modified
+	c.Assert(s.startUp(c), IsNil)
+}
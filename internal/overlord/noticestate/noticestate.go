@@ -0,0 +1,335 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package noticestate implements the notices that record events of
+// interest to the users of the system, such as the recovery key
+// having been used to unlock the system.
+//
+// A notice is identified by its type and key. When the same event
+// occurs again, the existing notice is updated rather than a new one
+// being added, and it expires once the event has not occurred for a
+// while. Notices are stored in the state.
+package noticestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// Type is the type of a notice.
+type Type string
+
+const (
+	// RecoveryKeyUsed records that a container was unlocked with a
+	// recovery key at boot. The key is the container UUID.
+	RecoveryKeyUsed Type = "recovery-key-used"
+	// ResealRequired records that the TPM sealed key of a container
+	// is not expected to unseal on the next boot. The key is the
+	// container UUID.
+	ResealRequired Type = "reseal-required"
+	// SealedKeysLost records that the TPM sealed keys of a container
+	// can never be unsealed again because the TPM was cleared, which
+	// removed the storage root key and the PCR policy counters. They
+	// need to be sealed anew once the TPM is provisioned again. The
+	// key is the container UUID.
+	SealedKeysLost Type = "sealed-keys-lost"
+	// TPMLockout records that the TPM is in dictionary attack
+	// lockout mode. The key is "tpm".
+	TPMLockout Type = "tpm-lockout"
+	// DBXUpdatePending records that an update of the secure boot
+	// forbidden signature database needs to be completed. The key
+	// is the ID of the change that performs it.
+	DBXUpdatePending Type = "dbx-update-pending"
+	// StateInconsistent records that the state of the manager does
+	// not match the containers, the sealed key objects or the TPM
+	// when the daemon started. The key is "fde".
+	StateInconsistent Type = "state-inconsistent"
+)
+
+// DefaultExpireAfter is how long after it last occurred that a notice
+// expires, if not specified when it is added.
+const DefaultExpireAfter = 7 * 24 * time.Hour
+
+var timeNow = time.Now
+
+// Notice records the occurrences of an event.
+type Notice struct {
+	// ID is unique among the notices.
+	ID   string `json:"id"`
+	Type Type   `json:"type"`
+	Key  string `json:"key"`
+
+	FirstOccurred time.Time `json:"first-occurred"`
+	LastOccurred  time.Time `json:"last-occurred"`
+	// LastRepeated is the time at which the notice was last added
+	// or repeated, which is what clients wait for. It is the same as
+	// LastOccurred unless occurrences are not repeated for a while.
+	LastRepeated time.Time `json:"last-repeated"`
+	// Occurrences is the number of times the event occurred.
+	Occurrences int `json:"occurrences"`
+
+	// LastData is the data supplied with the last occurrence.
+	LastData map[string]string `json:"last-data,omitempty"`
+
+	// RepeatAfter is how long after it was last repeated that an
+	// occurrence repeats the notice.
+	RepeatAfter time.Duration `json:"repeat-after,omitempty"`
+	// ExpireAfter is how long after it last occurred that the notice
+	// expires.
+	ExpireAfter time.Duration `json:"expire-after"`
+}
+
+func (n *Notice) expired(now time.Time) bool {
+	return !n.LastOccurred.Add(n.ExpireAfter).After(now)
+}
+
+func uniqueKey(typ Type, key string) string {
+	return fmt.Sprintf("%s:%s", typ, key)
+}
+
+func allNotices(st *state.State) (map[string]*Notice, error) {
+	var notices map[string]*Notice
+	err := st.Get("notices", &notices)
+	if err != nil && !errors.Is(err, state.ErrNoState) {
+		return nil, err
+	}
+	if notices == nil {
+		notices = make(map[string]*Notice)
+	}
+	return notices, nil
+}
+
+// AddOptions holds the options for adding a notice.
+type AddOptions struct {
+	// Data is recorded as the data of the last occurrence.
+	Data map[string]string
+
+	// RepeatAfter, if not zero, prevents an occurrence from
+	// repeating the notice until it elapsed since the notice was
+	// last repeated.
+	RepeatAfter time.Duration
+
+	// ExpireAfter overrides DefaultExpireAfter.
+	ExpireAfter time.Duration
+}
+
+// AddNotice records an occurrence of the event of the specified type
+// and key, adding a notice or updating the existing one, and returns
+// the ID of the notice. Clients waiting for notices are woken up if
+// the notice is added or repeated.
+func AddNotice(st *state.State, typ Type, key string, opts *AddOptions) (string, error) {
+	if typ == "" || key == "" {
+		return "", fmt.Errorf("internal error: notice type and key must be specified")
+	}
+	if opts == nil {
+		opts = &AddOptions{}
+	}
+	expireAfter := opts.ExpireAfter
+	if expireAfter == 0 {
+		expireAfter = DefaultExpireAfter
+	}
+
+	notices, err := allNotices(st)
+	if err != nil {
+		return "", err
+	}
+	now := timeNow().UTC()
+	pruneExpired(notices, now)
+
+	n, ok := notices[uniqueKey(typ, key)]
+	repeated := true
+	if ok {
+		n.Occurrences++
+		n.LastOccurred = now
+		repeated = !now.Before(n.LastRepeated.Add(opts.RepeatAfter))
+	} else {
+		var lastID int
+		if err := st.Get("last-notice-id", &lastID); err != nil && !errors.Is(err, state.ErrNoState) {
+			return "", err
+		}
+		lastID++
+		st.Set("last-notice-id", lastID)
+
+		n = &Notice{
+			ID:            strconv.Itoa(lastID),
+			Type:          typ,
+			Key:           key,
+			FirstOccurred: now,
+			LastOccurred:  now,
+			Occurrences:   1,
+		}
+		notices[uniqueKey(typ, key)] = n
+	}
+	if repeated {
+		n.LastRepeated = now
+	}
+	n.LastData = opts.Data
+	n.RepeatAfter = opts.RepeatAfter
+	n.ExpireAfter = expireAfter
+	st.Set("notices", notices)
+
+	if repeated {
+		wakeWaiters(st)
+	}
+	return n.ID, nil
+}
+
+func pruneExpired(notices map[string]*Notice, now time.Time) {
+	for k, n := range notices {
+		if n.expired(now) {
+			delete(notices, k)
+		}
+	}
+}
+
+// Prune removes the notices that expired.
+func Prune(st *state.State) error {
+	notices, err := allNotices(st)
+	if err != nil {
+		return err
+	}
+	n := len(notices)
+	pruneExpired(notices, timeNow())
+	if len(notices) != n {
+		st.Set("notices", notices)
+	}
+	return nil
+}
+
+// Filter selects notices. Empty fields select all notices.
+type Filter struct {
+	// Types selects notices of these types.
+	Types []Type
+	// Keys selects notices with these keys.
+	Keys []string
+	// After selects notices that were last repeated after this
+	// time.
+	After time.Time
+}
+
+func (f *Filter) match(n *Notice) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, typ := range f.Types {
+			if n.Type == typ {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Keys) > 0 {
+		found := false
+		for _, key := range f.Keys {
+			if n.Key == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return f.After.IsZero() || n.LastRepeated.After(f.After)
+}
+
+// Notices returns the notices that have not expired and are selected
+// by the filter, ordered by the time they were last repeated.
+func Notices(st *state.State, filter *Filter) ([]*Notice, error) {
+	if filter == nil {
+		filter = &Filter{}
+	}
+	notices, err := allNotices(st)
+	if err != nil {
+		return nil, err
+	}
+
+	now := timeNow()
+	var l []*Notice
+	for _, n := range notices {
+		if n.expired(now) || !filter.match(n) {
+			continue
+		}
+		l = append(l, n)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if !l[i].LastRepeated.Equal(l[j].LastRepeated) {
+			return l[i].LastRepeated.Before(l[j].LastRepeated)
+		}
+		idI, _ := strconv.Atoi(l[i].ID)
+		idJ, _ := strconv.Atoi(l[j].ID)
+		return idI < idJ
+	})
+	return l, nil
+}
+
+type waitersKey struct{}
+
+// waiters is closed and replaced when a notice is added or repeated.
+type waiters struct {
+	ch chan struct{}
+}
+
+func waitersChan(st *state.State) chan struct{} {
+	w, _ := st.Cached(waitersKey{}).(*waiters)
+	if w == nil {
+		w = &waiters{ch: make(chan struct{})}
+		st.Cache(waitersKey{}, w)
+	}
+	return w.ch
+}
+
+func wakeWaiters(st *state.State) {
+	if w, _ := st.Cached(waitersKey{}).(*waiters); w != nil {
+		close(w.ch)
+		st.Cache(waitersKey{}, nil)
+	}
+}
+
+// WaitNotices returns the notices selected by the filter, waiting for
+// one to be added or repeated if there are none. It must be called
+// with the state locked, which is released while waiting. It returns
+// the error of the context if it is done before any notice is
+// selected.
+func WaitNotices(ctx context.Context, st *state.State, filter *Filter) ([]*Notice, error) {
+	for {
+		notices, err := Notices(st, filter)
+		if err != nil || len(notices) > 0 {
+			return notices, err
+		}
+
+		ch := waitersChan(st)
+		st.Unlock()
+		select {
+		case <-ch:
+			st.Lock()
+		case <-ctx.Done():
+			st.Lock()
+			return nil, ctx.Err()
+		}
+	}
+}
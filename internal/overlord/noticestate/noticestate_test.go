@@ -0,0 +1,264 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package noticestate_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type noticesSuite struct {
+	testutil.BaseTest
+
+	st  *state.State
+	now time.Time
+}
+
+var _ = Suite(&noticesSuite{})
+
+var t0 = time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC)
+
+func (s *noticesSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.st = state.New(nil)
+	s.now = t0
+	s.AddCleanup(noticestate.MockTimeNow(func() time.Time { return s.now }))
+}
+
+func (s *noticesSuite) addNotice(c *C, typ noticestate.Type, key string, opts *noticestate.AddOptions) string {
+	id, err := noticestate.AddNotice(s.st, typ, key, opts)
+	c.Assert(err, IsNil)
+	return id
+}
+
+func (s *noticesSuite) notices(c *C, filter *noticestate.Filter) []*noticestate.Notice {
+	notices, err := noticestate.Notices(s.st, filter)
+	c.Assert(err, IsNil)
+	return notices
+}
+
+func (s *noticesSuite) TestAddNotice(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	c.Check(s.notices(c, nil), HasLen, 0)
+
+	id1 := s.addNotice(c, noticestate.ResealRequired, "uuid-1", &noticestate.AddOptions{
+		Data: map[string]string{"device-path": "/dev/sda4"},
+	})
+	s.now = t0.Add(time.Minute)
+	id2 := s.addNotice(c, noticestate.TPMLockout, "tpm", nil)
+	c.Check(id1, Equals, "1")
+	c.Check(id2, Equals, "2")
+
+	c.Check(s.notices(c, nil), DeepEquals, []*noticestate.Notice{
+		{
+			ID:            "1",
+			Type:          noticestate.ResealRequired,
+			Key:           "uuid-1",
+			FirstOccurred: t0,
+			LastOccurred:  t0,
+			LastRepeated:  t0,
+			Occurrences:   1,
+			LastData:      map[string]string{"device-path": "/dev/sda4"},
+			ExpireAfter:   noticestate.DefaultExpireAfter,
+		},
+		{
+			ID:            "2",
+			Type:          noticestate.TPMLockout,
+			Key:           "tpm",
+			FirstOccurred: t0.Add(time.Minute),
+			LastOccurred:  t0.Add(time.Minute),
+			LastRepeated:  t0.Add(time.Minute),
+			Occurrences:   1,
+			ExpireAfter:   noticestate.DefaultExpireAfter,
+		},
+	})
+
+	// the notices are stored in the state
+	data, err := json.Marshal(s.st)
+	c.Assert(err, IsNil)
+	st, err := state.ReadState(nil, bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	st.Lock()
+	defer st.Unlock()
+	notices, err := noticestate.Notices(st, nil)
+	c.Assert(err, IsNil)
+	c.Check(notices, DeepEquals, s.notices(c, nil))
+}
+
+func (s *noticesSuite) TestAddNoticeRepeat(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	opts := &noticestate.AddOptions{RepeatAfter: time.Hour}
+	id := s.addNotice(c, noticestate.ResealRequired, "uuid-1", opts)
+
+	// the occurrence is counted, but the notice is not repeated yet
+	s.now = t0.Add(30 * time.Minute)
+	opts.Data = map[string]string{"foo": "bar"}
+	c.Check(s.addNotice(c, noticestate.ResealRequired, "uuid-1", opts), Equals, id)
+	notices := s.notices(c, nil)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Occurrences, Equals, 2)
+	c.Check(notices[0].FirstOccurred, Equals, t0)
+	c.Check(notices[0].LastOccurred, Equals, t0.Add(30*time.Minute))
+	c.Check(notices[0].LastRepeated, Equals, t0)
+	c.Check(notices[0].LastData, DeepEquals, map[string]string{"foo": "bar"})
+
+	s.now = t0.Add(time.Hour)
+	c.Check(s.addNotice(c, noticestate.ResealRequired, "uuid-1", opts), Equals, id)
+	notices = s.notices(c, nil)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Occurrences, Equals, 3)
+	c.Check(notices[0].LastRepeated, Equals, t0.Add(time.Hour))
+
+	// without RepeatAfter every occurrence repeats the notice
+	s.now = t0.Add(61 * time.Minute)
+	s.addNotice(c, noticestate.ResealRequired, "uuid-1", nil)
+	notices = s.notices(c, nil)
+	c.Check(notices[0].LastRepeated, Equals, t0.Add(61*time.Minute))
+}
+
+func (s *noticesSuite) TestAddNoticeInvalid(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	_, err := noticestate.AddNotice(s.st, "", "foo", nil)
+	c.Check(err, ErrorMatches, "internal error: notice type and key must be specified")
+	_, err = noticestate.AddNotice(s.st, noticestate.TPMLockout, "", nil)
+	c.Check(err, ErrorMatches, "internal error: notice type and key must be specified")
+}
+
+func (s *noticesSuite) TestExpiry(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	s.addNotice(c, noticestate.ResealRequired, "uuid-1", &noticestate.AddOptions{ExpireAfter: time.Hour})
+	s.addNotice(c, noticestate.TPMLockout, "tpm", nil)
+
+	s.now = t0.Add(time.Hour)
+	notices := s.notices(c, nil)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, noticestate.TPMLockout)
+
+	// an expired notice is replaced by a new one
+	id := s.addNotice(c, noticestate.ResealRequired, "uuid-1", nil)
+	c.Check(id, Equals, "3")
+	notices = s.notices(c, &noticestate.Filter{Types: []noticestate.Type{noticestate.ResealRequired}})
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Occurrences, Equals, 1)
+	c.Check(notices[0].FirstOccurred, Equals, t0.Add(time.Hour))
+
+	s.now = t0.Add(noticestate.DefaultExpireAfter)
+	c.Assert(noticestate.Prune(s.st), IsNil)
+	var stored map[string]*noticestate.Notice
+	c.Assert(s.st.Get("notices", &stored), IsNil)
+	c.Check(stored, HasLen, 1)
+	c.Check(stored["reseal-required:uuid-1"], NotNil)
+}
+
+func (s *noticesSuite) TestFilter(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	s.addNotice(c, noticestate.ResealRequired, "uuid-1", nil)
+	s.now = t0.Add(time.Minute)
+	s.addNotice(c, noticestate.ResealRequired, "uuid-2", nil)
+	s.now = t0.Add(2 * time.Minute)
+	s.addNotice(c, noticestate.TPMLockout, "tpm", nil)
+	// repeating a notice moves it to the end
+	s.now = t0.Add(3 * time.Minute)
+	s.addNotice(c, noticestate.ResealRequired, "uuid-1", nil)
+
+	for _, t := range []struct {
+		filter *noticestate.Filter
+		ids    []string
+	}{
+		{nil, []string{"2", "3", "1"}},
+		{&noticestate.Filter{Types: []noticestate.Type{noticestate.ResealRequired}}, []string{"2", "1"}},
+		{&noticestate.Filter{Types: []noticestate.Type{noticestate.TPMLockout, noticestate.DBXUpdatePending}}, []string{"3"}},
+		{&noticestate.Filter{Keys: []string{"uuid-2", "tpm"}}, []string{"2", "3"}},
+		{&noticestate.Filter{After: t0.Add(time.Minute)}, []string{"3", "1"}},
+		{&noticestate.Filter{After: t0.Add(3 * time.Minute)}, nil},
+		{&noticestate.Filter{Types: []noticestate.Type{noticestate.ResealRequired}, After: t0.Add(2 * time.Minute)}, []string{"1"}},
+	} {
+		var ids []string
+		for _, n := range s.notices(c, t.filter) {
+			ids = append(ids, n.ID)
+		}
+		c.Check(ids, DeepEquals, t.ids, Commentf("%+v", t.filter))
+	}
+}
+
+func (s *noticesSuite) TestWaitNotices(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	s.addNotice(c, noticestate.ResealRequired, "uuid-1", nil)
+
+	// existing notices are returned right away
+	notices, err := noticestate.WaitNotices(context.Background(), s.st, nil)
+	c.Assert(err, IsNil)
+	c.Check(notices, HasLen, 1)
+
+	go func() {
+		// notices that are not selected do not end the wait
+		time.Sleep(10 * time.Millisecond)
+		s.st.Lock()
+		s.addNotice(c, noticestate.ResealRequired, "uuid-1", nil)
+		s.st.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		s.st.Lock()
+		s.addNotice(c, noticestate.TPMLockout, "tpm", nil)
+		s.st.Unlock()
+	}()
+
+	notices, err = noticestate.WaitNotices(context.Background(), s.st, &noticestate.Filter{
+		Types: []noticestate.Type{noticestate.TPMLockout},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, noticestate.TPMLockout)
+}
+
+func (s *noticesSuite) TestWaitNoticesCancelled(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	notices, err := noticestate.WaitNotices(ctx, s.st, nil)
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(notices, HasLen, 0)
+}
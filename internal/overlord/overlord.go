@@ -37,7 +37,10 @@ import (
 	"github.com/snapcore/snapd/timings"
 	"gopkg.in/tomb.v2"
 
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
 	"github.com/snapcore/fdemanager/internal/overlord/patch"
+	"github.com/snapcore/fdemanager/internal/overlord/tpmstate"
 	"github.com/snapcore/fdemanager/internal/paths"
 )
 
@@ -69,11 +72,14 @@ type Overlord struct {
 	ensureRun   int32
 	pruneTicker *time.Ticker
 	didPrune    bool
+	startedUp   bool
 
 	// managers
 	inited     bool
 	runner     *state.TaskRunner
 	restartMgr *restart.RestartManager
+	fdeMgr     *fdestate.FDEManager
+	tpmMgr     *tpmstate.TPMManager
 }
 
 // New creates a new Overlord with all its state managers.
@@ -87,7 +93,11 @@ func New(restartHandler restart.Handler) (*Overlord, error) {
 		path:         paths.ManagerStateFile,
 		ensureBefore: o.ensureBefore,
 	}
-	s, restartMgr, err := o.loadState(backend, restartHandler)
+	curBootID, err := osutil.BootID()
+	if err != nil {
+		return nil, fmt.Errorf("fatal: cannot find current boot id: %v", err)
+	}
+	s, restartMgr, err := o.loadState(backend, curBootID, restartHandler)
 	if err != nil {
 		return nil, err
 	}
@@ -104,6 +114,20 @@ func New(restartHandler restart.Handler) (*Overlord, error) {
 	o.restartMgr = restartMgr
 	o.addManager(o.restartMgr)
 
+	fdeMgr, err := fdestate.Manager(s, o.runner)
+	if err != nil {
+		return nil, err
+	}
+	o.fdeMgr = fdeMgr
+	o.addManager(o.fdeMgr)
+
+	tpmMgr, err := tpmstate.Manager(s, o.runner)
+	if err != nil {
+		return nil, err
+	}
+	o.tpmMgr = tpmMgr
+	o.addManager(o.tpmMgr)
+
 	// the shared task runner should be added last!
 	o.addManager(o.runner)
 
@@ -122,7 +146,7 @@ func initStateFileLock() (*osutil.FileLock, error) {
 	return osutil.NewFileLockWithMode(paths.ManagerStateLockFile, 0644)
 }
 
-func (o *Overlord) loadState(backend state.Backend, restartHandler restart.Handler) (*state.State, *restart.RestartManager, error) {
+func (o *Overlord) loadState(backend state.Backend, curBootID string, restartHandler restart.Handler) (*state.State, *restart.RestartManager, error) {
 	flock, err := initStateFileLock()
 	if err != nil {
 		return nil, nil, fmt.Errorf("fatal: error opening lock file: %v", err)
@@ -145,7 +169,7 @@ func (o *Overlord) loadState(backend state.Backend, restartHandler restart.Handl
 		}
 		s := state.New(backend)
 
-		restartMgr, err := initRestart(s, restartHandler)
+		restartMgr, err := initRestart(s, curBootID, restartHandler)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -170,7 +194,7 @@ func (o *Overlord) loadState(backend state.Backend, restartHandler restart.Handl
 		return nil, nil, err
 	}
 
-	restartMgr, err := initRestart(s, restartHandler)
+	restartMgr, err := initRestart(s, curBootID, restartHandler)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -183,10 +207,21 @@ func (o *Overlord) loadState(backend state.Backend, restartHandler restart.Handl
 	return s, restartMgr, nil
 }
 
-func initRestart(s *state.State, restartHandler restart.Handler) (*restart.RestartManager, error) {
+func initRestart(s *state.State, curBootID string, restartHandler restart.Handler) (*restart.RestartManager, error) {
 	s.Lock()
 	defer s.Unlock()
-	return restart.Manager(s, "", restartHandler)
+	return restart.Manager(s, curBootID, restartHandler)
+}
+
+// StartUp proceeds to run any Overlord or managers initialization, such
+// as resuming changes that were waiting for a system restart. After
+// this is done once it is a noop.
+func (o *Overlord) StartUp() error {
+	if o.startedUp {
+		return nil
+	}
+	o.startedUp = true
+	return o.stateEng.StartUp()
 }
 
 func (o *Overlord) ensureTimerSetup() {
@@ -235,6 +270,9 @@ func (o *Overlord) prune() {
 	st := o.State()
 	st.Lock()
 	st.Prune(time.Time{}, pruneWait, abortWait, pruneMaxChanges)
+	if err := noticestate.Prune(st); err != nil {
+		logger.Noticef("cannot prune notices: %v", err)
+	}
 	st.Unlock()
 	o.didPrune = true
 }
@@ -293,6 +331,10 @@ func (o *Overlord) Stop() error {
 }
 
 func (o *Overlord) settle(timeout time.Duration, beforeCleanups func()) error {
+	if err := o.StartUp(); err != nil {
+		return err
+	}
+
 	func() {
 		o.ensureLock.Lock()
 		defer o.ensureLock.Unlock()
@@ -400,6 +442,17 @@ func (o *Overlord) RestartManager() *restart.RestartManager {
 	return o.restartMgr
 }
 
+// FDEManager returns the manager responsible for full disk
+// encryption.
+func (o *Overlord) FDEManager() *fdestate.FDEManager {
+	return o.fdeMgr
+}
+
+// TPMManager returns the manager responsible for the TPM.
+func (o *Overlord) TPMManager() *tpmstate.TPMManager {
+	return o.tpmMgr
+}
+
 // Mock creates an Overlord without any managers and with a backend
 // not using disk. Managers can be added with AddManager. For testing.
 func Mock() *Overlord {
@@ -94,6 +94,8 @@ func (s *overlordSuite) TestNew(c *C) {
 	c.Check(o.StateEngine(), NotNil)
 	c.Check(o.TaskRunner(), NotNil)
 	c.Check(o.RestartManager(), NotNil)
+	c.Check(o.FDEManager(), NotNil)
+	c.Check(o.TPMManager(), NotNil)
 
 	st := o.State()
 	c.Check(st, NotNil)
@@ -143,6 +145,56 @@ func (s *overlordSuite) TestNewWithGoodState(c *C) {
 	c.Check(got, DeepEquals, expected)
 }
 
+func (s *overlordSuite) TestNewWithPatches(c *C) {
+	p := func(s *state.State) error {
+		s.Set("patched", true)
+		return nil
+	}
+	sp := func(s *state.State) error {
+		s.Set("patched2", true)
+		return nil
+	}
+	restore := patch.Mock(2, 1, map[int][]patch.PatchFunc{2: {p, sp}})
+	defer restore()
+
+	fakeState := []byte(`{"data":{"patch-level":1, "patch-sublevel":0}}`)
+	err := ioutil.WriteFile(paths.ManagerStateFile, fakeState, 0600)
+	c.Assert(err, IsNil)
+
+	o, err := New(nil)
+	c.Assert(err, IsNil)
+
+	state := o.State()
+	state.Lock()
+	defer state.Unlock()
+
+	var level int
+	c.Assert(state.Get("patch-level", &level), IsNil)
+	c.Check(level, Equals, 2)
+
+	var sublevel int
+	c.Assert(state.Get("patch-sublevel", &sublevel), IsNil)
+	c.Check(sublevel, Equals, 1)
+
+	var b bool
+	c.Assert(state.Get("patched", &b), IsNil)
+	c.Check(b, Equals, true)
+	c.Assert(state.Get("patched2", &b), IsNil)
+	c.Check(b, Equals, true)
+}
+
+func (s *overlordSuite) TestNewWithNewerState(c *C) {
+	restore := patch.Mock(1, 0, nil)
+	defer restore()
+
+	fakeState := []byte(`{"data":{"patch-level":2, "patch-sublevel":0}}`)
+	err := ioutil.WriteFile(paths.ManagerStateFile, fakeState, 0600)
+	c.Assert(err, IsNil)
+
+	_, err = New(nil)
+	c.Assert(err, ErrorMatches, `cannot downgrade: fdemanagerd is too old for the current system state \(patch level 2\)`)
+}
+
 func (s *overlordSuite) TestNewWithInvalidState(c *C) {
 	fakeState := []byte(``)
 	err := ioutil.WriteFile(paths.ManagerStateFile, fakeState, 0600)
@@ -152,6 +204,57 @@ func (s *overlordSuite) TestNewWithInvalidState(c *C) {
 	c.Assert(err, ErrorMatches, "cannot read state: EOF")
 }
 
+func (s *overlordSuite) TestNewRestartManagerUsesBootID(c *C) {
+	curBootID, err := osutil.BootID()
+	c.Assert(err, IsNil)
+
+	o, err := New(nil)
+	c.Assert(err, IsNil)
+
+	st := o.State()
+	st.Lock()
+	defer st.Unlock()
+
+	chg := st.NewChange("change", "...")
+	t := st.NewTask("task", "...")
+	chg.AddTask(t)
+	t.SetStatus(state.DoingStatus)
+	c.Assert(restart.TaskWaitForRestart(t), IsNil)
+
+	// tasks wait for a restart from the current boot
+	var waitBootID string
+	c.Assert(t.Get("wait-for-system-restart-from-boot-id", &waitBootID), IsNil)
+	c.Check(waitBootID, Equals, curBootID)
+}
+
+func (s *overlordSuite) TestStartUpResumesTasksAfterRestart(c *C) {
+	o, err := New(nil)
+	c.Assert(err, IsNil)
+
+	st := o.State()
+	st.Lock()
+	chg := st.NewChange("change", "...")
+	t1 := st.NewTask("task", "...")
+	chg.AddTask(t1)
+	t1.SetStatus(state.DoingStatus)
+	c.Assert(restart.TaskWaitForRestart(t1), IsNil)
+	// pretend that the system rebooted
+	restart.ReplaceBootID(st, "boot-2")
+	t2 := st.NewTask("task", "...")
+	chg.AddTask(t2)
+	t2.SetStatus(state.DoingStatus)
+	c.Assert(restart.TaskWaitForRestart(t2), IsNil)
+	st.Unlock()
+
+	c.Assert(o.StartUp(), IsNil)
+
+	st.Lock()
+	defer st.Unlock()
+	c.Check(t1.Status(), Equals, state.DoStatus)
+	// this one waits for a restart of the new boot
+	c.Check(t2.Status(), Equals, state.WaitStatus)
+}
+
 type witnessManager struct {
 	state          *state.State
 	expectedEnsure int
@@ -21,10 +21,13 @@ package patch
 
 import (
 	"errors"
+	"fmt"
 
+	"github.com/snapcore/snapd/logger"
 	"github.com/snapcore/snapd/overlord/state"
 )
 
+// Level is the current implemented patch level of the state format and content.
 var Level = 1
 
 // Sublevel is the current implemented sublevel for the Level.
@@ -52,9 +55,92 @@ func Init(s *state.State) {
 	s.Set("patch-sublevel", Sublevel)
 }
 
+// applySublevelPatches applies all sublevel patches for given level, starting
+// from firstSublevel index.
+func applySublevelPatches(level, firstSublevel int, s *state.State) error {
+	for sublevel := firstSublevel; sublevel < len(patches[level]); sublevel++ {
+		if sublevel > 0 {
+			logger.Noticef("Patching system state level %d to sublevel %d...", level, sublevel)
+		}
+		err := applyOne(patches[level][sublevel], s, level, sublevel)
+		if err != nil {
+			logger.Noticef("Cannot patch: %v", err)
+			return fmt.Errorf("cannot patch system state to level %d, sublevel %d: %v", level, sublevel, err)
+		}
+	}
+	return nil
+}
+
 // Apply applies any necessary patches to update the provided state to
 // conventions required by the current patch level of the system.
-func Apply(st *state.State) error {
+func Apply(s *state.State) error {
+	var stateLevel, stateSublevel int
+	s.Lock()
+	err := s.Get("patch-level", &stateLevel)
+	if err == nil || errors.Is(err, state.ErrNoState) {
+		err = s.Get("patch-sublevel", &stateSublevel)
+	}
+	s.Unlock()
+
+	if err != nil && !errors.Is(err, state.ErrNoState) {
+		return err
+	}
+
+	if stateLevel > Level {
+		return fmt.Errorf("cannot downgrade: fdemanagerd is too old for the current system state (patch level %d)", stateLevel)
+	}
+
+	if stateLevel == Level && stateSublevel == Sublevel {
+		return nil
+	}
+
+	// downgrade within same level; update sublevel in the state so that sublevel patches
+	// are re-applied if the user refreshes to a newer patch sublevel again.
+	if stateLevel == Level && stateSublevel > Sublevel {
+		s.Lock()
+		s.Set("patch-sublevel", Sublevel)
+		s.Unlock()
+		return nil
+	}
+
+	// apply any missing sublevel patches for current state level before upgrading to new levels.
+	// the 0th sublevel patch is a patch for major level update (e.g. 2.0),
+	// therefore there is +1 for the indices.
+	if stateSublevel+1 < len(patches[stateLevel]) {
+		if err := applySublevelPatches(stateLevel, stateSublevel+1, s); err != nil {
+			return err
+		}
+	}
+
+	// at the lower Level - apply all new level and sublevel patches
+	for level := stateLevel + 1; level <= Level; level++ {
+		sublevels := patches[level]
+		logger.Noticef("Patching system state from level %d to %d", level-1, level)
+		if sublevels == nil {
+			return fmt.Errorf("cannot upgrade: fdemanagerd is too new for the current system state (patch level %d)", level-1)
+		}
+		if err := applySublevelPatches(level, 0, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyOne applies a patch and records the level and sublevel that
+// the state is at afterwards, so that it is not applied again if a
+// later patch fails.
+func applyOne(patch func(s *state.State) error, s *state.State, newLevel, newSublevel int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	err := patch(s)
+	if err != nil {
+		return err
+	}
+
+	s.Set("patch-level", newLevel)
+	s.Set("patch-sublevel", newSublevel)
 	return nil
 }
 
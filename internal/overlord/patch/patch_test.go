@@ -0,0 +1,322 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package patch_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/internal/overlord/patch"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type patchSuite struct{}
+
+var _ = Suite(&patchSuite{})
+
+func generatePatchFunc(testValue int, sequence *[]int) patch.PatchFunc {
+	return func(st *state.State) error {
+		*sequence = append(*sequence, testValue)
+		return nil
+	}
+}
+
+func patchLevel(c *C, st *state.State) (level, sublevel int) {
+	st.Lock()
+	defer st.Unlock()
+	c.Assert(st.Get("patch-level", &level), IsNil)
+	c.Assert(st.Get("patch-sublevel", &sublevel), IsNil)
+	return level, sublevel
+}
+
+func (s *patchSuite) TestInit(c *C) {
+	restore := patch.Mock(2, 1, nil)
+	defer restore()
+
+	st := state.New(nil)
+	patch.Init(st)
+
+	level, sublevel := patchLevel(c, st)
+	c.Check(level, Equals, 2)
+	c.Check(sublevel, Equals, 1)
+}
+
+func (s *patchSuite) TestNothingToDo(c *C) {
+	restore := patch.Mock(2, 1, map[int][]patch.PatchFunc{
+		2: {
+			func(*state.State) error { return fmt.Errorf("unexpected patch") },
+			func(*state.State) error { return fmt.Errorf("unexpected patch") },
+		},
+	})
+	defer restore()
+
+	st := state.New(nil)
+	st.Lock()
+	st.Set("patch-level", 2)
+	st.Set("patch-sublevel", 1)
+	st.Unlock()
+	c.Assert(patch.Apply(st), IsNil)
+}
+
+func (s *patchSuite) TestNoDowngrade(c *C) {
+	restore := patch.Mock(2, 0, nil)
+	defer restore()
+
+	st := state.New(nil)
+	st.Lock()
+	st.Set("patch-level", 3)
+	st.Unlock()
+	err := patch.Apply(st)
+	c.Assert(err, ErrorMatches, `cannot downgrade: fdemanagerd is too old for the current system state \(patch level 3\)`)
+}
+
+func (s *patchSuite) TestApply(c *C) {
+	p12 := func(st *state.State) error {
+		var n int
+		st.Get("n", &n)
+		st.Set("n", n+1)
+		return nil
+	}
+	p121 := func(st *state.State) error {
+		var o int
+		st.Get("o", &o)
+		st.Set("o", o+1)
+		return nil
+	}
+	p23 := func(st *state.State) error {
+		var n int
+		st.Get("n", &n)
+		st.Set("n", n*10)
+		return nil
+	}
+
+	// patch level 3, sublevel 0
+	restore := patch.Mock(3, 0, map[int][]patch.PatchFunc{
+		2: {p12, p121},
+		3: {p23},
+	})
+	defer restore()
+
+	st := state.New(nil)
+	st.Lock()
+	st.Set("patch-level", 1)
+	st.Unlock()
+	c.Assert(patch.Apply(st), IsNil)
+
+	level, sublevel := patchLevel(c, st)
+	c.Check(level, Equals, 3)
+	c.Check(sublevel, Equals, 0)
+
+	st.Lock()
+	defer st.Unlock()
+	var n, o int
+	c.Assert(st.Get("n", &n), IsNil)
+	c.Check(n, Equals, 10)
+	c.Assert(st.Get("o", &o), IsNil)
+	c.Check(o, Equals, 1)
+}
+
+func (s *patchSuite) TestApplyFromSublevel(c *C) {
+	var sequence []int
+	p20 := generatePatchFunc(20, &sequence)
+	p21 := generatePatchFunc(21, &sequence)
+	p22 := generatePatchFunc(22, &sequence)
+	p30 := generatePatchFunc(30, &sequence)
+	p31 := generatePatchFunc(31, &sequence)
+
+	restore := patch.Mock(3, 1, map[int][]patch.PatchFunc{
+		2: {p20, p21, p22},
+		3: {p30, p31},
+	})
+	defer restore()
+
+	// we'll be patching from 2.0 -> 3.1
+	st := state.New(nil)
+	st.Lock()
+	st.Set("patch-level", 2)
+	st.Set("patch-sublevel", 0)
+	st.Unlock()
+	c.Assert(patch.Apply(st), IsNil)
+
+	level, sublevel := patchLevel(c, st)
+	c.Check(level, Equals, 3)
+	c.Check(sublevel, Equals, 1)
+	c.Check(sequence, DeepEquals, []int{21, 22, 30, 31})
+
+	// now patching from 3.1 -> 3.2
+	sequence = nil
+	p32 := generatePatchFunc(32, &sequence)
+	restore = patch.Mock(3, 2, map[int][]patch.PatchFunc{
+		2: {p20, p21, p22},
+		3: {p30, p31, p32},
+	})
+	defer restore()
+
+	c.Assert(patch.Apply(st), IsNil)
+	c.Check(sequence, DeepEquals, []int{32})
+
+	level, sublevel = patchLevel(c, st)
+	c.Check(level, Equals, 3)
+	c.Check(sublevel, Equals, 2)
+}
+
+func (s *patchSuite) TestMissing(c *C) {
+	restore := patch.Mock(3, 0, map[int][]patch.PatchFunc{
+		3: {func(s *state.State) error { return nil }},
+	})
+	defer restore()
+
+	st := state.New(nil)
+	st.Lock()
+	st.Set("patch-level", 1)
+	st.Unlock()
+	err := patch.Apply(st)
+	c.Assert(err, ErrorMatches, `cannot upgrade: fdemanagerd is too new for the current system state \(patch level 1\)`)
+}
+
+func (s *patchSuite) TestDowngradeSublevel(c *C) {
+	restore := patch.Mock(3, 1, map[int][]patch.PatchFunc{
+		3: {func(s *state.State) error { return nil }},
+	})
+	defer restore()
+
+	st := state.New(nil)
+	st.Lock()
+	st.Set("patch-level", 3)
+	st.Set("patch-sublevel", 6)
+	st.Unlock()
+
+	// we're at patch level 3, sublevel 6 according to state, but the
+	// implemented level is 3.1, which can still run with the state
+	c.Assert(patch.Apply(st), IsNil)
+
+	level, sublevel := patchLevel(c, st)
+	c.Check(level, Equals, 3)
+	c.Check(sublevel, Equals, 1)
+}
+
+func (s *patchSuite) TestRollbackReappliesSublevelPatches(c *C) {
+	var sequence []int
+	p20 := generatePatchFunc(20, &sequence)
+	p21 := generatePatchFunc(21, &sequence)
+
+	st := state.New(nil)
+	st.Lock()
+	st.Set("patch-level", 2)
+	st.Set("patch-sublevel", 1)
+	st.Unlock()
+
+	// an older fdemanagerd that only implements 2.0 runs
+	restore := patch.Mock(2, 0, map[int][]patch.PatchFunc{
+		2: {p20},
+	})
+	c.Assert(patch.Apply(st), IsNil)
+	restore()
+	c.Check(sequence, HasLen, 0)
+
+	// and then the newer one again, which patches what the older
+	// one may have written
+	restore = patch.Mock(2, 1, map[int][]patch.PatchFunc{
+		2: {p20, p21},
+	})
+	defer restore()
+	c.Assert(patch.Apply(st), IsNil)
+	c.Check(sequence, DeepEquals, []int{21})
+
+	level, sublevel := patchLevel(c, st)
+	c.Check(level, Equals, 2)
+	c.Check(sublevel, Equals, 1)
+}
+
+func (s *patchSuite) TestError(c *C) {
+	p12 := func(st *state.State) error {
+		var n int
+		st.Get("n", &n)
+		st.Set("n", n+1)
+		return nil
+	}
+	p23 := func(st *state.State) error {
+		var n int
+		st.Get("n", &n)
+		st.Set("n", n*10)
+		return fmt.Errorf("boom")
+	}
+	p34 := func(st *state.State) error {
+		var n int
+		st.Get("n", &n)
+		st.Set("n", n*100)
+		return nil
+	}
+	restore := patch.Mock(3, 0, map[int][]patch.PatchFunc{
+		2: {p12},
+		3: {p23},
+		4: {p34},
+	})
+	defer restore()
+
+	st := state.New(nil)
+	st.Lock()
+	st.Set("patch-level", 1)
+	st.Unlock()
+	err := patch.Apply(st)
+	c.Assert(err, ErrorMatches, `cannot patch system state to level 3, sublevel 0: boom`)
+
+	// the patches that were applied are recorded
+	level, sublevel := patchLevel(c, st)
+	c.Check(level, Equals, 2)
+	c.Check(sublevel, Equals, 0)
+
+	st.Lock()
+	defer st.Unlock()
+	var n int
+	c.Assert(st.Get("n", &n), IsNil)
+	c.Check(n, Equals, 10)
+}
+
+func (s *patchSuite) TestValidity(c *C) {
+	patches := patch.PatchesForTest()
+	levels := make([]int, 0, len(patches))
+	for l := range patches {
+		levels = append(levels, l)
+	}
+	sort.Ints(levels)
+	// all steps present, level 1 being the initial state format that
+	// only has sublevel patches
+	for i, level := range levels {
+		c.Check(level, Equals, levels[0]+i)
+	}
+	if len(levels) == 0 {
+		c.Check(patch.Level, Equals, 1)
+		c.Check(patch.Sublevel, Equals, 0)
+		return
+	}
+	c.Check(levels[0] == 1 || levels[0] == 2, Equals, true)
+	// ends at implemented patch level
+	c.Check(levels[len(levels)-1], Equals, patch.Level)
+
+	// Sublevel matches the number of patches for last Level.
+	c.Check(len(patches[patch.Level])-1, Equals, patch.Sublevel)
+}
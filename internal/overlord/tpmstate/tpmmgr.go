@@ -0,0 +1,298 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpmstate
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/overlord/state"
+	"gopkg.in/tomb.v2"
+
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/tpm"
+)
+
+var (
+	tpmConnect = tpm.Connect
+	randRead   = rand.Read
+	timeNow    = time.Now
+)
+
+const (
+	// refreshInterval is how often the status of the TPM is
+	// obtained at most, unless a task changes it.
+	refreshInterval = time.Minute
+
+	// lockoutAuthSize is the size of the authorization value of
+	// the lockout hierarchy.
+	lockoutAuthSize = 32
+
+	// lockoutNoticeRepeatAfter is how often the TPM lockout notice
+	// is repeated while the TPM is in lockout mode.
+	lockoutNoticeRepeatAfter = 24 * time.Hour
+)
+
+// TPMManager is responsible for obtaining the status of the TPM and
+// for provisioning it.
+type TPMManager struct {
+	state *state.State
+
+	nextRefresh time.Time
+}
+
+// Manager returns a new TPMManager.
+func Manager(st *state.State, runner *state.TaskRunner) (*TPMManager, error) {
+	m := &TPMManager{state: st}
+
+	runner.AddHandler("provision-tpm", m.doProvision, nil)
+	runner.AddHandler("reset-tpm-lockout", m.doResetLockout, nil)
+	runner.AddHandler("clear-tpm", m.doClear, nil)
+
+	return m, nil
+}
+
+// Ensure implements StateManager.Ensure. It refreshes the recorded
+// status of the TPM, unless it was refreshed recently.
+func (m *TPMManager) Ensure() error {
+	now := timeNow()
+	if now.Before(m.nextRefresh) {
+		return nil
+	}
+	m.nextRefresh = now.Add(refreshInterval)
+
+	conn, err := tpmConnect()
+	if err != nil && !errors.Is(err, tpm.ErrNoTPM) {
+		logger.Noticef("cannot connect to TPM: %v", err)
+		return nil
+	}
+	if conn != nil {
+		defer conn.Close()
+	}
+
+	m.state.Lock()
+	defer m.state.Unlock()
+
+	if err := m.updateStatus(conn); err != nil {
+		logger.Noticef("cannot obtain TPM status: %v", err)
+	}
+	return nil
+}
+
+func readLockoutAuth() ([]byte, error) {
+	lockoutAuth, err := ioutil.ReadFile(paths.ManagerTPMLockoutAuthFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return lockoutAuth, err
+}
+
+// updateStatus records the status of the TPM obtained with conn,
+// which is nil if there is no TPM, and adds a notice if the TPM is in
+// lockout mode. It must be called with the state locked.
+func (m *TPMManager) updateStatus(conn tpm.Conn) error {
+	now := timeNow()
+	if conn == nil {
+		m.state.Set("tpm-status", &Status{LastUpdated: now})
+		return nil
+	}
+
+	s, err := conn.Status()
+	if err != nil {
+		return err
+	}
+	status := newStatus(s, osutil.FileExists(paths.ManagerTPMLockoutAuthFile), now)
+	m.state.Set("tpm-status", status)
+
+	if status.InLockout {
+		_, err := noticestate.AddNotice(m.state, noticestate.TPMLockout, "tpm", &noticestate.AddOptions{
+			Data:        map[string]string{"lockout-counter": strconv.FormatUint(uint64(status.LockoutCounter), 10)},
+			RepeatAfter: lockoutNoticeRepeatAfter,
+		})
+		if err != nil {
+			logger.Noticef("cannot record TPM lockout notice: %v", err)
+		}
+	}
+	return nil
+}
+
+// withTPM runs f with a connection to the TPM without holding the
+// state lock, and then updates the recorded status of the TPM. It
+// must be called with the state locked.
+func (m *TPMManager) withTPM(f func(conn tpm.Conn, status *tpm.Status) error) error {
+	m.state.Unlock()
+	defer m.state.Lock()
+
+	conn, err := tpmConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	status, err := conn.Status()
+	if err != nil {
+		return fmt.Errorf("cannot obtain TPM status: %v", err)
+	}
+	err = f(conn, status)
+
+	m.state.Lock()
+	if err := m.updateStatus(conn); err != nil {
+		logger.Noticef("cannot obtain TPM status: %v", err)
+	}
+	m.state.Unlock()
+	return err
+}
+
+// lockoutAuth returns the authorization value of the lockout hierarchy,
+// which is empty if it isn't set.
+func lockoutAuth(status *tpm.Status) ([]byte, error) {
+	if !status.LockoutAuthSet {
+		return nil, nil
+	}
+	lockoutAuth, err := readLockoutAuth()
+	if err != nil {
+		return nil, err
+	}
+	if lockoutAuth == nil {
+		return nil, fmt.Errorf("the authorization value of the TPM lockout hierarchy was not set by the manager")
+	}
+	return lockoutAuth, nil
+}
+
+func (m *TPMManager) doProvision(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	// the task records once the TPM uses the new authorization
+	// value, so that a retry never authorizes with a value that may
+	// be wrong, which would lock the lockout hierarchy out
+	var authChanged bool
+	if err := t.Get("lockout-auth-changed", &authChanged); err != nil && !errors.Is(err, state.ErrNoState) {
+		return err
+	}
+
+	return m.withTPM(func(conn tpm.Conn, status *tpm.Status) error {
+		newFile := paths.ManagerTPMLockoutAuthFile + ".new"
+		if authChanged {
+			// the new value is only left to be recorded
+			if err := os.Rename(newFile, paths.ManagerTPMLockoutAuthFile); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+
+		current, err := lockoutAuth(status)
+		if err != nil {
+			return fmt.Errorf("cannot provision TPM: %v", err)
+		}
+
+		// the new value is left behind if provisioning was
+		// interrupted before the TPM started using it, in which
+		// case it is set again
+		newLockoutAuth, err := ioutil.ReadFile(newFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(newLockoutAuth) == 0 {
+			newLockoutAuth = make([]byte, lockoutAuthSize)
+			if _, err := randRead(newLockoutAuth); err != nil {
+				return fmt.Errorf("cannot generate lockout authorization value: %v", err)
+			}
+			// the new value is written before the TPM is
+			// modified so that it is not lost if writing it
+			// fails or provisioning is interrupted
+			if err := os.MkdirAll(filepath.Dir(newFile), 0700); err != nil {
+				return err
+			}
+			if err := osutil.AtomicWriteFile(newFile, newLockoutAuth, 0600, 0); err != nil {
+				return err
+			}
+		}
+		if err := conn.Provision(current, newLockoutAuth, &tpm.DefaultDAParams); err != nil {
+			// the new value is only dropped if the TPM
+			// certainly didn't start using it
+			if errors.Is(err, tpm.ErrLockoutAuthFail) || errors.Is(err, tpm.ErrLockoutUnavailable) {
+				os.Remove(newFile)
+			}
+			return fmt.Errorf("cannot provision TPM: %w", err)
+		}
+
+		// the state is written when it is unlocked
+		st.Lock()
+		t.Set("lockout-auth-changed", true)
+		st.Unlock()
+
+		return os.Rename(newFile, paths.ManagerTPMLockoutAuthFile)
+	})
+}
+
+func (m *TPMManager) doResetLockout(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	return m.withTPM(func(conn tpm.Conn, status *tpm.Status) error {
+		current, err := lockoutAuth(status)
+		if err != nil {
+			return fmt.Errorf("cannot reset TPM lockout: %v", err)
+		}
+		return conn.ResetLockout(current)
+	})
+}
+
+func (m *TPMManager) doClear(t *state.Task, _ *tomb.Tomb) error {
+	st := t.State()
+	st.Lock()
+	defer st.Unlock()
+
+	cleared := false
+	err := m.withTPM(func(conn tpm.Conn, status *tpm.Status) error {
+		current, err := lockoutAuth(status)
+		if err != nil {
+			return fmt.Errorf("cannot clear TPM: %v", err)
+		}
+		if err := conn.Clear(current); err != nil {
+			return err
+		}
+		cleared = true
+		if err := os.Remove(paths.ManagerTPMLockoutAuthFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if cleared {
+		// the sealed keys are lost
+		if err := fdestate.TPMCleared(st); err != nil {
+			logger.Noticef("cannot record that the TPM sealed keys are lost: %v", err)
+		}
+	}
+	return err
+}
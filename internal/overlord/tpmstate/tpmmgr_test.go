@@ -0,0 +1,446 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpmstate_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/testutil"
+
+	"github.com/snapcore/fdemanager/internal/overlord"
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/overlord/noticestate"
+	"github.com/snapcore/fdemanager/internal/overlord/tpmstate"
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/tpm"
+	"github.com/snapcore/fdemanager/internal/tpm/tpmtest"
+)
+
+func TestTPMState(t *testing.T) { TestingT(t) }
+
+type tpmMgrSuite struct {
+	testutil.BaseTest
+
+	o   *overlord.Overlord
+	st  *state.State
+	mgr *tpmstate.TPMManager
+
+	tpm *tpmtest.TPM
+	now time.Time
+}
+
+var _ = Suite(&tpmMgrSuite{})
+
+var lockoutAuth = []byte("0123456789abcdef0123456789abcdef")
+
+func (s *tpmMgrSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.AddCleanup(paths.MockRootDir(c.MkDir()))
+
+	s.tpm = tpmtest.New()
+	s.AddCleanup(tpmtest.Mock(s.tpm))
+	s.AddCleanup(tpmstate.MockRandRead(func(b []byte) (int, error) {
+		return copy(b, lockoutAuth), nil
+	}))
+	s.now = time.Date(2023, 10, 16, 12, 0, 0, 0, time.UTC)
+	s.AddCleanup(tpmstate.MockTimeNow(func() time.Time { return s.now }))
+
+	s.o = overlord.Mock()
+	s.st = s.o.State()
+	mgr, err := tpmstate.Manager(s.st, s.o.TaskRunner())
+	c.Assert(err, IsNil)
+	s.mgr = mgr
+	s.o.AddManager(s.mgr)
+	s.o.AddManager(s.o.TaskRunner())
+}
+
+func (s *tpmMgrSuite) status(c *C) *tpmstate.Status {
+	s.st.Lock()
+	defer s.st.Unlock()
+	status, err := tpmstate.GetStatus(s.st)
+	c.Assert(err, IsNil)
+	return status
+}
+
+func (s *tpmMgrSuite) notices(c *C) []*noticestate.Notice {
+	s.st.Lock()
+	defer s.st.Unlock()
+	notices, err := noticestate.Notices(s.st, nil)
+	c.Assert(err, IsNil)
+	return notices
+}
+
+func (s *tpmMgrSuite) runChange(c *C, f func(st *state.State) (*state.TaskSet, error)) *state.Change {
+	s.st.Lock()
+	ts, err := f(s.st)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("tpm", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	c.Assert(s.o.Settle(testutil.HostScaledTimeout(15*time.Second)), IsNil)
+	c.Check(s.tpm.Connections, Equals, 0)
+	return chg
+}
+
+func (s *tpmMgrSuite) TestEnsureStatus(c *C) {
+	c.Check(s.status(c), DeepEquals, &tpmstate.Status{})
+
+	c.Assert(s.mgr.Ensure(), IsNil)
+	c.Check(s.status(c), DeepEquals, &tpmstate.Status{
+		Present:         true,
+		Manufacturer:    "IBM",
+		FirmwareVersion: "8217.4131.22.13878",
+		MaxTries:        3,
+		RecoveryTime:    1000 * time.Second,
+		LastUpdated:     s.now,
+	})
+	c.Check(s.tpm.Connections, Equals, 0)
+	c.Check(s.notices(c), HasLen, 0)
+
+	// the status is not refreshed again right away
+	s.tpm.InLockout = true
+	s.tpm.LockoutCounter = 3
+	c.Assert(s.mgr.Ensure(), IsNil)
+	c.Check(s.status(c).InLockout, Equals, false)
+
+	s.now = s.now.Add(time.Minute)
+	c.Assert(s.mgr.Ensure(), IsNil)
+	status := s.status(c)
+	c.Check(status.InLockout, Equals, true)
+	c.Check(status.LockoutCounter, Equals, uint32(3))
+	c.Check(status.LastUpdated, Equals, s.now)
+
+	notices := s.notices(c)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, noticestate.TPMLockout)
+	c.Check(notices[0].Key, Equals, "tpm")
+	c.Check(notices[0].LastData, DeepEquals, map[string]string{"lockout-counter": "3"})
+}
+
+func (s *tpmMgrSuite) TestEnsureNoTPM(c *C) {
+	s.tpm.Err = tpm.ErrNoTPM
+
+	c.Assert(s.mgr.Ensure(), IsNil)
+	c.Check(s.status(c), DeepEquals, &tpmstate.Status{LastUpdated: s.now})
+}
+
+func (s *tpmMgrSuite) TestEnsureError(c *C) {
+	s.tpm.Err = errors.New("boom")
+
+	c.Assert(s.mgr.Ensure(), IsNil)
+	c.Check(s.status(c), DeepEquals, &tpmstate.Status{})
+}
+
+func (s *tpmMgrSuite) TestProvision(c *C) {
+	chg := s.runChange(c, tpmstate.Provision)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	c.Check(s.tpm.LockoutAuth, DeepEquals, lockoutAuth)
+	c.Check(s.tpm.SRKPresent, Equals, true)
+	c.Check(s.tpm.DAParams, DeepEquals, tpm.DefaultDAParams)
+	c.Check(paths.ManagerTPMLockoutAuthFile, testutil.FileEquals, lockoutAuth)
+	c.Check(paths.ManagerTPMLockoutAuthFile+".new", testutil.FileAbsent)
+
+	status := s.status(c)
+	c.Check(status.Owned, Equals, true)
+	c.Check(status.LockoutAuthKnown, Equals, true)
+	c.Check(status.MaxTries, Equals, uint32(32))
+
+	// provisioning again changes the authorization value
+	newLockoutAuth := []byte("fedcba9876543210fedcba9876543210")
+	s.AddCleanup(tpmstate.MockRandRead(func(b []byte) (int, error) {
+		return copy(b, newLockoutAuth), nil
+	}))
+	chg = s.runChange(c, tpmstate.Provision)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+	c.Check(s.tpm.LockoutAuth, DeepEquals, newLockoutAuth)
+	c.Check(paths.ManagerTPMLockoutAuthFile, testutil.FileEquals, newLockoutAuth)
+}
+
+func (s *tpmMgrSuite) TestProvisionLockoutAuthSetByOthers(c *C) {
+	s.tpm.LockoutAuth = []byte("other")
+
+	chg := s.runChange(c, tpmstate.Provision)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot provision TPM: the authorization value of the TPM lockout hierarchy was not set by the manager.*`)
+	s.st.Unlock()
+	c.Check(s.tpm.LockoutAuth, DeepEquals, []byte("other"))
+	c.Check(paths.ManagerTPMLockoutAuthFile, testutil.FileAbsent)
+
+	status := s.status(c)
+	c.Check(status.LockoutAuthSet, Equals, true)
+	c.Check(status.LockoutAuthKnown, Equals, false)
+}
+
+func (s *tpmMgrSuite) mockProvisioned(c *C) {
+	s.tpm.LockoutAuth = lockoutAuth
+	s.tpm.SRKPresent = true
+	c.Assert(os.MkdirAll(paths.ManagerStateDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(paths.ManagerTPMLockoutAuthFile, lockoutAuth, 0600), IsNil)
+}
+
+func (s *tpmMgrSuite) TestProvisionWrongLockoutAuth(c *C) {
+	s.mockProvisioned(c)
+	s.tpm.LockoutAuth = []byte("other")
+
+	chg := s.runChange(c, tpmstate.Provision)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot provision TPM: the authorization value of the TPM lockout hierarchy is wrong.*`)
+	s.st.Unlock()
+	// the current value is kept
+	c.Check(paths.ManagerTPMLockoutAuthFile, testutil.FileEquals, lockoutAuth)
+	c.Check(paths.ManagerTPMLockoutAuthFile+".new", testutil.FileAbsent)
+}
+
+func (s *tpmMgrSuite) mockPendingLockoutAuth(c *C, pending []byte) {
+	s.mockProvisioned(c)
+	c.Assert(ioutil.WriteFile(paths.ManagerTPMLockoutAuthFile+".new", pending, 0600), IsNil)
+	s.AddCleanup(tpmstate.MockRandRead(func(b []byte) (int, error) {
+		c.Error("unexpected new authorization value")
+		return 0, errors.New("unexpected")
+	}))
+}
+
+func (s *tpmMgrSuite) TestProvisionInterruptedAfterTPM(c *C) {
+	pending := []byte("fedcba9876543210fedcba9876543210")
+	s.mockPendingLockoutAuth(c, pending)
+	// the TPM was provisioned but the new value wasn't recorded
+	s.tpm.LockoutAuth = pending
+
+	s.st.Lock()
+	ts, err := tpmstate.Provision(s.st)
+	c.Assert(err, IsNil)
+	ts.Tasks()[0].Set("lockout-auth-changed", true)
+	chg := s.st.NewChange("tpm", "...")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	c.Assert(s.o.Settle(testutil.HostScaledTimeout(15*time.Second)), IsNil)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+	c.Check(s.tpm.LockoutUnavailable, Equals, false)
+	c.Check(s.tpm.LockoutAuth, DeepEquals, pending)
+	c.Check(paths.ManagerTPMLockoutAuthFile, testutil.FileEquals, pending)
+	c.Check(paths.ManagerTPMLockoutAuthFile+".new", testutil.FileAbsent)
+	c.Check(s.status(c).LockoutAuthKnown, Equals, true)
+}
+
+func (s *tpmMgrSuite) TestProvisionInterruptedBeforeTPM(c *C) {
+	pending := []byte("fedcba9876543210fedcba9876543210")
+	s.mockPendingLockoutAuth(c, pending)
+
+	chg := s.runChange(c, tpmstate.Provision)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	c.Check(chg.Tasks()[0].Get("lockout-auth-changed", new(bool)), IsNil)
+	s.st.Unlock()
+	// the TPM is authorized with the recorded value and the
+	// pending one is set
+	c.Check(s.tpm.LockoutUnavailable, Equals, false)
+	c.Check(s.tpm.LockoutAuth, DeepEquals, pending)
+	c.Check(paths.ManagerTPMLockoutAuthFile, testutil.FileEquals, pending)
+	c.Check(paths.ManagerTPMLockoutAuthFile+".new", testutil.FileAbsent)
+}
+
+func (s *tpmMgrSuite) TestProvisionInterruptedNoLockoutAuth(c *C) {
+	pending := []byte("fedcba9876543210fedcba9876543210")
+	c.Assert(os.MkdirAll(paths.ManagerStateDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(paths.ManagerTPMLockoutAuthFile+".new", pending, 0600), IsNil)
+	s.AddCleanup(tpmstate.MockRandRead(func(b []byte) (int, error) {
+		c.Error("unexpected new authorization value")
+		return 0, errors.New("unexpected")
+	}))
+
+	chg := s.runChange(c, tpmstate.Provision)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+	// the pending value is set rather than a new one
+	c.Check(s.tpm.LockoutAuth, DeepEquals, pending)
+	c.Check(paths.ManagerTPMLockoutAuthFile, testutil.FileEquals, pending)
+	c.Check(paths.ManagerTPMLockoutAuthFile+".new", testutil.FileAbsent)
+}
+
+func (s *tpmMgrSuite) TestResetLockout(c *C) {
+	s.mockProvisioned(c)
+	s.tpm.InLockout = true
+	s.tpm.LockoutCounter = 3
+
+	chg := s.runChange(c, tpmstate.ResetLockout)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+	c.Check(s.tpm.InLockout, Equals, false)
+	c.Check(s.tpm.LockoutCounter, Equals, uint32(0))
+
+	status := s.status(c)
+	c.Check(status.InLockout, Equals, false)
+	c.Check(status.LockoutCounter, Equals, uint32(0))
+}
+
+func (s *tpmMgrSuite) TestResetLockoutUnavailable(c *C) {
+	s.mockProvisioned(c)
+	s.tpm.InLockout = true
+	s.tpm.LockoutUnavailable = true
+
+	chg := s.runChange(c, tpmstate.ResetLockout)
+
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*the TPM lockout hierarchy is unavailable until the lockout recovery time elapses.*`)
+	s.st.Unlock()
+	c.Check(s.tpm.InLockout, Equals, true)
+}
+
+func (s *tpmMgrSuite) TestClear(c *C) {
+	s.mockProvisioned(c)
+
+	chg := s.runChange(c, tpmstate.Clear)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+	c.Check(s.tpm.LockoutAuth, IsNil)
+	c.Check(s.tpm.SRKPresent, Equals, false)
+	c.Check(paths.ManagerTPMLockoutAuthFile, testutil.FileAbsent)
+
+	status := s.status(c)
+	c.Check(status.Owned, Equals, false)
+	c.Check(status.LockoutAuthKnown, Equals, false)
+}
+
+func (s *tpmMgrSuite) TestClearSealedKeysLost(c *C) {
+	s.mockProvisioned(c)
+	s.st.Lock()
+	for _, container := range []*fdestate.Container{{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "run", Protector: fdestate.ProtectorTPM},
+			{Slot: 1, Name: "default-recovery", Protector: fdestate.ProtectorRecoveryKey},
+		},
+	}, {
+		DevicePath: "/dev/sda5",
+		UUID:       "5a5ae4a0-d9b6-477f-9b0b-2bcd0cc9dc4d",
+		Keyslots: []*fdestate.Keyslot{
+			{Slot: 0, Name: "user", Protector: fdestate.ProtectorPassphrase},
+		},
+	}} {
+		c.Assert(fdestate.SetContainer(s.st, container), IsNil)
+	}
+	s.st.Unlock()
+
+	chg := s.runChange(c, tpmstate.Clear)
+
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+
+	// the keys sealed with the TPM cannot be resealed
+	notices := s.notices(c)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Type, Equals, noticestate.SealedKeysLost)
+	c.Check(notices[0].Key, Equals, "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	c.Check(notices[0].LastData, DeepEquals, map[string]string{
+		"device-path": "/dev/sda4",
+		"keyslots":    "run",
+	})
+}
+
+func (s *tpmMgrSuite) TestClearFDEChangeConflict(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	t := s.st.NewTask("reseal-key", "...")
+	t.Set("container", "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21")
+	chg := s.st.NewChange("reseal", "...")
+	chg.AddTask(t)
+	c.Assert(fdestate.SetContainer(s.st, &fdestate.Container{
+		DevicePath: "/dev/sda4",
+		UUID:       "7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21",
+	}), IsNil)
+
+	_, err := tpmstate.Clear(s.st)
+	c.Check(err, ErrorMatches, `container 7eebd2a4-4e45-4c1a-a8d1-3f0d4e5b8a21 has "reseal" change in progress`)
+	c.Check(err, FitsTypeOf, &fdestate.ChangeConflictError{})
+
+	// resetting the lockout does not affect the sealed keys
+	_, err = tpmstate.ResetLockout(s.st)
+	c.Check(err, IsNil)
+
+	t.SetStatus(state.DoneStatus)
+	_, err = tpmstate.Clear(s.st)
+	c.Check(err, IsNil)
+}
+
+func (s *tpmMgrSuite) TestTaskNoTPM(c *C) {
+	s.tpm.Err = tpm.ErrNoTPM
+
+	chg := s.runChange(c, tpmstate.Provision)
+
+	s.st.Lock()
+	defer s.st.Unlock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*no TPM2 device is available.*`)
+}
+
+func (s *tpmMgrSuite) TestChangeConflict(c *C) {
+	s.st.Lock()
+	defer s.st.Unlock()
+
+	ts, err := tpmstate.Provision(s.st)
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("provision-tpm", "...")
+	chg.AddAll(ts)
+
+	for _, f := range []func(*state.State) (*state.TaskSet, error){
+		tpmstate.Provision,
+		tpmstate.ResetLockout,
+		tpmstate.Clear,
+	} {
+		_, err = f(s.st)
+		c.Check(err, DeepEquals, &tpmstate.ChangeConflictError{ChangeKind: "provision-tpm", ChangeID: chg.ID()})
+		c.Check(err, ErrorMatches, `TPM has "provision-tpm" change in progress`)
+	}
+
+	chg.SetStatus(state.DoneStatus)
+	_, err = tpmstate.Clear(s.st)
+	c.Check(err, IsNil)
+}
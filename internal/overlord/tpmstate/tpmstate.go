@@ -0,0 +1,155 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package tpmstate implements the manager and state aspects
+// responsible for the TPM of the system.
+package tpmstate
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/snapcore/snapd/overlord/state"
+
+	"github.com/snapcore/fdemanager/internal/overlord/fdestate"
+	"github.com/snapcore/fdemanager/internal/tpm"
+)
+
+// Status holds the state of the TPM, as last obtained by the manager.
+type Status struct {
+	// Present indicates whether the system has a TPM2 device.
+	Present         bool   `json:"present"`
+	Manufacturer    string `json:"manufacturer,omitempty"`
+	FirmwareVersion string `json:"firmware-version,omitempty"`
+
+	// Owned indicates whether the TPM is provisioned, with the
+	// authorization value of the lockout hierarchy set and the
+	// storage root key persisted.
+	Owned          bool `json:"owned"`
+	LockoutAuthSet bool `json:"lockout-auth-set"`
+	SRKPresent     bool `json:"srk-present"`
+	// LockoutAuthKnown indicates whether the manager holds the
+	// authorization value of the lockout hierarchy, which is
+	// required to reset the lockout and clear the TPM.
+	LockoutAuthKnown bool `json:"lockout-auth-known"`
+
+	InLockout       bool          `json:"in-lockout"`
+	LockoutCounter  uint32        `json:"lockout-counter"`
+	MaxTries        uint32        `json:"max-tries"`
+	RecoveryTime    time.Duration `json:"recovery-time"`
+	LockoutRecovery time.Duration `json:"lockout-recovery"`
+
+	// LastUpdated is zero if the status was not obtained yet.
+	LastUpdated time.Time `json:"last-updated"`
+}
+
+func newStatus(s *tpm.Status, lockoutAuthKnown bool, now time.Time) *Status {
+	return &Status{
+		Present:          true,
+		Manufacturer:     s.Manufacturer,
+		FirmwareVersion:  s.FirmwareVersion,
+		Owned:            s.Owned(),
+		LockoutAuthSet:   s.LockoutAuthSet,
+		SRKPresent:       s.SRKPresent,
+		LockoutAuthKnown: lockoutAuthKnown,
+		InLockout:        s.InLockout,
+		LockoutCounter:   s.LockoutCounter,
+		MaxTries:         s.DAParams.MaxTries,
+		RecoveryTime:     s.DAParams.RecoveryTime,
+		LockoutRecovery:  s.DAParams.LockoutRecovery,
+		LastUpdated:      now,
+	}
+}
+
+// GetStatus returns the state of the TPM.
+func GetStatus(st *state.State) (*Status, error) {
+	var status Status
+	err := st.Get("tpm-status", &status)
+	if err != nil && !errors.Is(err, state.ErrNoState) {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ChangeConflictError is returned when a change cannot be created
+// because another change is already operating on the TPM.
+type ChangeConflictError struct {
+	ChangeKind string
+	ChangeID   string
+}
+
+func (e *ChangeConflictError) Error() string {
+	return fmt.Sprintf("TPM has %q change in progress", e.ChangeKind)
+}
+
+var tpmTaskKinds = map[string]bool{
+	"provision-tpm":     true,
+	"reset-tpm-lockout": true,
+	"clear-tpm":         true,
+}
+
+// checkChangeConflict returns a *ChangeConflictError if there is an
+// in-progress change that operates on the TPM.
+func checkChangeConflict(st *state.State) error {
+	for _, chg := range st.Changes() {
+		if chg.IsReady() {
+			continue
+		}
+		for _, t := range chg.Tasks() {
+			if tpmTaskKinds[t.Kind()] {
+				return &ChangeConflictError{ChangeKind: chg.Kind(), ChangeID: chg.ID()}
+			}
+		}
+	}
+	return nil
+}
+
+func tpmTask(st *state.State, kind, summary string) (*state.TaskSet, error) {
+	if err := checkChangeConflict(st); err != nil {
+		return nil, err
+	}
+	return state.NewTaskSet(st.NewTask(kind, summary)), nil
+}
+
+// Provision returns a set of tasks that provisions the TPM: it
+// persists the storage root key, sets the dictionary attack protection
+// parameters and sets the authorization value of the lockout hierarchy
+// to a new random value held by the manager. A TPM that is already
+// provisioned by the manager gets a new authorization value.
+func Provision(st *state.State) (*state.TaskSet, error) {
+	return tpmTask(st, "provision-tpm", "Provision the TPM")
+}
+
+// ResetLockout returns a set of tasks that takes the TPM out of
+// dictionary attack lockout mode.
+func ResetLockout(st *state.State) (*state.TaskSet, error) {
+	return tpmTask(st, "reset-tpm-lockout", "Reset the TPM dictionary attack lockout")
+}
+
+// Clear returns a set of tasks that clears the TPM, which makes the
+// keys sealed with it unusable. It returns a *fdestate.ChangeConflictError
+// while any change of the FDE manager is in progress, as these use the
+// TPM too.
+func Clear(st *state.State) (*state.TaskSet, error) {
+	if err := fdestate.CheckChangeConflict(st); err != nil {
+		return nil, err
+	}
+	return tpmTask(st, "clear-tpm", "Clear the TPM")
+}
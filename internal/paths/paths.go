@@ -21,6 +21,7 @@ package paths
 
 import (
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -31,6 +32,29 @@ var (
 	ManagerStateDir      string
 	ManagerStateFile     string
 	ManagerStateLockFile string
+	ManagerKeysDir       string
+	ManagerAuditLogFile  string
+
+	// ManagerTPMLockoutAuthFile holds the authorization value of
+	// the TPM lockout hierarchy once the TPM is provisioned.
+	ManagerTPMLockoutAuthFile string
+
+	// ManagerDBXUpdatesDir holds the forbidden signature database
+	// updates that are being applied.
+	ManagerDBXUpdatesDir string
+
+	// BootUnlockStateFile is written during boot by the hook that
+	// unlocks the encrypted containers.
+	BootUnlockStateFile string
+
+	SysfsDir string
+	ProcDir  string
+
+	// EventLogFile is the TCG event log of the current boot.
+	EventLogFile string
+
+	// EFIVarsDir is where efivarfs is mounted.
+	EFIVarsDir string
 )
 
 func init() {
@@ -43,14 +67,53 @@ func reinit() {
 	ManagerStateDir = filepath.Join(rootdir, "var/lib/fdemanagerd")
 	ManagerStateFile = filepath.Join(ManagerStateDir, "state.json")
 	ManagerStateLockFile = filepath.Join(ManagerStateDir, "state.lock")
+	// in install mode, the sealed key objects are written to the
+	// target system while the rest of the state, which belongs to
+	// the daemon running on the installer, is not
+	ManagerKeysDir = filepath.Join(ManagerStateDir, "keys")
+	if targetRootdir != "" {
+		ManagerKeysDir = filepath.Join(targetRootdir, "var/lib/fdemanagerd/keys")
+	}
+	ManagerAuditLogFile = filepath.Join(ManagerStateDir, "audit.log")
+	ManagerTPMLockoutAuthFile = filepath.Join(ManagerStateDir, "tpm-lockout-auth")
+	ManagerDBXUpdatesDir = filepath.Join(ManagerStateDir, "dbx-updates")
+
+	BootUnlockStateFile = filepath.Join(rootdir, "run/fdemanagerd/boot-unlock.json")
 
-	SetTargetRootDir(targetRootdir)
+	SysfsDir = filepath.Join(rootdir, "sys")
+	ProcDir = filepath.Join(rootdir, "proc")
+
+	EventLogFile = filepath.Join(SysfsDir, "kernel/security/tpm0/binary_bios_measurements")
+	EFIVarsDir = filepath.Join(SysfsDir, "firmware/efi/efivars")
 }
 
 // SetTargetRootDir sets the root directory of the target system
-// in which state will be stored during installation.
+// in which the sealed key objects will be stored during
+// installation. An empty target leaves install mode.
 func SetTargetRootDir(target string) {
 	targetRootdir = target
+	reinit()
+}
+
+// TargetRootDir returns the root directory of the target system, or
+// an empty string if not in install mode.
+func TargetRootDir() string {
+	return targetRootdir
+}
+
+// InstalledPath returns the path that a file written under the
+// target root directory will have on the installed system. Outside
+// of install mode, and for paths outside of the target root
+// directory, path is returned unchanged.
+func InstalledPath(path string) string {
+	if targetRootdir == "" {
+		return path
+	}
+	rel, err := filepath.Rel(targetRootdir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	return filepath.Join("/", rel)
 }
 
 func MockRootDir(dir string) (restore func()) {
@@ -38,4 +38,44 @@ func (s *pathsSuite) TestDefault(c *C) {
 	c.Check(ManagerStateDir, Equals, "/var/lib/fdemanagerd")
 	c.Check(ManagerStateFile, Equals, "/var/lib/fdemanagerd/state.json")
 	c.Check(ManagerStateLockFile, Equals, "/var/lib/fdemanagerd/state.lock")
+	c.Check(ManagerKeysDir, Equals, "/var/lib/fdemanagerd/keys")
+	c.Check(ManagerAuditLogFile, Equals, "/var/lib/fdemanagerd/audit.log")
+	c.Check(ManagerTPMLockoutAuthFile, Equals, "/var/lib/fdemanagerd/tpm-lockout-auth")
+	c.Check(ManagerDBXUpdatesDir, Equals, "/var/lib/fdemanagerd/dbx-updates")
+	c.Check(BootUnlockStateFile, Equals, "/run/fdemanagerd/boot-unlock.json")
+	c.Check(SysfsDir, Equals, "/sys")
+	c.Check(ProcDir, Equals, "/proc")
+	c.Check(EventLogFile, Equals, "/sys/kernel/security/tpm0/binary_bios_measurements")
+	c.Check(EFIVarsDir, Equals, "/sys/firmware/efi/efivars")
+}
+
+func (s *pathsSuite) TestTargetRootDir(c *C) {
+	restore := MockRootDir("/installer")
+	defer restore()
+	SetTargetRootDir("/target")
+	defer SetTargetRootDir("")
+
+	c.Check(TargetRootDir(), Equals, "/target")
+	c.Check(ManagerKeysDir, Equals, "/target/var/lib/fdemanagerd/keys")
+	// the daemon itself runs on the installer, and its state is not
+	// on a filesystem that is being formatted
+	c.Check(ManagerStateDir, Equals, "/installer/var/lib/fdemanagerd")
+	c.Check(ManagerStateFile, Equals, "/installer/var/lib/fdemanagerd/state.json")
+	c.Check(ManagerStateLockFile, Equals, "/installer/var/lib/fdemanagerd/state.lock")
+	c.Check(ManagerAuditLogFile, Equals, "/installer/var/lib/fdemanagerd/audit.log")
+	c.Check(ManagerTPMLockoutAuthFile, Equals, "/installer/var/lib/fdemanagerd/tpm-lockout-auth")
+	c.Check(ManagerDBXUpdatesDir, Equals, "/installer/var/lib/fdemanagerd/dbx-updates")
+	c.Check(ManagerSocket, Equals, "/installer/run/fdemanagerd.socket")
+	c.Check(BootUnlockStateFile, Equals, "/installer/run/fdemanagerd/boot-unlock.json")
+	c.Check(SysfsDir, Equals, "/installer/sys")
+
+	c.Check(InstalledPath("/target/var/lib/fdemanagerd/keys/foo"), Equals, "/var/lib/fdemanagerd/keys/foo")
+	c.Check(InstalledPath("/target"), Equals, "/")
+	c.Check(InstalledPath("/targets/foo"), Equals, "/targets/foo")
+	c.Check(InstalledPath("/boot/efi"), Equals, "/boot/efi")
+
+	SetTargetRootDir("")
+	c.Check(TargetRootDir(), Equals, "")
+	c.Check(ManagerKeysDir, Equals, "/installer/var/lib/fdemanagerd/keys")
+	c.Check(InstalledPath("/target/foo"), Equals, "/target/foo")
 }
@@ -0,0 +1,109 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017-2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package polkit asks the polkit authority whether a process is
+// authorized to perform an action.
+package polkit
+
+import (
+	"errors"
+
+	"github.com/godbus/dbus"
+	"github.com/snapcore/snapd/dbusutil"
+
+	"github.com/snapcore/fdemanager/internal/procfs"
+)
+
+// CheckFlags modify the behaviour of an authorization check.
+type CheckFlags uint32
+
+const (
+	CheckNone             CheckFlags = 0x00
+	CheckAllowInteraction CheckFlags = 0x01
+)
+
+var (
+	// ErrDismissed is returned when the user dismissed an interactive
+	// authentication prompt.
+	ErrDismissed = errors.New("authorization request dismissed")
+	// ErrInteraction is returned when the action could be authorized
+	// if the user authenticated interactively.
+	ErrInteraction = errors.New("authorization requires interaction")
+)
+
+type authSubject struct {
+	Kind    string
+	Details map[string]dbus.Variant
+}
+
+type authResult struct {
+	IsAuthorized bool
+	IsChallenge  bool
+	Details      map[string]string
+}
+
+func checkAuthorization(subject authSubject, actionID string, details map[string]string, flags CheckFlags) (bool, error) {
+	bus, err := dbusutil.SystemBus()
+	if err != nil {
+		return false, err
+	}
+	authority := bus.Object("org.freedesktop.PolicyKit1",
+		"/org/freedesktop/PolicyKit1/Authority")
+
+	var result authResult
+	err = authority.Call(
+		"org.freedesktop.PolicyKit1.Authority.CheckAuthorization", 0,
+		subject, actionID, details, flags, "").Store(&result)
+	if err != nil {
+		return false, err
+	}
+	if !result.IsAuthorized {
+		if result.IsChallenge {
+			err = ErrInteraction
+		} else if result.Details["polkit.dismissed"] != "" {
+			err = ErrDismissed
+		}
+	}
+	return result.IsAuthorized, err
+}
+
+// CheckAuthorization queries polkit to determine whether the process
+// with the specified pid and uid is authorized to perform an action.
+func CheckAuthorization(pid int32, uid uint32, actionID string, details map[string]string, flags CheckFlags) (bool, error) {
+	startTime, err := procfs.StartTime(pid)
+	if err != nil {
+		return false, err
+	}
+	// While discovering the start time of the process is racy, it
+	// isn't security relevant since it only impacts expiring the
+	// authorization after the process exits.
+	subject := authSubject{
+		Kind: "unix-process",
+		Details: map[string]dbus.Variant{
+			// polkit expects the pid as uint32
+			"pid":        dbus.MakeVariant(uint32(pid)),
+			"start-time": dbus.MakeVariant(startTime),
+			"uid":        dbus.MakeVariant(uid),
+		},
+	}
+	if details == nil {
+		details = map[string]string{}
+	}
+	return checkAuthorization(subject, actionID, details, flags)
+}
@@ -0,0 +1,122 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017-2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package polkit_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/polkit"
+	"github.com/snapcore/fdemanager/internal/polkit/polkittest"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type polkitSuite struct {
+	testutil.BaseTest
+}
+
+var _ = Suite(&polkitSuite{})
+
+func (s *polkitSuite) mockAuthority(c *C, result *polkittest.Result, err error) *[]*polkittest.Request {
+	var reqs []*polkittest.Request
+	restore, mockErr := polkittest.MockAuthority(func(req *polkittest.Request) (*polkittest.Result, error) {
+		reqs = append(reqs, req)
+		return result, err
+	})
+	c.Assert(mockErr, IsNil)
+	s.AddCleanup(restore)
+	return &reqs
+}
+
+func (s *polkitSuite) TestCheckAuthorization(c *C) {
+	reqs := s.mockAuthority(c, &polkittest.Result{Authorized: true}, nil)
+
+	pid := int32(os.Getpid())
+	authorized, err := polkit.CheckAuthorization(pid, 1000, "io.snapcraft.fdemanager.manage-keys", map[string]string{"foo": "bar"}, polkit.CheckNone)
+	c.Assert(err, IsNil)
+	c.Check(authorized, Equals, true)
+
+	c.Assert(*reqs, HasLen, 1)
+	req := (*reqs)[0]
+	c.Check(req.Pid, Equals, uint32(pid))
+	c.Check(req.Uid, Equals, uint32(1000))
+	c.Check(req.StartTime, Not(Equals), uint64(0))
+	c.Check(req.ActionID, Equals, "io.snapcraft.fdemanager.manage-keys")
+	c.Check(req.Details, DeepEquals, map[string]string{"foo": "bar"})
+	c.Check(req.Flags, Equals, polkit.CheckNone)
+}
+
+func (s *polkitSuite) TestCheckAuthorizationInteractive(c *C) {
+	reqs := s.mockAuthority(c, &polkittest.Result{Authorized: true}, nil)
+
+	authorized, err := polkit.CheckAuthorization(int32(os.Getpid()), 1000, "io.snapcraft.fdemanager.manage-keys", nil, polkit.CheckAllowInteraction)
+	c.Assert(err, IsNil)
+	c.Check(authorized, Equals, true)
+	c.Assert(*reqs, HasLen, 1)
+	c.Check((*reqs)[0].Flags, Equals, polkit.CheckAllowInteraction)
+	c.Check((*reqs)[0].Details, DeepEquals, map[string]string{})
+}
+
+func (s *polkitSuite) TestCheckAuthorizationNotAuthorized(c *C) {
+	s.mockAuthority(c, &polkittest.Result{}, nil)
+
+	authorized, err := polkit.CheckAuthorization(int32(os.Getpid()), 1000, "io.snapcraft.fdemanager.manage-keys", nil, polkit.CheckNone)
+	c.Assert(err, IsNil)
+	c.Check(authorized, Equals, false)
+}
+
+func (s *polkitSuite) TestCheckAuthorizationChallenge(c *C) {
+	s.mockAuthority(c, &polkittest.Result{Challenge: true}, nil)
+
+	authorized, err := polkit.CheckAuthorization(int32(os.Getpid()), 1000, "io.snapcraft.fdemanager.manage-keys", nil, polkit.CheckNone)
+	c.Check(err, Equals, polkit.ErrInteraction)
+	c.Check(authorized, Equals, false)
+}
+
+func (s *polkitSuite) TestCheckAuthorizationDismissed(c *C) {
+	s.mockAuthority(c, &polkittest.Result{Dismissed: true}, nil)
+
+	authorized, err := polkit.CheckAuthorization(int32(os.Getpid()), 1000, "io.snapcraft.fdemanager.manage-keys", nil, polkit.CheckAllowInteraction)
+	c.Check(err, Equals, polkit.ErrDismissed)
+	c.Check(authorized, Equals, false)
+}
+
+func (s *polkitSuite) TestCheckAuthorizationError(c *C) {
+	s.mockAuthority(c, nil, errors.New("boom"))
+
+	authorized, err := polkit.CheckAuthorization(int32(os.Getpid()), 1000, "io.snapcraft.fdemanager.manage-keys", nil, polkit.CheckNone)
+	c.Check(err, ErrorMatches, "boom")
+	c.Check(authorized, Equals, false)
+}
+
+func (s *polkitSuite) TestCheckAuthorizationNoProcess(c *C) {
+	s.mockAuthority(c, &polkittest.Result{Authorized: true}, nil)
+	dir := c.MkDir()
+	s.AddCleanup(paths.MockRootDir(dir))
+
+	_, err := polkit.CheckAuthorization(100, 1000, "io.snapcraft.fdemanager.manage-keys", nil, polkit.CheckNone)
+	c.Check(err, ErrorMatches, "open "+dir+"/proc/100/stat: no such file or directory")
+}
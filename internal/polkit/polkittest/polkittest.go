@@ -0,0 +1,136 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package polkittest provides a fake polkit authority on a private
+// D-Bus connection for testing.
+package polkittest
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus"
+	"github.com/snapcore/snapd/dbusutil"
+	"github.com/snapcore/snapd/dbusutil/dbustest"
+
+	"github.com/snapcore/fdemanager/internal/polkit"
+)
+
+// Request is an authorization check received by the fake authority.
+type Request struct {
+	Pid       uint32
+	Uid       uint32
+	StartTime uint64
+	ActionID  string
+	Details   map[string]string
+	Flags     polkit.CheckFlags
+}
+
+// Result is the outcome of an authorization check.
+type Result struct {
+	Authorized bool
+	Challenge  bool
+	Dismissed  bool
+}
+
+// Handler decides the outcome of an authorization check. If it returns
+// an error, the authority replies with a D-Bus error.
+type Handler func(req *Request) (*Result, error)
+
+type subject struct {
+	Kind    string
+	Details map[string]dbus.Variant
+}
+
+type authResult struct {
+	IsAuthorized bool
+	IsChallenge  bool
+	Details      map[string]string
+}
+
+func handleCheckAuthorization(handler Handler, msg *dbus.Message) (*dbus.Message, error) {
+	member, _ := msg.Headers[dbus.FieldMember].Value().(string)
+	if member != "CheckAuthorization" {
+		return nil, fmt.Errorf("unexpected method %q", member)
+	}
+
+	var subj subject
+	var req Request
+	var flags uint32
+	var cancellationID string
+	if err := dbus.Store(msg.Body, &subj, &req.ActionID, &req.Details, &flags, &cancellationID); err != nil {
+		return nil, err
+	}
+	if subj.Kind != "unix-process" {
+		return nil, fmt.Errorf("unexpected subject kind %q", subj.Kind)
+	}
+	req.Pid, _ = subj.Details["pid"].Value().(uint32)
+	req.Uid, _ = subj.Details["uid"].Value().(uint32)
+	req.StartTime, _ = subj.Details["start-time"].Value().(uint64)
+	req.Flags = polkit.CheckFlags(flags)
+
+	result, err := handler(&req)
+	if err != nil {
+		return &dbus.Message{
+			Type: dbus.TypeError,
+			Headers: map[dbus.HeaderField]dbus.Variant{
+				dbus.FieldReplySerial: dbus.MakeVariant(msg.Serial()),
+				dbus.FieldErrorName:   dbus.MakeVariant("org.freedesktop.PolicyKit1.Error.Failed"),
+				dbus.FieldSignature:   dbus.MakeVariant(dbus.SignatureOf("")),
+			},
+			Body: []interface{}{err.Error()},
+		}, nil
+	}
+
+	reply := authResult{
+		IsAuthorized: result.Authorized,
+		IsChallenge:  result.Challenge,
+		Details:      map[string]string{},
+	}
+	if result.Dismissed {
+		reply.Details["polkit.dismissed"] = "true"
+	}
+	return &dbus.Message{
+		Type: dbus.TypeMethodReply,
+		Headers: map[dbus.HeaderField]dbus.Variant{
+			dbus.FieldReplySerial: dbus.MakeVariant(msg.Serial()),
+			dbus.FieldSignature:   dbus.MakeVariant(dbus.SignatureOf(reply)),
+		},
+		Body: []interface{}{reply},
+	}, nil
+}
+
+// MockAuthority makes the polkit package talk to a fake authority that
+// uses handler to decide the outcome of authorization checks.
+func MockAuthority(handler Handler) (restore func(), err error) {
+	conn, err := dbustest.Connection(func(msg *dbus.Message, n int) ([]*dbus.Message, error) {
+		reply, err := handleCheckAuthorization(handler, msg)
+		if err != nil {
+			return nil, err
+		}
+		return []*dbus.Message{reply}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	restoreBus := dbusutil.MockOnlySystemBusAvailable(conn)
+	return func() {
+		restoreBus()
+		conn.Close()
+	}, nil
+}
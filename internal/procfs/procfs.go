@@ -0,0 +1,113 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package procfs reads information about processes from /proc.
+//
+// The pid of a process may be reused once it exits, so the information
+// only describes a particular process if it is known to be alive
+// afterwards, for example by using a pidfd.
+package procfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/fdemanager/internal/paths"
+)
+
+func procPath(pid int32, name string) string {
+	return filepath.Join(paths.ProcDir, strconv.Itoa(int(pid)), name)
+}
+
+// StartTime returns the start time of the process with the specified
+// pid, in clock ticks after boot.
+//
+// The implementation is intended to be compatible with polkit:
+//
+//	https://gitlab.freedesktop.org/polkit/polkit/-/blob/master/src/polkit/polkitunixprocess.c
+func StartTime(pid int32) (uint64, error) {
+	filename := procPath(pid, "stat")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	contents := string(data)
+
+	// The start time is the token at index 19 after the "(process
+	// name)" entry. Only this entry can contain the ')' character, so
+	// search backwards for it to avoid being fooled by malicious
+	// process names.
+	//
+	// See proc(5) for a description of the format of the
+	// /proc/[pid]/stat file and of the starttime field.
+	idx := strings.LastIndexByte(contents, ')')
+	if idx < 0 {
+		return 0, fmt.Errorf("cannot parse %s", filename)
+	}
+	idx += 2 // skip ") "
+	if idx > len(contents) {
+		return 0, fmt.Errorf("cannot parse %s", filename)
+	}
+	tokens := strings.Split(contents[idx:], " ")
+	if len(tokens) < 20 {
+		return 0, fmt.Errorf("cannot parse %s", filename)
+	}
+	return strconv.ParseUint(tokens[19], 10, 64)
+}
+
+// Groups returns the supplementary groups of the process with the
+// specified pid.
+func Groups(pid int32) ([]uint32, error) {
+	f, err := os.Open(procPath(pid, "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var gids []uint32
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse supplementary group %q: %v", field, err)
+			}
+			gids = append(gids, uint32(gid))
+		}
+		return gids, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("cannot find supplementary groups of process %d", pid)
+}
+
+// Exe returns the path of the executable of the process with the
+// specified pid.
+func Exe(pid int32) (string, error) {
+	return os.Readlink(procPath(pid, "exe"))
+}
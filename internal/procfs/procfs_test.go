@@ -0,0 +1,127 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package procfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/paths"
+	"github.com/snapcore/fdemanager/internal/procfs"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type procfsSuite struct {
+	dir string
+}
+
+var _ = Suite(&procfsSuite{})
+
+func (s *procfsSuite) mockProcFile(c *C, name, contents string) {
+	s.dir = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(s.dir, "proc/1234"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(s.dir, "proc/1234", name), []byte(contents), 0644), IsNil)
+}
+
+func (s *procfsSuite) TestStartTime(c *C) {
+	// a process name containing ") " must not confuse the parser
+	s.mockProcFile(c, "stat", "1234 (a) b c d) S 1 1234 1234 0 -1 4194560 1000 0 0 0 10 5 0 0 20 0 1 0 54321 12345678 900 18446744073709551615\n")
+	restore := paths.MockRootDir(s.dir)
+	defer restore()
+
+	startTime, err := procfs.StartTime(1234)
+	c.Assert(err, IsNil)
+	c.Check(startTime, Equals, uint64(54321))
+}
+
+func (s *procfsSuite) TestStartTimeErrors(c *C) {
+	for i, contents := range []string{
+		"1234 no parenthesis",
+		"1234 (truncated)",
+		"1234 (short) S 1 2 3",
+		"1234 (bad) S 1 1234 1234 0 -1 4194560 1000 0 0 0 10 5 0 0 20 0 1 0 notanumber 12345678",
+	} {
+		s.mockProcFile(c, "stat", contents)
+		restore := paths.MockRootDir(s.dir)
+		_, err := procfs.StartTime(1234)
+		restore()
+		c.Check(err, NotNil, Commentf("#%d", i))
+	}
+
+	restore := paths.MockRootDir(c.MkDir())
+	defer restore()
+	_, err := procfs.StartTime(1234)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *procfsSuite) TestStartTimeSelf(c *C) {
+	startTime, err := procfs.StartTime(int32(os.Getpid()))
+	c.Assert(err, IsNil)
+	c.Check(startTime, Not(Equals), uint64(0))
+}
+
+func (s *procfsSuite) TestGroups(c *C) {
+	s.mockProcFile(c, "status", "Name:\tfdectl\nUid:\t1000\t1000\t1000\t1000\nGroups:\t4 24 989 1000 \nVmPeak:\t0 kB\n")
+	restore := paths.MockRootDir(s.dir)
+	defer restore()
+
+	groups, err := procfs.Groups(1234)
+	c.Assert(err, IsNil)
+	c.Check(groups, DeepEquals, []uint32{4, 24, 989, 1000})
+}
+
+func (s *procfsSuite) TestGroupsNone(c *C) {
+	s.mockProcFile(c, "status", "Name:\tfdectl\nGroups:\t\n")
+	restore := paths.MockRootDir(s.dir)
+	defer restore()
+
+	groups, err := procfs.Groups(1234)
+	c.Assert(err, IsNil)
+	c.Check(groups, HasLen, 0)
+}
+
+func (s *procfsSuite) TestGroupsErrors(c *C) {
+	s.mockProcFile(c, "status", "Name:\tfdectl\nGroups:\t4 foo\n")
+	restore := paths.MockRootDir(s.dir)
+	_, err := procfs.Groups(1234)
+	restore()
+	c.Check(err, ErrorMatches, `cannot parse supplementary group "foo": .*`)
+
+	s.mockProcFile(c, "status", "Name:\tfdectl\n")
+	restore = paths.MockRootDir(s.dir)
+	_, err = procfs.Groups(1234)
+	restore()
+	c.Check(err, ErrorMatches, `cannot find supplementary groups of process 1234`)
+}
+
+func (s *procfsSuite) TestExe(c *C) {
+	s.mockProcFile(c, "stat", "")
+	c.Assert(os.Symlink("/usr/bin/fdectl", filepath.Join(s.dir, "proc/1234/exe")), IsNil)
+	restore := paths.MockRootDir(s.dir)
+	defer restore()
+
+	exe, err := procfs.Exe(1234)
+	c.Assert(err, IsNil)
+	c.Check(exe, Equals, "/usr/bin/fdectl")
+}
@@ -0,0 +1,49 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+//go:build !nosecboot
+// +build !nosecboot
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm
+
+import "github.com/canonical/go-tpm2"
+
+// ResetSimulator starts up the TPM simulator if needed and clears it
+// with the platform hierarchy, which does not require the
+// authorization value of the lockout hierarchy.
+func ResetSimulator(c Conn) error {
+	ctx := c.(*conn).tpm
+	if err := ctx.Startup(tpm2.StartupClear); err != nil && !tpm2.IsTPMError(err, tpm2.ErrorInitialize, tpm2.CommandStartup) {
+		return err
+	}
+	return ctx.Clear(ctx.PlatformHandleContext(), nil)
+}
+
+// DefineNVIndex defines an NV counter index with the specified handle
+// in the owner hierarchy.
+func DefineNVIndex(c Conn, handle uint32) error {
+	ctx := c.(*conn).tpm
+	pub := &tpm2.NVPublic{
+		Index:   tpm2.Handle(handle),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8,
+	}
+	_, err := ctx.NVDefineSpace(ctx.OwnerHandleContext(), nil, pub, nil)
+	return err
+}
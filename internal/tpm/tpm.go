@@ -0,0 +1,175 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package tpm provides access to the TPM of the system, or to a TPM
+// simulator on systems without one.
+package tpm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrNoTPM is returned when the system has no TPM2 device.
+	ErrNoTPM = errors.New("no TPM2 device is available")
+
+	// ErrLockoutAuthFail is returned when the authorization value
+	// supplied for the lockout hierarchy is wrong.
+	ErrLockoutAuthFail = errors.New("the authorization value of the TPM lockout hierarchy is wrong")
+
+	// ErrLockoutUnavailable is returned when the lockout hierarchy
+	// cannot be used until the lockout recovery time elapses after
+	// an authorization failure.
+	ErrLockoutUnavailable = errors.New("the TPM lockout hierarchy is unavailable until the lockout recovery time elapses")
+)
+
+// SRKHandle is the persistent handle of the storage root key, under
+// which the TPM sealed keys are created.
+const SRKHandle = 0x81000001
+
+// DAParams are the dictionary attack protection parameters of a TPM.
+type DAParams struct {
+	// MaxTries is the number of authorization failures before the
+	// TPM enters lockout mode.
+	MaxTries uint32
+	// RecoveryTime is how long it takes for an authorization failure
+	// to be forgotten.
+	RecoveryTime time.Duration
+	// LockoutRecovery is how long after an authorization failure of
+	// the lockout hierarchy that its authorization value can be used
+	// again.
+	LockoutRecovery time.Duration
+}
+
+// DefaultDAParams are the dictionary attack protection parameters set
+// when a TPM is provisioned, which are the ones used by secboot.
+var DefaultDAParams = DAParams{
+	MaxTries:        32,
+	RecoveryTime:    2 * time.Hour,
+	LockoutRecovery: 24 * time.Hour,
+}
+
+// Status describes the state of a TPM.
+type Status struct {
+	// Manufacturer is the vendor ID of the TPM manufacturer, such as
+	// "IBM" or "INTC".
+	Manufacturer string
+	// FirmwareVersion is the version of the TPM firmware, made of
+	// four 16-bit components.
+	FirmwareVersion string
+
+	LockoutAuthSet bool
+	OwnerAuthSet   bool
+	// SRKPresent indicates whether the storage root key is persisted
+	// at SRKHandle.
+	SRKPresent bool
+
+	// InLockout indicates whether the TPM is in dictionary attack
+	// lockout mode, in which case authorizations of objects that
+	// are subject to dictionary attack protection fail.
+	InLockout bool
+	// LockoutCounter is the current number of authorization
+	// failures.
+	LockoutCounter uint32
+	DAParams       DAParams
+}
+
+// Owned returns whether the TPM is provisioned, which is the case when
+// the authorization value of the lockout hierarchy is set and the
+// storage root key is persisted.
+func (s *Status) Owned() bool {
+	return s.LockoutAuthSet && s.SRKPresent
+}
+
+// Conn is a connection to a TPM. The lockoutAuth arguments are the
+// current authorization value of the lockout hierarchy, which is
+// empty if it is not set.
+type Conn interface {
+	// Status returns the state of the TPM.
+	Status() (*Status, error)
+
+	// Provision persists the storage root key if it isn't already,
+	// sets the dictionary attack protection parameters and changes
+	// the authorization value of the lockout hierarchy to
+	// newLockoutAuth.
+	Provision(lockoutAuth, newLockoutAuth []byte, params *DAParams) error
+
+	// ResetLockout takes the TPM out of dictionary attack lockout
+	// mode and resets the authorization failure counter.
+	ResetLockout(lockoutAuth []byte) error
+
+	// Clear clears the TPM, removing the storage root key, which
+	// makes the keys sealed with the TPM unusable, and the
+	// authorization values of the hierarchies.
+	Clear(lockoutAuth []byte) error
+
+	// NVIndices returns the handles of the NV indices that are
+	// defined, in ascending order.
+	NVIndices() ([]uint32, error)
+
+	Close() error
+}
+
+var (
+	simulatorAddr string
+	connectHook   func() (Conn, error)
+)
+
+// UseSimulator makes Connect connect to the TPM simulator listening
+// on the specified TCP address, such as "localhost:2321", rather than
+// to the TPM device. An empty address restores the default.
+func UseSimulator(addr string) {
+	simulatorAddr = addr
+}
+
+// MockConnect makes Connect call f, for testing.
+func MockConnect(f func() (Conn, error)) (restore func()) {
+	old := connectHook
+	connectHook = f
+	return func() {
+		connectHook = old
+	}
+}
+
+// Connect opens a connection to the TPM.
+func Connect() (Conn, error) {
+	if connectHook != nil {
+		return connectHook()
+	}
+	if simulatorAddr != "" {
+		return connectSimulator(simulatorAddr)
+	}
+	return connectDevice()
+}
+
+func formatFirmwareVersion(v1, v2 uint32) string {
+	return fmt.Sprintf("%d.%d.%d.%d", v1>>16, v1&0xffff, v2>>16, v2&0xffff)
+}
+
+func formatManufacturer(id uint32) string {
+	b := []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	// vendor IDs shorter than four characters are padded with
+	// zeros
+	for len(b) > 0 && (b[len(b)-1] == 0 || b[len(b)-1] == ' ') {
+		b = b[:len(b)-1]
+	}
+	return string(b)
+}
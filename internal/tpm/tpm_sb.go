@@ -0,0 +1,234 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+//go:build !nosecboot
+// +build !nosecboot
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/linux"
+	"github.com/canonical/go-tpm2/mssim"
+)
+
+const devicePath = "/dev/tpmrm0"
+
+// srkTemplate is the template of the storage root key, as defined by
+// the TCG TPM v2.0 Provisioning Guidance and used by secboot.
+var srkTemplate = &tpm2.Public{
+	Type:    tpm2.ObjectTypeRSA,
+	NameAlg: tpm2.HashAlgorithmSHA256,
+	Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrNoDA |
+		tpm2.AttrRestricted | tpm2.AttrDecrypt,
+	Params: &tpm2.PublicParamsU{
+		RSADetail: &tpm2.RSAParams{
+			Symmetric: tpm2.SymDefObject{
+				Algorithm: tpm2.SymObjectAlgorithmAES,
+				KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+				Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB},
+			},
+			Scheme:   tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+			KeyBits:  2048,
+			Exponent: 0,
+		},
+	},
+}
+
+type conn struct {
+	tpm *tpm2.TPMContext
+}
+
+func connectDevice() (Conn, error) {
+	tcti, err := linux.OpenDevice(devicePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoTPM
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open TPM device: %v", err)
+	}
+	return &conn{tpm: tpm2.NewTPMContext(tcti)}, nil
+}
+
+func connectSimulator(addr string) (Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TPM simulator address: %v", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TPM simulator port %q", portStr)
+	}
+	tcti, err := mssim.OpenConnection(host, uint(port))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to TPM simulator: %v", err)
+	}
+	return &conn{tpm: tpm2.NewTPMContext(tcti)}, nil
+}
+
+func (c *conn) Close() error {
+	return c.tpm.Close()
+}
+
+func (c *conn) property(property tpm2.Property) (uint32, error) {
+	props, err := c.tpm.GetCapabilityTPMProperties(property, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(props) == 0 || props[0].Property != property {
+		return 0, fmt.Errorf("TPM property %v is not available", property)
+	}
+	return props[0].Value, nil
+}
+
+func (c *conn) srkPresent() (bool, error) {
+	_, err := c.tpm.CreateResourceContextFromTPM(SRKHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, SRKHandle):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *conn) Status() (*Status, error) {
+	props := make(map[tpm2.Property]uint32)
+	for _, property := range []tpm2.Property{
+		tpm2.PropertyManufacturer,
+		tpm2.PropertyFirmwareVersion1,
+		tpm2.PropertyFirmwareVersion2,
+		tpm2.PropertyPermanent,
+		tpm2.PropertyLockoutCounter,
+		tpm2.PropertyMaxAuthFail,
+		tpm2.PropertyLockoutInterval,
+		tpm2.PropertyLockoutRecovery,
+	} {
+		value, err := c.property(property)
+		if err != nil {
+			return nil, fmt.Errorf("cannot obtain TPM properties: %v", err)
+		}
+		props[property] = value
+	}
+	srkPresent, err := c.srkPresent()
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain storage root key: %v", err)
+	}
+
+	permanent := tpm2.PermanentAttributes(props[tpm2.PropertyPermanent])
+	return &Status{
+		Manufacturer:    formatManufacturer(props[tpm2.PropertyManufacturer]),
+		FirmwareVersion: formatFirmwareVersion(props[tpm2.PropertyFirmwareVersion1], props[tpm2.PropertyFirmwareVersion2]),
+		LockoutAuthSet:  permanent&tpm2.AttrLockoutAuthSet != 0,
+		OwnerAuthSet:    permanent&tpm2.AttrOwnerAuthSet != 0,
+		SRKPresent:      srkPresent,
+		InLockout:       permanent&tpm2.AttrInLockout != 0,
+		LockoutCounter:  props[tpm2.PropertyLockoutCounter],
+		DAParams: DAParams{
+			MaxTries:        props[tpm2.PropertyMaxAuthFail],
+			RecoveryTime:    time.Duration(props[tpm2.PropertyLockoutInterval]) * time.Second,
+			LockoutRecovery: time.Duration(props[tpm2.PropertyLockoutRecovery]) * time.Second,
+		},
+	}, nil
+}
+
+// lockoutError converts the error returned by a command authorized
+// with the lockout hierarchy.
+func lockoutError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case tpm2.IsTPMSessionError(err, tpm2.ErrorAuthFail, tpm2.AnyCommandCode, tpm2.AnySessionIndex),
+		tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.AnyCommandCode, tpm2.AnySessionIndex):
+		return ErrLockoutAuthFail
+	case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.AnyCommandCode):
+		return ErrLockoutUnavailable
+	}
+	return err
+}
+
+func (c *conn) lockout(lockoutAuth []byte) tpm2.ResourceContext {
+	lockout := c.tpm.LockoutHandleContext()
+	lockout.SetAuthValue(lockoutAuth)
+	return lockout
+}
+
+func (c *conn) Provision(lockoutAuth, newLockoutAuth []byte, params *DAParams) error {
+	srkPresent, err := c.srkPresent()
+	if err != nil {
+		return fmt.Errorf("cannot obtain storage root key: %v", err)
+	}
+	if !srkPresent {
+		owner := c.tpm.OwnerHandleContext()
+		srk, _, _, _, _, err := c.tpm.CreatePrimary(owner, nil, srkTemplate, nil, nil, nil)
+		if err != nil {
+			return fmt.Errorf("cannot create storage root key: %v", err)
+		}
+		_, err = c.tpm.EvictControl(owner, srk, SRKHandle, nil)
+		c.tpm.FlushContext(srk)
+		if err != nil {
+			return fmt.Errorf("cannot persist storage root key: %v", err)
+		}
+	}
+
+	lockout := c.lockout(lockoutAuth)
+	err = c.tpm.DictionaryAttackParameters(lockout, params.MaxTries,
+		uint32(params.RecoveryTime/time.Second), uint32(params.LockoutRecovery/time.Second), nil)
+	if err := lockoutError(err); err != nil {
+		return fmt.Errorf("cannot set dictionary attack parameters: %w", err)
+	}
+	if err := lockoutError(c.tpm.HierarchyChangeAuth(lockout, newLockoutAuth, nil)); err != nil {
+		return fmt.Errorf("cannot change lockout hierarchy authorization value: %w", err)
+	}
+	return nil
+}
+
+func (c *conn) ResetLockout(lockoutAuth []byte) error {
+	if err := lockoutError(c.tpm.DictionaryAttackLockReset(c.lockout(lockoutAuth), nil)); err != nil {
+		return fmt.Errorf("cannot reset dictionary attack lockout: %w", err)
+	}
+	return nil
+}
+
+func (c *conn) Clear(lockoutAuth []byte) error {
+	if err := lockoutError(c.tpm.Clear(c.lockout(lockoutAuth), nil)); err != nil {
+		return fmt.Errorf("cannot clear TPM: %w", err)
+	}
+	return nil
+}
+
+func (c *conn) NVIndices() ([]uint32, error) {
+	handles, err := c.tpm.GetCapabilityHandles(tpm2.HandleTypeNVIndex.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain NV indices: %v", err)
+	}
+	indices := make([]uint32, 0, len(handles))
+	for _, h := range handles {
+		if h.Type() == tpm2.HandleTypeNVIndex {
+			indices = append(indices, uint32(h))
+		}
+	}
+	return indices, nil
+}
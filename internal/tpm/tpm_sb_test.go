@@ -0,0 +1,118 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+//go:build !nosecboot
+// +build !nosecboot
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm_test
+
+import (
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/tpm"
+)
+
+// simulatorSuite runs against the TCG reference TPM simulator, for
+// instance the one provided by the ibmswtpm2 package, whose address
+// is set in FDEMANAGERD_TPM_SIMULATOR, such as "localhost:2321".
+type simulatorSuite struct {
+	conn tpm.Conn
+}
+
+var _ = Suite(&simulatorSuite{})
+
+func (s *simulatorSuite) SetUpSuite(c *C) {
+	addr := os.Getenv("FDEMANAGERD_TPM_SIMULATOR")
+	if addr == "" {
+		c.Skip("FDEMANAGERD_TPM_SIMULATOR is not set")
+	}
+	tpm.UseSimulator(addr)
+}
+
+func (s *simulatorSuite) TearDownSuite(c *C) {
+	tpm.UseSimulator("")
+}
+
+func (s *simulatorSuite) SetUpTest(c *C) {
+	conn, err := tpm.Connect()
+	c.Assert(err, IsNil)
+	s.conn = conn
+	c.Assert(tpm.ResetSimulator(conn), IsNil)
+}
+
+func (s *simulatorSuite) TearDownTest(c *C) {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *simulatorSuite) TestStatusUnprovisioned(c *C) {
+	status, err := s.conn.Status()
+	c.Assert(err, IsNil)
+	c.Check(status.Manufacturer, Equals, "IBM")
+	c.Check(status.FirmwareVersion, Not(Equals), "")
+	c.Check(status.LockoutAuthSet, Equals, false)
+	c.Check(status.SRKPresent, Equals, false)
+	c.Check(status.Owned(), Equals, false)
+	c.Check(status.InLockout, Equals, false)
+}
+
+func (s *simulatorSuite) TestProvision(c *C) {
+	params := &tpm.DAParams{
+		MaxTries:        10,
+		RecoveryTime:    time.Hour,
+		LockoutRecovery: 0,
+	}
+	c.Assert(s.conn.Provision(nil, []byte("lockout"), params), IsNil)
+
+	status, err := s.conn.Status()
+	c.Assert(err, IsNil)
+	c.Check(status.Owned(), Equals, true)
+	c.Check(status.DAParams, DeepEquals, *params)
+
+	// provisioning again changes the authorization value
+	c.Assert(s.conn.Provision([]byte("lockout"), []byte("other"), params), IsNil)
+	c.Assert(s.conn.ResetLockout([]byte("other")), IsNil)
+
+	status, err = s.conn.Status()
+	c.Assert(err, IsNil)
+	c.Check(status.LockoutCounter, Equals, uint32(0))
+}
+
+func (s *simulatorSuite) TestClear(c *C) {
+	c.Assert(s.conn.Provision(nil, []byte("lockout"), &tpm.DefaultDAParams), IsNil)
+	c.Assert(s.conn.Clear([]byte("lockout")), IsNil)
+
+	status, err := s.conn.Status()
+	c.Assert(err, IsNil)
+	c.Check(status.LockoutAuthSet, Equals, false)
+	c.Check(status.SRKPresent, Equals, false)
+}
+
+func (s *simulatorSuite) TestNVIndices(c *C) {
+	c.Assert(tpm.DefineNVIndex(s.conn, 0x01880011), IsNil)
+	c.Assert(tpm.DefineNVIndex(s.conn, 0x01880010), IsNil)
+
+	indices, err := s.conn.NVIndices()
+	c.Assert(err, IsNil)
+	c.Check(indices, DeepEquals, []uint32{0x01880010, 0x01880011})
+}
@@ -0,0 +1,52 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm_test
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/fdemanager/internal/tpm"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type tpmSuite struct{}
+
+var _ = Suite(&tpmSuite{})
+
+func (s *tpmSuite) TestFormatManufacturer(c *C) {
+	c.Check(tpm.FormatManufacturer(0x49424d00), Equals, "IBM")
+	c.Check(tpm.FormatManufacturer(0x494e5443), Equals, "INTC")
+	c.Check(tpm.FormatManufacturer(0x4d534654), Equals, "MSFT")
+}
+
+func (s *tpmSuite) TestFormatFirmwareVersion(c *C) {
+	c.Check(tpm.FormatFirmwareVersion(0x00070055, 0x00050000), Equals, "7.85.5.0")
+	c.Check(tpm.FormatFirmwareVersion(0x20191023, 0x00163636), Equals, "8217.4131.22.13878")
+}
+
+func (s *tpmSuite) TestStatusOwned(c *C) {
+	c.Check((&tpm.Status{}).Owned(), Equals, false)
+	c.Check((&tpm.Status{LockoutAuthSet: true}).Owned(), Equals, false)
+	c.Check((&tpm.Status{SRKPresent: true}).Owned(), Equals, false)
+	c.Check((&tpm.Status{LockoutAuthSet: true, SRKPresent: true}).Owned(), Equals, true)
+}
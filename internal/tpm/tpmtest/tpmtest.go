@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package tpmtest provides a fake TPM for testing.
+package tpmtest
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/snapcore/fdemanager/internal/tpm"
+)
+
+// TPM is a fake TPM. Its fields can be modified by tests while no
+// connection is in use.
+type TPM struct {
+	mu sync.Mutex
+
+	Manufacturer    string
+	FirmwareVersion string
+
+	// LockoutAuth is the authorization value of the lockout
+	// hierarchy, which is set if it isn't empty.
+	LockoutAuth  []byte
+	OwnerAuthSet bool
+	SRKPresent   bool
+
+	InLockout      bool
+	LockoutCounter uint32
+	DAParams       tpm.DAParams
+	// LockoutUnavailable is set when the authorization of the
+	// lockout hierarchy fails, after which it cannot be used until
+	// it is cleared.
+	LockoutUnavailable bool
+
+	// NVIndices are the handles of the defined NV indices.
+	NVIndices []uint32
+
+	// Err, if set, is returned by every operation.
+	Err error
+	// Connections is the number of connections that are open.
+	Connections int
+}
+
+// New returns a fake TPM that is not provisioned.
+func New() *TPM {
+	return &TPM{
+		Manufacturer:    "IBM",
+		FirmwareVersion: "8217.4131.22.13878",
+		DAParams: tpm.DAParams{
+			MaxTries:     3,
+			RecoveryTime: 1000 * time.Second,
+		},
+	}
+}
+
+// Mock makes tpm.Connect connect to the fake TPM.
+func Mock(t *TPM) (restore func()) {
+	return tpm.MockConnect(t.Connect)
+}
+
+// Connect opens a connection to the fake TPM.
+func (t *TPM) Connect() (tpm.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	t.Connections++
+	return &conn{t: t}, nil
+}
+
+type conn struct {
+	t      *TPM
+	closed bool
+}
+
+func (c *conn) Close() error {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.t.Connections--
+	}
+	return nil
+}
+
+func (c *conn) Status() (*tpm.Status, error) {
+	t := c.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	return &tpm.Status{
+		Manufacturer:    t.Manufacturer,
+		FirmwareVersion: t.FirmwareVersion,
+		LockoutAuthSet:  len(t.LockoutAuth) > 0,
+		OwnerAuthSet:    t.OwnerAuthSet,
+		SRKPresent:      t.SRKPresent,
+		InLockout:       t.InLockout,
+		LockoutCounter:  t.LockoutCounter,
+		DAParams:        t.DAParams,
+	}, nil
+}
+
+// checkLockoutAuth must be called with the mutex held.
+func (t *TPM) checkLockoutAuth(lockoutAuth []byte) error {
+	if t.Err != nil {
+		return t.Err
+	}
+	if t.LockoutUnavailable {
+		return tpm.ErrLockoutUnavailable
+	}
+	if !bytes.Equal(lockoutAuth, t.LockoutAuth) {
+		t.LockoutUnavailable = true
+		return tpm.ErrLockoutAuthFail
+	}
+	return nil
+}
+
+func (c *conn) Provision(lockoutAuth, newLockoutAuth []byte, params *tpm.DAParams) error {
+	t := c.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.checkLockoutAuth(lockoutAuth); err != nil {
+		return err
+	}
+	t.SRKPresent = true
+	t.DAParams = *params
+	t.LockoutAuth = append([]byte(nil), newLockoutAuth...)
+	return nil
+}
+
+func (c *conn) ResetLockout(lockoutAuth []byte) error {
+	t := c.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.checkLockoutAuth(lockoutAuth); err != nil {
+		return err
+	}
+	t.InLockout = false
+	t.LockoutCounter = 0
+	return nil
+}
+
+func (c *conn) Clear(lockoutAuth []byte) error {
+	t := c.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.checkLockoutAuth(lockoutAuth); err != nil {
+		return err
+	}
+	t.LockoutAuth = nil
+	t.OwnerAuthSet = false
+	t.SRKPresent = false
+	// the NV indices of the owner hierarchy are undefined
+	t.NVIndices = nil
+	return nil
+}
+
+func (c *conn) NVIndices() ([]uint32, error) {
+	t := c.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	indices := append([]uint32(nil), t.NVIndices...)
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	return indices, nil
+}